@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/initialed85/loser/pkg/packets"
+)
+
+func runBufferbloat(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("bufferbloat", flag.ExitOnError)
+	duration := flags.Duration("duration", time.Second*10, "how long to measure for in each phase (idle, upload, download)")
+	streams := flags.Int("streams", 4, "number of parallel TCP streams used to saturate the link")
+	asJSON := flags.Bool("json", false, "print the result as JSON instead of a summary")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: loser bufferbloat [flags] <host>\n\n")
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	host := flags.Arg(0)
+
+	log.Printf("running latency under load test against %s (%s per phase)...", host, *duration)
+
+	result, err := packets.RunLatencyUnderLoad(ctx, host, *duration, *streams)
+	if err != nil {
+		log.Printf("error: failed packets.RunLatencyUnderLoad: %s", err)
+		return 1
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			log.Printf("error: failed json.MarshalIndent for result: %s", err)
+			return 1
+		}
+
+		_, _ = fmt.Fprintln(os.Stdout, string(b))
+		return 0
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "latency under load for %s\n\n", host)
+	_, _ = fmt.Fprintf(os.Stdout, "%-10s %12s %12s %12s %12s %12s %8s %14s\n", "phase", "rtt_min", "rtt_avg", "rtt_max", "jitter", "increase", "loss", "throughput")
+
+	for _, phase := range result.Phases {
+		loss := float64(0)
+		if phase.Sent > 0 {
+			loss = float64(phase.Lost) / float64(phase.Sent) * 100
+		}
+
+		throughput := "-"
+		if phase.BitsPerSecond > 0 {
+			throughput = fmt.Sprintf("%.2f Mbit/s", phase.BitsPerSecond/1_000_000)
+		}
+
+		_, _ = fmt.Fprintf(
+			os.Stdout,
+			"%-10s %12s %12s %12s %12s %12s %7.2f%% %14s\n",
+			phase.Name,
+			phase.RTTMin.Round(time.Microsecond),
+			phase.RTTAvg.Round(time.Microsecond),
+			phase.RTTMax.Round(time.Microsecond),
+			phase.Jitter.Round(time.Microsecond),
+			phase.RTTIncrease.Round(time.Microsecond),
+			loss,
+			throughput,
+		)
+	}
+
+	return 0
+}
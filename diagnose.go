@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/initialed85/loser/pkg/packets"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	diagnoseOK          = "ok"
+	diagnoseFailed      = "failed"
+	diagnoseUnavailable = "unavailable"
+)
+
+type diagnoseProbe struct {
+	Protocol string `json:"protocol"`
+	Result   string `json:"result"`
+	history.Status
+	Errors []string `json:"errors,omitempty"` // the distinct ones
+}
+
+type diagnoseTarget struct {
+	Host            string                    `json:"host"`
+	OK              bool                      `json:"ok"`
+	Failures        []string                  `json:"failures"`
+	Probes          []*diagnoseProbe          `json:"probes"`
+	MTU             *packets.MTUResult        `json:"mtu,omitempty"`
+	MTUError        string                    `json:"mtu_error,omitempty"`
+	Traceroute      *packets.TracerouteResult `json:"traceroute,omitempty"`
+	TracerouteError string                    `json:"traceroute_error,omitempty"`
+}
+
+// diagnoseInterface is how an interface changed between the snapshots at the start and the end
+type diagnoseInterface struct {
+	Name           string                    `json:"name"`
+	OperStateStart string                    `json:"oper_state_start,omitempty"`
+	OperStateEnd   string                    `json:"oper_state_end,omitempty"`
+	CarrierChanges int64                     `json:"carrier_changes"`
+	RxErrors       int64                     `json:"rx_errors"`
+	TxErrors       int64                     `json:"tx_errors"`
+	RxDropped      int64                     `json:"rx_dropped"`
+	TxDropped      int64                     `json:"tx_dropped"`
+	Rates          *network_interfaces.Rates `json:"rates,omitempty"`
+	Warnings       []string                  `json:"warnings"`
+}
+
+type diagnoseResult struct {
+	Started    time.Time            `json:"started"`
+	Finished   time.Time            `json:"finished"`
+	Duration   time.Duration        `json:"duration"`
+	OK         bool                 `json:"ok"`
+	Targets    []*diagnoseTarget    `json:"targets"`
+	Interfaces []*diagnoseInterface `json:"interfaces"`
+}
+
+// getDiagnoseProbe works out how a probe did from its reports (and its errors, if it never got going); refused is
+// whether any of those errors was the connection being refused
+func getDiagnoseProbe(protocol string, host string, reports []packets.Report, errs []string, refused bool, maxLossPercent float64) *diagnoseProbe {
+	samples := make([]history.ProbeSample, 0, len(reports))
+	for _, report := range reports {
+		samples = append(samples, history.NewProbeSample(report))
+	}
+
+	probe := diagnoseProbe{
+		Protocol: protocol,
+		Status:   history.GetStatus(history.GetProbeTarget(protocol, host), samples),
+		Errors:   errs,
+	}
+
+	switch {
+	// tcp and udp need loser at the other end, so the host refusing them isn't its fault (but a timeout or it being
+	// unreachable is)
+	case probe.Sent == 0 && refused && (protocol == "tcp" || protocol == "udp"):
+		probe.Result = diagnoseUnavailable
+	case probe.Received == 0:
+		probe.Result = diagnoseFailed
+	case probe.LossPercent > maxLossPercent:
+		probe.Result = diagnoseFailed
+	default:
+		probe.Result = diagnoseOK
+	}
+
+	return &probe
+}
+
+// getDiagnoseFailure says why a probe failed; one that never sent anything (e.g. no CAP_NET_RAW for ICMP) has no loss
+// to speak of, so it gets its last error instead
+func getDiagnoseFailure(probe *diagnoseProbe) string {
+	if probe.Sent > 0 {
+		return fmt.Sprintf("%s %.2f%% loss", probe.Protocol, probe.LossPercent)
+	}
+
+	if len(probe.Errors) > 0 {
+		return fmt.Sprintf("%s: no replies (%s)", probe.Protocol, probe.Errors[len(probe.Errors)-1])
+	}
+
+	return fmt.Sprintf("%s: no replies", probe.Protocol)
+}
+
+// getDiagnoseInterfaces compares the interface snapshots from the start and the end
+func getDiagnoseInterfaces(start []network_interfaces.NetworkInterface, end []network_interfaces.NetworkInterface) []*diagnoseInterface {
+	startByName := make(map[string]network_interfaces.NetworkInterface)
+	for _, networkInterface := range start {
+		startByName[networkInterface.Name] = networkInterface
+	}
+
+	endByName := make(map[string]network_interfaces.NetworkInterface)
+	for _, networkInterface := range end {
+		endByName[networkInterface.Name] = networkInterface
+	}
+
+	names := make([]string, 0)
+	for name := range startByName {
+		names = append(names, name)
+	}
+
+	for name := range endByName {
+		if _, ok := startByName[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	interfaces := make([]*diagnoseInterface, 0, len(names))
+
+	for _, name := range names {
+		first, hadStart := startByName[name]
+		last, hadEnd := endByName[name]
+
+		i := diagnoseInterface{
+			Name:           name,
+			OperStateStart: first.OperState,
+			OperStateEnd:   last.OperState,
+			Warnings:       make([]string, 0),
+		}
+
+		switch {
+		case !hadStart:
+			i.Warnings = append(i.Warnings, "appeared")
+		case !hadEnd:
+			i.Warnings = append(i.Warnings, "went away")
+		default:
+			i.CarrierChanges = network_interfaces.GetCounterDelta(first.CarrierChanges, last.CarrierChanges)
+			i.RxErrors = network_interfaces.GetCounterDelta(first.RxErrors, last.RxErrors)
+			i.TxErrors = network_interfaces.GetCounterDelta(first.TxErrors, last.TxErrors)
+			i.RxDropped = network_interfaces.GetCounterDelta(first.RxDropped, last.RxDropped)
+			i.TxDropped = network_interfaces.GetCounterDelta(first.TxDropped, last.TxDropped)
+			i.Rates = network_interfaces.GetRates(first, last)
+
+			if first.OperState != last.OperState {
+				i.Warnings = append(i.Warnings, fmt.Sprintf("went from %s to %s", first.OperState, last.OperState))
+			}
+
+			if i.CarrierChanges > 0 {
+				i.Warnings = append(i.Warnings, fmt.Sprintf("%d carrier changes", i.CarrierChanges))
+			}
+
+			if i.RxErrors+i.TxErrors > 0 {
+				i.Warnings = append(i.Warnings, fmt.Sprintf("%d rx / %d tx errors", i.RxErrors, i.TxErrors))
+			}
+
+			if i.RxDropped+i.TxDropped > 0 {
+				i.Warnings = append(i.Warnings, fmt.Sprintf("%d rx / %d tx dropped", i.RxDropped, i.TxDropped))
+			}
+		}
+
+		interfaces = append(interfaces, &i)
+	}
+
+	return interfaces
+}
+
+func writeDiagnoseSummary(w io.Writer, result diagnoseResult) {
+	verdict := "OK"
+	if !result.OK {
+		verdict = "FAILED"
+	}
+
+	_, _ = fmt.Fprintf(w, "diagnose: %s (%s from %s)\n", verdict, result.Duration, result.Started.Format(time.RFC3339))
+
+	for _, target := range result.Targets {
+		targetVerdict := "ok"
+		if !target.OK {
+			targetVerdict = "FAILED: " + strings.Join(target.Failures, "; ")
+		}
+
+		_, _ = fmt.Fprintf(w, "\n%s - %s\n\n", target.Host, targetVerdict)
+		_, _ = fmt.Fprintf(w, "  %-8s %-12s %7s %7s %8s %12s %12s %12s %12s\n", "probe", "result", "sent", "recv", "loss", "rtt_min", "rtt_avg", "rtt_max", "jitter")
+
+		for _, probe := range target.Probes {
+			loss := "-"
+			if probe.Sent > 0 {
+				loss = fmt.Sprintf("%.2f%%", probe.LossPercent)
+			}
+
+			_, _ = fmt.Fprintf(
+				w,
+				"  %-8s %-12s %7d %7d %8s %12s %12s %12s %12s\n",
+				probe.Protocol,
+				probe.Result,
+				probe.Sent,
+				probe.Received,
+				loss,
+				probe.RTTMin.Round(time.Microsecond),
+				probe.RTTAvg.Round(time.Microsecond),
+				probe.RTTMax.Round(time.Microsecond),
+				probe.Jitter.Round(time.Microsecond),
+			)
+
+			if probe.Result != diagnoseOK && len(probe.Errors) > 0 {
+				_, _ = fmt.Fprintf(w, "           (%s)\n", probe.Errors[len(probe.Errors)-1])
+			}
+		}
+
+		if target.MTU != nil {
+			reported := ""
+			if target.MTU.ReportedMTU > 0 {
+				reported = fmt.Sprintf(" (a router reported %d)", target.MTU.ReportedMTU)
+			}
+
+			_, _ = fmt.Fprintf(w, "\n  path mtu: %d%s\n", target.MTU.PathMTU, reported)
+		} else if target.MTUError != "" {
+			_, _ = fmt.Fprintf(w, "\n  path mtu: failed: %s\n", target.MTUError)
+		}
+
+		if target.Traceroute != nil {
+			reached := "reached"
+			if !target.Traceroute.Reached {
+				reached = "not reached"
+			}
+
+			_, _ = fmt.Fprintf(w, "\n  traceroute (%s):\n", reached)
+
+			for _, hop := range target.Traceroute.Hops {
+				if hop.Address == "" {
+					_, _ = fmt.Fprintf(w, "  %4d  *\n", hop.TTL)
+					continue
+				}
+
+				_, _ = fmt.Fprintf(w, "  %4d  %-40s %12s  (%d/%d)\n", hop.TTL, hop.Address, hop.RTTAvg.Round(time.Microsecond), hop.Received, hop.Sent)
+			}
+		} else if target.TracerouteError != "" {
+			_, _ = fmt.Fprintf(w, "\n  traceroute: failed: %s\n", target.TracerouteError)
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, "\ninterfaces\n\n")
+	_, _ = fmt.Fprintf(w, "  %-16s %-10s %14s %14s  %s\n", "interface", "state", "rx", "tx", "warnings")
+
+	for _, i := range result.Interfaces {
+		rx, tx := "-", "-"
+		if i.Rates != nil {
+			rx = fmt.Sprintf("%.2f Mbit/s", i.Rates.RxBitsPerSecond/1_000_000)
+			tx = fmt.Sprintf("%.2f Mbit/s", i.Rates.TxBitsPerSecond/1_000_000)
+		}
+
+		_, _ = fmt.Fprintf(w, "  %-16s %-10s %14s %14s  %s\n", i.Name, i.OperStateEnd, rx, tx, strings.Join(i.Warnings, "; "))
+	}
+}
+
+// redirectStdoutToStderr points stdout at stderr (at the fd level, so the package loggers follow), returning a file
+// for what used to be stdout
+func redirectStdoutToStderr() (*os.File, error) {
+	stdoutFd, err := unix.Dup(int(os.Stdout.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed unix.Dup: %s", err)
+	}
+
+	err = unix.Dup3(int(os.Stderr.Fd()), int(os.Stdout.Fd()), 0)
+	if err != nil {
+		_ = unix.Close(stdoutFd)
+		return nil, fmt.Errorf("failed unix.Dup3: %s", err)
+	}
+
+	return os.NewFile(uintptr(stdoutFd), "/dev/stdout"), nil
+}
+
+func runDiagnose(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	duration := flags.Duration("duration", time.Second*60, "how long to run the probes for")
+	probes := flags.String("probes", "icmp,tcp,udp", fmt.Sprintf("comma separated probes to run against each host (%s; tcp and udp are skipped if the host refuses them, i.e. loser isn't running at the other end)", strings.Join(probeProtocols, ", ")))
+	mtu := flags.Bool("mtu", true, "work out the path MTU to each host")
+	mtuMax := flags.Int("mtu-max", packets.DefaultMTUSweepMax, "the biggest MTU to try")
+	minMTU := flags.Int("min-mtu", 0, "fail if the path MTU is less than this (e.g. 1500)")
+	traceroute := flags.Bool("traceroute", true, "traceroute to each host")
+	maxHops := flags.Int("max-hops", packets.DefaultTracerouteMaxHops, "how far the traceroute goes")
+	maxLoss := flags.Float64("max-loss", 1, "fail if a probe loses more than this percentage")
+	asJSON := flags.Bool("json", false, "only print the JSON (not the summary)")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: loser diagnose [flags] <host...>\n\n")
+		flags.PrintDefaults()
+	}
+
+	// so the flags can come after the hosts too (e.g. loser diagnose 192.168.100.1 -duration 10s)
+	hosts := make([]string, 0)
+	for {
+		_ = flags.Parse(args)
+
+		if flags.NArg() == 0 {
+			break
+		}
+
+		hosts = append(hosts, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(hosts) == 0 || *duration <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	protocols := splitList(*probes)
+	for _, protocol := range protocols {
+		_, err := getProbeFn(protocol)
+		if err != nil {
+			log.Printf("error: %s", err)
+			return 2
+		}
+	}
+
+	// the log lines (ours and the packages') go to stderr, so stdout is just the summary and the JSON
+	stdout, err := redirectStdoutToStderr()
+	if err != nil {
+		log.Printf("error: %s", err)
+		return 1
+	}
+	defer func() {
+		_ = stdout.Close()
+	}()
+
+	result := diagnoseResult{
+		Started: time.Now(),
+		Targets: make([]*diagnoseTarget, 0, len(hosts)),
+	}
+
+	log.Printf("diagnosing %s for %s (%s)...", strings.Join(hosts, ", "), *duration, strings.Join(protocols, ", "))
+
+	startInterfaces, err := network_interfaces.GetNetworkInterfaces()
+	if err != nil {
+		log.Printf("warning: failed network_interfaces.GetNetworkInterfaces(): %s", err)
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+
+	for _, host := range hosts {
+		target := diagnoseTarget{
+			Host:     host,
+			Failures: make([]string, 0),
+			Probes:   make([]*diagnoseProbe, len(protocols)),
+		}
+
+		result.Targets = append(result.Targets, &target)
+
+		for i, protocol := range protocols {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				reports := make([]packets.Report, 0)
+				errs := make([]string, 0)
+				refused := false
+
+				runProbeLoop(probeCtx, protocol, host, time.Second, func(report packets.Report) {
+					mu.Lock()
+					reports = append(reports, report)
+					mu.Unlock()
+				}, func(err error) {
+					mu.Lock()
+					if !slices.Contains(errs, err.Error()) {
+						errs = append(errs, err.Error())
+					}
+					if errors.Is(err, syscall.ECONNREFUSED) {
+						refused = true
+					}
+					mu.Unlock()
+				})
+
+				mu.Lock()
+				target.Probes[i] = getDiagnoseProbe(protocol, host, reports, errs, refused, *maxLoss)
+				mu.Unlock()
+			}()
+		}
+
+		// these are done well within the duration, so they share the probes' deadline
+		if *mtu {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				mtuResult, err := packets.RunMTUSweep(probeCtx, host, *mtuMax)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil {
+					target.MTUError = err.Error()
+					return
+				}
+
+				target.MTU = mtuResult
+			}()
+		}
+
+		if *traceroute {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				tracerouteResult, err := packets.RunTraceroute(probeCtx, host, *maxHops)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil {
+					target.TracerouteError = err.Error()
+					return
+				}
+
+				target.Traceroute = tracerouteResult
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	endInterfaces, err := network_interfaces.GetNetworkInterfaces()
+	if err != nil {
+		log.Printf("warning: failed network_interfaces.GetNetworkInterfaces(): %s", err)
+	}
+
+	result.Finished = time.Now()
+	result.Duration = result.Finished.Sub(result.Started).Round(time.Millisecond)
+	result.Interfaces = getDiagnoseInterfaces(startInterfaces, endInterfaces)
+	result.OK = true
+
+	for _, target := range result.Targets {
+		for _, probe := range target.Probes {
+			if probe.Result == diagnoseFailed {
+				target.Failures = append(target.Failures, getDiagnoseFailure(probe))
+			}
+		}
+
+		if *mtu {
+			if target.MTU == nil {
+				target.Failures = append(target.Failures, fmt.Sprintf("mtu sweep failed: %s", target.MTUError))
+			} else if target.MTU.PathMTU == 0 {
+				target.Failures = append(target.Failures, "no path mtu")
+			} else if target.MTU.PathMTU < *minMTU {
+				target.Failures = append(target.Failures, fmt.Sprintf("path mtu %d < %d", target.MTU.PathMTU, *minMTU))
+			}
+		}
+
+		if *traceroute {
+			if target.Traceroute == nil {
+				target.Failures = append(target.Failures, fmt.Sprintf("traceroute failed: %s", target.TracerouteError))
+			} else if !target.Traceroute.Reached {
+				target.Failures = append(target.Failures, "traceroute didn't reach it")
+			}
+		}
+
+		target.OK = len(target.Failures) == 0
+		if !target.OK {
+			result.OK = false
+		}
+	}
+
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Printf("error: failed json.MarshalIndent for result: %s", err)
+		return 1
+	}
+
+	if !*asJSON {
+		writeDiagnoseSummary(stdout, result)
+		_, _ = fmt.Fprintln(stdout)
+	}
+
+	_, _ = fmt.Fprintln(stdout, string(b))
+
+	if !result.OK {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/initialed85/loser/pkg/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnose(t *testing.T) {
+	at := func(seconds int) time.Time {
+		return time.Date(2024, 1, 1, 12, 0, seconds, 0, time.UTC)
+	}
+
+	replies := []packets.Report{
+		{Timestamp: at(1), Sent: 10, Received: 10, RTTMin: time.Millisecond, RTTAvg: time.Millisecond, RTTMax: time.Millisecond},
+		{Timestamp: at(2), Sent: 10, Received: 10, RTTMin: time.Millisecond, RTTAvg: time.Millisecond, RTTMax: time.Millisecond},
+	}
+
+	someLoss := []packets.Report{
+		{Timestamp: at(1), Sent: 10, Received: 10},
+		{Timestamp: at(2), Sent: 10, Received: 9, Lost: 1},
+	}
+
+	noReplies := []packets.Report{
+		{Timestamp: at(1), Sent: 10, Lost: 10},
+	}
+
+	t.Run("GetDiagnoseProbe", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name     string
+			protocol string
+			reports  []packets.Report
+			errs     []string
+			refused  bool
+			maxLoss  float64
+			expected string
+		}{
+			{"OK", "icmp", replies, nil, false, 1, diagnoseOK},
+			{"LossUnderMax", "icmp", someLoss, nil, false, 10, diagnoseOK},
+			{"LossOverMax", "icmp", someLoss, nil, false, 1, diagnoseFailed},
+			{"NoReplies", "udp", noReplies, nil, false, 1, diagnoseFailed},
+			{"ICMPNeverSent", "icmp", nil, []string{"operation not permitted"}, false, 1, diagnoseFailed},
+			{"TCPRefused", "tcp", nil, []string{"connect: connection refused"}, true, 1, diagnoseUnavailable},
+			{"UDPRefused", "udp", nil, []string{"read: connection refused"}, true, 1, diagnoseUnavailable},
+			{"TCPTimedOut", "tcp", nil, []string{"i/o timeout"}, false, 1, diagnoseFailed},
+			{"TCPUnreachable", "tcp", nil, []string{"connect: no route to host"}, false, 1, diagnoseFailed},
+			{"TCPRefusedAfterSending", "tcp", noReplies, []string{"connect: connection refused"}, true, 1, diagnoseFailed},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				probe := getDiagnoseProbe(testCase.protocol, "192.168.1.1", testCase.reports, testCase.errs, testCase.refused, testCase.maxLoss)
+				require.Equal(t, testCase.expected, probe.Result)
+				require.Equal(t, testCase.protocol, probe.Protocol)
+				require.Equal(t, testCase.protocol+"/192.168.1.1", probe.Target)
+			})
+		}
+	})
+
+	t.Run("GetDiagnoseFailure", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name     string
+			reports  []packets.Report
+			errs     []string
+			expected string
+		}{
+			{"Loss", someLoss, nil, "tcp 5.00% loss"},
+			{"NoReplies", noReplies, []string{"ignored"}, "tcp 100.00% loss"},
+			{"NeverSent", nil, []string{"i/o timeout", "connect: no route to host"}, "tcp: no replies (connect: no route to host)"},
+			{"NeverSentNoErrors", nil, nil, "tcp: no replies"},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				probe := getDiagnoseProbe("tcp", "192.168.1.1", testCase.reports, testCase.errs, false, 1)
+				require.Equal(t, testCase.expected, getDiagnoseFailure(probe))
+			})
+		}
+	})
+
+	t.Run("GetDiagnoseInterfaces", func(t *testing.T) {
+		start := []network_interfaces.NetworkInterface{
+			{Name: "eth0", OperState: "up", Timestamp: at(0), RxErrors: 10, TxDropped: 5},
+			{Name: "eth1", OperState: "up", Timestamp: at(0), CarrierChanges: 2},
+			{Name: "eth2", OperState: "up", Timestamp: at(0)},
+			{Name: "lo", OperState: "unknown", Timestamp: at(0)},
+		}
+
+		end := []network_interfaces.NetworkInterface{
+			{Name: "eth0", OperState: "up", Timestamp: at(60), RxErrors: 13, TxDropped: 5},
+			{Name: "eth1", OperState: "down", Timestamp: at(60), CarrierChanges: 3},
+			{Name: "eth3", OperState: "up", Timestamp: at(60)},
+			{Name: "lo", OperState: "unknown", Timestamp: at(60)},
+		}
+
+		interfaces := getDiagnoseInterfaces(start, end)
+
+		names := make([]string, 0)
+		for _, networkInterface := range interfaces {
+			names = append(names, networkInterface.Name)
+		}
+
+		require.Equal(t, []string{"eth0", "eth1", "eth2", "eth3", "lo"}, names)
+
+		for _, testCase := range []struct {
+			name     string
+			index    int
+			expected []string
+		}{
+			{"Errors", 0, []string{"3 rx / 0 tx errors"}},
+			{"WentDown", 1, []string{"went from up to down", "1 carrier changes"}},
+			{"WentAway", 2, []string{"went away"}},
+			{"Appeared", 3, []string{"appeared"}},
+			{"Unchanged", 4, []string{}},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				require.Equal(t, testCase.expected, interfaces[testCase.index].Warnings)
+			})
+		}
+
+		require.Equal(t, int64(3), interfaces[0].RxErrors)
+		require.Equal(t, int64(0), interfaces[0].TxDropped)
+		require.NotNil(t, interfaces[0].Rates)
+		require.Nil(t, interfaces[2].Rates)
+	})
+}
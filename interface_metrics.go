@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type interfaceCounter struct {
+	name     string
+	getValue func(network_interfaces.NetworkInterface) int64
+}
+
+var interfaceCounters = []interfaceCounter{
+	{"carrier_changes", func(n network_interfaces.NetworkInterface) int64 { return n.CarrierChanges }},
+	{"carrier_up_count", func(n network_interfaces.NetworkInterface) int64 { return n.CarrierUpCount }},
+	{"carrier_down_count", func(n network_interfaces.NetworkInterface) int64 { return n.CarrierDownCount }},
+	{"collisions", func(n network_interfaces.NetworkInterface) int64 { return n.Collisions }},
+	{"multicast", func(n network_interfaces.NetworkInterface) int64 { return n.Multicast }},
+	{"rx_bytes", func(n network_interfaces.NetworkInterface) int64 { return n.RxBytes }},
+	{"rx_compressed", func(n network_interfaces.NetworkInterface) int64 { return n.RxCompressed }},
+	{"rx_crc_errors", func(n network_interfaces.NetworkInterface) int64 { return n.RxCrcErrors }},
+	{"rx_dropped", func(n network_interfaces.NetworkInterface) int64 { return n.RxDropped }},
+	{"rx_errors", func(n network_interfaces.NetworkInterface) int64 { return n.RxErrors }},
+	{"rx_fifo_errors", func(n network_interfaces.NetworkInterface) int64 { return n.RxFifoErrors }},
+	{"rx_frame_errors", func(n network_interfaces.NetworkInterface) int64 { return n.RxFrameErrors }},
+	{"rx_length_errors", func(n network_interfaces.NetworkInterface) int64 { return n.RxLengthErrors }},
+	{"rx_missed_errors", func(n network_interfaces.NetworkInterface) int64 { return n.RxMissedErrors }},
+	{"rx_nohandler", func(n network_interfaces.NetworkInterface) int64 { return n.RxNohandler }},
+	{"rx_over_errors", func(n network_interfaces.NetworkInterface) int64 { return n.RxOverErrors }},
+	{"rx_packets", func(n network_interfaces.NetworkInterface) int64 { return n.RxPackets }},
+	{"tx_aborted_errors", func(n network_interfaces.NetworkInterface) int64 { return n.TxAbortedErrors }},
+	{"tx_bytes", func(n network_interfaces.NetworkInterface) int64 { return n.TxBytes }},
+	{"tx_carrier_errors", func(n network_interfaces.NetworkInterface) int64 { return n.TxCarrierErrors }},
+	{"tx_compressed", func(n network_interfaces.NetworkInterface) int64 { return n.TxCompressed }},
+	{"tx_dropped", func(n network_interfaces.NetworkInterface) int64 { return n.TxDropped }},
+	{"tx_errors", func(n network_interfaces.NetworkInterface) int64 { return n.TxErrors }},
+	{"tx_fifo_errors", func(n network_interfaces.NetworkInterface) int64 { return n.TxFifoErrors }},
+	{"tx_heartbeat_errors", func(n network_interfaces.NetworkInterface) int64 { return n.TxHeartbeatErrors }},
+	{"tx_packets", func(n network_interfaces.NetworkInterface) int64 { return n.TxPackets }},
+	{"tx_window_errors", func(n network_interfaces.NetworkInterface) int64 { return n.TxWindowErrors }},
+}
+
+type interfaceGauge struct {
+	name     string
+	getValue func(network_interfaces.NetworkInterface) float64
+}
+
+var interfaceGauges = []interfaceGauge{
+	{"mtu", func(n network_interfaces.NetworkInterface) float64 { return float64(n.MTU) }},
+	{"speed", func(n network_interfaces.NetworkInterface) float64 { return float64(n.Speed) }},
+	{"duplex", func(n network_interfaces.NetworkInterface) float64 {
+		return float64(network_interfaces.GetDuplexValue(n.Duplex))
+	}},
+	{"oper_state", func(n network_interfaces.NetworkInterface) float64 {
+		return float64(network_interfaces.GetOperStateValue(n.OperState))
+	}},
+	{"carrier", func(n network_interfaces.NetworkInterface) float64 { return float64(n.Carrier) }},
+}
+
+type rateGauge struct {
+	name     string
+	getValue func(network_interfaces.Rates) float64
+}
+
+// only exported with -interface-rate-gauges (rate() in Prometheus does the same job for the counters); the utilisation
+// ones are -1 if the speed isn't known
+var rateGauges = []rateGauge{
+	{"rx_bits_per_second", func(r network_interfaces.Rates) float64 { return r.RxBitsPerSecond }},
+	{"tx_bits_per_second", func(r network_interfaces.Rates) float64 { return r.TxBitsPerSecond }},
+	{"rx_packets_per_second", func(r network_interfaces.Rates) float64 { return r.RxPacketsPerSecond }},
+	{"tx_packets_per_second", func(r network_interfaces.Rates) float64 { return r.TxPacketsPerSecond }},
+	{"rx_errors_per_second", func(r network_interfaces.Rates) float64 { return r.RxErrorsPerSecond }},
+	{"tx_errors_per_second", func(r network_interfaces.Rates) float64 { return r.TxErrorsPerSecond }},
+	{"rx_dropped_per_second", func(r network_interfaces.Rates) float64 { return r.RxDroppedPerSecond }},
+	{"tx_dropped_per_second", func(r network_interfaces.Rates) float64 { return r.TxDroppedPerSecond }},
+	{"rx_utilisation_percent", func(r network_interfaces.Rates) float64 { return getUtilisationPercent(r.RxUtilisationPercent) }},
+	{"tx_utilisation_percent", func(r network_interfaces.Rates) float64 { return getUtilisationPercent(r.TxUtilisationPercent) }},
+}
+
+func getUtilisationPercent(utilisationPercent *float64) float64 {
+	if utilisationPercent == nil {
+		return -1
+	}
+
+	return *utilisationPercent
+}
+
+type wirelessGauge struct {
+	name     string
+	getValue func(network_interfaces.Wireless) float64
+}
+
+var wirelessGauges = []wirelessGauge{
+	{"wireless_link_quality", func(w network_interfaces.Wireless) float64 { return w.LinkQuality }},
+	{"wireless_signal_level", func(w network_interfaces.Wireless) float64 { return w.SignalLevel }},
+	{"wireless_noise_level", func(w network_interfaces.Wireless) float64 { return w.NoiseLevel }},
+}
+
+type wirelessCounter struct {
+	name     string
+	getValue func(network_interfaces.Wireless) int64
+}
+
+var wirelessCounters = []wirelessCounter{
+	{"wireless_discarded_nwid", func(w network_interfaces.Wireless) int64 { return w.DiscardedNWID }},
+	{"wireless_discarded_crypt", func(w network_interfaces.Wireless) int64 { return w.DiscardedCrypt }},
+	{"wireless_discarded_frag", func(w network_interfaces.Wireless) int64 { return w.DiscardedFrag }},
+	{"wireless_discarded_retry", func(w network_interfaces.Wireless) int64 { return w.DiscardedRetry }},
+	{"wireless_discarded_misc", func(w network_interfaces.Wireless) int64 { return w.DiscardedMisc }},
+	{"wireless_missed_beacon", func(w network_interfaces.Wireless) int64 { return w.MissedBeacon }},
+}
+
+type stationGauge struct {
+	name     string
+	getValue func(network_interfaces.Station) float64
+}
+
+// the station metrics are only exported while there's a single station (i.e. a client talking to its access point); an
+// access point's clients are in the JSON
+var stationGauges = []stationGauge{
+	{"wireless_station_signal", func(s network_interfaces.Station) float64 { return float64(s.Signal) }},
+	{"wireless_station_tx_bitrate_bits_per_second", func(s network_interfaces.Station) float64 { return float64(s.TxBitrate) }},
+	{"wireless_station_rx_bitrate_bits_per_second", func(s network_interfaces.Station) float64 { return float64(s.RxBitrate) }},
+}
+
+type stationCounter struct {
+	name     string
+	getValue func(network_interfaces.Station) int64
+}
+
+var stationCounters = []stationCounter{
+	{"wireless_station_tx_retries", func(s network_interfaces.Station) int64 { return s.TxRetries }},
+	{"wireless_station_tx_failed", func(s network_interfaces.Station) int64 { return s.TxFailed }},
+	{"wireless_station_beacon_loss", func(s network_interfaces.Station) int64 { return s.BeaconLoss }},
+}
+
+type qdiscCounter struct {
+	name     string
+	getValue func(network_interfaces.Qdisc) int64
+}
+
+var qdiscCounters = []qdiscCounter{
+	{"bytes", func(q network_interfaces.Qdisc) int64 { return q.Bytes }},
+	{"packets", func(q network_interfaces.Qdisc) int64 { return q.Packets }},
+	{"drops", func(q network_interfaces.Qdisc) int64 { return q.Drops }},
+	{"overlimits", func(q network_interfaces.Qdisc) int64 { return q.Overlimits }},
+	{"requeues", func(q network_interfaces.Qdisc) int64 { return q.Requeues }},
+}
+
+type qdiscGauge struct {
+	name     string
+	getValue func(network_interfaces.Qdisc) float64
+}
+
+var qdiscGauges = []qdiscGauge{
+	{"backlog", func(q network_interfaces.Qdisc) float64 { return float64(q.Backlog) }},
+	{"qlen", func(q network_interfaces.Qdisc) float64 { return float64(q.QLen) }},
+}
+
+type ringGauge struct {
+	name     string
+	getValue func(network_interfaces.RingParams) float64
+}
+
+var ringGauges = []ringGauge{
+	{"ethtool_ring_rx_pending", func(r network_interfaces.RingParams) float64 { return float64(r.RxPending) }},
+	{"ethtool_ring_rx_max_pending", func(r network_interfaces.RingParams) float64 { return float64(r.RxMaxPending) }},
+	{"ethtool_ring_tx_pending", func(r network_interfaces.RingParams) float64 { return float64(r.TxPending) }},
+	{"ethtool_ring_tx_max_pending", func(r network_interfaces.RingParams) float64 { return float64(r.TxMaxPending) }},
+}
+
+// qdiscMetrics are the metrics for one qdisc or class (e.g. eth0_qdisc_drops{kind="fq_codel",handle="0:",parent="root"})
+type qdiscMetrics struct {
+	last       network_interfaces.Qdisc
+	collectors []prometheus.Collector
+	counters   []prometheus.Counter
+	gauges     []prometheus.Gauge
+}
+
+// stationMetrics are the metrics for the access point a wireless client is connected to; they start again (as a counter
+// reset) if it connects to another one
+type stationMetrics struct {
+	last       network_interfaces.Station
+	collectors []prometheus.Collector
+	gauges     []prometheus.Gauge
+	counters   []prometheus.Counter
+}
+
+type interfaceMetrics struct {
+	friendlyNetworkInterfaceName string
+	constLabels                  prometheus.Labels
+
+	collectors []prometheus.Collector
+	counters   []prometheus.Counter
+	gauges     []prometheus.Gauge
+
+	withRateGauges bool
+	rateGauges     []prometheus.Gauge
+
+	// only created once we've seen the interface is wireless
+	wirelessGauges   []prometheus.Gauge
+	wirelessCounters []prometheus.Counter
+
+	// only there while there's a single station; unregistered otherwise (rather than left showing the last one's values)
+	stationMetrics *stationMetrics
+
+	// keyed by getQdiscKey; created and unregistered as the qdiscs / classes come and go
+	qdiscMetricsByKey map[string]*qdiscMetrics
+
+	// keyed by the driver's name for the stat (e.g. eth0_ethtool_stat{stat="rx_missed_errors"}); only the allowed ones
+	ethtoolStatCounters map[string]prometheus.Counter
+	lastEthtoolStats    map[string]int64
+	ringGauges          []prometheus.Gauge
+}
+
+// newInterfaceMetrics registers the metrics for an interface (e.g. eth0_rx_bytes, or netns_eth0_rx_bytes for a prefix
+// of "netns"); constLabels may be nil
+func newInterfaceMetrics(prefix string, networkInterfaceName string, constLabels prometheus.Labels, withRateGauges bool) *interfaceMetrics {
+	friendlyNetworkInterfaceName := getFriendlyName(networkInterfaceName)
+	if prefix != "" {
+		friendlyNetworkInterfaceName = fmt.Sprintf("%s_%s", prefix, friendlyNetworkInterfaceName)
+	}
+
+	m := interfaceMetrics{
+		friendlyNetworkInterfaceName: friendlyNetworkInterfaceName,
+		constLabels:                  constLabels,
+		collectors:                   make([]prometheus.Collector, 0),
+		counters:                     make([]prometheus.Counter, 0),
+		gauges:                       make([]prometheus.Gauge, 0),
+		withRateGauges:               withRateGauges,
+		qdiscMetricsByKey:            make(map[string]*qdiscMetrics),
+		ethtoolStatCounters:          make(map[string]prometheus.Counter),
+	}
+
+	// not updated; kept around so the metric still shows up
+	ifIndexCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_if_index", friendlyNetworkInterfaceName), ConstLabels: constLabels})
+	m.collectors = append(m.collectors, ifIndexCounter)
+
+	for _, interfaceCounter := range interfaceCounters {
+		counter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_%s", friendlyNetworkInterfaceName, interfaceCounter.name), ConstLabels: constLabels})
+		m.collectors = append(m.collectors, counter)
+		m.counters = append(m.counters, counter)
+	}
+
+	for _, interfaceGauge := range interfaceGauges {
+		m.gauges = append(m.gauges, m.newGauge(interfaceGauge.name))
+	}
+
+	return &m
+}
+
+// report updates the gauges and (if we've seen the interface before) adds the change since last time to the counters
+// (allowing for wraps and resets, see network_interfaces.GetCounterDelta)
+func (m *interfaceMetrics) report(networkInterface network_interfaces.NetworkInterface, lastNetworkInterface *network_interfaces.NetworkInterface) {
+	for i, interfaceGauge := range interfaceGauges {
+		m.gauges[i].Set(interfaceGauge.getValue(networkInterface))
+	}
+
+	if networkInterface.Wireless != nil {
+		if m.wirelessGauges == nil {
+			for _, wirelessGauge := range wirelessGauges {
+				m.wirelessGauges = append(m.wirelessGauges, m.newGauge(wirelessGauge.name))
+			}
+
+			for _, wirelessCounter := range wirelessCounters {
+				m.wirelessCounters = append(m.wirelessCounters, m.newCounter(wirelessCounter.name))
+			}
+		} else if lastNetworkInterface != nil && lastNetworkInterface.Wireless != nil {
+			for i, wirelessCounter := range wirelessCounters {
+				m.wirelessCounters[i].Add(float64(network_interfaces.GetCounterDelta(wirelessCounter.getValue(*lastNetworkInterface.Wireless), wirelessCounter.getValue(*networkInterface.Wireless))))
+			}
+		}
+
+		for i, wirelessGauge := range wirelessGauges {
+			m.wirelessGauges[i].Set(wirelessGauge.getValue(*networkInterface.Wireless))
+		}
+	}
+
+	m.reportStation(networkInterface.Wireless)
+
+	m.reportQdiscs(networkInterface.Qdiscs)
+
+	if networkInterface.Ethtool != nil {
+		m.reportEthtool(*networkInterface.Ethtool)
+	}
+
+	if lastNetworkInterface == nil {
+		return
+	}
+
+	for i, interfaceCounter := range interfaceCounters {
+		m.counters[i].Add(float64(network_interfaces.GetCounterDelta(interfaceCounter.getValue(*lastNetworkInterface), interfaceCounter.getValue(networkInterface))))
+	}
+
+	if m.withRateGauges && networkInterface.Rates != nil {
+		if m.rateGauges == nil {
+			for _, rateGauge := range rateGauges {
+				m.rateGauges = append(m.rateGauges, m.newGauge(rateGauge.name))
+			}
+		}
+
+		for i, rateGauge := range rateGauges {
+			m.rateGauges[i].Set(rateGauge.getValue(*networkInterface.Rates))
+		}
+	}
+}
+
+// reportStation updates the station metrics while there's a single station, and unregisters them otherwise
+func (m *interfaceMetrics) reportStation(wireless *network_interfaces.Wireless) {
+	if wireless == nil || len(wireless.Stations) != 1 {
+		m.unregisterStation()
+		return
+	}
+
+	station := wireless.Stations[0]
+
+	if m.stationMetrics != nil && m.stationMetrics.last.MAC != station.MAC {
+		m.unregisterStation()
+	}
+
+	if m.stationMetrics == nil {
+		m.stationMetrics = m.newStationMetrics()
+	} else {
+		for i, stationCounter := range stationCounters {
+			m.stationMetrics.counters[i].Add(float64(network_interfaces.GetCounterDelta(stationCounter.getValue(m.stationMetrics.last), stationCounter.getValue(station))))
+		}
+	}
+
+	for i, stationGauge := range stationGauges {
+		m.stationMetrics.gauges[i].Set(stationGauge.getValue(station))
+	}
+
+	m.stationMetrics.last = station
+}
+
+func (m *interfaceMetrics) newStationMetrics() *stationMetrics {
+	sm := stationMetrics{}
+
+	for _, stationGauge := range stationGauges {
+		gauge := promauto.NewGauge(prometheus.GaugeOpts{Name: fmt.Sprintf("%s_%s", m.friendlyNetworkInterfaceName, stationGauge.name), ConstLabels: m.constLabels})
+		sm.collectors = append(sm.collectors, gauge)
+		sm.gauges = append(sm.gauges, gauge)
+	}
+
+	for _, stationCounter := range stationCounters {
+		counter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_%s", m.friendlyNetworkInterfaceName, stationCounter.name), ConstLabels: m.constLabels})
+		sm.collectors = append(sm.collectors, counter)
+		sm.counters = append(sm.counters, counter)
+	}
+
+	return &sm
+}
+
+func (m *interfaceMetrics) unregisterStation() {
+	if m.stationMetrics == nil {
+		return
+	}
+
+	for _, collector := range m.stationMetrics.collectors {
+		_ = prometheus.DefaultRegisterer.Unregister(collector)
+	}
+
+	m.stationMetrics = nil
+}
+
+func getQdiscKey(qdisc network_interfaces.Qdisc) string {
+	return fmt.Sprintf("%v/%s/%s/%s", qdisc.Class, qdisc.Kind, qdisc.Handle, qdisc.Parent)
+}
+
+// reportQdiscs updates the metrics for each qdisc / class (replacing a qdisc starts its stats again from zero, which
+// GetCounterDelta takes as a reset)
+func (m *interfaceMetrics) reportQdiscs(qdiscs []network_interfaces.Qdisc) {
+	seenKeys := make(map[string]struct{})
+
+	for _, qdisc := range qdiscs {
+		key := getQdiscKey(qdisc)
+		seenKeys[key] = struct{}{}
+
+		qm, ok := m.qdiscMetricsByKey[key]
+		if !ok {
+			qm = m.newQdiscMetrics(qdisc)
+			m.qdiscMetricsByKey[key] = qm
+		} else {
+			for i, qdiscCounter := range qdiscCounters {
+				qm.counters[i].Add(float64(network_interfaces.GetCounterDelta(qdiscCounter.getValue(qm.last), qdiscCounter.getValue(qdisc))))
+			}
+		}
+
+		for i, qdiscGauge := range qdiscGauges {
+			qm.gauges[i].Set(qdiscGauge.getValue(qdisc))
+		}
+
+		qm.last = qdisc
+	}
+
+	for key, qm := range m.qdiscMetricsByKey {
+		_, ok := seenKeys[key]
+		if ok {
+			continue
+		}
+
+		for _, collector := range qm.collectors {
+			_ = prometheus.DefaultRegisterer.Unregister(collector)
+		}
+
+		delete(m.qdiscMetricsByKey, key)
+	}
+}
+
+func (m *interfaceMetrics) newQdiscMetrics(qdisc network_interfaces.Qdisc) *qdiscMetrics {
+	constLabels := prometheus.Labels{
+		"kind":   qdisc.Kind,
+		"handle": qdisc.Handle,
+		"parent": qdisc.Parent,
+	}
+
+	for k, v := range m.constLabels {
+		constLabels[k] = v
+	}
+
+	prefix := "qdisc"
+	if qdisc.Class {
+		prefix = "class"
+	}
+
+	qm := qdiscMetrics{
+		last: qdisc,
+	}
+
+	for _, qdiscCounter := range qdiscCounters {
+		counter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_%s_%s", m.friendlyNetworkInterfaceName, prefix, qdiscCounter.name), ConstLabels: constLabels})
+		qm.collectors = append(qm.collectors, counter)
+		qm.counters = append(qm.counters, counter)
+	}
+
+	for _, qdiscGauge := range qdiscGauges {
+		gauge := promauto.NewGauge(prometheus.GaugeOpts{Name: fmt.Sprintf("%s_%s_%s", m.friendlyNetworkInterfaceName, prefix, qdiscGauge.name), ConstLabels: constLabels})
+		qm.collectors = append(qm.collectors, gauge)
+		qm.gauges = append(qm.gauges, gauge)
+	}
+
+	return &qm
+}
+
+// reportEthtool updates the driver stats (a driver reload starts them from zero again) and the ring parameters
+func (m *interfaceMetrics) reportEthtool(ethtool network_interfaces.Ethtool) {
+	for name, value := range ethtool.Stats {
+		counter, ok := m.ethtoolStatCounters[name]
+		if !ok {
+			constLabels := prometheus.Labels{"stat": name}
+			for k, v := range m.constLabels {
+				constLabels[k] = v
+			}
+
+			counter = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_ethtool_stat", m.friendlyNetworkInterfaceName), ConstLabels: constLabels})
+			m.ethtoolStatCounters[name] = counter
+
+			continue
+		}
+
+		counter.Add(float64(network_interfaces.GetCounterDelta(m.lastEthtoolStats[name], value)))
+	}
+
+	for name, counter := range m.ethtoolStatCounters {
+		_, ok := ethtool.Stats[name]
+		if ok {
+			continue
+		}
+
+		_ = prometheus.DefaultRegisterer.Unregister(counter)
+		delete(m.ethtoolStatCounters, name)
+	}
+
+	m.lastEthtoolStats = ethtool.Stats
+
+	if ethtool.Ring != nil {
+		if m.ringGauges == nil {
+			for _, ringGauge := range ringGauges {
+				m.ringGauges = append(m.ringGauges, m.newGauge(ringGauge.name))
+			}
+		}
+
+		for i, ringGauge := range ringGauges {
+			m.ringGauges[i].Set(ringGauge.getValue(*ethtool.Ring))
+		}
+	}
+}
+
+func (m *interfaceMetrics) newGauge(name string) prometheus.Gauge {
+	gauge := promauto.NewGauge(prometheus.GaugeOpts{Name: fmt.Sprintf("%s_%s", m.friendlyNetworkInterfaceName, name), ConstLabels: m.constLabels})
+	m.collectors = append(m.collectors, gauge)
+
+	return gauge
+}
+
+func (m *interfaceMetrics) newCounter(name string) prometheus.Counter {
+	counter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_%s", m.friendlyNetworkInterfaceName, name), ConstLabels: m.constLabels})
+	m.collectors = append(m.collectors, counter)
+
+	return counter
+}
+
+func (m *interfaceMetrics) unregister() {
+	for _, collector := range m.collectors {
+		_ = prometheus.DefaultRegisterer.Unregister(collector)
+	}
+
+	m.unregisterStation()
+
+	for _, qm := range m.qdiscMetricsByKey {
+		for _, collector := range qm.collectors {
+			_ = prometheus.DefaultRegisterer.Unregister(collector)
+		}
+	}
+
+	for _, counter := range m.ethtoolStatCounters {
+		_ = prometheus.DefaultRegisterer.Unregister(counter)
+	}
+}
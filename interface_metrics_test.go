@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterfaceMetrics(t *testing.T) {
+	// getMetric is the given metric from the default registry, or nil if it isn't registered
+	getMetric := func(t *testing.T, name string) *dto.MetricFamily {
+		metricFamilies, err := prometheus.DefaultGatherer.Gather()
+		require.NoError(t, err)
+
+		for _, metricFamily := range metricFamilies {
+			if metricFamily.GetName() == name {
+				return metricFamily
+			}
+		}
+
+		return nil
+	}
+
+	t.Run("Types", func(t *testing.T) {
+		m := newInterfaceMetrics("", "typetest0", nil, false)
+		t.Cleanup(m.unregister)
+
+		first := network_interfaces.NetworkInterface{Name: "typetest0", Speed: 1000, CarrierChanges: 4, CarrierUpCount: 2, CarrierDownCount: 2}
+		m.report(first, nil)
+
+		second := network_interfaces.NetworkInterface{Name: "typetest0", Speed: 100, CarrierChanges: 6, CarrierUpCount: 3, CarrierDownCount: 3}
+		m.report(second, &first)
+
+		speed := getMetric(t, "typetest0_speed")
+		require.NotNil(t, speed)
+		require.Equal(t, dto.MetricType_GAUGE, speed.GetType())
+		require.Equal(t, 100.0, speed.GetMetric()[0].GetGauge().GetValue())
+
+		for name, expected := range map[string]float64{"carrier_changes": 2, "carrier_up_count": 1, "carrier_down_count": 1} {
+			counter := getMetric(t, "typetest0_"+name)
+			require.NotNil(t, counter, name)
+			require.Equal(t, dto.MetricType_COUNTER, counter.GetType(), name)
+			require.Equal(t, expected, counter.GetMetric()[0].GetCounter().GetValue(), name)
+		}
+	})
+
+	t.Run("Wireless", func(t *testing.T) {
+		m := newInterfaceMetrics("", "wltest0", nil, false)
+		t.Cleanup(m.unregister)
+
+		station := network_interfaces.Station{MAC: "00:11:22:33:44:55", Signal: -50, TxRetries: 10, BeaconLoss: 1}
+
+		first := network_interfaces.NetworkInterface{
+			Name:     "wltest0",
+			Wireless: &network_interfaces.Wireless{SignalLevel: -50, MissedBeacon: 100, Stations: []network_interfaces.Station{station}},
+		}
+		m.report(first, nil)
+
+		station.Signal = -60
+		station.TxRetries = 15
+		second := network_interfaces.NetworkInterface{
+			Name:     "wltest0",
+			Wireless: &network_interfaces.Wireless{SignalLevel: -60, MissedBeacon: 103, Stations: []network_interfaces.Station{station}},
+		}
+		m.report(second, &first)
+
+		// the monotonic ones are counters of what's happened since we started watching
+		missedBeacon := getMetric(t, "wltest0_wireless_missed_beacon")
+		require.NotNil(t, missedBeacon)
+		require.Equal(t, dto.MetricType_COUNTER, missedBeacon.GetType())
+		require.Equal(t, 3.0, missedBeacon.GetMetric()[0].GetCounter().GetValue())
+
+		txRetries := getMetric(t, "wltest0_wireless_station_tx_retries")
+		require.NotNil(t, txRetries)
+		require.Equal(t, dto.MetricType_COUNTER, txRetries.GetType())
+		require.Equal(t, 5.0, txRetries.GetMetric()[0].GetCounter().GetValue())
+
+		signal := getMetric(t, "wltest0_wireless_station_signal")
+		require.NotNil(t, signal)
+		require.Equal(t, dto.MetricType_GAUGE, signal.GetType())
+		require.Equal(t, -60.0, signal.GetMetric()[0].GetGauge().GetValue())
+
+		// disconnected, so no station metrics (rather than the last one's)
+		third := network_interfaces.NetworkInterface{
+			Name:     "wltest0",
+			Wireless: &network_interfaces.Wireless{SignalLevel: -256, MissedBeacon: 103},
+		}
+		m.report(third, &second)
+
+		require.Nil(t, getMetric(t, "wltest0_wireless_station_signal"))
+		require.Nil(t, getMetric(t, "wltest0_wireless_station_tx_retries"))
+		require.NotNil(t, getMetric(t, "wltest0_wireless_signal_level"))
+
+		// and back again, on another access point (so starting from scratch)
+		station = network_interfaces.Station{MAC: "66:77:88:99:aa:bb", Signal: -40, TxRetries: 1000}
+		fourth := network_interfaces.NetworkInterface{
+			Name:     "wltest0",
+			Wireless: &network_interfaces.Wireless{SignalLevel: -40, MissedBeacon: 103, Stations: []network_interfaces.Station{station}},
+		}
+		m.report(fourth, &third)
+
+		require.Equal(t, -40.0, getMetric(t, "wltest0_wireless_station_signal").GetMetric()[0].GetGauge().GetValue())
+		require.Equal(t, 0.0, getMetric(t, "wltest0_wireless_station_tx_retries").GetMetric()[0].GetCounter().GetValue())
+
+		m.unregister()
+		require.Nil(t, getMetric(t, "wltest0_wireless_station_signal"))
+		require.Nil(t, getMetric(t, "wltest0_wireless_missed_beacon"))
+	})
+}
@@ -3,27 +3,400 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/initialed85/loser/pkg/dashboard"
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/initialed85/loser/pkg/netns"
 	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/initialed85/loser/pkg/network_stack"
 	"github.com/initialed85/loser/pkg/packets"
+	"github.com/initialed85/loser/pkg/report"
+	"github.com/initialed85/loser/pkg/store"
+	"github.com/initialed85/loser/pkg/stream"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func main() {
-	log.Printf("starting loser...")
+// networkNamespace is what /netns serves up for each namespace
+type networkNamespace struct {
+	netns.Namespace
+	NetworkInterfaces []network_interfaces.NetworkInterface `json:"network_interfaces"`
+}
+
+// splitList splits up a comma separated flag value, ignoring any empty items
+func splitList(value string) []string {
+	items := make([]string, 0)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
 
+	return items
+}
+
+func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bufferbloat":
+			os.Exit(runBufferbloat(ctx, os.Args[2:]))
+		case "top":
+			os.Exit(runTop(ctx, os.Args[2:]))
+		case "diagnose":
+			os.Exit(runDiagnose(ctx, os.Args[2:]))
+		case "report":
+			os.Exit(runReport(ctx, os.Args[2:]))
+		}
+	}
+
+	networkInterfacesBackend := flag.String("network-interfaces-backend", network_interfaces.BackendSysfs, fmt.Sprintf("how to collect interface stats (%s or %s; %s falls back to %s on failure)", network_interfaces.BackendSysfs, network_interfaces.BackendNetlink, network_interfaces.BackendNetlink, network_interfaces.BackendSysfs))
+	bulkServer := flag.Bool("bulk-server", false, "serve the bulk path on TCP 6944 for loser bufferbloat run from another host (unauthenticated, so each transfer is capped by -bulk-max-duration and -bulk-max-bytes)")
+	bulkMaxDuration := flag.Duration("bulk-max-duration", packets.DefaultBulkMaxDuration, "how long a single bulk transfer can run for")
+	bulkMaxBytes := flag.Int64("bulk-max-bytes", packets.DefaultBulkMaxBytes, "how many bytes a single bulk transfer can move")
+	probeGateways := flag.Bool("probe-gateways", true, "automatically ping the default gateway(s) (ICMP, needs CAP_NET_RAW; without it they're skipped with a warning)")
+	probeL2 := flag.Bool("probe-l2", false, "also probe the hosts and gateways at L2 (ARP / NDP, needs CAP_NET_RAW) if they're on-link")
+	collectNetns := flag.Bool("netns", false, "also collect interface stats inside the named network namespaces (/var/run/netns, needs CAP_SYS_ADMIN)")
+	collectNetnsProcesses := flag.Bool("netns-processes", false, "with -netns, also include the network namespaces other processes are in (e.g. containers, Kubernetes pods)")
+	interfacesInclude := flag.String("interfaces-include", "", "comma separated globs (or names) for the interfaces to collect (default all of them)")
+	interfacesExclude := flag.String("interfaces-exclude", "", "comma separated globs (or names) for the interfaces not to collect (e.g. \"veth*,cali*,docker*\")")
+	interfacesIncludeRegexp := flag.String("interfaces-include-regexp", "", "a regexp for the interfaces to collect (on top of -interfaces-include)")
+	interfacesExcludeRegexp := flag.String("interfaces-exclude-regexp", "", "a regexp for the interfaces not to collect (on top of -interfaces-exclude)")
+	interfacesPhysicalOnly := flag.Bool("interfaces-physical-only", false, "skip the virtual interfaces (anything without a /sys/class/net/*/device, e.g. veths, bridges, tunnels, lo)")
+	interfacesSkipLoopback := flag.Bool("interfaces-skip-loopback", false, "skip the loopback interface(s)")
+	interfaceRateGauges := flag.Bool("interface-rate-gauges", false, "also export the interface rates (bits / packets / errors / drops per second and utilisation %) as gauges")
+	historyRetention := flag.Duration("history", time.Hour*24, "how much history of the probe stats and interface snapshots to keep in memory (see /api/history)")
+	historyResolution := flag.Duration("history-resolution", time.Second*5, "the resolution of that history")
+	dataDir := flag.String("data-dir", "", "where to keep the probe stats, interface snapshots and events on disk so they survive a restart (default not at all)")
+	dataRetention := flag.Duration("data-retention", time.Hour*24*7, "how long to keep the data in -data-dir for")
+	dataMaxBytes := flag.Int64("data-max-bytes", 1024*1024*1024, "how big -data-dir can get before the oldest data is deleted")
+	sysfs := flag.String("sysfs", "/sys", "where to read sysfs from (e.g. /host/sys for a host's /sys bind mounted into a container)")
+	procfs := flag.String("procfs", "/proc", "where to read procfs (for /proc/net) from (e.g. /host/proc/1 for the network namespace of a host's pid 1, with its /proc bind mounted into a container)")
+	interfaceDetails := flag.String("interface-details", strings.Join(network_interfaces.AllDetails, ","), fmt.Sprintf("comma separated details to look up for each interface on top of its stats (some of %s; \"\" for none)", strings.Join(network_interfaces.AllDetails, ", ")))
+	interfaceDetailsInterval := flag.Duration("interface-details-interval", time.Second*30, "how often to look those details up again (the last ones are used in between, unless there's a new interface; 0 for every tick)")
+	ethtoolStats := flag.String("ethtool-stats", strings.Join(network_interfaces.DefaultEthtoolStatsAllowlist, ","), "comma separated glob patterns for the driver stats (ethtool -S) to collect (\"*\" for all of them, \"\" for none)")
+	probeNetns := flag.String("probe-netns", "", "run the host probes (tcp, udp, l2) from inside this network namespace (a name from /var/run/netns, inode:<inode> as per /netns, pid:<pid> or a path)")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "usage: loser [flags] [host...]\n       loser bufferbloat [flags] <host>\n       loser top [flags] <host...> | -attach <host:port>\n       loser diagnose [flags] <host...>\n       loser report [flags] -attach <host:port> | -data-dir <dir>\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	hosts := flag.Args()
+
+	err := network_interfaces.SetBackend(*networkInterfacesBackend)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	network_interfaces.SetFS(os.DirFS(*sysfs), os.DirFS(*procfs))
+	network_stack.SetProcfs(*procfs)
+
+	err = network_interfaces.SetEthtoolStatsAllowlist(splitList(*ethtoolStats))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = network_interfaces.SetDetails(network_interfaces.Details{
+		Enabled:  splitList(*interfaceDetails),
+		Interval: *interfaceDetailsInterval,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filter := network_interfaces.Filter{
+		Include:      splitList(*interfacesInclude),
+		Exclude:      splitList(*interfacesExclude),
+		PhysicalOnly: *interfacesPhysicalOnly,
+		SkipLoopback: *interfacesSkipLoopback,
+	}
+
+	if *interfacesIncludeRegexp != "" {
+		filter.IncludeRegexps = []string{*interfacesIncludeRegexp}
+	}
+
+	if *interfacesExcludeRegexp != "" {
+		filter.ExcludeRegexps = []string{*interfacesExcludeRegexp}
+	}
+
+	err = network_interfaces.SetFilter(filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("starting loser...")
+
+	//
+	// event log and handler
+	//
+
+	eventLog := events.NewLog(1000)
+
+	//
+	// history (probe stats and interface snapshots) and handler
+	//
+
+	if *historyResolution <= 0 {
+		log.Fatalf("-history-resolution must be positive")
+	}
+
+	sampleHistory := history.New(*historyRetention, *historyResolution)
+
+	//
+	// on-disk store (replayed into the history and the event log, then kept up to date from them)
+	//
+
+	if *dataDir != "" {
+		dataStore, err := store.Open(*dataDir, *dataRetention, *dataMaxBytes)
+		if err != nil {
+			log.Fatalf("failed to open -data-dir: %s", err)
+		}
+
+		loadedSamples, loadedEvents := 0, 0
+		err = dataStore.Read(func(record store.Record) {
+			switch record.Type {
+			case store.TypeSample:
+				sampleHistory.Load(*record.Sample)
+				loadedSamples++
+			case store.TypeEvent:
+				eventLog.Load(*record.Event)
+				loadedEvents++
+			}
+		})
+		if err != nil {
+			log.Fatalf("failed to read -data-dir: %s", err)
+		}
+
+		log.Printf("loaded %d samples and %d events from %s", loadedSamples, loadedEvents, *dataDir)
+
+		_ = sampleHistory.Subscribe(func(sample history.Sample) {
+			err := dataStore.WriteSample(sample)
+			if err != nil {
+				log.Printf("warning: failed to store sample: %s", err)
+			}
+		})
+
+		_ = eventLog.Subscribe(func(event events.Event) {
+			err := dataStore.WriteEvent(event)
+			if err != nil {
+				log.Printf("warning: failed to store event: %s", err)
+			}
+		})
+
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				err := dataStore.Flush()
+				if err != nil {
+					log.Printf("warning: failed to flush -data-dir: %s", err)
+				}
+			}
+		}()
+
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+			<-signals
+
+			err := dataStore.Close()
+			if err != nil {
+				log.Printf("warning: failed to close -data-dir: %s", err)
+			}
+
+			os.Exit(0)
+		}()
+	}
+
+	http.Handle("/api/history", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		target := query.Get("target")
+		if target == "" {
+			body, err := json.MarshalIndent(map[string][]string{"targets": sampleHistory.Targets()}, "", "  ")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(body)
+			return
+		}
+
+		now := time.Now()
+
+		from, err := history.ParseTime(query.Get("from"), now, now.Add(-sampleHistory.Retention()))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad from: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		to, err := history.ParseTime(query.Get("to"), now, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad to: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		series, err := sampleHistory.Query(target, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if query.Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			w.Header().Set("Content-Type", "text/csv")
+			w.WriteHeader(http.StatusOK)
+			_ = series.WriteCSV(w)
+			return
+		}
+
+		body, err := json.MarshalIndent(series, "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}))
+
+	http.Handle("/api/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		window := time.Minute
+
+		if value := r.URL.Query().Get("window"); value != "" {
+			var err error
+
+			window, err = time.ParseDuration(value)
+			if err != nil || window <= 0 {
+				http.Error(w, fmt.Sprintf("bad window: %#+v", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		body, err := json.MarshalIndent(sampleHistory.Statuses(time.Now(), window), "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}))
+
+	log.Printf("registering /api/report endpoint")
+	http.Handle("/api/report", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		now := time.Now()
+
+		from, err := history.ParseTime(query.Get("from"), now, now.Add(-time.Hour))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad from: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		to, err := history.ParseTime(query.Get("to"), now, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad to: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		format := query.Get("format")
+		if format == "" {
+			format = report.FormatHTML
+		}
+
+		if !slices.Contains(report.Formats, format) {
+			http.Error(w, fmt.Sprintf("bad format: %#+v (should be one of %v)", format, report.Formats), http.StatusBadRequest)
+			return
+		}
+
+		allSeries := make([]*history.Series, 0)
+		for _, target := range sampleHistory.Targets() {
+			series, err := sampleHistory.Query(target, from, to)
+			if err != nil {
+				continue
+			}
+
+			allSeries = append(allSeries, series)
+		}
+
+		incidentReport := report.Build(from, to, allSeries, eventLog.Events())
+		incidentReport.Hostname, _ = os.Hostname()
+
+		w.Header().Set("Content-Type", report.GetContentType(format))
+		w.WriteHeader(http.StatusOK)
+		_ = report.Write(w, incidentReport, format)
+	}))
+
+	//
+	// live stream (probe reports, interface snapshots and events as they happen)
+	//
+
+	broker := stream.NewBroker(1024)
+
+	_ = eventLog.Subscribe(func(event events.Event) {
+		broker.Publish(stream.Message{Type: stream.TypeEvent, Timestamp: event.Timestamp, Target: event.Interface, Data: event})
+	})
+
+	log.Printf("registering /api/stream endpoint")
+	http.Handle("/api/stream", broker)
+
+	eventCountersMu := new(sync.Mutex)
+	eventCounters := make(map[string]prometheus.Counter)
+
+	_ = eventLog.Subscribe(func(event events.Event) {
+		eventCountersMu.Lock()
+		defer eventCountersMu.Unlock()
+
+		eventCounter, ok := eventCounters[event.Kind]
+		if !ok {
+			eventCounter = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("events_%s", event.Kind)})
+			eventCounters[event.Kind] = eventCounter
+		}
+
+		eventCounter.Inc()
+	})
+
+	log.Printf("registering /events endpoint")
+	http.Handle("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.MarshalIndent(eventLog.Events(), "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}))
+
 	//
 	// network interface ticker and handler
 	//
@@ -31,9 +404,10 @@ func main() {
 	networkInterfacesBodyMu := new(sync.Mutex)
 	networkInterfacesBody := []byte("{}")
 	networkInterfacesTicker := time.NewTicker(time.Second * 5)
+	networkInterfacesRefresh := make(chan struct{}, 1)
 
-	countersMu := new(sync.Mutex)
-	counters := make(map[string]prometheus.Counter)
+	metricsMu := new(sync.Mutex)
+	metricsByNetworkInterfaceName := make(map[string]*interfaceMetrics)
 
 	go func() {
 		log.Printf("starting network interface ticker...")
@@ -45,6 +419,7 @@ func main() {
 			case <-ctx.Done():
 				return
 			case <-networkInterfacesTicker.C:
+			case <-networkInterfacesRefresh:
 			}
 
 			err := func() error {
@@ -53,6 +428,13 @@ func main() {
 					return fmt.Errorf("warning: failed GetNetworkInterfaces(): %s", err)
 				}
 
+				for i, networkInterface := range rawNetworkInterfaces {
+					lastNetworkInterface, ok := lastNetworkInterfaces[networkInterface.Name]
+					if ok {
+						rawNetworkInterfaces[i].Rates = network_interfaces.GetRates(lastNetworkInterface, networkInterface)
+					}
+				}
+
 				body, err := json.MarshalIndent(rawNetworkInterfaces, "", "  ")
 				if err != nil {
 					return fmt.Errorf("warning: failed json.Marshal() for networkInterfaces: %s", err)
@@ -62,6 +444,11 @@ func main() {
 				networkInterfacesBody = body
 				networkInterfacesBodyMu.Unlock()
 
+				for _, networkInterface := range rawNetworkInterfaces {
+					sampleHistory.AddNetworkInterface(networkInterface.Name, networkInterface)
+					broker.Publish(stream.Message{Type: stream.TypeInterface, Timestamp: networkInterface.Timestamp, Target: networkInterface.Name, Data: networkInterface})
+				}
+
 				networkInterfaces := make(map[string]network_interfaces.NetworkInterface)
 
 				for _, networkInterface := range rawNetworkInterfaces {
@@ -74,77 +461,114 @@ func main() {
 					if !exists {
 						log.Printf("adding interface %s...", networkInterfaceName)
 
-						friendlyNetworkInterfaceName := strings.ReplaceAll(networkInterfaceName, ".", "_")
-						friendlyNetworkInterfaceName = strings.ReplaceAll(friendlyNetworkInterfaceName, ":", "_")
-
-						countersMu.Lock()
-						counters[fmt.Sprintf("%s_IFIndex", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_if_index", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_MTU", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_mtu", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_Speed", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_speed", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_Collisions", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_collisions", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_Multicast", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_multicast", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxBytes", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_bytes", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxCompressed", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_compressed", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxCrcErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_crc_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxDropped", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_dropped", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxFifoErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_fifo_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxFrameErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_frame_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxLengthErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_length_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxMissedErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_missed_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxNohandler", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_nohandler", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxOverErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_over_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_RxPackets", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_rx_packets", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxAbortedErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_aborted_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxBytes", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_bytes", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxCarrierErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_carrier_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxCompressed", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_compressed", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxDropped", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_dropped", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxFifoErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_fifo_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxHeartbeatErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_heartbeat_errors", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxPackets", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_packets", friendlyNetworkInterfaceName)})
-						counters[fmt.Sprintf("%s_TxWindowErrors", networkInterfaceName)] = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_tx_window_errors", friendlyNetworkInterfaceName)})
-						countersMu.Unlock()
+						metricsMu.Lock()
+						metricsByNetworkInterfaceName[networkInterfaceName] = newInterfaceMetrics("", networkInterfaceName, nil, *interfaceRateGauges)
+						metricsMu.Unlock()
 					}
 				}
 
 				// handle the actual metrics
-				countersMu.Lock()
+				metricsMu.Lock()
 				for networkInterfaceName, networkInterface := range networkInterfaces {
 					lastNetworkInterface, ok := lastNetworkInterfaces[networkInterfaceName]
 					if !ok {
+						metricsByNetworkInterfaceName[networkInterfaceName].report(networkInterface, nil)
 						continue
 					}
 
-					counters[fmt.Sprintf("%s_MTU", networkInterfaceName)].Add(float64(networkInterface.MTU - lastNetworkInterface.MTU))
-					counters[fmt.Sprintf("%s_Speed", networkInterfaceName)].Add(float64(networkInterface.Speed - lastNetworkInterface.Speed))
-					counters[fmt.Sprintf("%s_Collisions", networkInterfaceName)].Add(float64(networkInterface.Collisions - lastNetworkInterface.Collisions))
-					counters[fmt.Sprintf("%s_Multicast", networkInterfaceName)].Add(float64(networkInterface.Multicast - lastNetworkInterface.Multicast))
-					counters[fmt.Sprintf("%s_RxBytes", networkInterfaceName)].Add(float64(networkInterface.RxBytes - lastNetworkInterface.RxBytes))
-					counters[fmt.Sprintf("%s_RxCompressed", networkInterfaceName)].Add(float64(networkInterface.RxCompressed - lastNetworkInterface.RxCompressed))
-					counters[fmt.Sprintf("%s_RxCrcErrors", networkInterfaceName)].Add(float64(networkInterface.RxCrcErrors - lastNetworkInterface.RxCrcErrors))
-					counters[fmt.Sprintf("%s_RxDropped", networkInterfaceName)].Add(float64(networkInterface.RxDropped - lastNetworkInterface.RxDropped))
-					counters[fmt.Sprintf("%s_RxErrors", networkInterfaceName)].Add(float64(networkInterface.RxErrors - lastNetworkInterface.RxErrors))
-					counters[fmt.Sprintf("%s_RxFifoErrors", networkInterfaceName)].Add(float64(networkInterface.RxFifoErrors - lastNetworkInterface.RxFifoErrors))
-					counters[fmt.Sprintf("%s_RxFrameErrors", networkInterfaceName)].Add(float64(networkInterface.RxFrameErrors - lastNetworkInterface.RxFrameErrors))
-					counters[fmt.Sprintf("%s_RxLengthErrors", networkInterfaceName)].Add(float64(networkInterface.RxLengthErrors - lastNetworkInterface.RxLengthErrors))
-					counters[fmt.Sprintf("%s_RxMissedErrors", networkInterfaceName)].Add(float64(networkInterface.RxMissedErrors - lastNetworkInterface.RxMissedErrors))
-					counters[fmt.Sprintf("%s_RxNohandler", networkInterfaceName)].Add(float64(networkInterface.RxNohandler - lastNetworkInterface.RxNohandler))
-					counters[fmt.Sprintf("%s_RxOverErrors", networkInterfaceName)].Add(float64(networkInterface.RxOverErrors - lastNetworkInterface.RxOverErrors))
-					counters[fmt.Sprintf("%s_RxPackets", networkInterfaceName)].Add(float64(networkInterface.RxPackets - lastNetworkInterface.RxPackets))
-					counters[fmt.Sprintf("%s_TxAbortedErrors", networkInterfaceName)].Add(float64(networkInterface.TxAbortedErrors - lastNetworkInterface.TxAbortedErrors))
-					counters[fmt.Sprintf("%s_TxBytes", networkInterfaceName)].Add(float64(networkInterface.TxBytes - lastNetworkInterface.TxBytes))
-					counters[fmt.Sprintf("%s_TxCarrierErrors", networkInterfaceName)].Add(float64(networkInterface.TxCarrierErrors - lastNetworkInterface.TxCarrierErrors))
-					counters[fmt.Sprintf("%s_TxCompressed", networkInterfaceName)].Add(float64(networkInterface.TxCompressed - lastNetworkInterface.TxCompressed))
-					counters[fmt.Sprintf("%s_TxDropped", networkInterfaceName)].Add(float64(networkInterface.TxDropped - lastNetworkInterface.TxDropped))
-					counters[fmt.Sprintf("%s_TxErrors", networkInterfaceName)].Add(float64(networkInterface.TxErrors - lastNetworkInterface.TxErrors))
-					counters[fmt.Sprintf("%s_TxFifoErrors", networkInterfaceName)].Add(float64(networkInterface.TxFifoErrors - lastNetworkInterface.TxFifoErrors))
-					counters[fmt.Sprintf("%s_TxHeartbeatErrors", networkInterfaceName)].Add(float64(networkInterface.TxHeartbeatErrors - lastNetworkInterface.TxHeartbeatErrors))
-					counters[fmt.Sprintf("%s_TxPackets", networkInterfaceName)].Add(float64(networkInterface.TxPackets - lastNetworkInterface.TxPackets))
-					counters[fmt.Sprintf("%s_TxWindowErrors", networkInterfaceName)].Add(float64(networkInterface.TxWindowErrors - lastNetworkInterface.TxWindowErrors))
-				}
-				countersMu.Unlock()
+					metricsByNetworkInterfaceName[networkInterfaceName].report(networkInterface, &lastNetworkInterface)
+
+					// emit events for link changes between ticks
+					if networkInterface.OperState != lastNetworkInterface.OperState {
+						eventLog.Add(events.Event{
+							Timestamp: networkInterface.Timestamp,
+							Kind:      events.KindOperStateChanged,
+							Interface: networkInterfaceName,
+							Old:       lastNetworkInterface.OperState,
+							New:       networkInterface.OperState,
+							Message:   fmt.Sprintf("%s operstate changed from %s to %s", networkInterfaceName, lastNetworkInterface.OperState, networkInterface.OperState),
+						})
+					}
+
+					if networkInterface.Carrier != lastNetworkInterface.Carrier {
+						eventLog.Add(events.Event{
+							Timestamp: networkInterface.Timestamp,
+							Kind:      events.KindCarrierChanged,
+							Interface: networkInterfaceName,
+							Old:       fmt.Sprintf("%d", lastNetworkInterface.Carrier),
+							New:       fmt.Sprintf("%d", networkInterface.Carrier),
+							Message:   fmt.Sprintf("%s carrier changed from %d to %d", networkInterfaceName, lastNetworkInterface.Carrier, networkInterface.Carrier),
+						})
+					}
+
+					if networkInterface.Speed != lastNetworkInterface.Speed {
+						eventLog.Add(events.Event{
+							Timestamp: networkInterface.Timestamp,
+							Kind:      events.KindSpeedChanged,
+							Interface: networkInterfaceName,
+							Old:       fmt.Sprintf("%d", lastNetworkInterface.Speed),
+							New:       fmt.Sprintf("%d", networkInterface.Speed),
+							Message:   fmt.Sprintf("%s speed changed from %d to %d", networkInterfaceName, lastNetworkInterface.Speed, networkInterface.Speed),
+						})
+					}
+
+					if networkInterface.Duplex != lastNetworkInterface.Duplex {
+						eventLog.Add(events.Event{
+							Timestamp: networkInterface.Timestamp,
+							Kind:      events.KindDuplexChanged,
+							Interface: networkInterfaceName,
+							Old:       lastNetworkInterface.Duplex,
+							New:       networkInterface.Duplex,
+							Message:   fmt.Sprintf("%s duplex changed from %s to %s", networkInterfaceName, lastNetworkInterface.Duplex, networkInterface.Duplex),
+						})
+					}
+
+					if networkInterface.Master != lastNetworkInterface.Master {
+						eventLog.Add(events.Event{
+							Timestamp: networkInterface.Timestamp,
+							Kind:      events.KindMasterChanged,
+							Interface: networkInterfaceName,
+							Old:       lastNetworkInterface.Master,
+							New:       networkInterface.Master,
+							Message:   fmt.Sprintf("%s master changed from %#+v to %#+v", networkInterfaceName, lastNetworkInterface.Master, networkInterface.Master),
+						})
+					}
+
+					if networkInterface.Bond != nil && lastNetworkInterface.Bond != nil {
+						if networkInterface.Bond.ActiveSlave != lastNetworkInterface.Bond.ActiveSlave {
+							eventLog.Add(events.Event{
+								Timestamp: networkInterface.Timestamp,
+								Kind:      events.KindBondActiveSlaveChanged,
+								Interface: networkInterfaceName,
+								Old:       lastNetworkInterface.Bond.ActiveSlave,
+								New:       networkInterface.Bond.ActiveSlave,
+								Message:   fmt.Sprintf("%s active slave changed from %#+v to %#+v", networkInterfaceName, lastNetworkInterface.Bond.ActiveSlave, networkInterface.Bond.ActiveSlave),
+							})
+						}
+
+						lastMIIStatusBySlave := make(map[string]string)
+						for _, slave := range lastNetworkInterface.Bond.Slaves {
+							lastMIIStatusBySlave[slave.Name] = slave.MIIStatus
+						}
+
+						for _, slave := range networkInterface.Bond.Slaves {
+							lastMIIStatus, ok := lastMIIStatusBySlave[slave.Name]
+							if !ok || slave.MIIStatus == lastMIIStatus {
+								continue
+							}
+
+							eventLog.Add(events.Event{
+								Timestamp: networkInterface.Timestamp,
+								Kind:      events.KindBondSlaveMIIStatusChanged,
+								Interface: slave.Name,
+								Old:       lastMIIStatus,
+								New:       slave.MIIStatus,
+								Message:   fmt.Sprintf("%s (slave of %s) MII status changed from %s to %s", slave.Name, networkInterfaceName, lastMIIStatus, slave.MIIStatus),
+							})
+						}
+					}
+				}
+				metricsMu.Unlock()
 
 				// handle old interfaces we're no longer seeing
 				for lastNetworkInterfaceName := range lastNetworkInterfaces {
@@ -152,63 +576,10 @@ func main() {
 					if !exists {
 						log.Printf("removing interface %s...", lastNetworkInterfaceName)
 
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_IFIndex", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_MTU", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_Speed", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_Collisions", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_Multicast", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxBytes", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxCompressed", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxCrcErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxDropped", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxFifoErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxFrameErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxLengthErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxMissedErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxNohandler", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxOverErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_RxPackets", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxAbortedErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxBytes", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxCarrierErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxCompressed", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxDropped", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxFifoErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxHeartbeatErrors", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxPackets", lastNetworkInterfaceName)])
-						_ = prometheus.DefaultRegisterer.Unregister(counters[fmt.Sprintf("%s_TxWindowErrors", lastNetworkInterfaceName)])
-
-						countersMu.Lock()
-						delete(counters, fmt.Sprintf("%s_IFIndex", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_MTU", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_Speed", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_Collisions", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_Multicast", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxBytes", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxCompressed", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxCrcErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxDropped", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxFifoErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxFrameErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxLengthErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxMissedErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxNohandler", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxOverErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_RxPackets", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxAbortedErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxBytes", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxCarrierErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxCompressed", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxDropped", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxFifoErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxHeartbeatErrors", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxPackets", lastNetworkInterfaceName))
-						delete(counters, fmt.Sprintf("%s_TxWindowErrors", lastNetworkInterfaceName))
-						countersMu.Unlock()
+						metricsMu.Lock()
+						metricsByNetworkInterfaceName[lastNetworkInterfaceName].unregister()
+						delete(metricsByNetworkInterfaceName, lastNetworkInterfaceName)
+						metricsMu.Unlock()
 					}
 				}
 
@@ -223,6 +594,149 @@ func main() {
 		}
 	}()
 
+	//
+	// link event watcher (so we see sub-second flaps and can react to interfaces coming and going straight away)
+	//
+
+	go func() {
+		log.Printf("starting link event watcher...")
+
+		for {
+			err := network_interfaces.WatchLinkEvents(ctx, func(event events.Event) {
+				eventLog.Add(event)
+
+				switch event.Kind {
+				case events.KindLinkAdded, events.KindLinkRemoved, events.KindLinkUp, events.KindLinkDown:
+					select {
+					case networkInterfacesRefresh <- struct{}{}:
+					default:
+					}
+				}
+			})
+			if err != nil {
+				log.Printf("warning: failed network_interfaces.WatchLinkEvents: %s", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second * 5):
+			}
+		}
+	}()
+
+	//
+	// network namespace ticker and handler (interfaces in other namespaces, e.g. containers / pods)
+	//
+
+	networkNamespacesBodyMu := new(sync.Mutex)
+	networkNamespacesBody := []byte("[]")
+
+	if *collectNetns {
+		go func() {
+			log.Printf("starting network namespace ticker...")
+
+			networkNamespacesTicker := time.NewTicker(time.Second * 5)
+			defer networkNamespacesTicker.Stop()
+
+			// keyed by namespace name and interface name (e.g. "inode:4026532291/eth0")
+			lastNetworkInterfaces := make(map[string]network_interfaces.NetworkInterface)
+			metricsByKey := make(map[string]*interfaceMetrics)
+
+			for {
+				namespaces, err := netns.List(*collectNetnsProcesses)
+				if err != nil {
+					log.Printf("warning: failed netns.List: %s", err)
+				}
+
+				networkNamespaces := make([]networkNamespace, 0)
+				networkInterfaces := make(map[string]network_interfaces.NetworkInterface)
+
+				for _, namespace := range namespaces {
+					namespaceNetworkInterfaces, err := network_interfaces.GetNetworkInterfacesInNetns(namespace.Path)
+					if err != nil {
+						// usually a process that's gone away since we listed it
+						log.Printf("warning: failed network_interfaces.GetNetworkInterfacesInNetns for %s: %s", namespace.Name, err)
+						continue
+					}
+
+					for i, networkInterface := range namespaceNetworkInterfaces {
+						key := fmt.Sprintf("%s/%s", namespace.Name, networkInterface.Name)
+
+						lastNetworkInterface, ok := lastNetworkInterfaces[key]
+						if ok {
+							namespaceNetworkInterfaces[i].Rates = network_interfaces.GetRates(lastNetworkInterface, networkInterface)
+						}
+					}
+
+					networkNamespaces = append(networkNamespaces, networkNamespace{
+						Namespace:         namespace,
+						NetworkInterfaces: namespaceNetworkInterfaces,
+					})
+
+					for _, networkInterface := range namespaceNetworkInterfaces {
+						key := fmt.Sprintf("%s/%s", namespace.Name, networkInterface.Name)
+
+						networkInterfaces[key] = networkInterface
+						sampleHistory.AddNetworkInterface(key, networkInterface)
+						broker.Publish(stream.Message{Type: stream.TypeInterface, Timestamp: networkInterface.Timestamp, Target: key, Data: networkInterface})
+
+						lastNetworkInterface, ok := lastNetworkInterfaces[key]
+						if !ok {
+							log.Printf("adding interface %s in network namespace %s...", networkInterface.Name, namespace.Name)
+
+							metricsByKey[key] = newInterfaceMetrics("netns", networkInterface.Name, prometheus.Labels{"netns": namespace.Name}, *interfaceRateGauges)
+							metricsByKey[key].report(networkInterface, nil)
+							continue
+						}
+
+						metricsByKey[key].report(networkInterface, &lastNetworkInterface)
+					}
+				}
+
+				for key := range lastNetworkInterfaces {
+					_, ok := networkInterfaces[key]
+					if ok {
+						continue
+					}
+
+					log.Printf("removing interface %s...", key)
+
+					metricsByKey[key].unregister()
+					delete(metricsByKey, key)
+				}
+
+				lastNetworkInterfaces = networkInterfaces
+
+				body, err := json.MarshalIndent(networkNamespaces, "", "  ")
+				if err != nil {
+					log.Printf("warning: failed json.Marshal() for networkNamespaces: %s", err)
+				} else {
+					networkNamespacesBodyMu.Lock()
+					networkNamespacesBody = body
+					networkNamespacesBodyMu.Unlock()
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-networkNamespacesTicker.C:
+				}
+			}
+		}()
+	}
+
+	log.Printf("registering /netns endpoint")
+	http.Handle("/netns", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		networkNamespacesBodyMu.Lock()
+		body := networkNamespacesBody
+		networkNamespacesBodyMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}))
+
 	log.Printf("registering /network-interfaces endpoint")
 	http.Handle("/network-interfaces", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		networkInterfacesBodyMu.Lock()
@@ -234,6 +748,290 @@ func main() {
 		_, _ = w.Write(body)
 	}))
 
+	log.Printf("registering /network endpoint")
+	http.Handle("/network", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := network_interfaces.GetSnapshot()
+		if err != nil {
+			log.Printf("warning: failed network_interfaces.GetSnapshot(): %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, err := json.MarshalIndent(snapshot, "", "  ")
+		if err != nil {
+			log.Printf("warning: failed json.Marshal() for snapshot: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}))
+
+	//
+	// network stack ticker and handler
+	//
+
+	networkStackBodyMu := new(sync.Mutex)
+	networkStackBody := []byte("{}")
+	networkStackTicker := time.NewTicker(time.Second * 5)
+
+	networkStackCounters := make(map[string]prometheus.Counter)
+	networkStackGauges := make(map[string]prometheus.Gauge)
+
+	// the values that go up and down (the rest are counters)
+	networkStackGaugeNames := map[string]struct{}{
+		"tcp_curr_estab": {},
+	}
+
+	go func() {
+		log.Printf("starting network stack ticker...")
+
+		lastValues := make(map[string]int64)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-networkStackTicker.C:
+			}
+
+			err := func() error {
+				networkStack, err := network_stack.GetNetworkStack()
+				if err != nil {
+					return fmt.Errorf("warning: failed GetNetworkStack(): %s", err)
+				}
+
+				body, err := json.MarshalIndent(networkStack, "", "  ")
+				if err != nil {
+					return fmt.Errorf("warning: failed json.Marshal() for networkStack: %s", err)
+				}
+
+				networkStackBodyMu.Lock()
+				networkStackBody = body
+				networkStackBodyMu.Unlock()
+
+				values := map[string]int64{
+					"ip_in_receives":             networkStack.IPInReceives,
+					"ip_in_hdr_errors":           networkStack.IPInHdrErrors,
+					"ip_in_addr_errors":          networkStack.IPInAddrErrors,
+					"ip_forw_datagrams":          networkStack.IPForwDatagrams,
+					"ip_in_unknown_protos":       networkStack.IPInUnknownProtos,
+					"ip_in_discards":             networkStack.IPInDiscards,
+					"ip_in_delivers":             networkStack.IPInDelivers,
+					"ip_out_requests":            networkStack.IPOutRequests,
+					"ip_out_discards":            networkStack.IPOutDiscards,
+					"ip_out_no_routes":           networkStack.IPOutNoRoutes,
+					"ip_reasm_timeout":           networkStack.IPReasmTimeout,
+					"ip_reasm_reqds":             networkStack.IPReasmReqds,
+					"ip_reasm_oks":               networkStack.IPReasmOKs,
+					"ip_reasm_fails":             networkStack.IPReasmFails,
+					"ip_frag_oks":                networkStack.IPFragOKs,
+					"ip_frag_fails":              networkStack.IPFragFails,
+					"ip_frag_creates":            networkStack.IPFragCreates,
+					"ip_ext_in_no_routes":        networkStack.IPExtInNoRoutes,
+					"ip_ext_in_truncated_pkts":   networkStack.IPExtInTruncatedPkts,
+					"ip_ext_in_csum_errors":      networkStack.IPExtInCsumErrors,
+					"ip_ext_in_octets":           networkStack.IPExtInOctets,
+					"ip_ext_out_octets":          networkStack.IPExtOutOctets,
+					"icmp_in_msgs":               networkStack.ICMPInMsgs,
+					"icmp_in_errors":             networkStack.ICMPInErrors,
+					"icmp_in_csum_errors":        networkStack.ICMPInCsumErrors,
+					"icmp_in_dest_unreachs":      networkStack.ICMPInDestUnreachs,
+					"icmp_in_time_excds":         networkStack.ICMPInTimeExcds,
+					"icmp_out_msgs":              networkStack.ICMPOutMsgs,
+					"icmp_out_errors":            networkStack.ICMPOutErrors,
+					"icmp_out_dest_unreachs":     networkStack.ICMPOutDestUnreachs,
+					"icmp_out_time_excds":        networkStack.ICMPOutTimeExcds,
+					"tcp_active_opens":           networkStack.TCPActiveOpens,
+					"tcp_passive_opens":          networkStack.TCPPassiveOpens,
+					"tcp_attempt_fails":          networkStack.TCPAttemptFails,
+					"tcp_estab_resets":           networkStack.TCPEstabResets,
+					"tcp_curr_estab":             networkStack.TCPCurrEstab,
+					"tcp_in_segs":                networkStack.TCPInSegs,
+					"tcp_out_segs":               networkStack.TCPOutSegs,
+					"tcp_retrans_segs":           networkStack.TCPRetransSegs,
+					"tcp_in_errs":                networkStack.TCPInErrs,
+					"tcp_out_rsts":               networkStack.TCPOutRsts,
+					"tcp_in_csum_errors":         networkStack.TCPInCsumErrors,
+					"tcp_ext_syncookies_sent":    networkStack.TCPExtSyncookiesSent,
+					"tcp_ext_syncookies_failed":  networkStack.TCPExtSyncookiesFailed,
+					"tcp_ext_prune_called":       networkStack.TCPExtPruneCalled,
+					"tcp_ext_rcv_pruned":         networkStack.TCPExtRcvPruned,
+					"tcp_ext_ofo_pruned":         networkStack.TCPExtOfoPruned,
+					"tcp_ext_listen_overflows":   networkStack.TCPExtListenOverflows,
+					"tcp_ext_listen_drops":       networkStack.TCPExtListenDrops,
+					"tcp_ext_timeouts":           networkStack.TCPExtTimeouts,
+					"tcp_ext_lost_retransmit":    networkStack.TCPExtLostRetransmit,
+					"tcp_ext_fast_retrans":       networkStack.TCPExtFastRetrans,
+					"tcp_ext_slow_start_retrans": networkStack.TCPExtSlowStartRetrans,
+					"tcp_ext_syn_retrans":        networkStack.TCPExtSynRetrans,
+					"tcp_ext_loss_probes":        networkStack.TCPExtLossProbes,
+					"tcp_ext_retrans_fail":       networkStack.TCPExtRetransFail,
+					"tcp_ext_ofo_queue":          networkStack.TCPExtOFOQueue,
+					"tcp_ext_ofo_drop":           networkStack.TCPExtOFODrop,
+					"tcp_ext_rcv_qdrop":          networkStack.TCPExtRcvQDrop,
+					"tcp_ext_backlog_drop":       networkStack.TCPExtBacklogDrop,
+					"tcp_ext_abort_on_timeout":   networkStack.TCPExtAbortOnTimeout,
+					"tcp_ext_abort_on_memory":    networkStack.TCPExtAbortOnMemory,
+					"tcp_ext_memory_pressures":   networkStack.TCPExtMemoryPressures,
+					"udp_in_datagrams":           networkStack.UDPInDatagrams,
+					"udp_no_ports":               networkStack.UDPNoPorts,
+					"udp_in_errors":              networkStack.UDPInErrors,
+					"udp_out_datagrams":          networkStack.UDPOutDatagrams,
+					"udp_rcvbuf_errors":          networkStack.UDPRcvbufErrors,
+					"udp_sndbuf_errors":          networkStack.UDPSndbufErrors,
+					"udp_in_csum_errors":         networkStack.UDPInCsumErrors,
+					"udp_ignored_multi":          networkStack.UDPIgnoredMulti,
+					"udp_mem_errors":             networkStack.UDPMemErrors,
+					"ip6_in_receives":            networkStack.IP6InReceives,
+					"ip6_in_hdr_errors":          networkStack.IP6InHdrErrors,
+					"ip6_in_addr_errors":         networkStack.IP6InAddrErrors,
+					"ip6_in_no_routes":           networkStack.IP6InNoRoutes,
+					"ip6_in_too_big_errors":      networkStack.IP6InTooBigErrors,
+					"ip6_in_discards":            networkStack.IP6InDiscards,
+					"ip6_in_delivers":            networkStack.IP6InDelivers,
+					"ip6_out_requests":           networkStack.IP6OutRequests,
+					"ip6_out_discards":           networkStack.IP6OutDiscards,
+					"ip6_out_no_routes":          networkStack.IP6OutNoRoutes,
+					"ip6_reasm_timeout":          networkStack.IP6ReasmTimeout,
+					"ip6_reasm_reqds":            networkStack.IP6ReasmReqds,
+					"ip6_reasm_oks":              networkStack.IP6ReasmOKs,
+					"ip6_reasm_fails":            networkStack.IP6ReasmFails,
+					"ip6_frag_oks":               networkStack.IP6FragOKs,
+					"ip6_frag_fails":             networkStack.IP6FragFails,
+					"ip6_frag_creates":           networkStack.IP6FragCreates,
+					"icmp6_in_msgs":              networkStack.ICMP6InMsgs,
+					"icmp6_in_errors":            networkStack.ICMP6InErrors,
+					"icmp6_in_csum_errors":       networkStack.ICMP6InCsumErrors,
+					"icmp6_in_dest_unreachs":     networkStack.ICMP6InDestUnreachs,
+					"icmp6_in_pkt_too_bigs":      networkStack.ICMP6InPktTooBigs,
+					"icmp6_out_msgs":             networkStack.ICMP6OutMsgs,
+					"icmp6_out_errors":           networkStack.ICMP6OutErrors,
+					"icmp6_out_dest_unreachs":    networkStack.ICMP6OutDestUnreachs,
+					"udp6_in_datagrams":          networkStack.UDP6InDatagrams,
+					"udp6_no_ports":              networkStack.UDP6NoPorts,
+					"udp6_in_errors":             networkStack.UDP6InErrors,
+					"udp6_out_datagrams":         networkStack.UDP6OutDatagrams,
+					"udp6_rcvbuf_errors":         networkStack.UDP6RcvbufErrors,
+					"udp6_sndbuf_errors":         networkStack.UDP6SndbufErrors,
+					"udp6_in_csum_errors":        networkStack.UDP6InCsumErrors,
+					"udp6_ignored_multi":         networkStack.UDP6IgnoredMulti,
+					"udp6_mem_errors":            networkStack.UDP6MemErrors,
+					"softnet_processed":          networkStack.SoftnetProcessed,
+					"softnet_dropped":            networkStack.SoftnetDropped,
+					"softnet_time_squeeze":       networkStack.SoftnetTimeSqueeze,
+				}
+
+				for _, softnetStat := range networkStack.Softnet {
+					values[fmt.Sprintf("softnet_cpu_%d_processed", softnetStat.CPU)] = softnetStat.Processed
+					values[fmt.Sprintf("softnet_cpu_%d_dropped", softnetStat.CPU)] = softnetStat.Dropped
+					values[fmt.Sprintf("softnet_cpu_%d_time_squeeze", softnetStat.CPU)] = softnetStat.TimeSqueeze
+					values[fmt.Sprintf("softnet_cpu_%d_cpu_collision", softnetStat.CPU)] = softnetStat.CPUCollision
+					values[fmt.Sprintf("softnet_cpu_%d_received_rps", softnetStat.CPU)] = softnetStat.ReceivedRPS
+					values[fmt.Sprintf("softnet_cpu_%d_flow_limit_count", softnetStat.CPU)] = softnetStat.FlowLimitCount
+				}
+
+				deltas := make(map[string]int64)
+				for name, value := range values {
+					_, isGauge := networkStackGaugeNames[name]
+					if isGauge {
+						continue
+					}
+
+					lastValue, ok := lastValues[name]
+					if ok {
+						deltas[name] = network_interfaces.GetCounterDelta(lastValue, value)
+					}
+				}
+
+				// the softnet totals are sums of the per-CPU (32-bit) counters, so one CPU wrapping doesn't look like a
+				// wrap of the total; they're the sums of the per-CPU deltas instead
+				for _, field := range []string{"processed", "dropped", "time_squeeze"} {
+					total := fmt.Sprintf("softnet_%s", field)
+
+					_, ok := deltas[total]
+					if !ok {
+						continue
+					}
+
+					deltas[total] = 0
+					for _, softnetStat := range networkStack.Softnet {
+						deltas[total] += deltas[fmt.Sprintf("softnet_cpu_%d_%s", softnetStat.CPU, field)]
+					}
+				}
+
+				for name, value := range values {
+					_, isGauge := networkStackGaugeNames[name]
+					if isGauge {
+						gauge, ok := networkStackGauges[name]
+						if !ok {
+							gauge = promauto.NewGauge(prometheus.GaugeOpts{Name: fmt.Sprintf("network_stack_%s", name)})
+							networkStackGauges[name] = gauge
+						}
+
+						gauge.Set(float64(value))
+
+						continue
+					}
+
+					counter, ok := networkStackCounters[name]
+					if !ok {
+						counter = promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("network_stack_%s", name)})
+						networkStackCounters[name] = counter
+					}
+
+					if deltas[name] > 0 {
+						counter.Add(float64(deltas[name]))
+					}
+				}
+
+				lastValues = values
+
+				return nil
+			}()
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+		}
+	}()
+
+	log.Printf("registering /network-stack endpoint")
+	http.Handle("/network-stack", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		networkStackBodyMu.Lock()
+		body := networkStackBody
+		networkStackBodyMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}))
+
+	//
+	// where the host probes run from (our own network namespace unless -probe-netns says otherwise)
+	//
+
+	var probeLabels prometheus.Labels
+
+	inProbeNetns := func(fn func() error) error {
+		return fn()
+	}
+
+	if *probeNetns != "" {
+		probeLabels = prometheus.Labels{"netns": *probeNetns}
+
+		inProbeNetns = func(fn func() error) error {
+			path, err := netns.GetPath(*probeNetns)
+			if err != nil {
+				return err
+			}
+
+			return netns.Do(path, fn)
+		}
+	}
+
 	//
 	// tcp server
 	//
@@ -245,26 +1043,32 @@ func main() {
 		}
 	}()
 
+	// reportProbe has a probe's reports go to its metrics, the history and the stream
+	reportProbe := func(metrics *probeMetrics) func(packets.Report) {
+		return func(report packets.Report) {
+			metrics.report(report)
+			sampleHistory.AddProbeReport(report)
+			broker.Publish(stream.Message{Type: stream.TypeProbe, Timestamp: report.Timestamp, Target: history.GetProbeTarget(report.Protocol, report.Host), Data: report})
+		}
+	}
+
+	// reportProbeFailure has a probe attempt that failed outright (e.g. a TCP connection that was refused or timed out)
+	// go to the history and the stream as a lost probe, so its target shows as down rather than not at all (the metrics
+	// only count what the probes themselves sent)
+	reportProbeFailure := func(protocol string, host string) {
+		report := packets.Report{Timestamp: time.Now(), Protocol: protocol, Host: host, Sent: 1, Lost: 1}
+
+		sampleHistory.AddProbeReport(report)
+		broker.Publish(stream.Message{Type: stream.TypeProbe, Timestamp: report.Timestamp, Target: history.GetProbeTarget(report.Protocol, report.Host), Data: report})
+	}
+
 	//
 	// tcp clients
 	//
 
-	for _, host := range os.Args[1:] {
+	for _, host := range hosts {
 		go func() {
-			friendlyRawDialAddr := strings.ReplaceAll(host, ".", "_")
-			friendlyRawDialAddr = strings.ReplaceAll(friendlyRawDialAddr, ":", "_")
-
-			sentCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("tcp_%s_sent", friendlyRawDialAddr)})
-			receivedCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("tcp_%s_received", friendlyRawDialAddr)})
-			outOfOrderCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("tcp_%s_out_of_order", friendlyRawDialAddr)})
-			lostCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("tcp_%s_lost", friendlyRawDialAddr)})
-
-			reportFn := func(now time.Time, sent int64, received int64, outOfOrder int64, lost int64) {
-				sentCounter.Add(float64(sent))
-				receivedCounter.Add(float64(received))
-				outOfOrderCounter.Add(float64(outOfOrder))
-				lostCounter.Add(float64(lost))
-			}
+			metrics := newProbeMetrics("tcp", host, probeLabels)
 
 			for {
 				select {
@@ -273,9 +1077,12 @@ func main() {
 				default:
 				}
 
-				err := packets.RunTCPClient(ctx, host, reportFn)
+				err := inProbeNetns(func() error {
+					return packets.RunTCPClient(ctx, host, time.Second*5, reportProbe(metrics))
+				})
 				if err != nil {
 					log.Printf("warning: failed packets.RunTCPClient: %s", err)
+					reportProbeFailure("tcp", host)
 
 					// TODO: looks like a busy loop- should be fine, we've got a 1s timeout inside
 					// time.Sleep(time.Second * 1)
@@ -299,37 +1106,234 @@ func main() {
 	// udp clients
 	//
 
-	for _, host := range os.Args[1:] {
+	for _, host := range hosts {
 		go func() {
-			friendlyRawDialAddr := strings.ReplaceAll(host, ".", "_")
-			friendlyRawDialAddr = strings.ReplaceAll(friendlyRawDialAddr, ":", "_")
-
-			sentCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("udp_%s_sent", friendlyRawDialAddr)})
-			receivedCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("udp_%s_received", friendlyRawDialAddr)})
-			outOfOrderCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("udp_%s_out_of_order", friendlyRawDialAddr)})
-			lostCounter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("udp_%s_lost", friendlyRawDialAddr)})
-
-			reportFn := func(now time.Time, sent int64, received int64, outOfOrder int64, lost int64) {
-				sentCounter.Add(float64(sent))
-				receivedCounter.Add(float64(received))
-				outOfOrderCounter.Add(float64(outOfOrder))
-				lostCounter.Add(float64(lost))
-			}
+			metrics := newProbeMetrics("udp", host, probeLabels)
 
 			for {
-				err := packets.RunUDPClient(ctx, host, reportFn)
+				err := inProbeNetns(func() error {
+					return packets.RunUDPClient(ctx, host, time.Second*5, reportProbe(metrics))
+				})
 				if err != nil {
 					log.Printf("warning: failed packets.RunUDPClient: %s", err)
+					reportProbeFailure("udp", host)
 					time.Sleep(time.Second * 1)
 				}
 			}
 		}()
 	}
 
+	//
+	// l2 clients (only useful for on-link hosts; tells us whether L2 still works when L3 doesn't)
+	//
+
+	if *probeL2 {
+		for _, host := range hosts {
+			go func() {
+				metrics := newProbeMetrics(getL2Protocol(host), host, probeLabels)
+
+				for {
+					err := inProbeNetns(func() error {
+						return packets.RunL2Client(ctx, host, time.Second*5, reportProbe(metrics))
+					})
+					if err != nil {
+						log.Printf("warning: failed packets.RunL2Client: %s", err)
+						reportProbeFailure(getL2Protocol(host), host)
+						time.Sleep(time.Second * 1)
+					}
+				}
+			}()
+		}
+	}
+
+	//
+	// gateway clients (discovered from the routing table and kept up to date as it changes)
+	//
+
+	if *probeGateways {
+		go func() {
+			log.Printf("starting gateway watcher...")
+
+			gatewaysRefresh := make(chan struct{}, 1)
+
+			_ = eventLog.Subscribe(func(event events.Event) {
+				if event.Kind != events.KindDefaultRouteChanged {
+					return
+				}
+
+				select {
+				case gatewaysRefresh <- struct{}{}:
+				default:
+				}
+			})
+
+			gatewaysTicker := time.NewTicker(time.Second * 30)
+			defer gatewaysTicker.Stop()
+
+			// a gateway's probes are only forgotten once they've stopped (and unregistered their metrics), so a gateway
+			// that comes straight back (e.g. a DHCP renew) doesn't register the same metrics twice
+			type gatewayProbes struct {
+				cancel context.CancelFunc
+				wg     *sync.WaitGroup
+			}
+
+			probesByHost := make(map[string]gatewayProbes)
+
+			// without CAP_NET_RAW the probes can't work, so rather than failing every second forever we say so once and
+			// give up on the gateways
+			notPermitted := new(atomic.Bool)
+			isNotPermitted := func(err error) bool {
+				if !errors.Is(err, os.ErrPermission) {
+					return false
+				}
+
+				if notPermitted.CompareAndSwap(false, true) {
+					log.Printf("warning: not probing the gateways, it needs CAP_NET_RAW (%s)", err)
+				}
+
+				return true
+			}
+
+			for {
+				routes, err := network_interfaces.GetRoutes()
+				if err != nil {
+					log.Printf("warning: failed network_interfaces.GetRoutes: %s", err)
+				} else {
+					gatewayHosts := make(map[string]struct{})
+
+					for _, gateway := range network_interfaces.GetDefaultGateways(routes) {
+						host := gateway.IP
+
+						// link-local gateways (common for IPv6) only make sense with the interface as the zone
+						if strings.HasPrefix(host, "fe80:") {
+							host = fmt.Sprintf("%s%%%s", host, gateway.Interface)
+						}
+
+						gatewayHosts[host] = struct{}{}
+					}
+
+					for host := range gatewayHosts {
+						_, ok := probesByHost[host]
+						if ok {
+							continue
+						}
+
+						log.Printf("adding gateway %s...", host)
+
+						gatewayCtx, cancelGateway := context.WithCancel(ctx)
+						gatewayWg := new(sync.WaitGroup)
+						probesByHost[host] = gatewayProbes{cancel: cancelGateway, wg: gatewayWg}
+
+						gatewayWg.Add(1)
+						go func() {
+							defer gatewayWg.Done()
+
+							metrics := newProbeMetrics("icmp", host, prometheus.Labels{"role": "gateway"})
+							defer metrics.unregister()
+
+							for {
+								select {
+								case <-gatewayCtx.Done():
+									return
+								default:
+								}
+
+								err := packets.RunICMPClient(gatewayCtx, host, time.Second*5, reportProbe(metrics))
+								if err != nil {
+									if isNotPermitted(err) {
+										return
+									}
+
+									log.Printf("warning: failed packets.RunICMPClient: %s", err)
+									reportProbeFailure("icmp", host)
+								}
+							}
+						}()
+
+						// a gateway that's also one of the hosts is already being probed at L2 (under the same metric names)
+						if *probeL2 && !slices.Contains(hosts, host) {
+							gatewayWg.Add(1)
+							go func() {
+								defer gatewayWg.Done()
+
+								metrics := newProbeMetrics(getL2Protocol(host), host, prometheus.Labels{"role": "gateway"})
+								defer metrics.unregister()
+
+								for {
+									select {
+									case <-gatewayCtx.Done():
+										return
+									default:
+									}
+
+									err := packets.RunL2Client(gatewayCtx, host, time.Second*5, reportProbe(metrics))
+									if err != nil {
+										if isNotPermitted(err) {
+											return
+										}
+
+										log.Printf("warning: failed packets.RunL2Client: %s", err)
+										reportProbeFailure(getL2Protocol(host), host)
+									}
+								}
+							}()
+						}
+					}
+
+					for host, probes := range probesByHost {
+						_, ok := gatewayHosts[host]
+						if ok {
+							continue
+						}
+
+						log.Printf("removing gateway %s...", host)
+
+						probes.cancel()
+						probes.wg.Wait()
+						delete(probesByHost, host)
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-gatewaysTicker.C:
+				case <-gatewaysRefresh:
+				}
+
+				if notPermitted.Load() {
+					for _, probes := range probesByHost {
+						probes.cancel()
+						probes.wg.Wait()
+					}
+
+					return
+				}
+			}
+		}()
+	}
+
+	//
+	// bulk server (for latency under load tests run against us)
+	//
+
+	if *bulkServer {
+		go func() {
+			err := packets.RunBulkServer(ctx, 6944, *bulkMaxDuration, *bulkMaxBytes)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	//
 	// general stuff
 	//
 
 	http.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("registering / (dashboard)")
+	http.Handle("/", dashboard.Handler())
+
 	http.ListenAndServe(":6942", nil)
 }
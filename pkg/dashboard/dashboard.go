@@ -0,0 +1,23 @@
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// static is the dashboard itself: plain HTML / JS / CSS with no external dependencies (it has to work at sites with no
+// internet access), pulling everything from the JSON endpoints
+//
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard (index.html at /, plus its assets)
+func Handler() http.Handler {
+	staticFS, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(staticFS))
+}
@@ -0,0 +1,264 @@
+"use strict";
+
+// everything is relative, so it still works behind a reverse proxy with a path prefix
+const refreshInterval = 5000;
+const sparklineWindow = "15m";
+const maxEvents = 100;
+
+const svgNamespace = "http://www.w3.org/2000/svg";
+
+function formatDuration(nanoseconds) {
+    if (!nanoseconds) {
+        return "-";
+    }
+
+    const milliseconds = nanoseconds / 1e6;
+    if (milliseconds < 1) {
+        return `${(nanoseconds / 1e3).toFixed(0)} µs`;
+    }
+
+    if (milliseconds < 1000) {
+        return `${milliseconds.toFixed(milliseconds < 10 ? 2 : 1)} ms`;
+    }
+
+    return `${(milliseconds / 1000).toFixed(2)} s`;
+}
+
+function formatBits(bitsPerSecond) {
+    if (bitsPerSecond === undefined || bitsPerSecond === null) {
+        return "-";
+    }
+
+    const units = ["b/s", "Kb/s", "Mb/s", "Gb/s", "Tb/s"];
+
+    let value = bitsPerSecond;
+    let i = 0;
+    while (value >= 1000 && i < units.length - 1) {
+        value /= 1000;
+        i++;
+    }
+
+    return `${value.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+function formatSpeed(megabitsPerSecond) {
+    if (!megabitsPerSecond || megabitsPerSecond < 0) {
+        return "-";
+    }
+
+    return formatBits(megabitsPerSecond * 1e6).replace("/s", "");
+}
+
+function formatPercent(value) {
+    if (value === undefined || value === null) {
+        return "-";
+    }
+
+    return `${value.toFixed(value < 10 ? 2 : 1)}%`;
+}
+
+function formatRate(value) {
+    if (!value) {
+        return "0";
+    }
+
+    return value.toFixed(value < 10 ? 2 : 0);
+}
+
+function formatTime(timestamp) {
+    return new Date(timestamp).toLocaleString();
+}
+
+async function getJSON(url) {
+    const response = await fetch(url, {headers: {"Accept": "application/json"}});
+    if (!response.ok) {
+        throw new Error(`${url}: ${response.status} ${response.statusText}`);
+    }
+
+    const text = await response.text();
+
+    // some endpoints are empty until their first tick
+    if (!text) {
+        return null;
+    }
+
+    return JSON.parse(text);
+}
+
+function newCell(row, text, className) {
+    const cell = row.insertCell();
+
+    if (text instanceof Node) {
+        cell.appendChild(text);
+    } else {
+        cell.textContent = text;
+    }
+
+    if (className) {
+        cell.className = className;
+    }
+
+    return cell;
+}
+
+function replaceRows(table, rows, emptyMessage, columns) {
+    const tbody = table.tBodies[0];
+    tbody.replaceChildren();
+
+    if (rows.length === 0) {
+        const row = tbody.insertRow();
+        const cell = newCell(row, emptyMessage, "empty");
+        cell.colSpan = columns;
+        return;
+    }
+
+    for (const fn of rows) {
+        fn(tbody.insertRow());
+    }
+}
+
+// newSparkline draws one or more series (each a list of numbers, null for a gap) as lines, plus optional bars (e.g.
+// for loss) along the bottom
+function newSparkline(lines, bars, width = 160, height = 24) {
+    const svg = document.createElementNS(svgNamespace, "svg");
+    svg.setAttribute("class", "sparkline");
+    svg.setAttribute("width", width);
+    svg.setAttribute("height", height);
+    svg.setAttribute("viewBox", `0 0 ${width} ${height}`);
+
+    const length = Math.max(0, ...lines.map((line) => line.length), bars ? bars.length : 0);
+    if (length === 0) {
+        return svg;
+    }
+
+    const max = Math.max(0, ...lines.flat().filter((value) => value !== null));
+    const step = length > 1 ? width / (length - 1) : width;
+
+    lines.forEach((line, i) => {
+        const points = line
+            .map((value, j) => value === null ? null : `${(j * step).toFixed(1)},${(height - 1 - (max > 0 ? value / max : 0) * (height - 2)).toFixed(1)}`)
+            .filter((point) => point !== null);
+
+        const polyline = document.createElementNS(svgNamespace, "polyline");
+        polyline.setAttribute("points", points.join(" "));
+        if (i > 0) {
+            polyline.setAttribute("class", "secondary");
+        }
+
+        svg.appendChild(polyline);
+    });
+
+    if (bars) {
+        bars.forEach((value, j) => {
+            if (!value) {
+                return;
+            }
+
+            const barHeight = Math.max(1, value / 100 * height);
+
+            const rect = document.createElementNS(svgNamespace, "rect");
+            rect.setAttribute("x", Math.max(0, j * step - step / 2).toFixed(1));
+            rect.setAttribute("y", (height - barHeight).toFixed(1));
+            rect.setAttribute("width", Math.max(1, step).toFixed(1));
+            rect.setAttribute("height", barHeight.toFixed(1));
+            svg.appendChild(rect);
+        });
+    }
+
+    return svg;
+}
+
+async function getHistory(target) {
+    try {
+        const series = await getJSON(`api/history?target=${encodeURIComponent(target)}&from=${sparklineWindow}`);
+        return series || {};
+    } catch (e) {
+        return {};
+    }
+}
+
+async function refreshTargets(statusWindow) {
+    const statuses = await getJSON(`api/status?window=${statusWindow}`) || [];
+    const histories = await Promise.all(statuses.map((status) => getHistory(status.target)));
+
+    replaceRows(document.getElementById("targets"), statuses.map((status, i) => (row) => {
+        const samples = histories[i].probe_samples || [];
+
+        newCell(row, status.target);
+        newCell(row, status.state, `state state-${status.state}`);
+        newCell(row, formatPercent(status.loss_percent), status.loss_percent > 0 ? "number bad" : "number");
+        newCell(row, formatDuration(status.rtt_min), "number");
+        newCell(row, formatDuration(status.rtt_avg), "number");
+        newCell(row, formatDuration(status.rtt_max), "number");
+        newCell(row, formatDuration(status.jitter), "number");
+        newCell(row, newSparkline([
+            samples.map((sample) => sample.received > 0 ? sample.rtt_avg : null),
+            samples.map((sample) => sample.received > 0 ? sample.rtt_max : null),
+        ]));
+        newCell(row, newSparkline([], samples.map((sample) => {
+            const total = sample.received + sample.lost;
+            return total > 0 ? sample.lost / total * 100 : 0;
+        })));
+    }), "no probe targets yet", 9);
+}
+
+async function refreshInterfaces() {
+    const networkInterfaces = await getJSON("network-interfaces") || [];
+    networkInterfaces.sort((a, b) => a.name.localeCompare(b.name));
+
+    const histories = await Promise.all(networkInterfaces.map((networkInterface) => getHistory(`interface/${networkInterface.name}`)));
+
+    replaceRows(document.getElementById("interfaces"), networkInterfaces.map((networkInterface, i) => (row) => {
+        const rates = networkInterface.rates || {};
+        const samples = histories[i].interface_samples || [];
+        const errors = (rates.rx_errors_per_second || 0) + (rates.tx_errors_per_second || 0);
+        const drops = (rates.rx_dropped_per_second || 0) + (rates.tx_dropped_per_second || 0);
+        const state = networkInterface.oper_state === "up" ? "up" : (networkInterface.oper_state === "down" ? "down" : "unknown");
+
+        newCell(row, networkInterface.name);
+        newCell(row, networkInterface.oper_state, `state state-${state}`);
+        newCell(row, formatSpeed(networkInterface.speed), "number");
+        newCell(row, formatBits(rates.rx_bits_per_second), "number");
+        newCell(row, formatBits(rates.tx_bits_per_second), "number");
+        newCell(row, formatPercent(rates.rx_utilisation_percent), "number");
+        newCell(row, formatPercent(rates.tx_utilisation_percent), "number");
+        newCell(row, formatRate(errors), errors > 0 ? "number bad" : "number");
+        newCell(row, formatRate(drops), drops > 0 ? "number bad" : "number");
+        newCell(row, newSparkline([
+            samples.map((sample) => sample.rx_bits_per_second),
+            samples.map((sample) => sample.tx_bits_per_second),
+        ]));
+    }), "no interfaces yet", 10);
+}
+
+async function refreshEvents() {
+    const events = (await getJSON("events") || []).slice(-maxEvents).reverse();
+
+    replaceRows(document.getElementById("events"), events.map((event) => (row) => {
+        newCell(row, formatTime(event.timestamp));
+        newCell(row, event.kind);
+        newCell(row, event.interface || "");
+        newCell(row, event.message, "message");
+    }), "no events yet", 4);
+}
+
+async function refresh() {
+    const statusWindow = document.getElementById("window").value;
+    const updated = document.getElementById("updated");
+
+    const results = await Promise.allSettled([refreshTargets(statusWindow), refreshInterfaces(), refreshEvents()]);
+    const failures = results.filter((result) => result.status === "rejected");
+
+    if (failures.length > 0) {
+        updated.textContent = `failed to refresh: ${failures.map((failure) => failure.reason.message).join(", ")}`;
+        updated.classList.add("bad");
+    } else {
+        updated.textContent = `updated ${new Date().toLocaleTimeString()}`;
+        updated.classList.remove("bad");
+    }
+}
+
+document.getElementById("window").addEventListener("change", refresh);
+
+refresh();
+setInterval(refresh, refreshInterval);
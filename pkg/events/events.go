@@ -0,0 +1,138 @@
+package events
+
+import (
+	_log "log"
+	"os"
+	"sync"
+	"time"
+)
+
+var log = _log.New(
+	os.Stdout,
+	"loser: ",
+	_log.Ldate|
+		_log.Ltime|
+		_log.Lmicroseconds|
+		_log.LUTC|
+		_log.Lmsgprefix|
+		_log.LstdFlags,
+)
+
+const (
+	KindOperStateChanged = "oper_state_changed"
+	KindCarrierChanged   = "carrier_changed"
+	KindSpeedChanged     = "speed_changed"
+	KindDuplexChanged    = "duplex_changed"
+
+	KindMasterChanged             = "master_changed"
+	KindBondActiveSlaveChanged    = "bond_active_slave_changed"
+	KindBondSlaveMIIStatusChanged = "bond_slave_mii_status_changed"
+
+	KindLinkAdded           = "link_added"
+	KindLinkRemoved         = "link_removed"
+	KindLinkUp              = "link_up"
+	KindLinkDown            = "link_down"
+	KindAddressAdded        = "address_added"
+	KindAddressRemoved      = "address_removed"
+	KindRouteAdded          = "route_added"
+	KindRouteRemoved        = "route_removed"
+	KindDefaultRouteChanged = "default_route_changed"
+)
+
+type Event struct {
+	Timestamp time.Time `json:"timestamp"`
+	Kind      string    `json:"kind"`
+	Interface string    `json:"interface,omitempty"`
+	Old       string    `json:"old,omitempty"`
+	New       string    `json:"new,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// Log keeps the most recent events in memory
+type Log struct {
+	mu          *sync.Mutex
+	size        int
+	events      []Event
+	subscribers map[int]func(Event)
+	lastID      int
+}
+
+func NewLog(size int) *Log {
+	l := Log{
+		mu:          new(sync.Mutex),
+		size:        size,
+		events:      make([]Event, 0),
+		subscribers: make(map[int]func(Event)),
+	}
+
+	return &l
+}
+
+func (l *Log) Add(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	log.Printf("event: %s", event.Message)
+
+	l.mu.Lock()
+
+	l.events = append(l.events, event)
+
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+
+	subscribers := make([]func(Event), 0, len(l.subscribers))
+	for _, subscriber := range l.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+
+	l.mu.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+}
+
+// Load adds an event without logging it or handing it to the subscribers (e.g. when it's being read back from disk)
+func (l *Log) Load(event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, event)
+
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+}
+
+// Subscribe has the given function called for every event added from now on (until the returned function is called);
+// it's called synchronously so it shouldn't block
+func (l *Log) Subscribe(fn func(Event)) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastID++
+	id := l.lastID
+
+	l.subscribers[id] = fn
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		delete(l.subscribers, id)
+	}
+}
+
+// Events returns a copy of the events currently held, oldest first
+func (l *Log) Events() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := make([]Event, len(l.events))
+	copy(events, l.events)
+
+	return events
+}
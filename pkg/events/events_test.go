@@ -0,0 +1,33 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	l := NewLog(3)
+
+	for i := 0; i < 5; i++ {
+		l.Add(Event{Kind: KindOperStateChanged, Interface: "eth0", Message: fmt.Sprintf("event %d", i)})
+	}
+
+	events := l.Events()
+	require.Len(t, events, 3)
+	require.Equal(t, "event 2", events[0].Message)
+	require.Equal(t, "event 4", events[2].Message)
+	require.False(t, events[0].Timestamp.IsZero())
+
+	kinds := make([]string, 0)
+	unsubscribe := l.Subscribe(func(event Event) {
+		kinds = append(kinds, event.Kind)
+	})
+
+	l.Add(Event{Kind: KindLinkDown, Interface: "eth0", Message: "eth0 went down"})
+	unsubscribe()
+	l.Add(Event{Kind: KindLinkUp, Interface: "eth0", Message: "eth0 came up"})
+
+	require.Equal(t, []string{KindLinkDown}, kinds)
+}
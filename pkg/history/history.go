@@ -0,0 +1,590 @@
+package history
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/initialed85/loser/pkg/packets"
+)
+
+const (
+	KindProbe     = "probe"
+	KindInterface = "interface"
+)
+
+// ProbeSample is a probe report (minus the bits that don't make sense over time, like the TCP_INFO); the durations are
+// in nanoseconds, like the rest of the JSON
+type ProbeSample struct {
+	Timestamp  time.Time     `json:"timestamp"`
+	Sent       int64         `json:"sent"`
+	Received   int64         `json:"received"`
+	OutOfOrder int64         `json:"out_of_order"`
+	Lost       int64         `json:"lost"`
+	RTTMin     time.Duration `json:"rtt_min"`
+	RTTAvg     time.Duration `json:"rtt_avg"`
+	RTTMax     time.Duration `json:"rtt_max"`
+	Jitter     time.Duration `json:"jitter"`
+}
+
+var probeSampleColumns = []string{"timestamp", "sent", "received", "out_of_order", "lost", "rtt_min", "rtt_avg", "rtt_max", "jitter"}
+
+func (s ProbeSample) record() []string {
+	return []string{
+		s.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.FormatInt(s.Sent, 10),
+		strconv.FormatInt(s.Received, 10),
+		strconv.FormatInt(s.OutOfOrder, 10),
+		strconv.FormatInt(s.Lost, 10),
+		strconv.FormatInt(int64(s.RTTMin), 10),
+		strconv.FormatInt(int64(s.RTTAvg), 10),
+		strconv.FormatInt(int64(s.RTTMax), 10),
+		strconv.FormatInt(int64(s.Jitter), 10),
+	}
+}
+
+// InterfaceSample is the gist of an interface snapshot: its state, the main counters and the rates (if we had a
+// previous snapshot to work them out from)
+type InterfaceSample struct {
+	Timestamp            time.Time `json:"timestamp"`
+	OperState            string    `json:"oper_state"`
+	Carrier              int       `json:"carrier"`
+	Speed                int       `json:"speed"`
+	RxBytes              int64     `json:"rx_bytes"`
+	TxBytes              int64     `json:"tx_bytes"`
+	RxPackets            int64     `json:"rx_packets"`
+	TxPackets            int64     `json:"tx_packets"`
+	RxErrors             int64     `json:"rx_errors"`
+	TxErrors             int64     `json:"tx_errors"`
+	RxDropped            int64     `json:"rx_dropped"`
+	TxDropped            int64     `json:"tx_dropped"`
+	RxBitsPerSecond      float64   `json:"rx_bits_per_second"`
+	TxBitsPerSecond      float64   `json:"tx_bits_per_second"`
+	RxPacketsPerSecond   float64   `json:"rx_packets_per_second"`
+	TxPacketsPerSecond   float64   `json:"tx_packets_per_second"`
+	RxErrorsPerSecond    float64   `json:"rx_errors_per_second"`
+	TxErrorsPerSecond    float64   `json:"tx_errors_per_second"`
+	RxDroppedPerSecond   float64   `json:"rx_dropped_per_second"`
+	TxDroppedPerSecond   float64   `json:"tx_dropped_per_second"`
+	RxUtilisationPercent *float64  `json:"rx_utilisation_percent,omitempty"`
+	TxUtilisationPercent *float64  `json:"tx_utilisation_percent,omitempty"`
+}
+
+var interfaceSampleColumns = []string{
+	"timestamp", "oper_state", "carrier", "speed",
+	"rx_bytes", "tx_bytes", "rx_packets", "tx_packets", "rx_errors", "tx_errors", "rx_dropped", "tx_dropped",
+	"rx_bits_per_second", "tx_bits_per_second", "rx_packets_per_second", "tx_packets_per_second",
+	"rx_errors_per_second", "tx_errors_per_second", "rx_dropped_per_second", "tx_dropped_per_second",
+	"rx_utilisation_percent", "tx_utilisation_percent",
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// formatOptionalFloat leaves the cell empty if there's no value
+func formatOptionalFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+
+	return formatFloat(*value)
+}
+
+func (s InterfaceSample) record() []string {
+	return []string{
+		s.Timestamp.UTC().Format(time.RFC3339Nano),
+		s.OperState,
+		strconv.Itoa(s.Carrier),
+		strconv.Itoa(s.Speed),
+		strconv.FormatInt(s.RxBytes, 10),
+		strconv.FormatInt(s.TxBytes, 10),
+		strconv.FormatInt(s.RxPackets, 10),
+		strconv.FormatInt(s.TxPackets, 10),
+		strconv.FormatInt(s.RxErrors, 10),
+		strconv.FormatInt(s.TxErrors, 10),
+		strconv.FormatInt(s.RxDropped, 10),
+		strconv.FormatInt(s.TxDropped, 10),
+		formatFloat(s.RxBitsPerSecond),
+		formatFloat(s.TxBitsPerSecond),
+		formatFloat(s.RxPacketsPerSecond),
+		formatFloat(s.TxPacketsPerSecond),
+		formatFloat(s.RxErrorsPerSecond),
+		formatFloat(s.TxErrorsPerSecond),
+		formatFloat(s.RxDroppedPerSecond),
+		formatFloat(s.TxDroppedPerSecond),
+		formatOptionalFloat(s.RxUtilisationPercent),
+		formatOptionalFloat(s.TxUtilisationPercent),
+	}
+}
+
+func NewProbeSample(report packets.Report) ProbeSample {
+	return ProbeSample{
+		Timestamp:  report.Timestamp,
+		Sent:       report.Sent,
+		Received:   report.Received,
+		OutOfOrder: report.OutOfOrder,
+		Lost:       report.Lost,
+		RTTMin:     report.RTTMin,
+		RTTAvg:     report.RTTAvg,
+		RTTMax:     report.RTTMax,
+		Jitter:     report.Jitter,
+	}
+}
+
+// merge folds a later sample into this one (e.g. when it arrives within the resolution): the counts add up, the RTT
+// min / max are across both and the average RTT and jitter are weighted by the replies
+func (s ProbeSample) merge(other ProbeSample) ProbeSample {
+	merged := ProbeSample{
+		Timestamp:  other.Timestamp,
+		Sent:       s.Sent + other.Sent,
+		Received:   s.Received + other.Received,
+		OutOfOrder: s.OutOfOrder + other.OutOfOrder,
+		Lost:       s.Lost + other.Lost,
+		RTTMin:     s.RTTMin,
+		RTTAvg:     s.RTTAvg,
+		RTTMax:     s.RTTMax,
+		Jitter:     s.Jitter,
+	}
+
+	if s.Timestamp.After(other.Timestamp) {
+		merged.Timestamp = s.Timestamp
+	}
+
+	if other.Received == 0 {
+		return merged
+	}
+
+	if s.Received == 0 {
+		merged.RTTMin, merged.RTTAvg, merged.RTTMax, merged.Jitter = other.RTTMin, other.RTTAvg, other.RTTMax, other.Jitter
+		return merged
+	}
+
+	merged.RTTMin = min(s.RTTMin, other.RTTMin)
+	merged.RTTMax = max(s.RTTMax, other.RTTMax)
+	merged.RTTAvg = (s.RTTAvg*time.Duration(s.Received) + other.RTTAvg*time.Duration(other.Received)) / time.Duration(merged.Received)
+	merged.Jitter = (s.Jitter*time.Duration(s.Received) + other.Jitter*time.Duration(other.Received)) / time.Duration(merged.Received)
+
+	return merged
+}
+
+func NewInterfaceSample(networkInterface network_interfaces.NetworkInterface) InterfaceSample {
+	sample := InterfaceSample{
+		Timestamp: networkInterface.Timestamp,
+		OperState: networkInterface.OperState,
+		Carrier:   networkInterface.Carrier,
+		Speed:     networkInterface.Speed,
+		RxBytes:   networkInterface.RxBytes,
+		TxBytes:   networkInterface.TxBytes,
+		RxPackets: networkInterface.RxPackets,
+		TxPackets: networkInterface.TxPackets,
+		RxErrors:  networkInterface.RxErrors,
+		TxErrors:  networkInterface.TxErrors,
+		RxDropped: networkInterface.RxDropped,
+		TxDropped: networkInterface.TxDropped,
+	}
+
+	rates := networkInterface.Rates
+	if rates != nil {
+		sample.RxBitsPerSecond = rates.RxBitsPerSecond
+		sample.TxBitsPerSecond = rates.TxBitsPerSecond
+		sample.RxPacketsPerSecond = rates.RxPacketsPerSecond
+		sample.TxPacketsPerSecond = rates.TxPacketsPerSecond
+		sample.RxErrorsPerSecond = rates.RxErrorsPerSecond
+		sample.TxErrorsPerSecond = rates.TxErrorsPerSecond
+		sample.RxDroppedPerSecond = rates.RxDroppedPerSecond
+		sample.TxDroppedPerSecond = rates.TxDroppedPerSecond
+		sample.RxUtilisationPercent = rates.RxUtilisationPercent
+		sample.TxUtilisationPercent = rates.TxUtilisationPercent
+	}
+
+	return sample
+}
+
+// GetProbeTarget is how a probe is named in the history (e.g. "tcp/192.168.1.1")
+func GetProbeTarget(protocol string, host string) string {
+	return fmt.Sprintf("%s/%s", protocol, host)
+}
+
+// GetInterfaceTarget is how an interface is named in the history (e.g. "interface/eth0", or
+// "interface/inode:4026532291/eth0" for one in another network namespace)
+func GetInterfaceTarget(name string) string {
+	return fmt.Sprintf("%s/%s", KindInterface, name)
+}
+
+// ring is a fixed size ring buffer (that only grows to its capacity as it's used), oldest first
+type ring[T any] struct {
+	capacity int
+	items    []T
+	start    int
+}
+
+func newRing[T any](capacity int) *ring[T] {
+	return &ring[T]{
+		capacity: capacity,
+		items:    make([]T, 0),
+	}
+}
+
+func (r *ring[T]) add(item T) {
+	if len(r.items) < r.capacity {
+		r.items = append(r.items, item)
+		return
+	}
+
+	r.items[r.start] = item
+	r.start = (r.start + 1) % r.capacity
+}
+
+// last is the newest item (nil if there's nothing yet)
+func (r *ring[T]) last() *T {
+	if len(r.items) == 0 {
+		return nil
+	}
+
+	return &r.items[(r.start+len(r.items)-1)%len(r.items)]
+}
+
+// each calls fn for each item, oldest first
+func (r *ring[T]) each(fn func(T)) {
+	for i := 0; i < len(r.items); i++ {
+		fn(r.items[(r.start+i)%len(r.items)])
+	}
+}
+
+type series struct {
+	kind             string
+	last             time.Time
+	probeSamples     *ring[ProbeSample]
+	interfaceSamples *ring[InterfaceSample]
+}
+
+// Series is what a query returns (only one of the sample lists is set, depending on the kind)
+type Series struct {
+	Target           string            `json:"target"`
+	Kind             string            `json:"kind"`
+	From             time.Time         `json:"from"`
+	To               time.Time         `json:"to"`
+	ProbeSamples     []ProbeSample     `json:"probe_samples,omitempty"`
+	InterfaceSamples []InterfaceSample `json:"interface_samples,omitempty"`
+}
+
+// WriteCSV writes the samples out as CSV with a header row (the columns are named like the JSON fields)
+func (s *Series) WriteCSV(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+
+	switch s.Kind {
+	case KindProbe:
+		_ = csvWriter.Write(probeSampleColumns)
+		for _, sample := range s.ProbeSamples {
+			_ = csvWriter.Write(sample.record())
+		}
+	case KindInterface:
+		_ = csvWriter.Write(interfaceSampleColumns)
+		for _, sample := range s.InterfaceSamples {
+			_ = csvWriter.Write(sample.record())
+		}
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
+
+// History keeps the probe reports and interface snapshots in memory, one ring buffer per target sized to hold the
+// retention at the given resolution; probe reports arriving quicker than the resolution are merged into the last
+// sample (they're deltas, so dropping them would lose the sends and losses), interface snapshots are just dropped
+// (they're absolute, so the next one has it all anyway)
+type History struct {
+	mu             *sync.Mutex
+	lastPrune      time.Time
+	retention      time.Duration
+	resolution     time.Duration
+	capacity       int
+	seriesByTarget map[string]*series
+	subscribers    map[int]func(Sample)
+	lastID         int
+}
+
+func New(retention time.Duration, resolution time.Duration) *History {
+	capacity := int(retention / resolution)
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	h := History{
+		mu:             new(sync.Mutex),
+		retention:      retention,
+		resolution:     resolution,
+		capacity:       capacity,
+		seriesByTarget: make(map[string]*series),
+		subscribers:    make(map[int]func(Sample)),
+	}
+
+	return &h
+}
+
+func (h *History) Retention() time.Duration {
+	return h.retention
+}
+
+// prune forgets the targets we haven't heard from for longer than the retention (e.g. a container's veth), every so often
+func (h *History) prune(now time.Time) {
+	if now.Sub(h.lastPrune) < h.resolution {
+		return
+	}
+
+	h.lastPrune = now
+
+	for target, s := range h.seriesByTarget {
+		if now.Sub(s.last) > h.retention {
+			delete(h.seriesByTarget, target)
+		}
+	}
+}
+
+// getSeries gets (or creates) the series for a target, and whether it's too soon for another sample (i.e. it's still
+// within the resolution of the last one)
+func (h *History) getSeries(target string, kind string, timestamp time.Time) (*series, bool) {
+	h.prune(timestamp)
+
+	s, ok := h.seriesByTarget[target]
+	if !ok {
+		s = &series{
+			kind: kind,
+		}
+
+		if kind == KindProbe {
+			s.probeSamples = newRing[ProbeSample](h.capacity)
+		} else {
+			s.interfaceSamples = newRing[InterfaceSample](h.capacity)
+		}
+
+		h.seriesByTarget[target] = s
+	}
+
+	// a little slack so samples that arrive at the resolution (give or take some scheduling) aren't dropped
+	if !s.last.IsZero() && timestamp.Sub(s.last) < h.resolution*9/10 {
+		return s, true
+	}
+
+	s.last = timestamp
+
+	return s, false
+}
+
+// Sample is a probe or interface sample for a target (only one of Probe or Interface is set, depending on the kind);
+// it's what subscribers get given
+type Sample struct {
+	Target    string           `json:"target"`
+	Kind      string           `json:"kind"`
+	Probe     *ProbeSample     `json:"probe,omitempty"`
+	Interface *InterfaceSample `json:"interface,omitempty"`
+}
+
+func (s Sample) timestamp() time.Time {
+	if s.Probe != nil {
+		return s.Probe.Timestamp
+	}
+
+	if s.Interface != nil {
+		return s.Interface.Timestamp
+	}
+
+	return time.Time{}
+}
+
+func (h *History) add(sample Sample) bool {
+	if (sample.Kind == KindProbe) != (sample.Probe != nil) || (sample.Kind == KindInterface) != (sample.Interface != nil) {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, tooSoon := h.getSeries(sample.Target, sample.Kind, sample.timestamp())
+	if s.kind != sample.Kind {
+		return false
+	}
+
+	if sample.Probe != nil {
+		last := s.probeSamples.last()
+		if tooSoon && last != nil {
+			*last = last.merge(*sample.Probe)
+		} else {
+			s.probeSamples.add(*sample.Probe)
+		}
+	} else {
+		if tooSoon {
+			return false
+		}
+
+		s.interfaceSamples.add(*sample.Interface)
+	}
+
+	return true
+}
+
+// Add adds a sample (unless it's an interface snapshot too soon after the last one for the target; a probe report
+// that soon is merged into the last sample) and hands it to the subscribers
+func (h *History) Add(sample Sample) {
+	if !h.add(sample) {
+		return
+	}
+
+	h.mu.Lock()
+	subscribers := make([]func(Sample), 0, len(h.subscribers))
+	for _, subscriber := range h.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	h.mu.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(sample)
+	}
+}
+
+// Load adds a sample without handing it to the subscribers (e.g. when it's being read back from disk)
+func (h *History) Load(sample Sample) {
+	_ = h.add(sample)
+}
+
+// Subscribe has the given function called for every sample added from now on (until the returned function is called);
+// it's called synchronously so it shouldn't block
+func (h *History) Subscribe(fn func(Sample)) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	id := h.lastID
+
+	h.subscribers[id] = fn
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.subscribers, id)
+	}
+}
+
+func (h *History) AddProbeReport(report packets.Report) {
+	if report.Timestamp.IsZero() {
+		report.Timestamp = time.Now()
+	}
+
+	probeSample := NewProbeSample(report)
+
+	h.Add(Sample{
+		Target: GetProbeTarget(report.Protocol, report.Host),
+		Kind:   KindProbe,
+		Probe:  &probeSample,
+	})
+}
+
+// AddNetworkInterface adds an interface snapshot under the given name (see GetInterfaceTarget)
+func (h *History) AddNetworkInterface(name string, networkInterface network_interfaces.NetworkInterface) {
+	if networkInterface.Timestamp.IsZero() {
+		networkInterface.Timestamp = time.Now()
+	}
+
+	interfaceSample := NewInterfaceSample(networkInterface)
+
+	h.Add(Sample{
+		Target:    GetInterfaceTarget(name),
+		Kind:      KindInterface,
+		Interface: &interfaceSample,
+	})
+}
+
+// Targets returns the names of everything we've got history for, sorted
+func (h *History) Targets() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	targets := make([]string, 0, len(h.seriesByTarget))
+	for target := range h.seriesByTarget {
+		targets = append(targets, target)
+	}
+
+	sort.Strings(targets)
+
+	return targets
+}
+
+// Query returns the samples for a target between from and to (inclusive)
+func (h *History) Query(target string, from time.Time, to time.Time) (*Series, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.seriesByTarget[target]
+	if !ok {
+		return nil, fmt.Errorf("no history for target %#+v", target)
+	}
+
+	result := Series{
+		Target: target,
+		Kind:   s.kind,
+		From:   from,
+		To:     to,
+	}
+
+	inRange := func(timestamp time.Time) bool {
+		return !timestamp.Before(from) && !timestamp.After(to)
+	}
+
+	switch s.kind {
+	case KindProbe:
+		result.ProbeSamples = make([]ProbeSample, 0)
+		s.probeSamples.each(func(sample ProbeSample) {
+			if inRange(sample.Timestamp) {
+				result.ProbeSamples = append(result.ProbeSamples, sample)
+			}
+		})
+	case KindInterface:
+		result.InterfaceSamples = make([]InterfaceSample, 0)
+		s.interfaceSamples.each(func(sample InterfaceSample) {
+			if inRange(sample.Timestamp) {
+				result.InterfaceSamples = append(result.InterfaceSamples, sample)
+			}
+		})
+	}
+
+	return &result, nil
+}
+
+// ParseTime parses a query time: RFC3339, unix seconds, or a duration back from now (e.g. "1h" or "-1h" are both an
+// hour ago); empty gives the fallback
+func ParseTime(value string, now time.Time, fallback time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fallback, nil
+	}
+
+	if value == "now" {
+		return now, nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err == nil {
+		return timestamp, nil
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+
+	duration, err := time.ParseDuration(strings.TrimPrefix(value, "-"))
+	if err == nil {
+		return now.Add(-duration), nil
+	}
+
+	return time.Time{}, fmt.Errorf("can't parse %#+v as RFC3339, unix seconds or a duration", value)
+}
@@ -0,0 +1,245 @@
+package history
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/initialed85/loser/pkg/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Ring", func(t *testing.T) {
+		r := newRing[int](3)
+
+		for i := 0; i < 5; i++ {
+			r.add(i)
+		}
+
+		items := make([]int, 0)
+		r.each(func(item int) {
+			items = append(items, item)
+		})
+
+		require.Equal(t, []int{2, 3, 4}, items)
+	})
+
+	t.Run("ProbeReports", func(t *testing.T) {
+		h := New(time.Second*30, time.Second*5)
+
+		for i := 0; i < 10; i++ {
+			h.AddProbeReport(packets.Report{
+				Timestamp: start.Add(time.Second * 5 * time.Duration(i)),
+				Protocol:  "tcp",
+				Host:      "192.168.1.1",
+				Sent:      int64(i),
+				RTTAvg:    time.Millisecond,
+			})
+		}
+
+		// too soon after the last one, so it's merged into it
+		h.AddProbeReport(packets.Report{Timestamp: start.Add(time.Second * 46), Protocol: "tcp", Host: "192.168.1.1", Sent: 99})
+
+		require.Equal(t, []string{"tcp/192.168.1.1"}, h.Targets())
+
+		series, err := h.Query("tcp/192.168.1.1", start, start.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, KindProbe, series.Kind)
+		require.Len(t, series.ProbeSamples, 6)
+		require.Equal(t, int64(4), series.ProbeSamples[0].Sent)
+		require.Equal(t, int64(9+99), series.ProbeSamples[5].Sent)
+		require.Equal(t, start.Add(time.Second*46), series.ProbeSamples[5].Timestamp)
+		require.Equal(t, time.Millisecond, series.ProbeSamples[5].RTTAvg)
+
+		series, err = h.Query("tcp/192.168.1.1", start.Add(time.Second*30), start.Add(time.Second*35))
+		require.NoError(t, err)
+		require.Len(t, series.ProbeSamples, 2)
+
+		b := new(bytes.Buffer)
+		err = series.WriteCSV(b)
+		require.NoError(t, err)
+		require.Equal(t, strings.Join([]string{
+			"timestamp,sent,received,out_of_order,lost,rtt_min,rtt_avg,rtt_max,jitter",
+			"2024-01-01T00:00:30Z,6,0,0,0,0,1000000,0,0",
+			"2024-01-01T00:00:35Z,7,0,0,0,0,1000000,0,0",
+			"",
+		}, "\n"), b.String())
+
+		_, err = h.Query("udp/192.168.1.1", start, start.Add(time.Hour))
+		require.Error(t, err)
+	})
+
+	t.Run("MergeProbeReports", func(t *testing.T) {
+		h := New(time.Hour, time.Minute)
+
+		// a 5s report interval at a 1m resolution, the last one a partial report as the connection dropped
+		for _, report := range []packets.Report{
+			{Timestamp: start, Sent: 5, Received: 5, RTTMin: time.Millisecond * 2, RTTAvg: time.Millisecond * 3, RTTMax: time.Millisecond * 4, Jitter: time.Millisecond},
+			{Timestamp: start.Add(time.Second * 5), Sent: 5, Received: 0, Lost: 5},
+			{Timestamp: start.Add(time.Second * 10), Sent: 5, Received: 3, Lost: 2, OutOfOrder: 1, RTTMin: time.Millisecond, RTTAvg: time.Millisecond * 11, RTTMax: time.Millisecond * 20, Jitter: time.Millisecond * 5},
+			{Timestamp: start.Add(time.Second * 12), Sent: 2, Lost: 2},
+			{Timestamp: start.Add(time.Minute), Sent: 1, Received: 1, RTTMin: time.Millisecond, RTTAvg: time.Millisecond, RTTMax: time.Millisecond},
+		} {
+			report.Protocol, report.Host = "tcp", "192.168.1.1"
+			h.AddProbeReport(report)
+		}
+
+		series, err := h.Query("tcp/192.168.1.1", start, start.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []ProbeSample{
+			{
+				Timestamp:  start.Add(time.Second * 12),
+				Sent:       17,
+				Received:   8,
+				OutOfOrder: 1,
+				Lost:       9,
+				RTTMin:     time.Millisecond,
+				RTTAvg:     (time.Millisecond*3*5 + time.Millisecond*11*3) / 8,
+				RTTMax:     time.Millisecond * 20,
+				Jitter:     (time.Millisecond*5 + time.Millisecond*5*3) / 8,
+			},
+			{Timestamp: start.Add(time.Minute), Sent: 1, Received: 1, RTTMin: time.Millisecond, RTTAvg: time.Millisecond, RTTMax: time.Millisecond},
+		}, series.ProbeSamples)
+	})
+
+	t.Run("NetworkInterfaces", func(t *testing.T) {
+		h := New(time.Minute, time.Second*5)
+
+		utilisationPercent := 12.5
+
+		h.AddNetworkInterface("eth0", network_interfaces.NetworkInterface{Timestamp: start, OperState: "up", RxBytes: 100})
+		h.AddNetworkInterface("eth0", network_interfaces.NetworkInterface{
+			Timestamp: start.Add(time.Second * 5),
+			OperState: "up",
+			RxBytes:   200,
+			Rates:     &network_interfaces.Rates{RxBitsPerSecond: 160, RxUtilisationPercent: &utilisationPercent},
+		})
+		h.AddNetworkInterface("veth1234", network_interfaces.NetworkInterface{Timestamp: start})
+
+		series, err := h.Query(GetInterfaceTarget("eth0"), start, start.Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, KindInterface, series.Kind)
+		require.Len(t, series.InterfaceSamples, 2)
+		require.Equal(t, float64(160), series.InterfaceSamples[1].RxBitsPerSecond)
+
+		b := new(bytes.Buffer)
+		err = series.WriteCSV(b)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		require.Len(t, lines, 3)
+		require.True(t, strings.HasSuffix(lines[1], ",,"))
+		require.True(t, strings.HasSuffix(lines[2], ",12.5,"))
+
+		// veth1234 goes away and ages out
+		h.AddNetworkInterface("eth0", network_interfaces.NetworkInterface{Timestamp: start.Add(time.Minute * 2)})
+		require.Equal(t, []string{"interface/eth0"}, h.Targets())
+	})
+
+	t.Run("Subscribe", func(t *testing.T) {
+		h := New(time.Minute, time.Second*5)
+
+		samples := make([]Sample, 0)
+		unsubscribe := h.Subscribe(func(sample Sample) {
+			samples = append(samples, sample)
+		})
+
+		h.AddProbeReport(packets.Report{Timestamp: start, Protocol: "udp", Host: "192.168.1.1", Sent: 1})
+		h.AddProbeReport(packets.Report{Timestamp: start.Add(time.Second), Protocol: "udp", Host: "192.168.1.1", Sent: 2})
+
+		// the subscribers get every probe report as it was, even the ones merged in the history
+		require.Len(t, samples, 2)
+		require.Equal(t, "udp/192.168.1.1", samples[0].Target)
+		require.Equal(t, int64(1), samples[0].Probe.Sent)
+		require.Equal(t, int64(2), samples[1].Probe.Sent)
+
+		// but not interface snapshots that are too soon
+		h.AddNetworkInterface("eth0", network_interfaces.NetworkInterface{Timestamp: start})
+		h.AddNetworkInterface("eth0", network_interfaces.NetworkInterface{Timestamp: start.Add(time.Second)})
+		require.Len(t, samples, 3)
+
+		// loaded samples go in the history but not to the subscribers
+		h.Load(Sample{Target: "udp/192.168.1.1", Kind: KindProbe, Probe: &ProbeSample{Timestamp: start.Add(time.Second * 5), Sent: 3}})
+		require.Len(t, samples, 3)
+
+		// and samples that don't match their kind are ignored
+		h.Load(Sample{Target: "udp/192.168.1.1", Kind: KindInterface, Probe: &ProbeSample{Timestamp: start.Add(time.Second * 10)}})
+
+		series, err := h.Query("udp/192.168.1.1", start, start.Add(time.Minute))
+		require.NoError(t, err)
+		require.Len(t, series.ProbeSamples, 2)
+
+		unsubscribe()
+		h.AddProbeReport(packets.Report{Timestamp: start.Add(time.Second * 15), Protocol: "udp", Host: "192.168.1.1"})
+		require.Len(t, samples, 3)
+	})
+
+	t.Run("Statuses", func(t *testing.T) {
+		h := New(time.Hour, time.Second*5)
+
+		for i := 0; i < 4; i++ {
+			timestamp := start.Add(time.Second * 5 * time.Duration(i))
+
+			h.AddProbeReport(packets.Report{Timestamp: timestamp, Protocol: "tcp", Host: "good", Sent: 5, Received: 5, RTTMin: time.Millisecond, RTTAvg: time.Millisecond * 2, RTTMax: time.Millisecond * 3})
+			h.AddProbeReport(packets.Report{Timestamp: timestamp, Protocol: "tcp", Host: "lossy", Sent: 4, Received: 3, Lost: 1, RTTAvg: time.Millisecond, Jitter: time.Millisecond})
+
+			// was fine, now isn't
+			if i < 3 {
+				h.AddProbeReport(packets.Report{Timestamp: timestamp, Protocol: "icmp", Host: "dead", Sent: 1, Received: 1, RTTAvg: time.Millisecond * 10})
+			} else {
+				h.AddProbeReport(packets.Report{Timestamp: timestamp, Protocol: "icmp", Host: "dead", Sent: 1, Lost: 1})
+			}
+		}
+
+		h.AddNetworkInterface("eth0", network_interfaces.NetworkInterface{Timestamp: start})
+
+		statuses := h.Statuses(start.Add(time.Second*15), time.Minute)
+		require.Len(t, statuses, 3)
+
+		require.Equal(t, "icmp/dead", statuses[0].Target)
+		require.Equal(t, StateDown, statuses[0].State)
+		require.Equal(t, float64(25), statuses[0].LossPercent)
+		require.Equal(t, time.Millisecond*10, statuses[0].RTTAvg)
+
+		require.Equal(t, "tcp/lossy", statuses[1].Target)
+		require.Equal(t, StateUp, statuses[1].State)
+		require.Equal(t, float64(25), statuses[1].LossPercent)
+		require.Equal(t, time.Millisecond, statuses[1].Jitter)
+
+		require.Equal(t, "tcp/good", statuses[2].Target)
+		require.Equal(t, int64(20), statuses[2].Sent)
+		require.Equal(t, float64(0), statuses[2].LossPercent)
+		require.Equal(t, time.Millisecond, statuses[2].RTTMin)
+		require.Equal(t, time.Millisecond*2, statuses[2].RTTAvg)
+		require.Equal(t, time.Millisecond*3, statuses[2].RTTMax)
+
+		// nothing in the window
+		statuses = h.Statuses(start.Add(time.Hour), time.Minute)
+		require.Equal(t, StateUnknown, statuses[0].State)
+	})
+
+	t.Run("ParseTime", func(t *testing.T) {
+		now := start.Add(time.Hour)
+
+		for value, expected := range map[string]time.Time{
+			"":                     start,
+			"now":                  now,
+			"2024-01-01T00:30:00Z": start.Add(time.Minute * 30),
+			"1704067200":           start,
+			"1704067200.5":         start.Add(time.Millisecond * 500),
+			"15m":                  now.Add(-time.Minute * 15),
+			"-15m":                 now.Add(-time.Minute * 15),
+		} {
+			timestamp, err := ParseTime(value, now, start)
+			require.NoError(t, err, value)
+			require.True(t, expected.Equal(timestamp), "%#+v: %s != %s", value, expected, timestamp)
+		}
+
+		_, err := ParseTime("yesterday", now, start)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,146 @@
+package history
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	StateUp      = "up"
+	StateDown    = "down"
+	StateUnknown = "unknown"
+)
+
+// Status is how a probe target has been doing over a recent window: the state is from the latest sample (down if
+// nothing came back, unknown if nothing was sent), the rest is across the window
+type Status struct {
+	Target      string        `json:"target"`
+	State       string        `json:"state"`
+	Timestamp   time.Time     `json:"timestamp"`
+	Sent        int64         `json:"sent"`
+	Received    int64         `json:"received"`
+	Lost        int64         `json:"lost"`
+	LossPercent float64       `json:"loss_percent"`
+	RTTMin      time.Duration `json:"rtt_min"`
+	RTTAvg      time.Duration `json:"rtt_avg"`
+	RTTMax      time.Duration `json:"rtt_max"`
+	Jitter      time.Duration `json:"jitter"`
+}
+
+// GetLossPercent is the lost packets as a percentage of the ones we heard back about one way or the other (the ones still
+// in flight don't count yet)
+func GetLossPercent(received int64, lost int64) float64 {
+	if received+lost == 0 {
+		return 0
+	}
+
+	return float64(lost) / float64(received+lost) * 100
+}
+
+// GetStatus summarises some probe samples (oldest first, as a query returns them)
+func GetStatus(target string, samples []ProbeSample) Status {
+	status := Status{
+		Target: target,
+		State:  StateUnknown,
+	}
+
+	if len(samples) == 0 {
+		return status
+	}
+
+	last := samples[len(samples)-1]
+
+	status.Timestamp = last.Timestamp
+
+	if last.Received > 0 {
+		status.State = StateUp
+	} else if last.Sent > 0 || last.Lost > 0 {
+		status.State = StateDown
+	}
+
+	rttSum := time.Duration(0)
+	jitterSum := time.Duration(0)
+	rttCount := int64(0)
+
+	for _, sample := range samples {
+		status.Sent += sample.Sent
+		status.Received += sample.Received
+		status.Lost += sample.Lost
+
+		if sample.Received == 0 {
+			continue
+		}
+
+		if status.RTTMin == 0 || sample.RTTMin < status.RTTMin {
+			status.RTTMin = sample.RTTMin
+		}
+
+		if sample.RTTMax > status.RTTMax {
+			status.RTTMax = sample.RTTMax
+		}
+
+		// weighted by how many replies each sample is the average of
+		rttSum += sample.RTTAvg * time.Duration(sample.Received)
+		jitterSum += sample.Jitter * time.Duration(sample.Received)
+		rttCount += sample.Received
+	}
+
+	status.LossPercent = GetLossPercent(status.Received, status.Lost)
+
+	if rttCount > 0 {
+		status.RTTAvg = rttSum / time.Duration(rttCount)
+		status.Jitter = jitterSum / time.Duration(rttCount)
+	}
+
+	return status
+}
+
+// Statuses returns the status of each probe target over the window leading up to now, worst first (down, then unknown,
+// then by loss and RTT)
+func (h *History) Statuses(now time.Time, window time.Duration) []Status {
+	statuses := make([]Status, 0)
+
+	for _, target := range h.Targets() {
+		series, err := h.Query(target, now.Add(-window), now)
+		if err != nil || series.Kind != KindProbe {
+			continue
+		}
+
+		statuses = append(statuses, GetStatus(target, series.ProbeSamples))
+	}
+
+	SortStatuses(statuses)
+
+	return statuses
+}
+
+var stateOrder = map[string]int{
+	StateDown:    0,
+	StateUnknown: 1,
+	StateUp:      2,
+}
+
+// SortStatuses sorts statuses worst first (down, then unknown, then by loss, RTT and jitter, then by target)
+func SortStatuses(statuses []Status) {
+	sort.SliceStable(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+
+		if stateOrder[a.State] != stateOrder[b.State] {
+			return stateOrder[a.State] < stateOrder[b.State]
+		}
+
+		if a.LossPercent != b.LossPercent {
+			return a.LossPercent > b.LossPercent
+		}
+
+		if a.RTTAvg != b.RTTAvg {
+			return a.RTTAvg > b.RTTAvg
+		}
+
+		if a.Jitter != b.Jitter {
+			return a.Jitter > b.Jitter
+		}
+
+		return a.Target < b.Target
+	})
+}
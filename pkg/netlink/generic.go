@@ -0,0 +1,57 @@
+package netlink
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// struct genlmsghdr (cmd, version, reserved) comes before the attributes in generic netlink messages
+const SizeofGenlmsghdr = 4
+
+// GenericRequest is Request for generic netlink (unix.NETLINK_GENERIC) families; the responses have the genlmsghdr
+// stripped off, so their Data is just the attributes
+func GenericRequest(familyID uint16, command byte, flags uint16, attributes []byte) ([]Message, error) {
+	payload := make([]byte, SizeofGenlmsghdr, SizeofGenlmsghdr+len(attributes))
+	payload[0] = command
+	payload[1] = 1
+	payload = append(payload, attributes...)
+
+	messages, err := Request(unix.NETLINK_GENERIC, familyID, flags, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		if len(messages[i].Data) < SizeofGenlmsghdr {
+			return nil, fmt.Errorf("truncated genlmsghdr (%d bytes)", len(messages[i].Data))
+		}
+
+		messages[i].Data = messages[i].Data[SizeofGenlmsghdr:]
+	}
+
+	return messages, nil
+}
+
+// GetGenericFamilyID resolves a generic netlink family by name (e.g. "nl80211"); it fails if the family isn't there
+// (e.g. the module isn't loaded)
+func GetGenericFamilyID(name string) (uint16, error) {
+	messages, err := GenericRequest(unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY, 0, EncodeAttribute(unix.CTRL_ATTR_FAMILY_NAME, append([]byte(name), 0)))
+	if err != nil {
+		return 0, fmt.Errorf("failed GenericRequest for CTRL_CMD_GETFAMILY %#+v: %s", name, err)
+	}
+
+	for _, message := range messages {
+		attributes, err := ParseAttributeMap(message.Data)
+		if err != nil {
+			return 0, err
+		}
+
+		familyID, ok := attributes[unix.CTRL_ATTR_FAMILY_ID]
+		if ok {
+			return Uint16(familyID), nil
+		}
+	}
+
+	return 0, fmt.Errorf("no CTRL_ATTR_FAMILY_ID for %#+v", name)
+}
@@ -0,0 +1,328 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	_log "log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var log = _log.New(
+	os.Stdout,
+	"loser: ",
+	_log.Ldate|
+		_log.Ltime|
+		_log.Lmicroseconds|
+		_log.LUTC|
+		_log.Lmsgprefix|
+		_log.LstdFlags,
+)
+
+var ErrTimeout = errors.New("timed out waiting for netlink messages")
+
+// ErrOverrun is ENOBUFS from Receive: we fell behind and the kernel dropped some notifications (but the socket's fine)
+var ErrOverrun = errors.New("fell behind on netlink messages, some were dropped")
+
+type Message struct {
+	Type  uint16
+	Flags uint16
+	Seq   uint32
+	Data  []byte
+}
+
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Conn is a minimal netlink socket; it's only as clever as loser needs it to be (dumps, single requests and
+// multicast subscriptions)
+type Conn struct {
+	mu       *sync.Mutex
+	fd       int
+	pid      uint32
+	seq      uint32
+	protocol int
+}
+
+// Dial opens a netlink socket for the given protocol (e.g. unix.NETLINK_ROUTE), subscribed to the given multicast
+// groups (a bitmask, 0 for none)
+func Dial(protocol int, groups uint32) (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed unix.Socket: %s", err)
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups})
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed unix.Bind: %s", err)
+	}
+
+	sockaddr, err := unix.Getsockname(fd)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed unix.Getsockname: %s", err)
+	}
+
+	pid := uint32(0)
+	if sockaddrNetlink, ok := sockaddr.(*unix.SockaddrNetlink); ok {
+		pid = sockaddrNetlink.Pid
+	}
+
+	c := Conn{
+		mu:       new(sync.Mutex),
+		fd:       fd,
+		pid:      pid,
+		protocol: protocol,
+	}
+
+	return &c, nil
+}
+
+func (c *Conn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// JoinGroup subscribes to a multicast group by number (e.g. unix.RTNLGRP_LINK); needed for groups above 32
+func (c *Conn) JoinGroup(group int) error {
+	return unix.SetsockoptInt(c.fd, unix.SOL_NETLINK, unix.NETLINK_ADD_MEMBERSHIP, group)
+}
+
+// SetReceiveTimeout makes Receive give up with ErrTimeout if nothing arrives in time (so callers can check their context)
+func (c *Conn) SetReceiveTimeout(timeout time.Duration) error {
+	timeval := unix.NsecToTimeval(timeout.Nanoseconds())
+	return unix.SetsockoptTimeval(c.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeval)
+}
+
+// Execute sends a request and collects the responses; for dumps (unix.NLM_F_DUMP) that means everything up to
+// NLMSG_DONE, otherwise the first response (or the ack if unix.NLM_F_ACK was asked for)
+func (c *Conn) Execute(msgType uint16, flags uint16, payload []byte) ([]Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	seq := c.seq
+
+	flags |= unix.NLM_F_REQUEST
+
+	b := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(unix.NLMSG_HDRLEN+len(payload)))
+	binary.NativeEndian.PutUint16(b[4:6], msgType)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	binary.NativeEndian.PutUint32(b[12:16], c.pid)
+	b = append(b, payload...)
+
+	err := unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, fmt.Errorf("failed unix.Sendto: %s", err)
+	}
+
+	responses := make([]Message, 0)
+
+	for {
+		messages, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+			if message.Seq != seq {
+				continue
+			}
+
+			switch message.Type {
+			case unix.NLMSG_DONE:
+				return responses, nil
+			case unix.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return nil, fmt.Errorf("truncated NLMSG_ERROR")
+				}
+
+				errno := int32(binary.NativeEndian.Uint32(message.Data[0:4]))
+				if errno != 0 {
+					return nil, fmt.Errorf("netlink error: %s", unix.Errno(-errno))
+				}
+
+				// an ack
+				return responses, nil
+			}
+
+			responses = append(responses, message)
+
+			if flags&unix.NLM_F_DUMP != unix.NLM_F_DUMP && flags&unix.NLM_F_ACK == 0 && message.Flags&unix.NLM_F_MULTI == 0 {
+				return responses, nil
+			}
+		}
+	}
+}
+
+// Receive blocks until the next batch of messages arrives (e.g. multicast notifications)
+func (c *Conn) Receive() ([]Message, error) {
+	return c.receive()
+}
+
+func (c *Conn) receive() ([]Message, error) {
+	buf := make([]byte, 65536)
+
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				return nil, ErrTimeout
+			}
+
+			if err == unix.ENOBUFS {
+				return nil, ErrOverrun
+			}
+
+			return nil, fmt.Errorf("failed unix.Recvfrom: %s", err)
+		}
+
+		return ParseMessages(buf[:n])
+	}
+}
+
+func ParseMessages(b []byte) ([]Message, error) {
+	messages := make([]Message, 0)
+
+	for len(b) >= unix.NLMSG_HDRLEN {
+		length := int(binary.NativeEndian.Uint32(b[0:4]))
+		if length < unix.NLMSG_HDRLEN || length > len(b) {
+			return nil, fmt.Errorf("invalid netlink message length %d (have %d bytes)", length, len(b))
+		}
+
+		message := Message{
+			Type:  binary.NativeEndian.Uint16(b[4:6]),
+			Flags: binary.NativeEndian.Uint16(b[6:8]),
+			Seq:   binary.NativeEndian.Uint32(b[8:12]),
+			Data:  b[unix.NLMSG_HDRLEN:length],
+		}
+
+		messages = append(messages, message)
+
+		aligned := align(length)
+		if aligned > len(b) {
+			break
+		}
+
+		b = b[aligned:]
+	}
+
+	return messages, nil
+}
+
+func ParseAttributes(b []byte) ([]Attribute, error) {
+	attributes := make([]Attribute, 0)
+
+	for len(b) >= unix.SizeofNlAttr {
+		length := int(binary.NativeEndian.Uint16(b[0:2]))
+		if length < unix.SizeofNlAttr || length > len(b) {
+			return nil, fmt.Errorf("invalid netlink attribute length %d (have %d bytes)", length, len(b))
+		}
+
+		attribute := Attribute{
+			Type:  binary.NativeEndian.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			Value: b[unix.SizeofNlAttr:length],
+		}
+
+		attributes = append(attributes, attribute)
+
+		aligned := align(length)
+		if aligned > len(b) {
+			break
+		}
+
+		b = b[aligned:]
+	}
+
+	return attributes, nil
+}
+
+// ParseAttributeMap is ParseAttributes for when there are no repeated attribute types (or only the last one matters)
+func ParseAttributeMap(b []byte) (map[uint16][]byte, error) {
+	attributes, err := ParseAttributes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	attributeMap := make(map[uint16][]byte)
+	for _, attribute := range attributes {
+		attributeMap[attribute.Type] = attribute.Value
+	}
+
+	return attributeMap, nil
+}
+
+func EncodeAttribute(attributeType uint16, value []byte) []byte {
+	length := unix.SizeofNlAttr + len(value)
+
+	b := make([]byte, align(length))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(b[2:4], attributeType)
+	copy(b[unix.SizeofNlAttr:], value)
+
+	return b
+}
+
+func align(length int) int {
+	return (length + unix.NLA_ALIGNTO - 1) & ^(unix.NLA_ALIGNTO - 1)
+}
+
+func Uint16(b []byte) uint16 {
+	if len(b) < 2 {
+		return 0
+	}
+
+	return binary.NativeEndian.Uint16(b)
+}
+
+func Uint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+
+	return binary.NativeEndian.Uint32(b)
+}
+
+func Uint64(b []byte) uint64 {
+	if len(b) < 8 {
+		return 0
+	}
+
+	return binary.NativeEndian.Uint64(b)
+}
+
+// String handles the nul-terminated strings netlink likes to use
+func String(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+
+	return string(b)
+}
+
+// Request is Dial, Execute and Close in one go
+func Request(protocol int, msgType uint16, flags uint16, payload []byte) ([]Message, error) {
+	conn, err := Dial(protocol, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return conn.Execute(msgType, flags, payload)
+}
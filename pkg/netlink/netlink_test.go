@@ -0,0 +1,48 @@
+package netlink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestNetlink(t *testing.T) {
+	t.Run("EncodeAndParseAttributes", func(t *testing.T) {
+		b := make([]byte, 0)
+		b = append(b, EncodeAttribute(1, []byte("eth0\x00"))...)
+		b = append(b, EncodeAttribute(2|unix.NLA_F_NESTED, EncodeAttribute(3, []byte{1, 2, 3, 4}))...)
+
+		attributes, err := ParseAttributes(b)
+		require.NoError(t, err)
+		require.Len(t, attributes, 2)
+		require.Equal(t, "eth0", String(attributes[0].Value))
+		require.Equal(t, uint16(2), attributes[1].Type)
+
+		nestedAttributes, err := ParseAttributeMap(attributes[1].Value)
+		require.NoError(t, err)
+		require.Equal(t, []byte{1, 2, 3, 4}, nestedAttributes[3])
+
+		_, err = ParseAttributes([]byte{0xff, 0x00, 0x01, 0x00})
+		require.Error(t, err)
+	})
+
+	t.Run("RequestDump", func(t *testing.T) {
+		messages, err := Request(unix.NETLINK_ROUTE, unix.RTM_GETLINK, unix.NLM_F_DUMP, make([]byte, unix.SizeofIfInfomsg))
+		require.NoError(t, err)
+		require.NotEmpty(t, messages)
+
+		for _, message := range messages {
+			require.Equal(t, uint16(unix.RTM_NEWLINK), message.Type)
+		}
+	})
+	t.Run("GetGenericFamilyID", func(t *testing.T) {
+		// nlctrl is the generic netlink controller itself, so it's always there
+		familyID, err := GetGenericFamilyID("nlctrl")
+		require.NoError(t, err)
+		require.Equal(t, uint16(unix.GENL_ID_CTRL), familyID)
+
+		_, err = GetGenericFamilyID("loser-does-not-exist")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,251 @@
+package netns
+
+import (
+	"fmt"
+	_log "log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var log = _log.New(
+	os.Stdout,
+	"loser: ",
+	_log.Ldate|
+		_log.Ltime|
+		_log.Lmicroseconds|
+		_log.LUTC|
+		_log.Lmsgprefix|
+		_log.LstdFlags,
+)
+
+var (
+	// where "ip netns add" puts its bind mounts
+	runNetnsPath = "/var/run/netns"
+	procPath     = "/proc"
+)
+
+const (
+	pidPrefix   = "pid:"
+	inodePrefix = "inode:"
+)
+
+// Namespace is a network namespace; the ones other processes are in are named after their inode (which doesn't change
+// for as long as the namespace is around, unlike which processes are in it), with the lowest PID in there (and its
+// comm) just for information
+type Namespace struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Inode uint64 `json:"inode"`
+	PID   int    `json:"pid,omitempty"`
+	Comm  string `json:"comm,omitempty"`
+}
+
+type namespaceID struct {
+	dev uint64
+	ino uint64
+}
+
+func getNamespaceID(path string) (namespaceID, error) {
+	stat := unix.Stat_t{}
+
+	err := unix.Stat(path, &stat)
+	if err != nil {
+		return namespaceID{}, err
+	}
+
+	return namespaceID{dev: stat.Dev, ino: stat.Ino}, nil
+}
+
+// GetPath turns a namespace name as shown by List ("some-name" for /var/run/netns, "inode:4026532291" for the one some
+// processes are in) or "pid:1234" (the one a process is in) into something Do can use; anything with a "/" in it is
+// assumed to be a path already
+func GetPath(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+
+	if strings.HasPrefix(name, pidPrefix) {
+		return filepath.Join(procPath, strings.TrimPrefix(name, pidPrefix), "ns", "net"), nil
+	}
+
+	if strings.HasPrefix(name, inodePrefix) {
+		inode, err := strconv.ParseUint(strings.TrimPrefix(name, inodePrefix), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad network namespace %#+v: %s", name, err)
+		}
+
+		pids, err := getPIDs()
+		if err != nil {
+			return "", err
+		}
+
+		for _, pid := range pids {
+			path := filepath.Join(procPath, strconv.Itoa(pid), "ns", "net")
+
+			id, err := getNamespaceID(path)
+			if err != nil {
+				continue
+			}
+
+			if id.ino == inode {
+				return path, nil
+			}
+		}
+
+		return "", fmt.Errorf("no processes in network namespace %s", name)
+	}
+
+	return filepath.Join(runNetnsPath, name), nil
+}
+
+// getPIDs is the processes there are right now, lowest first
+func getPIDs() ([]int, error) {
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make([]int, 0)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+
+	return pids, nil
+}
+
+// List returns the named network namespaces (/var/run/netns) and, optionally, the ones other processes are in (e.g.
+// containers, Kubernetes pods), leaving out our own; each namespace shows up once (named ones win, otherwise it's named
+// after its inode, so the name stays put as processes come and go)
+func List(includeProcesses bool) ([]Namespace, error) {
+	selfID, err := getNamespaceID(filepath.Join(procPath, "self", "ns", "net"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat our own network namespace: %s", err)
+	}
+
+	seen := map[namespaceID]struct{}{
+		selfID: {},
+	}
+
+	namespaces := make([]Namespace, 0)
+
+	entries, err := os.ReadDir(runNetnsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(runNetnsPath, entry.Name())
+
+		id, err := getNamespaceID(path)
+		if err != nil {
+			log.Printf("warning: failed to stat %s: %s", path, err)
+			continue
+		}
+
+		_, ok := seen[id]
+		if ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		namespaces = append(namespaces, Namespace{
+			Name:  entry.Name(),
+			Path:  path,
+			Inode: id.ino,
+		})
+	}
+
+	if !includeProcesses {
+		return namespaces, nil
+	}
+
+	pids, err := getPIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pid := range pids {
+		path := filepath.Join(procPath, strconv.Itoa(pid), "ns", "net")
+
+		// processes come and go (and we may not be allowed to look at some of them), so this is best effort
+		id, err := getNamespaceID(path)
+		if err != nil {
+			continue
+		}
+
+		_, ok := seen[id]
+		if ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		comm, _ := os.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "comm"))
+
+		namespaces = append(namespaces, Namespace{
+			Name:  fmt.Sprintf("%s%d", inodePrefix, id.ino),
+			Path:  path,
+			Inode: id.ino,
+			PID:   pid,
+			Comm:  strings.TrimSpace(string(comm)),
+		})
+	}
+
+	return namespaces, nil
+}
+
+// Do runs fn with the calling goroutine locked to an OS thread that's been moved into the network namespace at the given
+// path (needs CAP_SYS_ADMIN); sockets opened by fn stay in that namespace even after Do returns, but anything fn starts
+// in other goroutines runs in our own namespace
+func Do(path string, fn func() error) error {
+	runtime.LockOSThread()
+
+	original, err := os.Open(filepath.Join(procPath, "thread-self", "ns", "net"))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() {
+		_ = original.Close()
+	}()
+
+	target, err := os.Open(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+
+	err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed unix.Setns for %s: %s", path, err)
+	}
+
+	defer func() {
+		err := unix.Setns(int(original.Fd()), unix.CLONE_NEWNET)
+		if err != nil {
+			// leaving the thread locked means the runtime throws it away (rather than reusing it in the wrong namespace)
+			// once this goroutine exits
+			log.Printf("warning: failed to return to our own network namespace from %s: %s", path, err)
+			return
+		}
+
+		runtime.UnlockOSThread()
+	}()
+
+	return fn()
+}
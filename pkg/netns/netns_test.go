@@ -0,0 +1,158 @@
+package netns
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetns(t *testing.T) {
+	t.Run("GetPath", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name     string
+			expected string
+		}{
+			{"some-pod", "/var/run/netns/some-pod"},
+			{"pid:1234", "/proc/1234/ns/net"},
+			{"/some/where/else", "/some/where/else"},
+		} {
+			path, err := GetPath(testCase.name)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, path)
+		}
+
+		// by inode, i.e. whichever process is in there (our own namespace is as good as any other)
+		selfID, err := getNamespaceID("/proc/self/ns/net")
+		require.NoError(t, err)
+
+		path, err := GetPath(fmt.Sprintf("inode:%d", selfID.ino))
+		require.NoError(t, err)
+
+		id, err := getNamespaceID(path)
+		require.NoError(t, err)
+		require.Equal(t, selfID, id)
+
+		_, err = GetPath("inode:1")
+		require.Error(t, err)
+
+		_, err = GetPath("inode:some-pod")
+		require.Error(t, err)
+	})
+
+	t.Run("ListAndDo", func(t *testing.T) {
+		namespaces, err := List(true)
+		require.NoError(t, err)
+
+		selfID, err := getNamespaceID("/proc/self/ns/net")
+		require.NoError(t, err)
+
+		for _, namespace := range namespaces {
+			log.Printf("%#+v", namespace)
+			require.NotEqual(t, selfID.ino, namespace.Inode)
+
+			// the ones processes are in are named after the inode, not whichever process we happened to find first
+			if namespace.PID != 0 {
+				require.Equal(t, fmt.Sprintf("inode:%d", namespace.Inode), namespace.Name)
+			}
+		}
+
+		// our own namespace is as good as any other for checking we come back out again
+		called := false
+		err = Do("/proc/self/ns/net", func() error {
+			called = true
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, called)
+
+		err = Do("/proc/self/ns/does-not-exist", func() error {
+			return nil
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("Processes", func(t *testing.T) {
+		cmd := exec.Command("unshare", "--net", "sleep", "10")
+		err := cmd.Start()
+		if err != nil {
+			t.Skipf("can't start a process in a network namespace (needs util-linux and CAP_SYS_ADMIN): %s", err)
+		}
+		defer func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}()
+
+		path := fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid)
+
+		// until unshare has got going and exec'd sleep
+		require.Eventually(t, func() bool {
+			comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", cmd.Process.Pid))
+			return string(comm) == "sleep\n"
+		}, time.Second*5, time.Millisecond*10)
+
+		id, err := getNamespaceID(path)
+		require.NoError(t, err)
+
+		namespaces, err := List(true)
+		require.NoError(t, err)
+
+		var found *Namespace
+		for i := range namespaces {
+			if namespaces[i].Inode == id.ino {
+				found = &namespaces[i]
+			}
+		}
+
+		require.NotNil(t, found)
+		require.Equal(t, fmt.Sprintf("inode:%d", id.ino), found.Name)
+		require.Equal(t, cmd.Process.Pid, found.PID)
+		require.Equal(t, "sleep", found.Comm)
+
+		foundPath, err := GetPath(found.Name)
+		require.NoError(t, err)
+		require.Equal(t, path, foundPath)
+	})
+
+	t.Run("Named", func(t *testing.T) {
+		name := "loser-test"
+
+		err := exec.Command("ip", "netns", "add", name).Run()
+		if err != nil {
+			t.Skipf("can't create a network namespace (needs iproute2 and CAP_SYS_ADMIN): %s", err)
+		}
+		defer func() {
+			_ = exec.Command("ip", "netns", "del", name).Run()
+		}()
+
+		namespaces, err := List(false)
+		require.NoError(t, err)
+
+		found := false
+		for _, namespace := range namespaces {
+			if namespace.Name == name {
+				found = true
+				require.Equal(t, filepath.Join(runNetnsPath, name), namespace.Path)
+			}
+		}
+		require.True(t, found)
+
+		var inside []byte
+		path, err := GetPath(name)
+		require.NoError(t, err)
+
+		err = Do(path, func() error {
+			var err error
+			inside, err = os.ReadFile("/proc/thread-self/net/dev")
+			return err
+		})
+		require.NoError(t, err)
+
+		// a fresh namespace only has a loopback interface
+		require.NotContains(t, string(inside), "eth0")
+	})
+}
@@ -0,0 +1,116 @@
+package network_interfaces
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/initialed85/loser/pkg/netlink"
+	"golang.org/x/sys/unix"
+)
+
+type Address struct {
+	Family    string `json:"family"`
+	IP        string `json:"ip"`
+	PrefixLen int    `json:"prefix_len"`
+	Scope     string `json:"scope"`
+	Label     string `json:"label,omitempty"`
+}
+
+func getFamilyName(family byte) string {
+	switch family {
+	case unix.AF_INET:
+		return "ipv4"
+	case unix.AF_INET6:
+		return "ipv6"
+	}
+
+	return fmt.Sprintf("%d", family)
+}
+
+func getScopeName(scope byte) string {
+	switch scope {
+	case unix.RT_SCOPE_UNIVERSE:
+		return "global"
+	case unix.RT_SCOPE_SITE:
+		return "site"
+	case unix.RT_SCOPE_LINK:
+		return "link"
+	case unix.RT_SCOPE_HOST:
+		return "host"
+	case unix.RT_SCOPE_NOWHERE:
+		return "nowhere"
+	}
+
+	return fmt.Sprintf("%d", scope)
+}
+
+// fillAddresses fills in the addresses for each interface (an empty list for the ones without any)
+func fillAddresses(networkInterfaces []NetworkInterface) {
+	addresses, err := GetAddresses()
+	if err != nil {
+		log.Printf("warning: failed GetAddresses: %s", err)
+		return
+	}
+
+	for i := range networkInterfaces {
+		networkInterfaces[i].Addresses = addresses[networkInterfaces[i].IFIndex]
+		if networkInterfaces[i].Addresses == nil {
+			networkInterfaces[i].Addresses = make([]Address, 0)
+		}
+	}
+}
+
+// GetAddresses dumps the IPv4 and IPv6 addresses (RTM_GETADDR), keyed by interface index
+func GetAddresses() (map[int][]Address, error) {
+	ifAddrmsg := make([]byte, unix.SizeofIfAddrmsg)
+	ifAddrmsg[0] = unix.AF_UNSPEC
+
+	messages, err := netlink.Request(unix.NETLINK_ROUTE, unix.RTM_GETADDR, unix.NLM_F_DUMP, ifAddrmsg)
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.Request for RTM_GETADDR: %s", err)
+	}
+
+	addresses := make(map[int][]Address)
+
+	for _, message := range messages {
+		if message.Type != unix.RTM_NEWADDR {
+			continue
+		}
+
+		ifIndex, address, err := parseAddressMessage(message.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses[ifIndex] = append(addresses[ifIndex], *address)
+	}
+
+	return addresses, nil
+}
+
+func parseAddressMessage(data []byte) (int, *Address, error) {
+	if len(data) < unix.SizeofIfAddrmsg {
+		return 0, nil, fmt.Errorf("truncated ifaddrmsg (%d bytes)", len(data))
+	}
+
+	attributes, err := netlink.ParseAttributeMap(data[unix.SizeofIfAddrmsg:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed netlink.ParseAttributeMap for RTM_NEWADDR: %s", err)
+	}
+
+	// IFA_LOCAL is the address on point-to-point links (where IFA_ADDRESS is the peer)
+	ip, ok := attributes[unix.IFA_LOCAL]
+	if !ok {
+		ip = attributes[unix.IFA_ADDRESS]
+	}
+
+	address := Address{
+		Family:    getFamilyName(data[0]),
+		IP:        net.IP(ip).String(),
+		PrefixLen: int(data[1]),
+		Scope:     getScopeName(data[3]),
+		Label:     netlink.String(attributes[unix.IFA_LABEL]),
+	}
+
+	return int(netlink.Uint32(data[4:8])), &address, nil
+}
@@ -0,0 +1,175 @@
+package network_interfaces
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// the details GetNetworkInterfaces can fill in on top of the interfaces themselves, each of which is a netlink dump, an
+// ioctl per interface or some more sysfs reads
+const (
+	DetailAddresses = "addresses" // RTM_GETADDR
+	DetailQdiscs    = "qdiscs"    // RTM_GETQDISC and RTM_GETTCLASS
+	DetailEthtool   = "ethtool"   // SIOCETHTOOL per interface
+	DetailWireless  = "wireless"  // /proc/net/wireless and nl80211 per wireless interface
+	DetailSpeed     = "speed"     // speed and duplex from sysfs for the netlink backend (the sysfs backend has them anyway)
+)
+
+var AllDetails = []string{DetailAddresses, DetailQdiscs, DetailEthtool, DetailWireless, DetailSpeed}
+
+// Details says which details GetNetworkInterfaces fills in and how often it looks them up again (in between, the ones
+// from last time are used, unless there's a new interface); the zero Interval is every time
+type Details struct {
+	Enabled  []string
+	Interval time.Duration
+}
+
+type detail struct {
+	// fill looks the detail up for the given interfaces; isOwnNetns is whether they're in our network namespace
+	fill func(networkInterfaces []NetworkInterface, isOwnNetns bool)
+
+	// copy puts the detail from a previous lookup on an interface
+	copy func(from NetworkInterface, to *NetworkInterface)
+
+	// ownNetnsOnly is for the ones that come from netlink / ioctls (i.e. our network namespace, not the sysfs's)
+	ownNetnsOnly bool
+}
+
+var detailsByName = map[string]detail{
+	DetailAddresses: {
+		fill: func(networkInterfaces []NetworkInterface, _ bool) {
+			fillAddresses(networkInterfaces)
+		},
+		copy: func(from NetworkInterface, to *NetworkInterface) {
+			to.Addresses = from.Addresses
+		},
+		ownNetnsOnly: true,
+	},
+	DetailQdiscs: {
+		fill: func(networkInterfaces []NetworkInterface, _ bool) {
+			fillQdiscs(networkInterfaces)
+		},
+		copy: func(from NetworkInterface, to *NetworkInterface) {
+			to.Qdiscs = from.Qdiscs
+		},
+		ownNetnsOnly: true,
+	},
+	DetailEthtool: {
+		fill: func(networkInterfaces []NetworkInterface, _ bool) {
+			fillEthtool(networkInterfaces)
+		},
+		copy: func(from NetworkInterface, to *NetworkInterface) {
+			to.Ethtool = from.Ethtool
+		},
+		ownNetnsOnly: true,
+	},
+	DetailWireless: {
+		fill: fillWireless,
+		copy: func(from NetworkInterface, to *NetworkInterface) {
+			to.Wireless = from.Wireless
+		},
+	},
+	DetailSpeed: {
+		fill: func(networkInterfaces []NetworkInterface, _ bool) {
+			for i := range networkInterfaces {
+				readSpeedAndDuplexFromSysfs(&networkInterfaces[i])
+			}
+		},
+		copy: func(from NetworkInterface, to *NetworkInterface) {
+			to.Speed = from.Speed
+			to.Duplex = from.Duplex
+		},
+		ownNetnsOnly: true,
+	},
+}
+
+// lastDetails is the interfaces as of the last time a detail was looked up (by name), and when that was
+type lastDetails struct {
+	timestamp         time.Time
+	networkInterfaces map[string]NetworkInterface
+}
+
+var detailsMu = new(sync.Mutex)
+var details = Details{Enabled: AllDetails}
+var lastDetailsByName = make(map[string]*lastDetails)
+
+// SetDetails checks the given details and then uses them for GetNetworkInterfaces from then on
+func SetDetails(newDetails Details) error {
+	for _, name := range newDetails.Enabled {
+		_, ok := detailsByName[name]
+		if !ok {
+			return fmt.Errorf("unknown interface detail %#+v; want some of %#+v", name, AllDetails)
+		}
+	}
+
+	detailsMu.Lock()
+	details = newDetails
+	lastDetailsByName = make(map[string]*lastDetails)
+	detailsMu.Unlock()
+
+	return nil
+}
+
+func isDetailEnabled(name string) bool {
+	detailsMu.Lock()
+	defer detailsMu.Unlock()
+
+	return slices.Contains(details.Enabled, name)
+}
+
+// fillDetails fills in the enabled details (all but speed and duplex, which fromNetlink says whether we need), looking
+// them up again if it's been long enough or there's an interface we haven't looked them up for yet
+func fillDetails(networkInterfaces []NetworkInterface, isOwnNetns bool, fromNetlink bool) {
+	detailsMu.Lock()
+	defer detailsMu.Unlock()
+
+	now := time.Now()
+
+	for _, name := range details.Enabled {
+		d := detailsByName[name]
+
+		if d.ownNetnsOnly && !isOwnNetns {
+			continue
+		}
+
+		if name == DetailSpeed && !fromNetlink {
+			continue
+		}
+
+		last := lastDetailsByName[name]
+
+		due := last == nil || now.Sub(last.timestamp) >= details.Interval
+		if !due {
+			for _, networkInterface := range networkInterfaces {
+				_, ok := last.networkInterfaces[networkInterface.Name]
+				if !ok {
+					due = true
+					break
+				}
+			}
+		}
+
+		if due {
+			d.fill(networkInterfaces, isOwnNetns)
+
+			last = &lastDetails{
+				timestamp:         now,
+				networkInterfaces: make(map[string]NetworkInterface),
+			}
+
+			for _, networkInterface := range networkInterfaces {
+				last.networkInterfaces[networkInterface.Name] = networkInterface
+			}
+
+			lastDetailsByName[name] = last
+
+			continue
+		}
+
+		for i := range networkInterfaces {
+			d.copy(last.networkInterfaces[networkInterfaces[i].Name], &networkInterfaces[i])
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package network_interfaces
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// from linux/ethtool.h (not in x/sys/unix)
+const (
+	ethSSStats       = 1
+	ethGStringLen    = 32
+	sizeofEthtoolCmd = 44
+)
+
+// DefaultEthtoolStatsAllowlist is the driver stats we keep by default; some drivers have thousands of them (e.g. a
+// handful per queue), so it's just the ones that look like drops and errors
+var DefaultEthtoolStatsAllowlist = []string{
+	"*drop*",
+	"*miss*",
+	"*err*",
+	"*no_buf*",
+	"*discard*",
+	"*fifo*",
+	"*crc*",
+	"*timeout*",
+}
+
+var ethtoolStatsAllowlistMu = new(sync.Mutex)
+var ethtoolStatsAllowlist = DefaultEthtoolStatsAllowlist
+
+// SetEthtoolStatsAllowlist sets the glob patterns (see path.Match) for the driver stats to keep ("*" for all of them,
+// nothing for none of them)
+func SetEthtoolStatsAllowlist(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("bad ethtool stats pattern %#+v: %s", pattern, err)
+		}
+	}
+
+	ethtoolStatsAllowlistMu.Lock()
+	ethtoolStatsAllowlist = patterns
+	ethtoolStatsAllowlistMu.Unlock()
+
+	return nil
+}
+
+func isEthtoolStatAllowed(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		ok, _ := path.Match(pattern, name)
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the legacy (32-bit) link mode bits from linux/ethtool.h, in bit order
+var linkModeNames = []string{
+	"10baseT/Half",
+	"10baseT/Full",
+	"100baseT/Half",
+	"100baseT/Full",
+	"1000baseT/Half",
+	"1000baseT/Full",
+	"Autoneg",
+	"TP",
+	"AUI",
+	"MII",
+	"FIBRE",
+	"BNC",
+	"10000baseT/Full",
+	"Pause",
+	"Asym_Pause",
+	"2500baseX/Full",
+	"Backplane",
+	"1000baseKX/Full",
+	"10000baseKX4/Full",
+	"10000baseKR/Full",
+	"10000baseR_FEC",
+	"20000baseMLD2/Full",
+	"20000baseKR2/Full",
+	"40000baseKR4/Full",
+	"40000baseCR4/Full",
+	"40000baseSR4/Full",
+	"40000baseLR4/Full",
+	"56000baseKR4/Full",
+	"56000baseCR4/Full",
+	"56000baseSR4/Full",
+	"56000baseLR4/Full",
+	"25000baseCR/Full",
+}
+
+var portNames = map[uint8]string{
+	0x00: "tp",
+	0x01: "aui",
+	0x02: "bnc",
+	0x03: "mii",
+	0x04: "fibre",
+	0x05: "da",
+	0xef: "none",
+	0xff: "other",
+}
+
+type RingParams struct {
+	RxPending    int64 `json:"rx_pending"`
+	RxMaxPending int64 `json:"rx_max_pending"`
+	TxPending    int64 `json:"tx_pending"`
+	TxMaxPending int64 `json:"tx_max_pending"`
+}
+
+type LinkModes struct {
+	Port                   string   `json:"port"`
+	Autoneg                bool     `json:"autoneg"`
+	Supported              []string `json:"supported"`
+	Advertising            []string `json:"advertising"`
+	LinkPartnerAdvertising []string `json:"link_partner_advertising"`
+}
+
+// Ethtool is what the driver tells us via the SIOCETHTOOL ioctl; each part is best effort (plenty of drivers don't do
+// ring parameters, virtual interfaces often don't have link modes)
+type Ethtool struct {
+	Driver    string           `json:"driver"`
+	Stats     map[string]int64 `json:"stats,omitempty"`
+	Ring      *RingParams      `json:"ring,omitempty"`
+	LinkModes *LinkModes       `json:"link_modes,omitempty"`
+}
+
+// ifreqData is struct ifreq with a pointer in the union (like the unexported one in x/sys/unix)
+type ifreqData struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+func ethtoolIoctl(fd int, name string, data unsafe.Pointer) error {
+	ifr := ifreqData{data: data}
+	copy(ifr.name[:unix.IFNAMSIZ-1], name)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// parseEthtoolStrings splits up the fixed width (ETH_GSTRING_LEN), NUL-padded strings from ETHTOOL_GSTRINGS
+func parseEthtoolStrings(data []byte, count int) []string {
+	names := make([]string, 0, count)
+
+	for i := 0; i < count && (i+1)*ethGStringLen <= len(data); i++ {
+		name, _, _ := strings.Cut(string(data[i*ethGStringLen:(i+1)*ethGStringLen]), "\x00")
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func getLinkModeNames(mask uint32) []string {
+	names := make([]string, 0)
+
+	for i, name := range linkModeNames {
+		if mask&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// parseEthtoolCmd parses the bits of struct ethtool_cmd (ETHTOOL_GSET) we care about
+func parseEthtoolCmd(data []byte) (*LinkModes, error) {
+	if len(data) < sizeofEthtoolCmd {
+		return nil, fmt.Errorf("truncated ethtool_cmd (%d bytes)", len(data))
+	}
+
+	port, ok := portNames[data[15]]
+	if !ok {
+		port = fmt.Sprintf("%d", data[15])
+	}
+
+	return &LinkModes{
+		Port:                   port,
+		Autoneg:                data[18] != 0,
+		Supported:              getLinkModeNames(binary.NativeEndian.Uint32(data[4:8])),
+		Advertising:            getLinkModeNames(binary.NativeEndian.Uint32(data[8:12])),
+		LinkPartnerAdvertising: getLinkModeNames(binary.NativeEndian.Uint32(data[32:36])),
+	}, nil
+}
+
+func getEthtoolStats(fd int, name string, count int, patterns []string) (map[string]int64, error) {
+	stats := make(map[string]int64)
+
+	if count == 0 || len(patterns) == 0 {
+		return stats, nil
+	}
+
+	// struct ethtool_gstrings: cmd, string_set, len (u32) and then the strings
+	gstrings := make([]byte, 12+count*ethGStringLen)
+	binary.NativeEndian.PutUint32(gstrings[0:4], unix.ETHTOOL_GSTRINGS)
+	binary.NativeEndian.PutUint32(gstrings[4:8], ethSSStats)
+	binary.NativeEndian.PutUint32(gstrings[8:12], uint32(count))
+
+	err := ethtoolIoctl(fd, name, unsafe.Pointer(&gstrings[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed ETHTOOL_GSTRINGS: %s", err)
+	}
+
+	names := parseEthtoolStrings(gstrings[12:], int(binary.NativeEndian.Uint32(gstrings[8:12])))
+
+	// struct ethtool_stats: cmd, n_stats (u32) and then the values (u64)
+	gstats := make([]byte, 8+count*8)
+	binary.NativeEndian.PutUint32(gstats[0:4], unix.ETHTOOL_GSTATS)
+	binary.NativeEndian.PutUint32(gstats[4:8], uint32(count))
+
+	err = ethtoolIoctl(fd, name, unsafe.Pointer(&gstats[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed ETHTOOL_GSTATS: %s", err)
+	}
+
+	for i, statName := range names {
+		if i >= int(binary.NativeEndian.Uint32(gstats[4:8])) {
+			break
+		}
+
+		if !isEthtoolStatAllowed(statName, patterns) {
+			continue
+		}
+
+		stats[statName] = int64(binary.NativeEndian.Uint64(gstats[8+i*8 : 16+i*8]))
+	}
+
+	return stats, nil
+}
+
+// GetEthtool gets the driver, the (allowed) driver stats, the ring parameters and the link modes for an interface; it
+// returns unix.EOPNOTSUPP if the interface doesn't do ethtool at all (e.g. lo)
+func GetEthtool(name string) (*Ethtool, error) {
+	ethtoolStatsAllowlistMu.Lock()
+	patterns := ethtoolStatsAllowlist
+	ethtoolStatsAllowlistMu.Unlock()
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed unix.Socket: %s", err)
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+
+	drvinfo, err := unix.IoctlGetEthtoolDrvinfo(fd, name)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, _, _ := strings.Cut(string(drvinfo.Driver[:]), "\x00")
+
+	ethtool := Ethtool{
+		Driver: driver,
+	}
+
+	stats, err := getEthtoolStats(fd, name, int(drvinfo.N_stats), patterns)
+	if err != nil {
+		log.Printf("warning: failed getEthtoolStats for %s: %s", name, err)
+	} else if len(stats) > 0 {
+		ethtool.Stats = stats
+	}
+
+	// struct ethtool_ringparam: cmd, rx_max_pending, rx_mini_max_pending, rx_jumbo_max_pending, tx_max_pending,
+	// rx_pending, rx_mini_pending, rx_jumbo_pending, tx_pending (u32)
+	ringparam := [9]uint32{unix.ETHTOOL_GRINGPARAM}
+	err = ethtoolIoctl(fd, name, unsafe.Pointer(&ringparam))
+	if err == nil {
+		ethtool.Ring = &RingParams{
+			RxPending:    int64(ringparam[5]),
+			RxMaxPending: int64(ringparam[1]),
+			TxPending:    int64(ringparam[8]),
+			TxMaxPending: int64(ringparam[4]),
+		}
+	}
+
+	cmd := make([]byte, sizeofEthtoolCmd)
+	binary.NativeEndian.PutUint32(cmd[0:4], unix.ETHTOOL_GSET)
+	err = ethtoolIoctl(fd, name, unsafe.Pointer(&cmd[0]))
+	if err == nil {
+		ethtool.LinkModes, _ = parseEthtoolCmd(cmd)
+	}
+
+	return &ethtool, nil
+}
+
+// fillEthtool fills in the ethtool details for each interface that has them
+func fillEthtool(networkInterfaces []NetworkInterface) {
+	for i := range networkInterfaces {
+		ethtool, err := GetEthtool(networkInterfaces[i].Name)
+		if err != nil {
+			if !errors.Is(err, unix.EOPNOTSUPP) && !errors.Is(err, unix.ENODEV) {
+				log.Printf("warning: failed GetEthtool for %s: %s", networkInterfaces[i].Name, err)
+			}
+
+			continue
+		}
+
+		networkInterfaces[i].Ethtool = ethtool
+	}
+}
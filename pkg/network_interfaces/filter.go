@@ -0,0 +1,201 @@
+package network_interfaces
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const arpHardwareLoopback = "772" // ARPHRD_LOOPBACK, as per /sys/class/net/*/type
+
+// Filter decides which interfaces GetNetworkInterfaces returns (and so which ones get metrics); the zero value lets
+// everything through
+type Filter struct {
+	// Include and Exclude are globs (see path.Match, so a plain name works too); if there are any includes (globs or
+	// regexps) an interface has to match one of them, and anything matching an exclude is dropped
+	Include        []string
+	Exclude        []string
+	IncludeRegexps []string
+	ExcludeRegexps []string
+
+	// PhysicalOnly skips the virtual interfaces (anything without a /sys/class/net/*/device, or a parent device as per
+	// rtnetlink for another network namespace, e.g. veths, bridges, bonds, tunnels, lo)
+	PhysicalOnly bool
+	SkipLoopback bool
+
+	includeRegexps []*regexp.Regexp
+	excludeRegexps []*regexp.Regexp
+}
+
+var filterMu = new(sync.Mutex)
+var filter = Filter{}
+
+// SetFilter checks (and compiles) the given filter and then uses it for GetNetworkInterfaces from then on
+func SetFilter(newFilter Filter) error {
+	for _, pattern := range append(append([]string{}, newFilter.Include...), newFilter.Exclude...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("bad interface pattern %#+v: %s", pattern, err)
+		}
+	}
+
+	newFilter.includeRegexps = make([]*regexp.Regexp, 0)
+	for _, expr := range newFilter.IncludeRegexps {
+		includeRegexp, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("bad interface regexp %#+v: %s", expr, err)
+		}
+
+		newFilter.includeRegexps = append(newFilter.includeRegexps, includeRegexp)
+	}
+
+	newFilter.excludeRegexps = make([]*regexp.Regexp, 0)
+	for _, expr := range newFilter.ExcludeRegexps {
+		excludeRegexp, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("bad interface regexp %#+v: %s", expr, err)
+		}
+
+		newFilter.excludeRegexps = append(newFilter.excludeRegexps, excludeRegexp)
+	}
+
+	filterMu.Lock()
+	filter = newFilter
+	filterMu.Unlock()
+
+	return nil
+}
+
+func getFilter() Filter {
+	filterMu.Lock()
+	defer filterMu.Unlock()
+
+	return filter
+}
+
+func matchesAnyGlob(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		ok, _ := path.Match(pattern, name)
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAnyRegexp(name string, regexps []*regexp.Regexp) bool {
+	for _, r := range regexps {
+		if r.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPhysical is whether there's a device behind the interface (i.e. /sys/class/net/<name>/device exists)
+func isPhysical(sys fs.FS, name string) bool {
+	_, err := fs.Stat(sys, path.Join("class/net", name, "device"))
+	return err == nil
+}
+
+// isLoopback goes by the ARPHRD type in sysfs, falling back to the name if we can't read it
+func isLoopback(sys fs.FS, name string) bool {
+	data, err := readSysClassNet(sys, name, "type")
+	if err != nil {
+		return name == "lo"
+	}
+
+	return strings.TrimSpace(string(data)) == arpHardwareLoopback
+}
+
+// isPhysicalFromNetlink is whether there's a device behind the interface as per rtnetlink, for when we can't see its
+// sysfs; kernels before 5.14 don't say (IFLA_PARENT_DEV_NAME), so there it's anything that isn't of some kind (veth,
+// bridge, vlan etc) or a loopback
+func isPhysicalFromNetlink(networkInterface NetworkInterface) bool {
+	if networkInterface.parentDevName != "" {
+		return true
+	}
+
+	return networkInterface.Kind == "" && !isLoopbackFromNetlink(networkInterface)
+}
+
+// isLoopbackFromNetlink goes by the ARPHRD type and flags from rtnetlink, for when we can't see its sysfs
+func isLoopbackFromNetlink(networkInterface NetworkInterface) bool {
+	return networkInterface.linkType == unix.ARPHRD_LOOPBACK || networkInterface.linkFlags&unix.IFF_LOOPBACK != 0
+}
+
+// Match is whether the interface makes it through the filter; the type based filters look in the given sysfs
+func (f *Filter) Match(sys fs.FS, name string) bool {
+	return f.match(
+		name,
+		func() bool { return isPhysical(sys, name) },
+		func() bool { return isLoopback(sys, name) },
+	)
+}
+
+// match is Match with the type checks handed in (they're only called if the filter needs them)
+func (f *Filter) match(name string, isPhysical func() bool, isLoopback func() bool) bool {
+	if len(f.Include) > 0 || len(f.includeRegexps) > 0 {
+		if !matchesAnyGlob(name, f.Include) && !matchesAnyRegexp(name, f.includeRegexps) {
+			return false
+		}
+	}
+
+	if matchesAnyGlob(name, f.Exclude) || matchesAnyRegexp(name, f.excludeRegexps) {
+		return false
+	}
+
+	if f.PhysicalOnly && !isPhysical() {
+		return false
+	}
+
+	if f.SkipLoopback && isLoopback() {
+		return false
+	}
+
+	return true
+}
+
+// applyFilter drops the interfaces that don't make it through the filter
+func applyFilter(f Filter, networkInterfaces []NetworkInterface) []NetworkInterface {
+	sys, _ := getFS()
+
+	filteredNetworkInterfaces := make([]NetworkInterface, 0, len(networkInterfaces))
+
+	for _, networkInterface := range networkInterfaces {
+		if !f.Match(sys, networkInterface.Name) {
+			continue
+		}
+
+		filteredNetworkInterfaces = append(filteredNetworkInterfaces, networkInterface)
+	}
+
+	return filteredNetworkInterfaces
+}
+
+// applyFilterFromNetlink is applyFilter for interfaces from the netlink backend in another network namespace, going by
+// what rtnetlink says about their types rather than our sysfs
+func applyFilterFromNetlink(f Filter, networkInterfaces []NetworkInterface) []NetworkInterface {
+	filteredNetworkInterfaces := make([]NetworkInterface, 0, len(networkInterfaces))
+
+	for _, networkInterface := range networkInterfaces {
+		if !f.match(
+			networkInterface.Name,
+			func() bool { return isPhysicalFromNetlink(networkInterface) },
+			func() bool { return isLoopbackFromNetlink(networkInterface) },
+		) {
+			continue
+		}
+
+		filteredNetworkInterfaces = append(filteredNetworkInterfaces, networkInterface)
+	}
+
+	return filteredNetworkInterfaces
+}
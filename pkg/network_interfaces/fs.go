@@ -0,0 +1,127 @@
+package network_interfaces
+
+import (
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var fsMu = new(sync.Mutex)
+var sysFS fs.FS = os.DirFS("/sys")
+var procFS fs.FS = os.DirFS("/proc")
+
+// nil until checked (see isSysOwnNetns)
+var sysIsOwnNetns *bool
+
+// SetFS sets where the sysfs and procfs files are read from, e.g. os.DirFS("/host/sys") for a host's /sys that's bind
+// mounted into a container, or a fixture tree for a test; a nil leaves that one as it was
+func SetFS(sys fs.FS, proc fs.FS) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+
+	if sys != nil {
+		sysFS = sys
+		sysIsOwnNetns = nil
+	}
+
+	if proc != nil {
+		procFS = proc
+	}
+}
+
+func getFS() (fs.FS, fs.FS) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+
+	return sysFS, procFS
+}
+
+// readSysClassNet reads a file from under class/net (e.g. readSysClassNet(sys, "eth0", "speed"))
+func readSysClassNet(sys fs.FS, elem ...string) ([]byte, error) {
+	return fs.ReadFile(sys, path.Join(append([]string{"class/net"}, elem...)...))
+}
+
+// getSysfsIFIndexes is the ifindex of each interface in the sysfs, by name
+func getSysfsIFIndexes(sys fs.FS) (map[string]int, error) {
+	dirEntries, err := fs.ReadDir(sys, "class/net")
+	if err != nil {
+		return nil, err
+	}
+
+	ifIndexes := make(map[string]int)
+
+	for _, dirEntry := range dirEntries {
+		data, err := readSysClassNet(sys, dirEntry.Name(), "ifindex")
+		if err != nil {
+			continue
+		}
+
+		ifIndex, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			continue
+		}
+
+		ifIndexes[dirEntry.Name()] = ifIndex
+	}
+
+	return ifIndexes, nil
+}
+
+// getNetlinkIFIndexes is the ifindex of each interface in our network namespace, by name
+func getNetlinkIFIndexes() (map[string]int, error) {
+	networkInterfaces, err := getNetworkInterfacesFromNetlink(false)
+	if err != nil {
+		return nil, err
+	}
+
+	ifIndexes := make(map[string]int)
+	for _, networkInterface := range networkInterfaces {
+		ifIndexes[networkInterface.Name] = networkInterface.IFIndex
+	}
+
+	return ifIndexes, nil
+}
+
+// isSysOwnNetns is whether the sysfs shows our own network namespace (it doesn't if it's e.g. a host's /sys bind mounted
+// into a container with a network namespace of its own), worked out once per SetFS by comparing its interfaces with an
+// RTM_GETLINK dump; the netlink / ioctl details (addresses, qdiscs, ethtool stats etc) are looked up by ifindex or name
+// in our namespace, so they're only any good for the interfaces if it does
+func isSysOwnNetns() bool {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+
+	if sysIsOwnNetns != nil {
+		return *sysIsOwnNetns
+	}
+
+	isOwn := false
+
+	// twice, in case an interface came or went in between
+	for attempt := 0; attempt < 2 && !isOwn; attempt++ {
+		sysIFIndexes, err := getSysfsIFIndexes(sysFS)
+		if err != nil {
+			log.Printf("warning: failed getSysfsIFIndexes (assuming the sysfs isn't for our network namespace): %s", err)
+			break
+		}
+
+		netlinkIFIndexes, err := getNetlinkIFIndexes()
+		if err != nil {
+			log.Printf("warning: failed getNetlinkIFIndexes (assuming the sysfs isn't for our network namespace): %s", err)
+			break
+		}
+
+		isOwn = maps.Equal(sysIFIndexes, netlinkIFIndexes)
+	}
+
+	if !isOwn {
+		log.Printf("warning: the sysfs isn't for our network namespace, so only going by what's in it (no netlink backend, addresses, qdiscs, ethtool stats or wireless stations)")
+	}
+
+	sysIsOwnNetns = &isOwn
+
+	return isOwn
+}
@@ -0,0 +1,117 @@
+package network_interfaces
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/initialed85/loser/pkg/netlink"
+	"golang.org/x/sys/unix"
+)
+
+type Neighbour struct {
+	Family    string `json:"family"`
+	IP        string `json:"ip"`
+	MAC       string `json:"mac,omitempty"`
+	Interface string `json:"interface"`
+	State     string `json:"state"`
+	Router    bool   `json:"router"`
+}
+
+var neighbourStates = []struct {
+	state uint16
+	name  string
+}{
+	{unix.NUD_INCOMPLETE, "INCOMPLETE"},
+	{unix.NUD_REACHABLE, "REACHABLE"},
+	{unix.NUD_STALE, "STALE"},
+	{unix.NUD_DELAY, "DELAY"},
+	{unix.NUD_PROBE, "PROBE"},
+	{unix.NUD_FAILED, "FAILED"},
+	{unix.NUD_NOARP, "NOARP"},
+	{unix.NUD_PERMANENT, "PERMANENT"},
+}
+
+func getNeighbourStateName(state uint16) string {
+	if state == unix.NUD_NONE {
+		return "NONE"
+	}
+
+	names := make([]string, 0)
+	for _, neighbourState := range neighbourStates {
+		if state&neighbourState.state != 0 {
+			names = append(names, neighbourState.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// GetNeighbours dumps the ARP (IPv4) and NDP (IPv6) neighbour tables (RTM_GETNEIGH)
+func GetNeighbours() ([]Neighbour, error) {
+	ndMsg := make([]byte, unix.SizeofNdMsg)
+	ndMsg[0] = unix.AF_UNSPEC
+
+	messages, err := netlink.Request(unix.NETLINK_ROUTE, unix.RTM_GETNEIGH, unix.NLM_F_DUMP, ndMsg)
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.Request for RTM_GETNEIGH: %s", err)
+	}
+
+	interfaceNames := getInterfaceNames()
+
+	neighbours := make([]Neighbour, 0)
+
+	for _, message := range messages {
+		if message.Type != unix.RTM_NEWNEIGH {
+			continue
+		}
+
+		neighbour, err := parseNeighbourMessage(message.Data, interfaceNames)
+		if err != nil {
+			return nil, err
+		}
+
+		if neighbour == nil {
+			continue
+		}
+
+		neighbours = append(neighbours, *neighbour)
+	}
+
+	return neighbours, nil
+}
+
+func parseNeighbourMessage(data []byte, interfaceNames map[int]string) (*Neighbour, error) {
+	if len(data) < unix.SizeofNdMsg {
+		return nil, fmt.Errorf("truncated ndmsg (%d bytes)", len(data))
+	}
+
+	family := data[0]
+
+	// bridge fdb entries come through here too (AF_BRIDGE), but they're not what we're after
+	if family != unix.AF_INET && family != unix.AF_INET6 {
+		return nil, nil
+	}
+
+	attributes, err := netlink.ParseAttributeMap(data[unix.SizeofNdMsg:])
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.ParseAttributeMap for RTM_NEWNEIGH: %s", err)
+	}
+
+	state := netlink.Uint16(data[8:10])
+
+	neighbour := Neighbour{
+		Family:    getFamilyName(family),
+		IP:        net.IP(attributes[unix.NDA_DST]).String(),
+		Interface: getInterfaceName(interfaceNames, int(int32(netlink.Uint32(data[4:8])))),
+		State:     getNeighbourStateName(state),
+		Router:    data[10]&unix.NTF_ROUTER != 0,
+	}
+
+	lladdr, ok := attributes[unix.NDA_LLADDR]
+	if ok {
+		neighbour.MAC = net.HardwareAddr(lladdr).String()
+	}
+
+	return &neighbour, nil
+}
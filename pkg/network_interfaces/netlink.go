@@ -0,0 +1,197 @@
+package network_interfaces
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/initialed85/loser/pkg/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// GetNetworkInterfacesFromNetlink gets everything in one RTM_GETLINK dump (with the counters coming from IFLA_STATS64, so
+// they're consistent with each other); speed and duplex aren't part of rtnetlink so those still come from sysfs
+func GetNetworkInterfacesFromNetlink() ([]NetworkInterface, error) {
+	return getNetworkInterfacesFromNetlink(true)
+}
+
+// getNetworkInterfacesFromNetlink can leave out the sysfs bits, because sysfs shows the network namespace it was mounted
+// in (rather than the one we're in)
+func getNetworkInterfacesFromNetlink(withSysfs bool) ([]NetworkInterface, error) {
+	now := time.Now()
+
+	ifInfomsg := make([]byte, unix.SizeofIfInfomsg)
+	ifInfomsg[0] = unix.AF_UNSPEC
+
+	messages, err := netlink.Request(unix.NETLINK_ROUTE, unix.RTM_GETLINK, unix.NLM_F_DUMP, ifInfomsg)
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.Request for RTM_GETLINK: %s", err)
+	}
+
+	networkInterfaces := make([]NetworkInterface, 0)
+
+	for _, message := range messages {
+		if message.Type != unix.RTM_NEWLINK {
+			continue
+		}
+
+		networkInterface, err := parseLinkMessage(message.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		networkInterface.Timestamp = now
+
+		if withSysfs {
+			readSpeedAndDuplexFromSysfs(networkInterface)
+		}
+
+		networkInterfaces = append(networkInterfaces, *networkInterface)
+	}
+
+	names := make(map[int]string)
+	for _, networkInterface := range networkInterfaces {
+		names[networkInterface.IFIndex] = networkInterface.Name
+	}
+
+	for i := range networkInterfaces {
+		if networkInterfaces[i].masterIFIndex != 0 {
+			networkInterfaces[i].Master = names[networkInterfaces[i].masterIFIndex]
+		}
+
+		// IFLA_LINK is the lower device for a VLAN (it means other things for other kinds, e.g. the peer of a veth)
+		if networkInterfaces[i].Kind == "vlan" && networkInterfaces[i].linkIFIndex != 0 {
+			networkInterfaces[i].VLANParent = names[networkInterfaces[i].linkIFIndex]
+		}
+	}
+
+	return networkInterfaces, nil
+}
+
+func parseLinkMessage(data []byte) (*NetworkInterface, error) {
+	if len(data) < unix.SizeofIfInfomsg {
+		return nil, fmt.Errorf("truncated ifinfomsg (%d bytes)", len(data))
+	}
+
+	attributes, err := netlink.ParseAttributeMap(data[unix.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.ParseAttributeMap for RTM_NEWLINK: %s", err)
+	}
+
+	networkInterface := NetworkInterface{
+		Name:             netlink.String(attributes[unix.IFLA_IFNAME]),
+		IFIndex:          int(int32(netlink.Uint32(data[4:8]))),
+		MTU:              int(netlink.Uint32(attributes[unix.IFLA_MTU])),
+		Speed:            SpeedUnknown,
+		Duplex:           DuplexUnknown,
+		OperState:        "unknown",
+		Carrier:          CarrierUnknown,
+		CarrierChanges:   int64(netlink.Uint32(attributes[unix.IFLA_CARRIER_CHANGES])),
+		CarrierUpCount:   int64(netlink.Uint32(attributes[unix.IFLA_CARRIER_UP_COUNT])),
+		CarrierDownCount: int64(netlink.Uint32(attributes[unix.IFLA_CARRIER_DOWN_COUNT])),
+	}
+
+	networkInterface.masterIFIndex = int(netlink.Uint32(attributes[unix.IFLA_MASTER]))
+	networkInterface.linkIFIndex = int(netlink.Uint32(attributes[unix.IFLA_LINK]))
+	networkInterface.linkType = netlink.Uint16(data[2:4])
+	networkInterface.linkFlags = netlink.Uint32(data[8:12])
+	networkInterface.parentDevName = netlink.String(attributes[unix.IFLA_PARENT_DEV_NAME])
+
+	linkInfo, ok := attributes[unix.IFLA_LINKINFO]
+	if ok {
+		linkInfoAttributes, err := netlink.ParseAttributeMap(linkInfo)
+		if err != nil {
+			return nil, fmt.Errorf("failed netlink.ParseAttributeMap for IFLA_LINKINFO: %s", err)
+		}
+
+		networkInterface.Kind = netlink.String(linkInfoAttributes[unix.IFLA_INFO_KIND])
+
+		if networkInterface.Kind == "vlan" {
+			vlanAttributes, err := netlink.ParseAttributeMap(linkInfoAttributes[unix.IFLA_INFO_DATA])
+			if err != nil {
+				return nil, fmt.Errorf("failed netlink.ParseAttributeMap for IFLA_INFO_DATA: %s", err)
+			}
+
+			networkInterface.VLANID = int(netlink.Uint16(vlanAttributes[unix.IFLA_VLAN_ID]))
+		}
+	}
+
+	address, ok := attributes[unix.IFLA_ADDRESS]
+	if ok {
+		networkInterface.MAC = net.HardwareAddr(address).String()
+	}
+
+	operState, ok := attributes[unix.IFLA_OPERSTATE]
+	if ok && len(operState) > 0 {
+		for name, value := range operStates {
+			if int(operState[0]) == value {
+				networkInterface.OperState = name
+				break
+			}
+		}
+	}
+
+	// the kernel doesn't report carrier for interfaces that are admin down (sysfs gives "invalid argument" too)
+	carrier, ok := attributes[unix.IFLA_CARRIER]
+	if ok && len(carrier) > 0 && data[8]&unix.IFF_UP != 0 {
+		networkInterface.Carrier = int(carrier[0])
+	}
+
+	// struct rtnl_link_stats64 is a list of __u64 in this order
+	stats64 := attributes[unix.IFLA_STATS64]
+	stats := make([]int64, 24)
+	for i := range stats {
+		if len(stats64) >= (i+1)*8 {
+			stats[i] = int64(netlink.Uint64(stats64[i*8:]))
+		}
+	}
+
+	networkInterface.RxPackets = stats[0]
+	networkInterface.TxPackets = stats[1]
+	networkInterface.RxBytes = stats[2]
+	networkInterface.TxBytes = stats[3]
+	networkInterface.RxErrors = stats[4]
+	networkInterface.TxErrors = stats[5]
+	networkInterface.RxDropped = stats[6]
+	networkInterface.TxDropped = stats[7]
+	networkInterface.Multicast = stats[8]
+	networkInterface.Collisions = stats[9]
+	networkInterface.RxLengthErrors = stats[10]
+	networkInterface.RxOverErrors = stats[11]
+	networkInterface.RxCrcErrors = stats[12]
+	networkInterface.RxFrameErrors = stats[13]
+	networkInterface.RxFifoErrors = stats[14]
+	networkInterface.RxMissedErrors = stats[15]
+	networkInterface.TxAbortedErrors = stats[16]
+	networkInterface.TxCarrierErrors = stats[17]
+	networkInterface.TxFifoErrors = stats[18]
+	networkInterface.TxHeartbeatErrors = stats[19]
+	networkInterface.TxWindowErrors = stats[20]
+	networkInterface.RxCompressed = stats[21]
+	networkInterface.TxCompressed = stats[22]
+	networkInterface.RxNohandler = stats[23]
+
+	return &networkInterface, nil
+}
+
+func readSpeedAndDuplexFromSysfs(networkInterface *NetworkInterface) {
+	sys, _ := getFS()
+
+	speedRaw, err := readSysClassNet(sys, networkInterface.Name, "speed")
+	if err == nil {
+		speed, err := strconv.ParseInt(strings.TrimSpace(string(speedRaw)), 10, 64)
+		if err == nil && speed >= 0 && speed != 0xFFFFFFFF {
+			networkInterface.Speed = int(speed)
+		}
+	}
+
+	duplexRaw, err := readSysClassNet(sys, networkInterface.Name, "duplex")
+	if err == nil {
+		duplex := strings.TrimSpace(string(duplexRaw))
+		if duplex == "full" || duplex == "half" {
+			networkInterface.Duplex = duplex
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package network_interfaces
+
+import (
+	"github.com/initialed85/loser/pkg/netns"
+)
+
+// GetNetworkInterfacesInNetns gets the interfaces (and their addresses) inside the network namespace at the given path
+// (see netns.List / netns.GetPath), through the same filter as GetNetworkInterfaces; it's always rtnetlink, so speed and
+// duplex are unknown (and the type based filters go by what rtnetlink says)
+func GetNetworkInterfacesInNetns(path string) ([]NetworkInterface, error) {
+	var networkInterfaces []NetworkInterface
+
+	err := netns.Do(path, func() error {
+		var err error
+
+		networkInterfaces, err = getNetworkInterfacesFromNetlink(false)
+		if err != nil {
+			return err
+		}
+
+		networkInterfaces = applyFilterFromNetlink(getFilter(), networkInterfaces)
+
+		// no bonding or wireless details though (/proc/net is the namespace of our main thread, not this one), and the
+		// other details are looked up every time (as the namespaces come and go)
+		fillSlaves(networkInterfaces)
+
+		if isDetailEnabled(DetailQdiscs) {
+			fillQdiscs(networkInterfaces)
+		}
+
+		if isDetailEnabled(DetailEthtool) {
+			fillEthtool(networkInterfaces)
+		}
+
+		if isDetailEnabled(DetailAddresses) {
+			fillAddresses(networkInterfaces)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return networkInterfaces, nil
+}
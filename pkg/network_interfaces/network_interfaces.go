@@ -2,11 +2,13 @@ package network_interfaces
 
 import (
 	"fmt"
+	"io/fs"
 	_log "log"
 	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,6 +30,12 @@ type NetworkInterface struct {
 	IFIndex           int       `json:"if_index"`
 	MTU               int       `json:"mtu"`
 	Speed             int       `json:"speed"`
+	Duplex            string    `json:"duplex"`
+	OperState         string    `json:"oper_state"`
+	Carrier           int       `json:"carrier"`
+	CarrierChanges    int64     `json:"carrier_changes"`
+	CarrierUpCount    int64     `json:"carrier_up_count"`
+	CarrierDownCount  int64     `json:"carrier_down_count"`
 	Collisions        int64     `json:"collisions"`
 	Multicast         int64     `json:"multicast"`
 	RxBytes           int64     `json:"rx_bytes"`
@@ -52,20 +60,153 @@ type NetworkInterface struct {
 	TxHeartbeatErrors int64     `json:"tx_heartbeat_errors"`
 	TxPackets         int64     `json:"tx_packets"`
 	TxWindowErrors    int64     `json:"tx_window_errors"`
+	Addresses         []Address `json:"addresses"`
+	Kind              string    `json:"kind,omitempty"`
+	Master            string    `json:"master,omitempty"`
+	Slaves            []string  `json:"slaves,omitempty"`
+	VLANParent        string    `json:"vlan_parent,omitempty"`
+	VLANID            int       `json:"vlan_id,omitempty"`
+	Bond              *Bond     `json:"bond,omitempty"`
+	Wireless          *Wireless `json:"wireless,omitempty"`
+	Qdiscs            []Qdisc   `json:"qdiscs,omitempty"`
+	Ethtool           *Ethtool  `json:"ethtool,omitempty"`
+	Rates             *Rates    `json:"rates,omitempty"`
+
+	// only used by the netlink backend while working out the names for Master and VLANParent
+	masterIFIndex int
+	linkIFIndex   int
+
+	// only set by the netlink backend, for filtering the interfaces in another network namespace (whose sysfs we can't
+	// see) by type: the ARPHRD type and IFF flags from the ifinfomsg and the device behind it (IFLA_PARENT_DEV_NAME)
+	linkType      uint16
+	linkFlags     uint32
+	parentDevName string
 }
 
+const (
+	SpeedUnknown   = -1
+	CarrierUnknown = -1
+	DuplexUnknown  = "unknown"
+)
+
 var relevantSysClassNetItems = []string{
 	"address",
 	"ifindex",
 	"mtu",
-	// TODO: speed not reliable on all drivers it seems
-	// "speed",
 }
 
+// these are unreadable (e.g. "invalid argument") for some drivers or while the interface is down, so we treat that as
+// "unknown" rather than a failure
+var optionalSysClassNetItems = []string{
+	"speed",
+	"duplex",
+	"operstate",
+	"carrier",
+	"carrier_changes",
+	"carrier_up_count",
+	"carrier_down_count",
+}
+
+// operStates maps the operstate strings to their RFC 2863 values (as used by IF_OPER_* in the kernel)
+var operStates = map[string]int{
+	"unknown":        0,
+	"notpresent":     1,
+	"down":           2,
+	"lowerlayerdown": 3,
+	"testing":        4,
+	"dormant":        5,
+	"up":             6,
+}
+
+func GetOperStateValue(operState string) int {
+	return operStates[operState]
+}
+
+func GetDuplexValue(duplex string) int {
+	switch duplex {
+	case "full":
+		return 1
+	case "half":
+		return 0
+	}
+
+	return -1
+}
+
+const (
+	BackendSysfs   = "sysfs"
+	BackendNetlink = "netlink"
+)
+
+var backendMu = new(sync.Mutex)
+var backend = BackendSysfs
+
+func SetBackend(name string) error {
+	if name != BackendSysfs && name != BackendNetlink {
+		return fmt.Errorf("unknown network interfaces backend %#+v; want %#+v or %#+v", name, BackendSysfs, BackendNetlink)
+	}
+
+	backendMu.Lock()
+	backend = name
+	backendMu.Unlock()
+
+	return nil
+}
+
+// GetNetworkInterfaces uses whichever backend was chosen with SetBackend (netlink falls back to sysfs if it fails),
+// drops anything that doesn't make it through the filter (see SetFilter) and then fills in the addresses etc for each
+// interface (as per SetDetails); if the sysfs isn't for our network namespace (see isSysOwnNetns) it's only ever sysfs,
+// with no addresses etc
 func GetNetworkInterfaces() ([]NetworkInterface, error) {
-	sysClassNetDirEntries, err := os.ReadDir("/sys/class/net")
+	backendMu.Lock()
+	thisBackend := backend
+	backendMu.Unlock()
+
+	isOwnNetns := isSysOwnNetns()
+
+	var networkInterfaces []NetworkInterface
+	var err error
+
+	if thisBackend == BackendNetlink && isOwnNetns {
+		// speed and duplex are one of the details
+		networkInterfaces, err = getNetworkInterfacesFromNetlink(false)
+		if err != nil {
+			log.Printf("warning: failed GetNetworkInterfacesFromNetlink (falling back to sysfs): %s", err)
+		}
+	}
+
+	fromNetlink := networkInterfaces != nil
+
+	if networkInterfaces == nil {
+		networkInterfaces, err = GetNetworkInterfacesFromSysfs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// before filtering, so a bridge still shows all of its ports
+	fillTopology(networkInterfaces)
+
+	networkInterfaces = applyFilter(getFilter(), networkInterfaces)
+
+	fillDetails(networkInterfaces, isOwnNetns, fromNetlink)
+
+	return networkInterfaces, nil
+}
+
+func GetNetworkInterfacesFromSysfs() ([]NetworkInterface, error) {
+	sys, proc := getFS()
+
+	sysClassNetDirEntries, err := fs.ReadDir(sys, "class/net")
 	if err != nil {
-		return nil, fmt.Errorf("failed os.ReadDir for sysClassNetDirEntries: %s", err)
+		return nil, fmt.Errorf("failed fs.ReadDir for sysClassNetDirEntries: %s", err)
+	}
+
+	// this only exists once the 8021q module is loaded
+	vlans := make(map[string]vlan)
+	vlanConfig, err := fs.ReadFile(proc, procNetVLANConfigPath)
+	if err == nil {
+		vlans = parseVLANConfig(vlanConfig)
 	}
 
 	networkInterfaces := make([]NetworkInterface, 0)
@@ -73,7 +214,7 @@ func GetNetworkInterfaces() ([]NetworkInterface, error) {
 	for _, sysClassNetDirEntry := range sysClassNetDirEntries {
 		now := time.Now()
 
-		statsDirEntries, err := os.ReadDir(filepath.Join("/sys/class/net", sysClassNetDirEntry.Name(), "statistics"))
+		statsDirEntries, err := fs.ReadDir(sys, path.Join("class/net", sysClassNetDirEntry.Name(), "statistics"))
 		if err != nil {
 			// TODO: not everything has stats apparently
 			// return nil, fmt.Errorf("failed os.ReadDir for statsDirEntries: %s", err)
@@ -86,18 +227,21 @@ func GetNetworkInterfaces() ([]NetworkInterface, error) {
 		items := make(map[string]string)
 
 		for _, relevantSysClassNetItem := range relevantSysClassNetItems {
-			// attempts to get speed for lo return an "invalid argument" error; so let's not do that
-			if relevantSysClassNetItem == "speed" && sysClassNetDirEntry.Name() == "lo" {
-				items[relevantSysClassNetItem] = "0"
-				continue
+			itemRaw, err := readSysClassNet(sys, sysClassNetDirEntry.Name(), relevantSysClassNetItem)
+			if err != nil {
+				return nil, fmt.Errorf("failed readSysClassNet for itemRaw: %s", err)
 			}
 
-			itemRaw, err := os.ReadFile(filepath.Join("/sys/class/net", sysClassNetDirEntry.Name(), relevantSysClassNetItem))
+			items[relevantSysClassNetItem] = strings.TrimSpace(string(itemRaw))
+		}
+
+		for _, optionalSysClassNetItem := range optionalSysClassNetItems {
+			itemRaw, err := readSysClassNet(sys, sysClassNetDirEntry.Name(), optionalSysClassNetItem)
 			if err != nil {
-				return nil, fmt.Errorf("failed os.ReadFile for itemRaw: %#+v: %s", itemRaw, err)
+				continue
 			}
 
-			items[relevantSysClassNetItem] = strings.TrimSpace(string(itemRaw))
+			items[optionalSysClassNetItem] = strings.TrimSpace(string(itemRaw))
 		}
 
 		ifIndex, err := strconv.ParseInt(items["ifindex"], 10, 64)
@@ -110,26 +254,55 @@ func GetNetworkInterfaces() ([]NetworkInterface, error) {
 			return nil, fmt.Errorf("failed strconv.ParseInt for mtu: %#+v: %s", items["mtu"], err)
 		}
 
-		// TODO: speed not reliable on all drivers it seems
-		// speed, err := strconv.ParseInt(items["speed"], 10, 64)
-		// if err != nil {
-		// 	return nil, fmt.Errorf("failed strconv.ParseInt for speed: %#+v: %s", items["speed"], err)
-		// }
+		// speed not reliable on all drivers (some give "invalid argument", some give -1, some give junk)
+		speed, err := strconv.ParseInt(items["speed"], 10, 64)
+		if err != nil || speed < 0 || speed == 0xFFFFFFFF {
+			speed = SpeedUnknown
+		}
+
+		duplex := items["duplex"]
+		if duplex != "full" && duplex != "half" {
+			duplex = DuplexUnknown
+		}
+
+		operState := items["operstate"]
+		if operState == "" {
+			operState = "unknown"
+		}
+
+		carrier, err := strconv.ParseInt(items["carrier"], 10, 64)
+		if err != nil {
+			carrier = CarrierUnknown
+		}
+
+		// these are missing on older kernels
+		carrierChanges, _ := strconv.ParseInt(items["carrier_changes"], 10, 64)
+		carrierUpCount, _ := strconv.ParseInt(items["carrier_up_count"], 10, 64)
+		carrierDownCount, _ := strconv.ParseInt(items["carrier_down_count"], 10, 64)
 
 		networkInterface := NetworkInterface{
-			Timestamp: now,
-			Name:      sysClassNetDirEntry.Name(),
-			MAC:       items["address"],
-			IFIndex:   int(ifIndex),
-			MTU:       int(mtu),
-			// TODO: speed not reliable on all drivers it seems
-			// Speed:     int(speed),
+			Timestamp:        now,
+			Name:             sysClassNetDirEntry.Name(),
+			MAC:              items["address"],
+			IFIndex:          int(ifIndex),
+			MTU:              int(mtu),
+			Speed:            int(speed),
+			Duplex:           duplex,
+			OperState:        operState,
+			Carrier:          int(carrier),
+			CarrierChanges:   carrierChanges,
+			CarrierUpCount:   carrierUpCount,
+			CarrierDownCount: carrierDownCount,
+			Kind:             getSysfsKind(sys, sysClassNetDirEntry.Name()),
+			Master:           getSysfsMaster(sys, sysClassNetDirEntry.Name()),
+			VLANParent:       vlans[sysClassNetDirEntry.Name()].parent,
+			VLANID:           vlans[sysClassNetDirEntry.Name()].id,
 		}
 
 		stats := make(map[string]int64)
 
 		for _, statsDirEntry := range statsDirEntries {
-			statRaw, err := os.ReadFile(filepath.Join("/sys/class/net", sysClassNetDirEntry.Name(), "statistics", statsDirEntry.Name()))
+			statRaw, err := readSysClassNet(sys, sysClassNetDirEntry.Name(), "statistics", statsDirEntry.Name())
 			if err != nil {
 				return nil, err
 			}
@@ -1,10 +1,22 @@
 package network_interfaces
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/netlink"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestGetNetworkInterfaces(t *testing.T) {
@@ -16,3 +28,804 @@ func TestGetNetworkInterfaces(t *testing.T) {
 	require.NoError(t, err)
 	log.Printf("networkInterfaces: %s", string(b))
 }
+
+func TestGetNetworkInterfacesFromSysfsFixtures(t *testing.T) {
+	useFixture := func(t *testing.T, name string) {
+		SetFS(os.DirFS(filepath.Join("testdata", name, "sys")), os.DirFS(filepath.Join("testdata", name, "proc")))
+		t.Cleanup(func() {
+			SetFS(os.DirFS("/sys"), os.DirFS("/proc"))
+		})
+	}
+
+	t.Run("Basic", func(t *testing.T) {
+		useFixture(t, "basic")
+
+		networkInterfaces, err := GetNetworkInterfacesFromSysfs()
+		require.NoError(t, err)
+
+		fillTopology(networkInterfaces)
+		fillWireless(networkInterfaces, false)
+
+		networkInterfacesByName := make(map[string]NetworkInterface)
+		for _, networkInterface := range networkInterfaces {
+			networkInterfacesByName[networkInterface.Name] = networkInterface
+		}
+
+		// sit0 has no statistics, so it's skipped
+		require.Len(t, networkInterfaces, 6)
+		require.NotContains(t, networkInterfacesByName, "sit0")
+
+		eth0 := networkInterfacesByName["eth0"]
+		require.Equal(t, "52:54:00:12:34:56", eth0.MAC)
+		require.Equal(t, 2, eth0.IFIndex)
+		require.Equal(t, 1500, eth0.MTU)
+		require.Equal(t, 1000, eth0.Speed)
+		require.Equal(t, "full", eth0.Duplex)
+		require.Equal(t, "up", eth0.OperState)
+		require.Equal(t, 1, eth0.Carrier)
+		require.Equal(t, int64(3), eth0.CarrierChanges)
+		require.Equal(t, int64(2), eth0.CarrierUpCount)
+		require.Equal(t, int64(1), eth0.CarrierDownCount)
+		require.Equal(t, int64(123456789), eth0.RxBytes)
+		require.Equal(t, int64(987654321), eth0.TxBytes)
+		require.Equal(t, int64(5), eth0.RxDropped)
+		require.Equal(t, int64(7), eth0.RxMissedErrors)
+		require.Equal(t, int64(12), eth0.Multicast)
+		require.Equal(t, int64(0), eth0.TxErrors) // missing files are zero
+		require.Empty(t, eth0.Kind)
+		require.Nil(t, eth0.Wireless)
+
+		// unreadable speed, empty duplex
+		lo := networkInterfacesByName["lo"]
+		require.Equal(t, SpeedUnknown, lo.Speed)
+		require.Equal(t, DuplexUnknown, lo.Duplex)
+		require.Equal(t, "unknown", lo.OperState)
+		require.Equal(t, int64(0), lo.CarrierChanges)
+
+		// junk speed, duplex, operstate and carrier; a bridge port
+		eth1 := networkInterfacesByName["eth1"]
+		require.Equal(t, 9000, eth1.MTU)
+		require.Equal(t, SpeedUnknown, eth1.Speed)
+		require.Equal(t, DuplexUnknown, eth1.Duplex)
+		require.Equal(t, "unknown", eth1.OperState)
+		require.Equal(t, CarrierUnknown, eth1.Carrier)
+		require.Equal(t, "br0", eth1.Master)
+
+		br0 := networkInterfacesByName["br0"]
+		require.Equal(t, "bridge", br0.Kind)
+		require.Equal(t, SpeedUnknown, br0.Speed)
+		require.Equal(t, []string{"eth1"}, br0.Slaves)
+
+		// SPEED_UNKNOWN as a u32
+		wlan0 := networkInterfacesByName["wlan0"]
+		require.Empty(t, wlan0.Kind) // a DEVTYPE, but not a kind as far as netlink is concerned
+		require.Equal(t, SpeedUnknown, wlan0.Speed)
+		require.Equal(t, "half", wlan0.Duplex)
+		require.NotNil(t, wlan0.Wireless)
+		require.Equal(t, float64(-56), wlan0.Wireless.SignalLevel)
+
+		vlan := networkInterfacesByName["eth0.100"]
+		require.Equal(t, "vlan", vlan.Kind)
+		require.Equal(t, "eth0", vlan.VLANParent)
+		require.Equal(t, 100, vlan.VLANID)
+	})
+
+	t.Run("IsSysOwnNetns", func(t *testing.T) {
+		require.True(t, isSysOwnNetns())
+
+		// someone else's interfaces, so none of the netlink / ioctl details
+		useFixture(t, "basic")
+		require.False(t, isSysOwnNetns())
+
+		networkInterfaces, err := GetNetworkInterfaces()
+		require.NoError(t, err)
+		require.NotEmpty(t, networkInterfaces)
+
+		for _, networkInterface := range networkInterfaces {
+			require.Nil(t, networkInterface.Addresses, networkInterface.Name)
+			require.Nil(t, networkInterface.Qdiscs, networkInterface.Name)
+		}
+	})
+
+	for _, name := range []string{"malformed-mtu", "malformed-stat", "missing-ifindex"} {
+		t.Run(name, func(t *testing.T) {
+			useFixture(t, name)
+
+			_, err := GetNetworkInterfacesFromSysfs()
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestGetNetworkInterfacesFromNetlink(t *testing.T) {
+	networkInterfacesFromNetlink, err := GetNetworkInterfacesFromNetlink()
+	require.NoError(t, err)
+	require.NotEmpty(t, networkInterfacesFromNetlink)
+
+	networkInterfacesFromSysfs, err := GetNetworkInterfacesFromSysfs()
+	require.NoError(t, err)
+
+	networkInterfacesFromSysfsByName := make(map[string]NetworkInterface)
+	for _, networkInterface := range networkInterfacesFromSysfs {
+		networkInterfacesFromSysfsByName[networkInterface.Name] = networkInterface
+	}
+
+	for _, networkInterface := range networkInterfacesFromNetlink {
+		networkInterfaceFromSysfs, ok := networkInterfacesFromSysfsByName[networkInterface.Name]
+		if !ok {
+			continue
+		}
+
+		require.Equal(t, networkInterfaceFromSysfs.IFIndex, networkInterface.IFIndex)
+		require.Equal(t, networkInterfaceFromSysfs.MAC, networkInterface.MAC)
+		require.Equal(t, networkInterfaceFromSysfs.MTU, networkInterface.MTU)
+		require.Equal(t, networkInterfaceFromSysfs.OperState, networkInterface.OperState)
+		require.Equal(t, networkInterfaceFromSysfs.Carrier, networkInterface.Carrier)
+		require.Equal(t, networkInterfaceFromSysfs.Speed, networkInterface.Speed)
+		require.Equal(t, networkInterfaceFromSysfs.Duplex, networkInterface.Duplex)
+
+		// sysfs only knows some of the kinds
+		expectedKind := networkInterface.Kind
+		_, isSysfsKind := sysfsKinds[expectedKind]
+		if !isSysfsKind {
+			expectedKind = ""
+		}
+
+		require.Equal(t, expectedKind, networkInterfaceFromSysfs.Kind, networkInterface.Name)
+		require.GreaterOrEqual(t, networkInterfaceFromSysfs.RxPackets, networkInterface.RxPackets)
+	}
+
+	require.NoError(t, SetBackend(BackendNetlink))
+	defer func() {
+		_ = SetBackend(BackendSysfs)
+	}()
+
+	networkInterfaces, err := GetNetworkInterfaces()
+	require.NoError(t, err)
+	require.Len(t, networkInterfaces, len(networkInterfacesFromNetlink))
+
+	require.Error(t, SetBackend("carrier-pigeon"))
+}
+
+func TestDetails(t *testing.T) {
+	t.Cleanup(func() {
+		delete(detailsByName, "test")
+		_ = SetDetails(Details{Enabled: AllDetails})
+	})
+
+	fills := 0
+	detailsByName["test"] = detail{
+		fill: func(networkInterfaces []NetworkInterface, _ bool) {
+			fills++
+			for i := range networkInterfaces {
+				networkInterfaces[i].Kind = fmt.Sprintf("test-%d", fills)
+			}
+		},
+		copy: func(from NetworkInterface, to *NetworkInterface) {
+			to.Kind = from.Kind
+		},
+	}
+
+	getKinds := func(names ...string) []string {
+		networkInterfaces := make([]NetworkInterface, 0)
+		for _, name := range names {
+			networkInterfaces = append(networkInterfaces, NetworkInterface{Name: name})
+		}
+
+		fillDetails(networkInterfaces, true, false)
+
+		kinds := make([]string, 0)
+		for _, networkInterface := range networkInterfaces {
+			kinds = append(kinds, networkInterface.Kind)
+		}
+
+		return kinds
+	}
+
+	// every time
+	require.NoError(t, SetDetails(Details{Enabled: []string{"test"}}))
+	require.Equal(t, []string{"test-1"}, getKinds("eth0"))
+	require.Equal(t, []string{"test-2"}, getKinds("eth0"))
+
+	// reusing the last ones until it's time, unless there's a new interface
+	require.NoError(t, SetDetails(Details{Enabled: []string{"test"}, Interval: time.Hour}))
+	require.Equal(t, []string{"test-3"}, getKinds("eth0"))
+	require.Equal(t, []string{"test-3"}, getKinds("eth0"))
+	require.Equal(t, []string{"test-4", "test-4"}, getKinds("eth0", "eth1"))
+	require.Equal(t, []string{"test-4"}, getKinds("eth1"))
+
+	// not at all
+	require.NoError(t, SetDetails(Details{}))
+	require.Equal(t, []string{""}, getKinds("eth0"))
+	require.Equal(t, 4, fills)
+
+	require.Error(t, SetDetails(Details{Enabled: []string{"carrier-pigeon"}}))
+
+	// and the real ones are left out of the interfaces when they're not enabled
+	networkInterfaces, err := GetNetworkInterfaces()
+	require.NoError(t, err)
+	for _, networkInterface := range networkInterfaces {
+		require.Nil(t, networkInterface.Addresses)
+		require.Nil(t, networkInterface.Qdiscs)
+		require.Nil(t, networkInterface.Ethtool)
+	}
+}
+
+func TestGetNetworkInterfacesInNetns(t *testing.T) {
+	name := "loser-test-interfaces"
+
+	err := exec.Command("ip", "netns", "add", name).Run()
+	if err != nil {
+		t.Skipf("can't create a network namespace (needs iproute2 and CAP_SYS_ADMIN): %s", err)
+	}
+	defer func() {
+		_ = exec.Command("ip", "netns", "del", name).Run()
+	}()
+
+	networkInterfaces, err := GetNetworkInterfacesInNetns("/var/run/netns/" + name)
+	require.NoError(t, err)
+
+	// a fresh namespace only has a loopback interface (with no addresses until it's brought up)
+	require.Len(t, networkInterfaces, 1)
+	require.Equal(t, "lo", networkInterfaces[0].Name)
+	require.Equal(t, SpeedUnknown, networkInterfaces[0].Speed)
+	require.NotNil(t, networkInterfaces[0].Addresses)
+
+	// the filter applies in there too, going by what rtnetlink says about the types (not our sysfs)
+	t.Cleanup(func() {
+		_ = SetFilter(Filter{})
+	})
+
+	err = SetFilter(Filter{SkipLoopback: true})
+	require.NoError(t, err)
+
+	networkInterfaces, err = GetNetworkInterfacesInNetns("/var/run/netns/" + name)
+	require.NoError(t, err)
+	require.Empty(t, networkInterfaces)
+
+	err = SetFilter(Filter{Exclude: []string{"eth*"}})
+	require.NoError(t, err)
+
+	networkInterfaces, err = GetNetworkInterfacesInNetns("/var/run/netns/" + name)
+	require.NoError(t, err)
+	require.Len(t, networkInterfaces, 1)
+
+	err = SetFilter(Filter{})
+	require.NoError(t, err)
+
+	// and we're back in our own namespace afterwards
+	networkInterfacesFromNetlink, err := GetNetworkInterfacesFromNetlink()
+	require.NoError(t, err)
+	require.Greater(t, len(networkInterfacesFromNetlink), 1)
+}
+
+func TestGetLinkStateChanges(t *testing.T) {
+	linkStates := map[int]linkState{
+		1: {name: "lo", operState: "unknown"},
+		2: {name: "eth0", operState: "up"},
+		3: {name: "eth1", operState: "up"},
+	}
+	interfaceNames := map[int]string{1: "lo", 2: "eth0", 3: "eth1"}
+
+	// e.g. after we fell behind: eth0 went down, eth1 went away and eth2 turned up
+	changes := getLinkStateChanges([]NetworkInterface{
+		{Name: "lo", IFIndex: 1, OperState: "unknown"},
+		{Name: "eth0", IFIndex: 2, OperState: "down"},
+		{Name: "eth2", IFIndex: 4, OperState: "up"},
+	}, linkStates, interfaceNames)
+
+	kinds := make([]string, 0)
+	for _, change := range changes {
+		kinds = append(kinds, fmt.Sprintf("%s %s", change.Interface, change.Kind))
+	}
+
+	require.Equal(t, []string{"eth0 " + events.KindLinkDown, "eth2 " + events.KindLinkAdded, "eth1 " + events.KindLinkRemoved}, kinds)
+	require.Equal(t, map[int]linkState{
+		1: {name: "lo", operState: "unknown"},
+		2: {name: "eth0", operState: "down"},
+		4: {name: "eth2", operState: "up"},
+	}, linkStates)
+
+	// the names are kept after a removal (for labelling the address and route removals that follow)
+	require.Equal(t, map[int]string{1: "lo", 2: "eth0", 3: "eth1", 4: "eth2"}, interfaceNames)
+
+	// and nothing if nothing's changed
+	require.Empty(t, getLinkStateChanges([]NetworkInterface{
+		{Name: "lo", IFIndex: 1, OperState: "unknown"},
+		{Name: "eth0", IFIndex: 2, OperState: "down"},
+		{Name: "eth2", IFIndex: 4, OperState: "up"},
+	}, linkStates, interfaceNames))
+}
+
+func TestHandleLinkMessage(t *testing.T) {
+	linkStates := make(map[int]linkState)
+
+	event := handleLinkMessage(unix.RTM_NEWLINK, &NetworkInterface{Name: "eth0", IFIndex: 2, OperState: "down"}, linkStates)
+	require.NotNil(t, event)
+	require.Equal(t, events.KindLinkAdded, event.Kind)
+
+	event = handleLinkMessage(unix.RTM_NEWLINK, &NetworkInterface{Name: "eth0", IFIndex: 2, OperState: "up"}, linkStates)
+	require.NotNil(t, event)
+	require.Equal(t, events.KindLinkUp, event.Kind)
+	require.Equal(t, "down", event.Old)
+	require.Equal(t, "up", event.New)
+
+	// nothing interesting changed
+	event = handleLinkMessage(unix.RTM_NEWLINK, &NetworkInterface{Name: "eth0", IFIndex: 2, OperState: "up"}, linkStates)
+	require.Nil(t, event)
+
+	event = handleLinkMessage(unix.RTM_NEWLINK, &NetworkInterface{Name: "eth0", IFIndex: 2, OperState: "lowerlayerdown"}, linkStates)
+	require.NotNil(t, event)
+	require.Equal(t, events.KindLinkDown, event.Kind)
+
+	event = handleLinkMessage(unix.RTM_DELLINK, &NetworkInterface{Name: "eth0", IFIndex: 2}, linkStates)
+	require.NotNil(t, event)
+	require.Equal(t, events.KindLinkRemoved, event.Kind)
+	require.Empty(t, linkStates)
+}
+
+func TestGetSnapshot(t *testing.T) {
+	snapshot, err := GetSnapshot()
+	require.NoError(t, err)
+	require.NotEmpty(t, snapshot.NetworkInterfaces)
+	require.NotEmpty(t, snapshot.Routes)
+
+	for _, networkInterface := range snapshot.NetworkInterfaces {
+		require.NotNil(t, networkInterface.Addresses)
+		if networkInterface.Name == "lo" {
+			require.Contains(t, networkInterface.Addresses, Address{Family: "ipv4", IP: "127.0.0.1", PrefixLen: 8, Scope: "host", Label: "lo"})
+		}
+	}
+
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	require.NoError(t, err)
+	log.Printf("snapshot: %s", string(b))
+}
+
+func TestGetDefaultGateways(t *testing.T) {
+	gateways := GetDefaultGateways([]Route{
+		{Family: "ipv4", Destination: "default", Gateway: "192.168.1.1", Interface: "eth0", Table: unix.RT_TABLE_MAIN, Type: "unicast", Metric: 100},
+		{Family: "ipv4", Destination: "192.168.1.0/24", Interface: "eth0", Table: unix.RT_TABLE_MAIN, Type: "unicast"},
+		{Family: "ipv4", Destination: "default", Gateway: "10.0.0.1", Interface: "eth1", Table: 100, Type: "unicast"},
+		{Family: "ipv6", Destination: "default", Table: unix.RT_TABLE_MAIN, Type: "unicast", NextHops: []NextHop{
+			{Gateway: "fe80::1", Interface: "eth0", Weight: 1},
+			{Gateway: "fe80::2", Interface: "eth1", Weight: 1},
+		}},
+	})
+
+	require.Equal(t, []Gateway{
+		{Family: "ipv4", IP: "192.168.1.1", Interface: "eth0", Metric: 100},
+		{Family: "ipv6", IP: "fe80::1", Interface: "eth0"},
+		{Family: "ipv6", IP: "fe80::2", Interface: "eth1"},
+	}, gateways)
+}
+
+func TestTopology(t *testing.T) {
+	t.Run("ParseBond", func(t *testing.T) {
+		bond, err := parseBond([]byte(`Ethernet Channel Bonding Driver: v5.15.0-91-generic
+
+Bonding Mode: fault-tolerance (active-backup)
+Primary Slave: None
+Currently Active Slave: eth1
+MII Status: up
+MII Polling Interval (ms): 100
+Up Delay (ms): 0
+Down Delay (ms): 0
+Peer Notification Delay (ms): 0
+
+Slave Interface: eth0
+MII Status: down
+Speed: Unknown
+Duplex: Unknown
+Link Failure Count: 3
+Permanent HW addr: 52:54:00:12:34:56
+Slave queue ID: 0
+
+Slave Interface: eth1
+MII Status: up
+Speed: 1000 Mbps
+Duplex: full
+Link Failure Count: 0
+Permanent HW addr: 52:54:00:12:34:57
+Slave queue ID: 0
+`))
+		require.NoError(t, err)
+		require.Equal(t, "fault-tolerance (active-backup)", bond.Mode)
+		require.Equal(t, "eth1", bond.ActiveSlave)
+		require.Equal(t, "up", bond.MIIStatus)
+		require.Len(t, bond.Slaves, 2)
+		require.Equal(t, BondSlave{Name: "eth0", MIIStatus: "down", Speed: "Unknown", Duplex: "Unknown", LinkFailureCount: 3, PermanentMAC: "52:54:00:12:34:56"}, bond.Slaves[0])
+		require.Equal(t, "up", bond.Slaves[1].MIIStatus)
+
+		_, err = parseBond([]byte("Slave Interface: eth0\n"))
+		require.Error(t, err)
+	})
+
+	t.Run("ParseVLANConfig", func(t *testing.T) {
+		vlans := parseVLANConfig([]byte(`VLAN Dev name	 | VLAN ID
+Name-Type: VLAN_NAME_TYPE_RAW_PLUS_VID_NO_PAD
+eth0.100       | 100  | eth0
+bond0.2000     | 2000  | bond0
+`))
+		require.Equal(t, map[string]vlan{
+			"eth0.100":   {parent: "eth0", id: 100},
+			"bond0.2000": {parent: "bond0", id: 2000},
+		}, vlans)
+	})
+
+	t.Run("Bridge", func(t *testing.T) {
+		err := exec.Command("ip", "link", "add", "loser-br", "type", "bridge").Run()
+		if err != nil {
+			t.Skipf("can't create a bridge (needs iproute2 and CAP_NET_ADMIN): %s", err)
+		}
+		defer func() {
+			_ = exec.Command("ip", "link", "del", "loser-br").Run()
+		}()
+
+		err = exec.Command("ip", "link", "add", "loser-port", "master", "loser-br", "type", "veth", "peer", "name", "loser-peer").Run()
+		require.NoError(t, err)
+		defer func() {
+			_ = exec.Command("ip", "link", "del", "loser-port").Run()
+		}()
+
+		for _, getNetworkInterfaces := range []func() ([]NetworkInterface, error){GetNetworkInterfacesFromSysfs, GetNetworkInterfacesFromNetlink} {
+			networkInterfaces, err := getNetworkInterfaces()
+			require.NoError(t, err)
+
+			fillTopology(networkInterfaces)
+
+			networkInterfacesByName := make(map[string]NetworkInterface)
+			for _, networkInterface := range networkInterfaces {
+				networkInterfacesByName[networkInterface.Name] = networkInterface
+			}
+
+			require.Equal(t, "bridge", networkInterfacesByName["loser-br"].Kind)
+			require.Equal(t, []string{"loser-port"}, networkInterfacesByName["loser-br"].Slaves)
+			require.Equal(t, "loser-br", networkInterfacesByName["loser-port"].Master)
+			require.Empty(t, networkInterfacesByName["loser-peer"].Master)
+		}
+	})
+}
+
+func TestWireless(t *testing.T) {
+	t.Run("ParseProcNetWireless", func(t *testing.T) {
+		wirelessByName, err := parseProcNetWireless([]byte(`Inter-| sta-|   Quality        |   Discarded packets               | Missed | WE
+ face | tus | link level noise |  nwid  crypt   frag  retry   misc | beacon | 22
+ wlan0: 0000   54.  -56.  -256        0      1      2     37     12        4
+`))
+		require.NoError(t, err)
+		require.Equal(t, map[string]Wireless{
+			"wlan0": {
+				LinkQuality:    54,
+				SignalLevel:    -56,
+				NoiseLevel:     -256,
+				DiscardedNWID:  0,
+				DiscardedCrypt: 1,
+				DiscardedFrag:  2,
+				DiscardedRetry: 37,
+				DiscardedMisc:  12,
+				MissedBeacon:   4,
+			},
+		}, wirelessByName)
+
+		_, err = parseProcNetWireless([]byte(" wlan0: 0000   a.  -56.  -256        0      1      2     37     12        4\n"))
+		require.Error(t, err)
+	})
+
+	t.Run("ParseStationMessage", func(t *testing.T) {
+		u32 := func(v uint32) []byte {
+			b := make([]byte, 4)
+			binary.NativeEndian.PutUint32(b, v)
+			return b
+		}
+
+		stationInfo := make([]byte, 0)
+		stationInfo = append(stationInfo, netlink.EncodeAttribute(unix.NL80211_STA_INFO_SIGNAL, []byte{0xc4})...)
+		stationInfo = append(stationInfo, netlink.EncodeAttribute(unix.NL80211_STA_INFO_TX_RETRIES, u32(17))...)
+		stationInfo = append(stationInfo, netlink.EncodeAttribute(unix.NL80211_STA_INFO_TX_FAILED, u32(3))...)
+		stationInfo = append(stationInfo, netlink.EncodeAttribute(unix.NL80211_STA_INFO_CONNECTED_TIME, u32(60))...)
+		stationInfo = append(stationInfo, netlink.EncodeAttribute(unix.NL80211_STA_INFO_TX_BITRATE, netlink.EncodeAttribute(unix.NL80211_RATE_INFO_BITRATE32, u32(8667)))...)
+
+		data := make([]byte, 0)
+		data = append(data, netlink.EncodeAttribute(unix.NL80211_ATTR_MAC, []byte{0x02, 0, 0, 0, 0, 0x01})...)
+		data = append(data, netlink.EncodeAttribute(unix.NL80211_ATTR_STA_INFO|unix.NLA_F_NESTED, stationInfo)...)
+
+		station, err := parseStationMessage(data)
+		require.NoError(t, err)
+		require.Equal(t, "02:00:00:00:00:01", station.MAC)
+		require.Equal(t, -60, station.Signal)
+		require.Equal(t, int64(17), station.TxRetries)
+		require.Equal(t, int64(3), station.TxFailed)
+		require.Equal(t, time.Minute, station.ConnectedTime)
+		require.Equal(t, int64(866_700_000), station.TxBitrate)
+	})
+
+	t.Run("WarnStations", func(t *testing.T) {
+		b := new(bytes.Buffer)
+		log.SetOutput(b)
+		defer log.SetOutput(os.Stdout)
+
+		err := errors.New("no such file or directory")
+
+		warnStations("wlan9", err)
+		warnStations("wlan9", err)
+		require.Equal(t, 1, strings.Count(b.String(), "failed GetStations for wlan9"))
+
+		// working again, so the next failure is news
+		warnStations("wlan9", nil)
+		warnStations("wlan9", err)
+		require.Equal(t, 2, strings.Count(b.String(), "failed GetStations for wlan9"))
+	})
+}
+
+func TestQdiscs(t *testing.T) {
+	t.Run("ParseQdiscMessage", func(t *testing.T) {
+		tcmsg := make([]byte, sizeofTcmsg)
+		binary.NativeEndian.PutUint32(tcmsg[4:8], 7)
+		binary.NativeEndian.PutUint32(tcmsg[8:12], 0x00010010)
+		binary.NativeEndian.PutUint32(tcmsg[12:16], tcHandleRoot)
+
+		basic := make([]byte, 16)
+		binary.NativeEndian.PutUint64(basic[0:8], 123456)
+		binary.NativeEndian.PutUint32(basic[8:12], 789)
+
+		queue := make([]byte, 20)
+		binary.NativeEndian.PutUint32(queue[0:4], 1)
+		binary.NativeEndian.PutUint32(queue[4:8], 1500)
+		binary.NativeEndian.PutUint32(queue[8:12], 42)
+		binary.NativeEndian.PutUint32(queue[12:16], 2)
+		binary.NativeEndian.PutUint32(queue[16:20], 99)
+
+		stats2 := make([]byte, 0)
+		stats2 = append(stats2, netlink.EncodeAttribute(tcaStatsBasic, basic)...)
+		stats2 = append(stats2, netlink.EncodeAttribute(tcaStatsQueue, queue)...)
+
+		data := tcmsg
+		data = append(data, netlink.EncodeAttribute(tcaKind, []byte("htb\x00"))...)
+		data = append(data, netlink.EncodeAttribute(tcaStats2|unix.NLA_F_NESTED, stats2)...)
+
+		class, ifIndex, err := parseQdiscMessage(data, true)
+		require.NoError(t, err)
+		require.Equal(t, 7, ifIndex)
+		require.Equal(t, Qdisc{
+			Class:      true,
+			Kind:       "htb",
+			Handle:     "1:10",
+			Parent:     "root",
+			Bytes:      123456,
+			Packets:    789,
+			Drops:      42,
+			Overlimits: 99,
+			Requeues:   2,
+			Backlog:    1500,
+			QLen:       1,
+		}, *class)
+
+		require.Equal(t, "1:", getTCHandleName(0x00010000, false))
+		require.Equal(t, "ingress", getTCHandleName(tcHandleIngress, true))
+
+		_, _, err = parseQdiscMessage(tcmsg[:4], false)
+		require.Error(t, err)
+	})
+
+	t.Run("HTB", func(t *testing.T) {
+		err := exec.Command("ip", "link", "add", "loser-q", "type", "veth", "peer", "name", "loser-q2").Run()
+		if err != nil {
+			t.Skipf("can't create a veth (needs iproute2 and CAP_NET_ADMIN): %s", err)
+		}
+		defer func() {
+			_ = exec.Command("ip", "link", "del", "loser-q").Run()
+		}()
+
+		err = exec.Command("tc", "qdisc", "add", "dev", "loser-q", "root", "handle", "1:", "htb").Run()
+		if err != nil {
+			t.Skipf("can't add an htb qdisc (needs tc and sch_htb): %s", err)
+		}
+
+		err = exec.Command("tc", "class", "add", "dev", "loser-q", "parent", "1:", "classid", "1:10", "htb", "rate", "1mbit").Run()
+		require.NoError(t, err)
+
+		networkInterfaces, err := GetNetworkInterfaces()
+		require.NoError(t, err)
+
+		var qdiscs []Qdisc
+		for _, networkInterface := range networkInterfaces {
+			if networkInterface.Name == "loser-q" {
+				qdiscs = networkInterface.Qdiscs
+			}
+		}
+
+		require.Len(t, qdiscs, 2)
+		require.Equal(t, "htb", qdiscs[0].Kind)
+		require.Equal(t, "1:", qdiscs[0].Handle)
+		require.Equal(t, "root", qdiscs[0].Parent)
+		require.False(t, qdiscs[0].Class)
+		require.Equal(t, "htb", qdiscs[1].Kind)
+		require.Equal(t, "1:10", qdiscs[1].Handle)
+		require.Equal(t, "root", qdiscs[1].Parent) // as tc shows it, a top level class hangs off root rather than 1:
+		require.True(t, qdiscs[1].Class)
+	})
+}
+
+func TestEthtool(t *testing.T) {
+	t.Run("ParseEthtoolStrings", func(t *testing.T) {
+		data := make([]byte, ethGStringLen*2)
+		copy(data[0:], "rx_missed_errors")
+		copy(data[ethGStringLen:], "tx_queue_0_packets")
+
+		require.Equal(t, []string{"rx_missed_errors", "tx_queue_0_packets"}, parseEthtoolStrings(data, 2))
+		require.Equal(t, []string{"rx_missed_errors"}, parseEthtoolStrings(data[:ethGStringLen], 2))
+	})
+
+	t.Run("ParseEthtoolCmd", func(t *testing.T) {
+		data := make([]byte, sizeofEthtoolCmd)
+		binary.NativeEndian.PutUint32(data[4:8], 0b1110_1111)   // 10 / 100 / 1000 full and half (less 1000 half), autoneg, tp
+		binary.NativeEndian.PutUint32(data[8:12], 0b0010_0000)  // 1000baseT/Full
+		binary.NativeEndian.PutUint32(data[32:36], 0b0010_1000) // 100baseT/Full, 1000baseT/Full
+		data[15] = 0x00
+		data[18] = 1
+
+		linkModes, err := parseEthtoolCmd(data)
+		require.NoError(t, err)
+		require.Equal(t, LinkModes{
+			Port:                   "tp",
+			Autoneg:                true,
+			Supported:              []string{"10baseT/Half", "10baseT/Full", "100baseT/Half", "100baseT/Full", "1000baseT/Full", "Autoneg", "TP"},
+			Advertising:            []string{"1000baseT/Full"},
+			LinkPartnerAdvertising: []string{"100baseT/Full", "1000baseT/Full"},
+		}, *linkModes)
+
+		_, err = parseEthtoolCmd(data[:8])
+		require.Error(t, err)
+	})
+
+	t.Run("Allowlist", func(t *testing.T) {
+		require.True(t, isEthtoolStatAllowed("rx_missed_errors", DefaultEthtoolStatsAllowlist))
+		require.True(t, isEthtoolStatAllowed("rx_queue_3_drops", DefaultEthtoolStatsAllowlist))
+		require.False(t, isEthtoolStatAllowed("rx_queue_3_packets", DefaultEthtoolStatsAllowlist))
+		require.False(t, isEthtoolStatAllowed("rx_queue_3_drops", nil))
+
+		require.Error(t, SetEthtoolStatsAllowlist([]string{"["}))
+	})
+
+	t.Run("Veth", func(t *testing.T) {
+		err := exec.Command("ip", "link", "add", "loser-e", "type", "veth", "peer", "name", "loser-e2").Run()
+		if err != nil {
+			t.Skipf("can't create a veth (needs iproute2 and CAP_NET_ADMIN): %s", err)
+		}
+		defer func() {
+			_ = exec.Command("ip", "link", "del", "loser-e").Run()
+		}()
+
+		ethtool, err := GetEthtool("loser-e")
+		require.NoError(t, err)
+		require.Equal(t, "veth", ethtool.Driver)
+		require.Contains(t, ethtool.Stats, "rx_queue_0_drops")
+		require.NotContains(t, ethtool.Stats, "peer_ifindex")
+
+		_, err = GetEthtool("lo")
+		require.ErrorIs(t, err, unix.EOPNOTSUPP)
+	})
+}
+
+func TestFilter(t *testing.T) {
+	sys := os.DirFS(filepath.Join("testdata", "basic", "sys"))
+
+	getNames := func(t *testing.T, f Filter) []string {
+		err := SetFilter(f)
+		require.NoError(t, err)
+
+		names := make([]string, 0)
+		for _, name := range []string{"br0", "eth0", "eth0.100", "eth1", "lo", "veth1234", "cali5678", "wlan0"} {
+			if filter.Match(sys, name) {
+				names = append(names, name)
+			}
+		}
+
+		return names
+	}
+
+	t.Cleanup(func() {
+		_ = SetFilter(Filter{})
+	})
+
+	require.Equal(t, []string{"br0", "eth0", "eth0.100", "eth1", "lo", "veth1234", "cali5678", "wlan0"}, getNames(t, Filter{}))
+	require.Equal(t, []string{"eth0", "eth0.100", "eth1"}, getNames(t, Filter{Include: []string{"eth*"}}))
+	require.Equal(t, []string{"br0", "eth0", "eth0.100", "eth1", "lo", "wlan0"}, getNames(t, Filter{Exclude: []string{"veth*", "cali*"}}))
+	require.Equal(t, []string{"eth0", "eth1"}, getNames(t, Filter{IncludeRegexps: []string{`^eth\d+$`}}))
+	require.Equal(t, []string{"eth0", "eth1", "wlan0"}, getNames(t, Filter{IncludeRegexps: []string{`^eth\d+$`}, Include: []string{"wlan0"}}))
+	require.Equal(t, []string{"br0", "eth0", "eth0.100", "eth1", "lo", "wlan0"}, getNames(t, Filter{ExcludeRegexps: []string{`^(veth|cali)`}}))
+	require.Equal(t, []string{"eth0", "wlan0"}, getNames(t, Filter{PhysicalOnly: true}))
+	require.Equal(t, []string{"br0", "eth0", "eth0.100", "eth1", "veth1234", "cali5678", "wlan0"}, getNames(t, Filter{SkipLoopback: true}))
+
+	require.Error(t, SetFilter(Filter{Include: []string{"["}}))
+	require.Error(t, SetFilter(Filter{ExcludeRegexps: []string{"("}}))
+
+	t.Run("GetNetworkInterfaces", func(t *testing.T) {
+		SetFS(sys, os.DirFS(filepath.Join("testdata", "basic", "proc")))
+		t.Cleanup(func() {
+			SetFS(os.DirFS("/sys"), os.DirFS("/proc"))
+		})
+
+		err := SetFilter(Filter{PhysicalOnly: true})
+		require.NoError(t, err)
+
+		networkInterfaces, err := GetNetworkInterfacesFromSysfs()
+		require.NoError(t, err)
+
+		networkInterfaces = applyFilter(getFilter(), networkInterfaces)
+		require.Len(t, networkInterfaces, 2)
+		require.Equal(t, "eth0", networkInterfaces[0].Name)
+		require.Equal(t, "wlan0", networkInterfaces[1].Name)
+	})
+
+	t.Run("FromNetlink", func(t *testing.T) {
+		networkInterfaces := []NetworkInterface{
+			{Name: "lo", linkType: unix.ARPHRD_LOOPBACK, linkFlags: unix.IFF_LOOPBACK | unix.IFF_UP},
+			{Name: "eth0", linkType: unix.ARPHRD_ETHER, parentDevName: "0000:00:03.0"},
+			{Name: "eth0.100", Kind: "vlan", linkType: unix.ARPHRD_ETHER},
+			{Name: "veth1234", Kind: "veth", linkType: unix.ARPHRD_ETHER},
+			// a kernel before 5.14, that doesn't say what the parent device is
+			{Name: "eth1", linkType: unix.ARPHRD_ETHER},
+		}
+
+		getNames := func(t *testing.T, f Filter) []string {
+			err := SetFilter(f)
+			require.NoError(t, err)
+
+			names := make([]string, 0)
+			for _, networkInterface := range applyFilterFromNetlink(getFilter(), networkInterfaces) {
+				names = append(names, networkInterface.Name)
+			}
+
+			return names
+		}
+
+		require.Equal(t, []string{"lo", "eth0", "eth0.100", "veth1234", "eth1"}, getNames(t, Filter{}))
+		require.Equal(t, []string{"eth0", "eth1"}, getNames(t, Filter{PhysicalOnly: true}))
+		require.Equal(t, []string{"eth0", "eth0.100", "veth1234", "eth1"}, getNames(t, Filter{SkipLoopback: true}))
+		require.Equal(t, []string{"lo", "eth0.100", "veth1234"}, getNames(t, Filter{Exclude: []string{"eth?"}}))
+	})
+}
+
+func TestRates(t *testing.T) {
+	t.Run("GetCounterDelta", func(t *testing.T) {
+		require.Equal(t, int64(0), GetCounterDelta(100, 100))
+		require.Equal(t, int64(50), GetCounterDelta(100, 150))
+
+		// a 32-bit counter wrapping
+		require.Equal(t, int64(11), GetCounterDelta(4294967290, 5))
+		require.Equal(t, int64(1), GetCounterDelta(4294967295, 0))
+
+		// a reset (well below the top of the 32-bit range, or a 64-bit counter)
+		require.Equal(t, int64(5), GetCounterDelta(100_000, 5))
+		require.Equal(t, int64(5), GetCounterDelta(10_000_000_000, 5))
+	})
+
+	t.Run("GetRates", func(t *testing.T) {
+		now := time.Now()
+
+		last := NetworkInterface{Timestamp: now, Speed: 100, RxBytes: 1_000, TxBytes: 4294967000, RxPackets: 10, TxPackets: 10, RxDropped: 2}
+		current := NetworkInterface{Timestamp: now.Add(time.Second * 2), Speed: 100, RxBytes: 2_501_000, TxBytes: 704, RxPackets: 30, TxPackets: 10, RxErrors: 4, RxDropped: 1}
+
+		rates := GetRates(last, current)
+		require.NotNil(t, rates)
+		require.Equal(t, float64(2), rates.Interval)
+		require.Equal(t, float64(10_000_000), rates.RxBitsPerSecond)
+		require.Equal(t, float64(4_000), rates.TxBitsPerSecond)
+		require.Equal(t, float64(10), rates.RxPacketsPerSecond)
+		require.Equal(t, float64(0), rates.TxPacketsPerSecond)
+		require.Equal(t, float64(2), rates.RxErrorsPerSecond)
+		require.Equal(t, float64(0.5), rates.RxDroppedPerSecond) // a reset
+		require.NotNil(t, rates.RxUtilisationPercent)
+		require.Equal(t, float64(10), *rates.RxUtilisationPercent)
+		require.Equal(t, float64(0.004), *rates.TxUtilisationPercent)
+
+		current.Speed = SpeedUnknown
+		rates = GetRates(last, current)
+		require.Nil(t, rates.RxUtilisationPercent)
+		require.Nil(t, rates.TxUtilisationPercent)
+
+		require.Nil(t, GetRates(current, last))
+	})
+}
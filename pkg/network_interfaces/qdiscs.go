@@ -0,0 +1,204 @@
+package network_interfaces
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/initialed85/loser/pkg/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// from linux/rtnetlink.h, linux/pkt_sched.h and linux/gen_stats.h (not in x/sys/unix)
+const (
+	sizeofTcmsg = 20
+
+	tcaKind   = 1
+	tcaStats  = 3
+	tcaStats2 = 7
+
+	tcaStatsBasic = 1
+	tcaStatsQueue = 3
+
+	tcHandleRoot    = 0xFFFFFFFF
+	tcHandleIngress = 0xFFFFFFF1
+)
+
+// the "classes" of these are really just their flow hash buckets (and there can be thousands of them)
+var flowQueueingKinds = map[string]struct{}{
+	"fq_codel": {},
+	"fq_pie":   {},
+	"fq":       {},
+	"cake":     {},
+	"sfq":      {},
+}
+
+// Qdisc is a queueing discipline (tc qdisc) or one of its classes (tc class) with its stats; drops in here never show up
+// in the interface counters
+type Qdisc struct {
+	Class      bool   `json:"class"`
+	Kind       string `json:"kind"`
+	Handle     string `json:"handle"`
+	Parent     string `json:"parent"`
+	Bytes      int64  `json:"bytes"`
+	Packets    int64  `json:"packets"`
+	Drops      int64  `json:"drops"`
+	Overlimits int64  `json:"overlimits"`
+	Requeues   int64  `json:"requeues"`
+	Backlog    int64  `json:"backlog"`
+	QLen       int64  `json:"qlen"`
+}
+
+// getTCHandleName formats a handle the way tc does ("1:" for a qdisc, "1:10" for a class)
+func getTCHandleName(handle uint32, isClass bool) string {
+	switch handle {
+	case tcHandleRoot:
+		return "root"
+	case tcHandleIngress:
+		return "ingress"
+	}
+
+	if !isClass && handle&0xFFFF == 0 {
+		return fmt.Sprintf("%x:", handle>>16)
+	}
+
+	return fmt.Sprintf("%x:%x", handle>>16, handle&0xFFFF)
+}
+
+// parseQdiscMessage parses an RTM_NEWQDISC / RTM_NEWTCLASS message (struct tcmsg and then the attributes), returning the
+// interface index too
+func parseQdiscMessage(data []byte, isClass bool) (*Qdisc, int, error) {
+	if len(data) < sizeofTcmsg {
+		return nil, 0, fmt.Errorf("truncated tcmsg (%d bytes)", len(data))
+	}
+
+	ifIndex := int(int32(netlink.Uint32(data[4:8])))
+
+	attributes, err := netlink.ParseAttributeMap(data[sizeofTcmsg:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed netlink.ParseAttributeMap for tcmsg: %s", err)
+	}
+
+	qdisc := Qdisc{
+		Class:  isClass,
+		Kind:   netlink.String(attributes[tcaKind]),
+		Handle: getTCHandleName(netlink.Uint32(data[8:12]), isClass),
+		Parent: getTCHandleName(netlink.Uint32(data[12:16]), true),
+	}
+
+	stats2, ok := attributes[tcaStats2]
+	if ok {
+		statsAttributes, err := netlink.ParseAttributeMap(stats2)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed netlink.ParseAttributeMap for TCA_STATS2: %s", err)
+		}
+
+		// struct gnet_stats_basic is bytes (u64) then packets (u32)
+		basic := statsAttributes[tcaStatsBasic]
+		if len(basic) >= 12 {
+			qdisc.Bytes = int64(netlink.Uint64(basic[0:8]))
+			qdisc.Packets = int64(netlink.Uint32(basic[8:12]))
+		}
+
+		// struct gnet_stats_queue is qlen, backlog, drops, requeues, overlimits (all u32)
+		queue := statsAttributes[tcaStatsQueue]
+		if len(queue) >= 20 {
+			qdisc.QLen = int64(netlink.Uint32(queue[0:4]))
+			qdisc.Backlog = int64(netlink.Uint32(queue[4:8]))
+			qdisc.Drops = int64(netlink.Uint32(queue[8:12]))
+			qdisc.Requeues = int64(netlink.Uint32(queue[12:16]))
+			qdisc.Overlimits = int64(netlink.Uint32(queue[16:20]))
+		}
+
+		return &qdisc, ifIndex, nil
+	}
+
+	// older kernels only have struct tc_stats: bytes (u64), packets, drops, overlimits, bps, pps, qlen, backlog (u32)
+	stats := attributes[tcaStats]
+	if len(stats) >= 36 {
+		qdisc.Bytes = int64(netlink.Uint64(stats[0:8]))
+		qdisc.Packets = int64(netlink.Uint32(stats[8:12]))
+		qdisc.Drops = int64(netlink.Uint32(stats[12:16]))
+		qdisc.Overlimits = int64(netlink.Uint32(stats[16:20]))
+		qdisc.QLen = int64(netlink.Uint32(stats[28:32]))
+		qdisc.Backlog = int64(netlink.Uint32(stats[32:36]))
+	}
+
+	return &qdisc, ifIndex, nil
+}
+
+// GetQdiscs dumps the qdiscs (RTM_GETQDISC) and then the classes of each interface that has a classful one
+// (RTM_GETTCLASS), keyed by interface index
+func GetQdiscs() (map[int][]Qdisc, error) {
+	tcmsg := make([]byte, sizeofTcmsg)
+	tcmsg[0] = unix.AF_UNSPEC
+
+	messages, err := netlink.Request(unix.NETLINK_ROUTE, unix.RTM_GETQDISC, unix.NLM_F_DUMP, tcmsg)
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.Request for RTM_GETQDISC: %s", err)
+	}
+
+	qdiscs := make(map[int][]Qdisc)
+	classfulIfIndexes := make(map[int]struct{})
+
+	for _, message := range messages {
+		if message.Type != unix.RTM_NEWQDISC {
+			continue
+		}
+
+		qdisc, ifIndex, err := parseQdiscMessage(message.Data, false)
+		if err != nil {
+			return nil, err
+		}
+
+		qdiscs[ifIndex] = append(qdiscs[ifIndex], *qdisc)
+
+		_, isFlowQueueing := flowQueueingKinds[qdisc.Kind]
+		if !isFlowQueueing && qdisc.Kind != "noqueue" && qdisc.Kind != "pfifo_fast" {
+			classfulIfIndexes[ifIndex] = struct{}{}
+		}
+	}
+
+	for ifIndex := range classfulIfIndexes {
+		tcmsg := make([]byte, sizeofTcmsg)
+		tcmsg[0] = unix.AF_UNSPEC
+		binary.NativeEndian.PutUint32(tcmsg[4:8], uint32(ifIndex))
+
+		messages, err := netlink.Request(unix.NETLINK_ROUTE, unix.RTM_GETTCLASS, unix.NLM_F_DUMP, tcmsg)
+		if err != nil {
+			return nil, fmt.Errorf("failed netlink.Request for RTM_GETTCLASS: %s", err)
+		}
+
+		for _, message := range messages {
+			if message.Type != unix.RTM_NEWTCLASS {
+				continue
+			}
+
+			class, _, err := parseQdiscMessage(message.Data, true)
+			if err != nil {
+				return nil, err
+			}
+
+			_, isFlowQueueing := flowQueueingKinds[class.Kind]
+			if isFlowQueueing {
+				continue
+			}
+
+			qdiscs[ifIndex] = append(qdiscs[ifIndex], *class)
+		}
+	}
+
+	return qdiscs, nil
+}
+
+// fillQdiscs fills in the qdiscs (and classes) for each interface
+func fillQdiscs(networkInterfaces []NetworkInterface) {
+	qdiscs, err := GetQdiscs()
+	if err != nil {
+		log.Printf("warning: failed GetQdiscs: %s", err)
+		return
+	}
+
+	for i := range networkInterfaces {
+		networkInterfaces[i].Qdiscs = qdiscs[networkInterfaces[i].IFIndex]
+	}
+}
@@ -0,0 +1,74 @@
+package network_interfaces
+
+import (
+	"math"
+)
+
+// Rates are worked out between two snapshots of an interface; the utilisation is a percentage of the link speed, so
+// it's only there if we know the speed
+type Rates struct {
+	Interval             float64  `json:"interval_seconds"`
+	RxBitsPerSecond      float64  `json:"rx_bits_per_second"`
+	TxBitsPerSecond      float64  `json:"tx_bits_per_second"`
+	RxPacketsPerSecond   float64  `json:"rx_packets_per_second"`
+	TxPacketsPerSecond   float64  `json:"tx_packets_per_second"`
+	RxErrorsPerSecond    float64  `json:"rx_errors_per_second"`
+	TxErrorsPerSecond    float64  `json:"tx_errors_per_second"`
+	RxDroppedPerSecond   float64  `json:"rx_dropped_per_second"`
+	TxDroppedPerSecond   float64  `json:"tx_dropped_per_second"`
+	RxUtilisationPercent *float64 `json:"rx_utilisation_percent,omitempty"`
+	TxUtilisationPercent *float64 `json:"tx_utilisation_percent,omitempty"`
+}
+
+// GetCounterDelta is how much a counter has gone up by, allowing for it going backwards: if the last value was in the
+// top half of the 32-bit range it's taken to be a 32-bit counter that's wrapped (some drivers still have them),
+// otherwise it's taken to be a reset (e.g. a driver reload, or the interface being recreated) and the delta is just the
+// current value (i.e. what's been counted since)
+func GetCounterDelta(last int64, current int64) int64 {
+	if current >= last {
+		return current - last
+	}
+
+	if last >= math.MaxUint32/2 && last <= math.MaxUint32 {
+		return (math.MaxUint32 - last) + current + 1
+	}
+
+	return current
+}
+
+// GetRates works out the rates between two snapshots of the same interface (nil if they're not in order)
+func GetRates(last NetworkInterface, current NetworkInterface) *Rates {
+	interval := current.Timestamp.Sub(last.Timestamp).Seconds()
+	if interval <= 0 {
+		return nil
+	}
+
+	getRate := func(getValue func(NetworkInterface) int64) float64 {
+		return float64(GetCounterDelta(getValue(last), getValue(current))) / interval
+	}
+
+	rates := Rates{
+		Interval:           interval,
+		RxBitsPerSecond:    getRate(func(n NetworkInterface) int64 { return n.RxBytes }) * 8,
+		TxBitsPerSecond:    getRate(func(n NetworkInterface) int64 { return n.TxBytes }) * 8,
+		RxPacketsPerSecond: getRate(func(n NetworkInterface) int64 { return n.RxPackets }),
+		TxPacketsPerSecond: getRate(func(n NetworkInterface) int64 { return n.TxPackets }),
+		RxErrorsPerSecond:  getRate(func(n NetworkInterface) int64 { return n.RxErrors }),
+		TxErrorsPerSecond:  getRate(func(n NetworkInterface) int64 { return n.TxErrors }),
+		RxDroppedPerSecond: getRate(func(n NetworkInterface) int64 { return n.RxDropped }),
+		TxDroppedPerSecond: getRate(func(n NetworkInterface) int64 { return n.TxDropped }),
+	}
+
+	// speed is in Mb/s
+	if current.Speed > 0 {
+		linkBitsPerSecond := float64(current.Speed) * 1_000_000
+
+		rxUtilisationPercent := rates.RxBitsPerSecond / linkBitsPerSecond * 100
+		txUtilisationPercent := rates.TxBitsPerSecond / linkBitsPerSecond * 100
+
+		rates.RxUtilisationPercent = &rxUtilisationPercent
+		rates.TxUtilisationPercent = &txUtilisationPercent
+	}
+
+	return &rates
+}
@@ -0,0 +1,285 @@
+package network_interfaces
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/initialed85/loser/pkg/netlink"
+	"golang.org/x/sys/unix"
+)
+
+type NextHop struct {
+	Gateway   string `json:"gateway,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Weight    int    `json:"weight"`
+}
+
+type Route struct {
+	Family      string    `json:"family"`
+	Destination string    `json:"destination"`
+	Gateway     string    `json:"gateway,omitempty"`
+	Interface   string    `json:"interface,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Metric      int       `json:"metric"`
+	Table       int       `json:"table"`
+	Protocol    string    `json:"protocol"`
+	Scope       string    `json:"scope"`
+	Type        string    `json:"type"`
+	NextHops    []NextHop `json:"next_hops,omitempty"`
+}
+
+type Gateway struct {
+	Family    string `json:"family"`
+	IP        string `json:"ip"`
+	Interface string `json:"interface"`
+	Metric    int    `json:"metric"`
+}
+
+var routeProtocols = map[byte]string{
+	unix.RTPROT_UNSPEC:     "unspec",
+	unix.RTPROT_REDIRECT:   "redirect",
+	unix.RTPROT_KERNEL:     "kernel",
+	unix.RTPROT_BOOT:       "boot",
+	unix.RTPROT_STATIC:     "static",
+	unix.RTPROT_RA:         "ra",
+	unix.RTPROT_DHCP:       "dhcp",
+	unix.RTPROT_BIRD:       "bird",
+	unix.RTPROT_ZEBRA:      "zebra",
+	unix.RTPROT_KEEPALIVED: "keepalived",
+	unix.RTPROT_BGP:        "bgp",
+	unix.RTPROT_OSPF:       "ospf",
+}
+
+var routeTypes = map[byte]string{
+	unix.RTN_UNSPEC:      "unspec",
+	unix.RTN_UNICAST:     "unicast",
+	unix.RTN_LOCAL:       "local",
+	unix.RTN_BROADCAST:   "broadcast",
+	unix.RTN_ANYCAST:     "anycast",
+	unix.RTN_MULTICAST:   "multicast",
+	unix.RTN_BLACKHOLE:   "blackhole",
+	unix.RTN_UNREACHABLE: "unreachable",
+	unix.RTN_PROHIBIT:    "prohibit",
+	unix.RTN_THROW:       "throw",
+}
+
+// getInterfaceNames maps interface index to name (for when all we've got from netlink is the index)
+func getInterfaceNames() map[int]string {
+	interfaceNames := make(map[int]string)
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("warning: failed net.Interfaces: %s", err)
+		return interfaceNames
+	}
+
+	for _, iface := range ifaces {
+		interfaceNames[iface.Index] = iface.Name
+	}
+
+	return interfaceNames
+}
+
+func getInterfaceName(interfaceNames map[int]string, ifIndex int) string {
+	if ifIndex == 0 {
+		return ""
+	}
+
+	name, ok := interfaceNames[ifIndex]
+	if ok {
+		return name
+	}
+
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err == nil {
+		return iface.Name
+	}
+
+	return fmt.Sprintf("if%d", ifIndex)
+}
+
+// GetRoutes dumps the IPv4 and IPv6 routes (RTM_GETROUTE), leaving out the local table (which is just the host's own
+// addresses and broadcast addresses)
+func GetRoutes() ([]Route, error) {
+	rtMsg := make([]byte, unix.SizeofRtMsg)
+	rtMsg[0] = unix.AF_UNSPEC
+
+	messages, err := netlink.Request(unix.NETLINK_ROUTE, unix.RTM_GETROUTE, unix.NLM_F_DUMP, rtMsg)
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.Request for RTM_GETROUTE: %s", err)
+	}
+
+	interfaceNames := getInterfaceNames()
+
+	routes := make([]Route, 0)
+
+	for _, message := range messages {
+		if message.Type != unix.RTM_NEWROUTE {
+			continue
+		}
+
+		route, err := parseRouteMessage(message.Data, interfaceNames)
+		if err != nil {
+			return nil, err
+		}
+
+		if route.Table == unix.RT_TABLE_LOCAL {
+			continue
+		}
+
+		routes = append(routes, *route)
+	}
+
+	return routes, nil
+}
+
+func parseRouteMessage(data []byte, interfaceNames map[int]string) (*Route, error) {
+	if len(data) < unix.SizeofRtMsg {
+		return nil, fmt.Errorf("truncated rtmsg (%d bytes)", len(data))
+	}
+
+	family := data[0]
+	dstLen := int(data[1])
+
+	attributes, err := netlink.ParseAttributeMap(data[unix.SizeofRtMsg:])
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.ParseAttributeMap for RTM_NEWROUTE: %s", err)
+	}
+
+	route := Route{
+		Family:      getFamilyName(family),
+		Destination: "default",
+		Table:       int(data[4]),
+		Protocol:    routeProtocols[data[5]],
+		Scope:       getScopeName(data[6]),
+		Type:        routeTypes[data[7]],
+		Metric:      int(netlink.Uint32(attributes[unix.RTA_PRIORITY])),
+	}
+
+	if route.Protocol == "" {
+		route.Protocol = fmt.Sprintf("%d", data[5])
+	}
+
+	if route.Type == "" {
+		route.Type = fmt.Sprintf("%d", data[7])
+	}
+
+	if dstLen > 0 {
+		route.Destination = fmt.Sprintf("%s/%d", net.IP(attributes[unix.RTA_DST]), dstLen)
+	}
+
+	table, ok := attributes[unix.RTA_TABLE]
+	if ok {
+		route.Table = int(netlink.Uint32(table))
+	}
+
+	gateway, ok := attributes[unix.RTA_GATEWAY]
+	if ok {
+		route.Gateway = net.IP(gateway).String()
+	}
+
+	oif, ok := attributes[unix.RTA_OIF]
+	if ok {
+		route.Interface = getInterfaceName(interfaceNames, int(netlink.Uint32(oif)))
+	}
+
+	source, ok := attributes[unix.RTA_PREFSRC]
+	if ok {
+		route.Source = net.IP(source).String()
+	}
+
+	// ECMP routes have their gateways in a list of struct rtnexthop (each followed by its own attributes)
+	multipath := attributes[unix.RTA_MULTIPATH]
+	for len(multipath) >= unix.SizeofRtNexthop {
+		length := int(binary.NativeEndian.Uint16(multipath[0:2]))
+		if length < unix.SizeofRtNexthop || length > len(multipath) {
+			return nil, fmt.Errorf("invalid rtnexthop length %d (have %d bytes)", length, len(multipath))
+		}
+
+		nextHop := NextHop{
+			Interface: getInterfaceName(interfaceNames, int(int32(netlink.Uint32(multipath[4:8])))),
+			Weight:    int(multipath[3]) + 1,
+		}
+
+		nextHopAttributes, err := netlink.ParseAttributeMap(multipath[unix.SizeofRtNexthop:length])
+		if err != nil {
+			return nil, fmt.Errorf("failed netlink.ParseAttributeMap for rtnexthop: %s", err)
+		}
+
+		nextHopGateway, ok := nextHopAttributes[unix.RTA_GATEWAY]
+		if ok {
+			nextHop.Gateway = net.IP(nextHopGateway).String()
+		}
+
+		route.NextHops = append(route.NextHops, nextHop)
+
+		aligned := (length + unix.NLA_ALIGNTO - 1) & ^(unix.NLA_ALIGNTO - 1)
+		if aligned > len(multipath) {
+			break
+		}
+
+		multipath = multipath[aligned:]
+	}
+
+	return &route, nil
+}
+
+// String renders a route roughly the way "ip route" would (e.g. "default via 192.168.1.1 dev eth0")
+func (r Route) String() string {
+	s := r.Destination
+
+	if r.Gateway != "" {
+		s = fmt.Sprintf("%s via %s", s, r.Gateway)
+	}
+
+	if r.Interface != "" {
+		s = fmt.Sprintf("%s dev %s", s, r.Interface)
+	}
+
+	for _, nextHop := range r.NextHops {
+		s = fmt.Sprintf("%s nexthop via %s dev %s weight %d", s, nextHop.Gateway, nextHop.Interface, nextHop.Weight)
+	}
+
+	if r.Family == "ipv6" {
+		s = fmt.Sprintf("%s (ipv6)", s)
+	}
+
+	return s
+}
+
+// GetDefaultGateways pulls the gateways out of the default routes in the main table (including each of the next hops
+// for ECMP default routes)
+func GetDefaultGateways(routes []Route) []Gateway {
+	gateways := make([]Gateway, 0)
+
+	for _, route := range routes {
+		if route.Destination != "default" || route.Table != unix.RT_TABLE_MAIN || route.Type != "unicast" {
+			continue
+		}
+
+		if route.Gateway != "" {
+			gateways = append(gateways, Gateway{
+				Family:    route.Family,
+				IP:        route.Gateway,
+				Interface: route.Interface,
+				Metric:    route.Metric,
+			})
+		}
+
+		for _, nextHop := range route.NextHops {
+			if nextHop.Gateway == "" {
+				continue
+			}
+
+			gateways = append(gateways, Gateway{
+				Family:    route.Family,
+				IP:        nextHop.Gateway,
+				Interface: nextHop.Interface,
+				Metric:    route.Metric,
+			})
+		}
+	}
+
+	return gateways
+}
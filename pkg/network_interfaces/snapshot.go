@@ -0,0 +1,42 @@
+package network_interfaces
+
+import (
+	"time"
+)
+
+type Snapshot struct {
+	Timestamp         time.Time          `json:"timestamp"`
+	NetworkInterfaces []NetworkInterface `json:"network_interfaces"`
+	Routes            []Route            `json:"routes"`
+	DefaultGateways   []Gateway          `json:"default_gateways"`
+	Neighbours        []Neighbour        `json:"neighbours"`
+}
+
+// GetSnapshot answers "what does this box think its network looks like": interfaces (with their addresses), routes
+// and the neighbour table
+func GetSnapshot() (*Snapshot, error) {
+	networkInterfaces, err := GetNetworkInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := GetRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	neighbours, err := GetNeighbours()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := Snapshot{
+		Timestamp:         time.Now(),
+		NetworkInterfaces: networkInterfaces,
+		Routes:            routes,
+		DefaultGateways:   GetDefaultGateways(routes),
+		Neighbours:        neighbours,
+	}
+
+	return &snapshot, nil
+}
@@ -0,0 +1,238 @@
+package network_interfaces
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// relative to procfs (see SetFS)
+	procNetBondingPath    = "net/bonding"
+	procNetVLANConfigPath = "net/vlan/config"
+)
+
+type BondSlave struct {
+	Name             string `json:"name"`
+	MIIStatus        string `json:"mii_status"`
+	Speed            string `json:"speed,omitempty"`
+	Duplex           string `json:"duplex,omitempty"`
+	LinkFailureCount int64  `json:"link_failure_count"`
+	PermanentMAC     string `json:"permanent_mac,omitempty"`
+}
+
+type Bond struct {
+	Mode        string      `json:"mode"`
+	ActiveSlave string      `json:"active_slave,omitempty"`
+	MIIStatus   string      `json:"mii_status"`
+	Slaves      []BondSlave `json:"slaves"`
+}
+
+// parseBond parses /proc/net/bonding/<bond>, which is some "Key: Value" lines for the bond and then a block of them per
+// slave (each starting with "Slave Interface: <name>")
+func parseBond(data []byte) (*Bond, error) {
+	bond := Bond{
+		Slaves: make([]BondSlave, 0),
+	}
+
+	var slave *BondSlave
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if key == "Slave Interface" {
+			bond.Slaves = append(bond.Slaves, BondSlave{Name: value})
+			slave = &bond.Slaves[len(bond.Slaves)-1]
+			continue
+		}
+
+		if slave == nil {
+			switch key {
+			case "Bonding Mode":
+				bond.Mode = value
+			case "Currently Active Slave":
+				if value != "None" {
+					bond.ActiveSlave = value
+				}
+			case "MII Status":
+				bond.MIIStatus = value
+			}
+
+			continue
+		}
+
+		switch key {
+		case "MII Status":
+			slave.MIIStatus = value
+		case "Speed":
+			slave.Speed = value
+		case "Duplex":
+			slave.Duplex = value
+		case "Link Failure Count":
+			linkFailureCount, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed strconv.ParseInt for Link Failure Count: %#+v: %s", value, err)
+			}
+
+			slave.LinkFailureCount = linkFailureCount
+		case "Permanent HW addr":
+			slave.PermanentMAC = value
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if bond.Mode == "" {
+		return nil, fmt.Errorf("no Bonding Mode line")
+	}
+
+	return &bond, nil
+}
+
+func GetBond(name string) (*Bond, error) {
+	_, proc := getFS()
+
+	data, err := fs.ReadFile(proc, path.Join(procNetBondingPath, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBond(data)
+}
+
+type vlan struct {
+	parent string
+	id     int
+}
+
+// parseVLANConfig parses /proc/net/vlan/config (two header lines, then "<name> | <id> | <parent>" per VLAN interface)
+func parseVLANConfig(data []byte) map[string]vlan {
+	vlans := make(map[string]vlan)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) != 3 {
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			continue
+		}
+
+		vlans[strings.TrimSpace(parts[0])] = vlan{
+			parent: strings.TrimSpace(parts[2]),
+			id:     id,
+		}
+	}
+
+	return vlans
+}
+
+// sysfsKinds are the DEVTYPEs that are also an IFLA_INFO_KIND, so the two backends agree; the rest (e.g. wlan, which
+// netlink has no kind for) are left empty, as are the kinds sysfs can't see at all (e.g. veth, dummy, ifb)
+var sysfsKinds = map[string]struct{}{
+	"bond":   {},
+	"bridge": {},
+	"geneve": {},
+	"vlan":   {},
+	"vxlan":  {},
+}
+
+// getSysfsKind gets the DEVTYPE from the uevent file, if it's one of the sysfsKinds
+func getSysfsKind(sys fs.FS, name string) string {
+	data, err := readSysClassNet(sys, name, "uevent")
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		devType, ok := strings.CutPrefix(line, "DEVTYPE=")
+		if !ok {
+			continue
+		}
+
+		devType = strings.TrimSpace(devType)
+
+		_, isKind := sysfsKinds[devType]
+		if isKind {
+			return devType
+		}
+
+		return ""
+	}
+
+	return ""
+}
+
+// getSysfsMaster gets the name of whatever the master symlink (present for bond slaves, bridge ports etc) points at,
+// from its uevent file (fs.FS can't read links)
+func getSysfsMaster(sys fs.FS, name string) string {
+	data, err := readSysClassNet(sys, name, "master", "uevent")
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		master, ok := strings.CutPrefix(line, "INTERFACE=")
+		if ok {
+			return strings.TrimSpace(master)
+		}
+	}
+
+	return ""
+}
+
+// fillSlaves works out the slaves (bond members, bridge ports) of each interface from the other interfaces' masters
+func fillSlaves(networkInterfaces []NetworkInterface) {
+	slavesByMaster := make(map[string][]string)
+
+	for _, networkInterface := range networkInterfaces {
+		if networkInterface.Master == "" {
+			continue
+		}
+
+		slavesByMaster[networkInterface.Master] = append(slavesByMaster[networkInterface.Master], networkInterface.Name)
+	}
+
+	for i := range networkInterfaces {
+		slaves := slavesByMaster[networkInterfaces[i].Name]
+		sort.Strings(slaves)
+
+		networkInterfaces[i].Slaves = slaves
+	}
+}
+
+// fillTopology fills in the slaves and (for bonds) the bonding details
+func fillTopology(networkInterfaces []NetworkInterface) {
+	fillSlaves(networkInterfaces)
+
+	for i := range networkInterfaces {
+		if networkInterfaces[i].Kind != "bond" {
+			continue
+		}
+
+		bond, err := GetBond(networkInterfaces[i].Name)
+		if err != nil {
+			log.Printf("warning: failed GetBond for %s: %s", networkInterfaces[i].Name, err)
+			continue
+		}
+
+		networkInterfaces[i].Bond = bond
+	}
+}
@@ -0,0 +1,289 @@
+package network_interfaces
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var watchedGroups = []int{
+	unix.RTNLGRP_LINK,
+	unix.RTNLGRP_IPV4_IFADDR,
+	unix.RTNLGRP_IPV6_IFADDR,
+	unix.RTNLGRP_IPV4_ROUTE,
+	unix.RTNLGRP_IPV6_ROUTE,
+}
+
+type linkState struct {
+	name      string
+	operState string
+}
+
+// WatchLinkEvents subscribes to the rtnetlink multicast groups for links, addresses and routes and turns the kernel's
+// notifications into events as they happen (rather than on the next tick); it blocks until the context is cancelled
+// (returning nil) or the socket fails (returning the error, so the caller can dial again)
+func WatchLinkEvents(ctx context.Context, eventFn func(events.Event)) error {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for _, group := range watchedGroups {
+		err = conn.JoinGroup(group)
+		if err != nil {
+			return fmt.Errorf("failed conn.JoinGroup for %d: %s", group, err)
+		}
+	}
+
+	err = conn.SetReceiveTimeout(time.Second * 1)
+	if err != nil {
+		return fmt.Errorf("failed conn.SetReceiveTimeout: %s", err)
+	}
+
+	// seed the link states so that we only report changes
+	linkStates := make(map[int]linkState)
+	interfaceNames := make(map[int]string)
+
+	// (everything's new the first time around, so those events don't count)
+	_, err = resyncLinkStates(linkStates, interfaceNames)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		messages, err := conn.Receive()
+		if err != nil {
+			if errors.Is(err, netlink.ErrTimeout) {
+				continue
+			}
+
+			// the socket's fine, but we've missed some notifications, so go by a fresh dump of the links instead
+			if errors.Is(err, netlink.ErrOverrun) {
+				log.Printf("warning: %s; going by a fresh dump of the links", err)
+
+				missedEvents, err := resyncLinkStates(linkStates, interfaceNames)
+				if err != nil {
+					return err
+				}
+
+				for _, event := range missedEvents {
+					event.Timestamp = time.Now()
+					eventFn(event)
+				}
+
+				continue
+			}
+
+			return fmt.Errorf("failed conn.Receive for link events: %s", err)
+		}
+
+		now := time.Now()
+
+		for _, message := range messages {
+			var event *events.Event
+
+			switch message.Type {
+			case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+				networkInterface, err := parseLinkMessage(message.Data)
+				if err != nil {
+					log.Printf("warning: failed parseLinkMessage: %s", err)
+					continue
+				}
+
+				event = handleLinkMessage(message.Type, networkInterface, linkStates)
+
+				// names are kept after a removal so the address and route removals that follow can still be labelled
+				interfaceNames[networkInterface.IFIndex] = networkInterface.Name
+
+			case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+				event, err = handleAddressMessage(message.Type, message.Data, interfaceNames)
+				if err != nil {
+					log.Printf("warning: failed handleAddressMessage: %s", err)
+					continue
+				}
+
+			case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+				event, err = handleRouteMessage(message.Type, message.Data, interfaceNames)
+				if err != nil {
+					log.Printf("warning: failed handleRouteMessage: %s", err)
+					continue
+				}
+			}
+
+			if event == nil {
+				continue
+			}
+
+			event.Timestamp = now
+
+			eventFn(*event)
+		}
+	}
+}
+
+// resyncLinkStates brings the link states up to date with a dump of the links, returning the events for any changes
+// (e.g. ones whose notifications the kernel dropped); the address and route changes in the meantime are lost though
+func resyncLinkStates(linkStates map[int]linkState, interfaceNames map[int]string) ([]events.Event, error) {
+	networkInterfaces, err := GetNetworkInterfacesFromNetlink()
+	if err != nil {
+		return nil, err
+	}
+
+	return getLinkStateChanges(networkInterfaces, linkStates, interfaceNames), nil
+}
+
+// getLinkStateChanges is the events for going from the link states we've got to the given interfaces
+func getLinkStateChanges(networkInterfaces []NetworkInterface, linkStates map[int]linkState, interfaceNames map[int]string) []events.Event {
+	changes := make([]events.Event, 0)
+
+	seen := make(map[int]struct{})
+
+	for i := range networkInterfaces {
+		seen[networkInterfaces[i].IFIndex] = struct{}{}
+		interfaceNames[networkInterfaces[i].IFIndex] = networkInterfaces[i].Name
+
+		event := handleLinkMessage(unix.RTM_NEWLINK, &networkInterfaces[i], linkStates)
+		if event != nil {
+			changes = append(changes, *event)
+		}
+	}
+
+	for ifIndex, state := range linkStates {
+		if _, ok := seen[ifIndex]; ok {
+			continue
+		}
+
+		event := handleLinkMessage(unix.RTM_DELLINK, &NetworkInterface{Name: state.name, IFIndex: ifIndex}, linkStates)
+		changes = append(changes, *event)
+	}
+
+	return changes
+}
+
+func handleLinkMessage(messageType uint16, networkInterface *NetworkInterface, linkStates map[int]linkState) *events.Event {
+	lastState, seen := linkStates[networkInterface.IFIndex]
+
+	if messageType == unix.RTM_DELLINK {
+		delete(linkStates, networkInterface.IFIndex)
+
+		return &events.Event{
+			Kind:      events.KindLinkRemoved,
+			Interface: networkInterface.Name,
+			Old:       lastState.operState,
+			Message:   fmt.Sprintf("%s removed", networkInterface.Name),
+		}
+	}
+
+	linkStates[networkInterface.IFIndex] = linkState{
+		name:      networkInterface.Name,
+		operState: networkInterface.OperState,
+	}
+
+	if !seen {
+		return &events.Event{
+			Kind:      events.KindLinkAdded,
+			Interface: networkInterface.Name,
+			New:       networkInterface.OperState,
+			Message:   fmt.Sprintf("%s added (%s)", networkInterface.Name, networkInterface.OperState),
+		}
+	}
+
+	// "unknown" is what drivers that don't track operstate (e.g. lo, tun) give while they're up
+	isUp := func(operState string) bool {
+		return operState == "up" || operState == "unknown"
+	}
+
+	if isUp(lastState.operState) == isUp(networkInterface.OperState) {
+		return nil
+	}
+
+	kind := events.KindLinkDown
+	if isUp(networkInterface.OperState) {
+		kind = events.KindLinkUp
+	}
+
+	return &events.Event{
+		Kind:      kind,
+		Interface: networkInterface.Name,
+		Old:       lastState.operState,
+		New:       networkInterface.OperState,
+		Message:   fmt.Sprintf("%s went from %s to %s", networkInterface.Name, lastState.operState, networkInterface.OperState),
+	}
+}
+
+func handleAddressMessage(messageType uint16, data []byte, interfaceNames map[int]string) (*events.Event, error) {
+	ifIndex, address, err := parseAddressMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	name := getInterfaceName(interfaceNames, ifIndex)
+	cidr := fmt.Sprintf("%s/%d", address.IP, address.PrefixLen)
+
+	if messageType == unix.RTM_DELADDR {
+		return &events.Event{
+			Kind:      events.KindAddressRemoved,
+			Interface: name,
+			Old:       cidr,
+			Message:   fmt.Sprintf("%s removed from %s", cidr, name),
+		}, nil
+	}
+
+	return &events.Event{
+		Kind:      events.KindAddressAdded,
+		Interface: name,
+		New:       cidr,
+		Message:   fmt.Sprintf("%s added to %s", cidr, name),
+	}, nil
+}
+
+func handleRouteMessage(messageType uint16, data []byte, interfaceNames map[int]string) (*events.Event, error) {
+	route, err := parseRouteMessage(data, interfaceNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// the local and broadcast routes in the other tables come and go with every address, so they're just noise
+	if route.Table != unix.RT_TABLE_MAIN || route.Type != "unicast" {
+		return nil, nil
+	}
+
+	kind := events.KindRouteAdded
+	if route.Destination == "default" {
+		kind = events.KindDefaultRouteChanged
+	}
+
+	if messageType == unix.RTM_DELROUTE {
+		if kind == events.KindRouteAdded {
+			kind = events.KindRouteRemoved
+		}
+
+		return &events.Event{
+			Kind:      kind,
+			Interface: route.Interface,
+			Old:       route.String(),
+			Message:   fmt.Sprintf("route removed (%s)", route),
+		}, nil
+	}
+
+	return &events.Event{
+		Kind:      kind,
+		Interface: route.Interface,
+		New:       route.String(),
+		Message:   fmt.Sprintf("route added (%s)", route),
+	}, nil
+}
@@ -0,0 +1,259 @@
+package network_interfaces
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/initialed85/loser/pkg/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// relative to procfs (see SetFS)
+var procNetWirelessPath = "net/wireless"
+
+// the interfaces we've already warned about failing to get the stations for (e.g. no nl80211), so it's not every tick
+var stationsWarnedMu = new(sync.Mutex)
+var stationsWarned = make(map[string]struct{})
+
+// Station is what nl80211 knows about a peer; for a client (managed mode) interface that's the access point
+type Station struct {
+	MAC           string        `json:"mac"`
+	Signal        int           `json:"signal"`
+	SignalAvg     int           `json:"signal_avg"`
+	TxBitrate     int64         `json:"tx_bitrate"`
+	RxBitrate     int64         `json:"rx_bitrate"`
+	TxRetries     int64         `json:"tx_retries"`
+	TxFailed      int64         `json:"tx_failed"`
+	BeaconLoss    int64         `json:"beacon_loss"`
+	RxBytes       int64         `json:"rx_bytes"`
+	TxBytes       int64         `json:"tx_bytes"`
+	RxPackets     int64         `json:"rx_packets"`
+	TxPackets     int64         `json:"tx_packets"`
+	ConnectedTime time.Duration `json:"connected_time"`
+	InactiveTime  time.Duration `json:"inactive_time"`
+}
+
+// Wireless is the wireless extensions view of an interface (/proc/net/wireless), plus the nl80211 stations if we could
+// get them; levels are in dBm for most drivers (a noise level of -256 means the driver doesn't know)
+type Wireless struct {
+	LinkQuality    float64   `json:"link_quality"`
+	SignalLevel    float64   `json:"signal_level"`
+	NoiseLevel     float64   `json:"noise_level"`
+	DiscardedNWID  int64     `json:"discarded_nwid"`
+	DiscardedCrypt int64     `json:"discarded_crypt"`
+	DiscardedFrag  int64     `json:"discarded_frag"`
+	DiscardedRetry int64     `json:"discarded_retry"`
+	DiscardedMisc  int64     `json:"discarded_misc"`
+	MissedBeacon   int64     `json:"missed_beacon"`
+	Stations       []Station `json:"stations,omitempty"`
+}
+
+// parseProcNetWireless parses /proc/net/wireless (two header lines, then "<name>: <status> <link> <level> <noise> <nwid>
+// <crypt> <frag> <retry> <misc> <beacon>" per interface; the quality values may have a trailing "." if they've changed)
+func parseProcNetWireless(data []byte) (map[string]Wireless, error) {
+	wirelessByName := make(map[string]Wireless)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		name = strings.TrimSpace(name)
+
+		fields := strings.Fields(rest)
+		if len(fields) < 10 || strings.Contains(name, "|") {
+			continue
+		}
+
+		quality := make([]float64, 3)
+		for i := range quality {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(fields[1+i], "."), 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed strconv.ParseFloat for %s: %#+v: %s", name, fields[1+i], err)
+			}
+
+			quality[i] = value
+		}
+
+		counters := make([]int64, 6)
+		for i := range counters {
+			value, err := strconv.ParseInt(fields[4+i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed strconv.ParseInt for %s: %#+v: %s", name, fields[4+i], err)
+			}
+
+			counters[i] = value
+		}
+
+		wirelessByName[name] = Wireless{
+			LinkQuality:    quality[0],
+			SignalLevel:    quality[1],
+			NoiseLevel:     quality[2],
+			DiscardedNWID:  counters[0],
+			DiscardedCrypt: counters[1],
+			DiscardedFrag:  counters[2],
+			DiscardedRetry: counters[3],
+			DiscardedMisc:  counters[4],
+			MissedBeacon:   counters[5],
+		}
+	}
+
+	return wirelessByName, nil
+}
+
+// getBitrate gets bits per second out of a nested struct nl80211_rate_info (which counts in units of 100 kb/s)
+func getBitrate(data []byte) int64 {
+	attributes, err := netlink.ParseAttributeMap(data)
+	if err != nil {
+		return 0
+	}
+
+	bitrate32, ok := attributes[unix.NL80211_RATE_INFO_BITRATE32]
+	if ok {
+		return int64(netlink.Uint32(bitrate32)) * 100_000
+	}
+
+	return int64(netlink.Uint16(attributes[unix.NL80211_RATE_INFO_BITRATE])) * 100_000
+}
+
+func parseStationMessage(data []byte) (*Station, error) {
+	attributes, err := netlink.ParseAttributeMap(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.ParseAttributeMap for NL80211_CMD_NEW_STATION: %s", err)
+	}
+
+	stationInfo, err := netlink.ParseAttributeMap(attributes[unix.NL80211_ATTR_STA_INFO])
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.ParseAttributeMap for NL80211_ATTR_STA_INFO: %s", err)
+	}
+
+	station := Station{
+		MAC:           net.HardwareAddr(attributes[unix.NL80211_ATTR_MAC]).String(),
+		TxRetries:     int64(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_TX_RETRIES])),
+		TxFailed:      int64(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_TX_FAILED])),
+		BeaconLoss:    int64(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_BEACON_LOSS])),
+		RxBytes:       int64(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_RX_BYTES])),
+		TxBytes:       int64(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_TX_BYTES])),
+		RxPackets:     int64(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_RX_PACKETS])),
+		TxPackets:     int64(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_TX_PACKETS])),
+		ConnectedTime: time.Duration(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_CONNECTED_TIME])) * time.Second,
+		InactiveTime:  time.Duration(netlink.Uint32(stationInfo[unix.NL80211_STA_INFO_INACTIVE_TIME])) * time.Millisecond,
+		TxBitrate:     getBitrate(stationInfo[unix.NL80211_STA_INFO_TX_BITRATE]),
+		RxBitrate:     getBitrate(stationInfo[unix.NL80211_STA_INFO_RX_BITRATE]),
+	}
+
+	// the 32-bit byte counters wrap quickly at Wi-Fi speeds, so the 64-bit ones win if the kernel has them
+	rxBytes64, ok := stationInfo[unix.NL80211_STA_INFO_RX_BYTES64]
+	if ok {
+		station.RxBytes = int64(netlink.Uint64(rxBytes64))
+	}
+
+	txBytes64, ok := stationInfo[unix.NL80211_STA_INFO_TX_BYTES64]
+	if ok {
+		station.TxBytes = int64(netlink.Uint64(txBytes64))
+	}
+
+	signal, ok := stationInfo[unix.NL80211_STA_INFO_SIGNAL]
+	if ok && len(signal) > 0 {
+		station.Signal = int(int8(signal[0]))
+	}
+
+	signalAvg, ok := stationInfo[unix.NL80211_STA_INFO_SIGNAL_AVG]
+	if ok && len(signalAvg) > 0 {
+		station.SignalAvg = int(int8(signalAvg[0]))
+	}
+
+	return &station, nil
+}
+
+// GetStations dumps the nl80211 stations for a wireless interface (NL80211_CMD_GET_STATION)
+func GetStations(ifIndex int) ([]Station, error) {
+	familyID, err := netlink.GetGenericFamilyID("nl80211")
+	if err != nil {
+		return nil, err
+	}
+
+	ifIndexValue := make([]byte, 4)
+	binary.NativeEndian.PutUint32(ifIndexValue, uint32(ifIndex))
+
+	messages, err := netlink.GenericRequest(familyID, unix.NL80211_CMD_GET_STATION, unix.NLM_F_DUMP, netlink.EncodeAttribute(unix.NL80211_ATTR_IFINDEX, ifIndexValue))
+	if err != nil {
+		return nil, fmt.Errorf("failed netlink.GenericRequest for NL80211_CMD_GET_STATION: %s", err)
+	}
+
+	stations := make([]Station, 0)
+
+	for _, message := range messages {
+		station, err := parseStationMessage(message.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		stations = append(stations, *station)
+	}
+
+	return stations, nil
+}
+
+// warnStations warns about failing to get an interface's stations the first time it happens (and again if it starts
+// failing after it's worked)
+func warnStations(name string, err error) {
+	stationsWarnedMu.Lock()
+	defer stationsWarnedMu.Unlock()
+
+	if err == nil {
+		delete(stationsWarned, name)
+		return
+	}
+
+	_, warned := stationsWarned[name]
+	if warned {
+		return
+	}
+
+	stationsWarned[name] = struct{}{}
+
+	log.Printf("warning: failed GetStations for %s (not warning again until it works): %s", name, err)
+}
+
+// fillWireless fills in the wireless details for the interfaces in /proc/net/wireless (the nl80211 stations are best
+// effort, e.g. wext-only drivers don't have them, and left out if the interfaces aren't in our network namespace)
+func fillWireless(networkInterfaces []NetworkInterface, withStations bool) {
+	_, proc := getFS()
+
+	data, err := fs.ReadFile(proc, procNetWirelessPath)
+	if err != nil {
+		// no wireless extensions (or no wireless at all)
+		return
+	}
+
+	wirelessByName, err := parseProcNetWireless(data)
+	if err != nil {
+		log.Printf("warning: failed parseProcNetWireless: %s", err)
+		return
+	}
+
+	for i := range networkInterfaces {
+		wireless, ok := wirelessByName[networkInterfaces[i].Name]
+		if !ok {
+			continue
+		}
+
+		if withStations {
+			stations, err := GetStations(networkInterfaces[i].IFIndex)
+			warnStations(networkInterfaces[i].Name, err)
+			if err == nil {
+				wireless.Stations = stations
+			}
+		}
+
+		networkInterfaces[i].Wireless = &wireless
+	}
+}
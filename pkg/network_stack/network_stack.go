@@ -0,0 +1,394 @@
+package network_stack
+
+import (
+	"errors"
+	"fmt"
+	_log "log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var log = _log.New(
+	os.Stdout,
+	"loser: ",
+	_log.Ldate|
+		_log.Ltime|
+		_log.Lmicroseconds|
+		_log.LUTC|
+		_log.Lmsgprefix|
+		_log.LstdFlags,
+)
+
+var (
+	procNetSNMPPath    = "/proc/net/snmp"
+	procNetSNMP6Path   = "/proc/net/snmp6"
+	procNetNetstatPath = "/proc/net/netstat"
+)
+
+// SetProcfs sets where procfs is read from, e.g. "/host/proc/1" for the network namespace of a host's pid 1 with its
+// /proc bind mounted into a container
+func SetProcfs(procfs string) {
+	procNetSNMPPath = path.Join(procfs, "net/snmp")
+	procNetSNMP6Path = path.Join(procfs, "net/snmp6")
+	procNetNetstatPath = path.Join(procfs, "net/netstat")
+	procNetSoftnetStatPath = path.Join(procfs, "net/softnet_stat")
+}
+
+var snmp6Prefixes = []string{
+	"UdpLite6",
+	"Icmp6",
+	"Udp6",
+	"Ip6",
+}
+
+type NetworkStack struct {
+	Timestamp              time.Time        `json:"timestamp"`
+	IPInReceives           int64            `json:"ip_in_receives"`
+	IPInHdrErrors          int64            `json:"ip_in_hdr_errors"`
+	IPInAddrErrors         int64            `json:"ip_in_addr_errors"`
+	IPForwDatagrams        int64            `json:"ip_forw_datagrams"`
+	IPInUnknownProtos      int64            `json:"ip_in_unknown_protos"`
+	IPInDiscards           int64            `json:"ip_in_discards"`
+	IPInDelivers           int64            `json:"ip_in_delivers"`
+	IPOutRequests          int64            `json:"ip_out_requests"`
+	IPOutDiscards          int64            `json:"ip_out_discards"`
+	IPOutNoRoutes          int64            `json:"ip_out_no_routes"`
+	IPReasmTimeout         int64            `json:"ip_reasm_timeout"`
+	IPReasmReqds           int64            `json:"ip_reasm_reqds"`
+	IPReasmOKs             int64            `json:"ip_reasm_oks"`
+	IPReasmFails           int64            `json:"ip_reasm_fails"`
+	IPFragOKs              int64            `json:"ip_frag_oks"`
+	IPFragFails            int64            `json:"ip_frag_fails"`
+	IPFragCreates          int64            `json:"ip_frag_creates"`
+	IPExtInNoRoutes        int64            `json:"ip_ext_in_no_routes"`
+	IPExtInTruncatedPkts   int64            `json:"ip_ext_in_truncated_pkts"`
+	IPExtInCsumErrors      int64            `json:"ip_ext_in_csum_errors"`
+	IPExtInOctets          int64            `json:"ip_ext_in_octets"`
+	IPExtOutOctets         int64            `json:"ip_ext_out_octets"`
+	ICMPInMsgs             int64            `json:"icmp_in_msgs"`
+	ICMPInErrors           int64            `json:"icmp_in_errors"`
+	ICMPInCsumErrors       int64            `json:"icmp_in_csum_errors"`
+	ICMPInDestUnreachs     int64            `json:"icmp_in_dest_unreachs"`
+	ICMPInTimeExcds        int64            `json:"icmp_in_time_excds"`
+	ICMPOutMsgs            int64            `json:"icmp_out_msgs"`
+	ICMPOutErrors          int64            `json:"icmp_out_errors"`
+	ICMPOutDestUnreachs    int64            `json:"icmp_out_dest_unreachs"`
+	ICMPOutTimeExcds       int64            `json:"icmp_out_time_excds"`
+	TCPActiveOpens         int64            `json:"tcp_active_opens"`
+	TCPPassiveOpens        int64            `json:"tcp_passive_opens"`
+	TCPAttemptFails        int64            `json:"tcp_attempt_fails"`
+	TCPEstabResets         int64            `json:"tcp_estab_resets"`
+	TCPCurrEstab           int64            `json:"tcp_curr_estab"`
+	TCPInSegs              int64            `json:"tcp_in_segs"`
+	TCPOutSegs             int64            `json:"tcp_out_segs"`
+	TCPRetransSegs         int64            `json:"tcp_retrans_segs"`
+	TCPInErrs              int64            `json:"tcp_in_errs"`
+	TCPOutRsts             int64            `json:"tcp_out_rsts"`
+	TCPInCsumErrors        int64            `json:"tcp_in_csum_errors"`
+	TCPExtSyncookiesSent   int64            `json:"tcp_ext_syncookies_sent"`
+	TCPExtSyncookiesFailed int64            `json:"tcp_ext_syncookies_failed"`
+	TCPExtPruneCalled      int64            `json:"tcp_ext_prune_called"`
+	TCPExtRcvPruned        int64            `json:"tcp_ext_rcv_pruned"`
+	TCPExtOfoPruned        int64            `json:"tcp_ext_ofo_pruned"`
+	TCPExtListenOverflows  int64            `json:"tcp_ext_listen_overflows"`
+	TCPExtListenDrops      int64            `json:"tcp_ext_listen_drops"`
+	TCPExtTimeouts         int64            `json:"tcp_ext_timeouts"`
+	TCPExtLostRetransmit   int64            `json:"tcp_ext_lost_retransmit"`
+	TCPExtFastRetrans      int64            `json:"tcp_ext_fast_retrans"`
+	TCPExtSlowStartRetrans int64            `json:"tcp_ext_slow_start_retrans"`
+	TCPExtSynRetrans       int64            `json:"tcp_ext_syn_retrans"`
+	TCPExtLossProbes       int64            `json:"tcp_ext_loss_probes"`
+	TCPExtRetransFail      int64            `json:"tcp_ext_retrans_fail"`
+	TCPExtOFOQueue         int64            `json:"tcp_ext_ofo_queue"`
+	TCPExtOFODrop          int64            `json:"tcp_ext_ofo_drop"`
+	TCPExtRcvQDrop         int64            `json:"tcp_ext_rcv_qdrop"`
+	TCPExtBacklogDrop      int64            `json:"tcp_ext_backlog_drop"`
+	TCPExtAbortOnTimeout   int64            `json:"tcp_ext_abort_on_timeout"`
+	TCPExtAbortOnMemory    int64            `json:"tcp_ext_abort_on_memory"`
+	TCPExtMemoryPressures  int64            `json:"tcp_ext_memory_pressures"`
+	UDPInDatagrams         int64            `json:"udp_in_datagrams"`
+	UDPNoPorts             int64            `json:"udp_no_ports"`
+	UDPInErrors            int64            `json:"udp_in_errors"`
+	UDPOutDatagrams        int64            `json:"udp_out_datagrams"`
+	UDPRcvbufErrors        int64            `json:"udp_rcvbuf_errors"`
+	UDPSndbufErrors        int64            `json:"udp_sndbuf_errors"`
+	UDPInCsumErrors        int64            `json:"udp_in_csum_errors"`
+	UDPIgnoredMulti        int64            `json:"udp_ignored_multi"`
+	UDPMemErrors           int64            `json:"udp_mem_errors"`
+	IP6InReceives          int64            `json:"ip6_in_receives"`
+	IP6InHdrErrors         int64            `json:"ip6_in_hdr_errors"`
+	IP6InAddrErrors        int64            `json:"ip6_in_addr_errors"`
+	IP6InNoRoutes          int64            `json:"ip6_in_no_routes"`
+	IP6InTooBigErrors      int64            `json:"ip6_in_too_big_errors"`
+	IP6InDiscards          int64            `json:"ip6_in_discards"`
+	IP6InDelivers          int64            `json:"ip6_in_delivers"`
+	IP6OutRequests         int64            `json:"ip6_out_requests"`
+	IP6OutDiscards         int64            `json:"ip6_out_discards"`
+	IP6OutNoRoutes         int64            `json:"ip6_out_no_routes"`
+	IP6ReasmTimeout        int64            `json:"ip6_reasm_timeout"`
+	IP6ReasmReqds          int64            `json:"ip6_reasm_reqds"`
+	IP6ReasmOKs            int64            `json:"ip6_reasm_oks"`
+	IP6ReasmFails          int64            `json:"ip6_reasm_fails"`
+	IP6FragOKs             int64            `json:"ip6_frag_oks"`
+	IP6FragFails           int64            `json:"ip6_frag_fails"`
+	IP6FragCreates         int64            `json:"ip6_frag_creates"`
+	ICMP6InMsgs            int64            `json:"icmp6_in_msgs"`
+	ICMP6InErrors          int64            `json:"icmp6_in_errors"`
+	ICMP6InCsumErrors      int64            `json:"icmp6_in_csum_errors"`
+	ICMP6InDestUnreachs    int64            `json:"icmp6_in_dest_unreachs"`
+	ICMP6InPktTooBigs      int64            `json:"icmp6_in_pkt_too_bigs"`
+	ICMP6OutMsgs           int64            `json:"icmp6_out_msgs"`
+	ICMP6OutErrors         int64            `json:"icmp6_out_errors"`
+	ICMP6OutDestUnreachs   int64            `json:"icmp6_out_dest_unreachs"`
+	UDP6InDatagrams        int64            `json:"udp6_in_datagrams"`
+	UDP6NoPorts            int64            `json:"udp6_no_ports"`
+	UDP6InErrors           int64            `json:"udp6_in_errors"`
+	UDP6OutDatagrams       int64            `json:"udp6_out_datagrams"`
+	UDP6RcvbufErrors       int64            `json:"udp6_rcvbuf_errors"`
+	UDP6SndbufErrors       int64            `json:"udp6_sndbuf_errors"`
+	UDP6InCsumErrors       int64            `json:"udp6_in_csum_errors"`
+	UDP6IgnoredMulti       int64            `json:"udp6_ignored_multi"`
+	UDP6MemErrors          int64            `json:"udp6_mem_errors"`
+	SoftnetProcessed       int64            `json:"softnet_processed"`
+	SoftnetDropped         int64            `json:"softnet_dropped"`
+	SoftnetTimeSqueeze     int64            `json:"softnet_time_squeeze"`
+	Softnet                []SoftnetStat    `json:"softnet"`
+	Counters               map[string]int64 `json:"counters"`
+}
+
+// parseHeaderValuePairs handles the format of /proc/net/snmp and /proc/net/netstat, where each line of names is
+// followed by a line of values with the same prefix (e.g. "Tcp: RtoAlgorithm ..." then "Tcp: 1 ...")
+func parseHeaderValuePairs(data []byte) (map[string]int64, error) {
+	counters := make(map[string]int64)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines)%2 != 0 {
+		return nil, fmt.Errorf("expected an even number of lines, got %d", len(lines))
+	}
+
+	for i := 0; i < len(lines); i += 2 {
+		names := strings.Fields(lines[i])
+		values := strings.Fields(lines[i+1])
+
+		if len(names) == 0 || len(names) != len(values) {
+			return nil, fmt.Errorf("mismatched names and values for line %d: %#+v / %#+v", i, lines[i], lines[i+1])
+		}
+
+		if names[0] != values[0] {
+			return nil, fmt.Errorf("mismatched prefixes for line %d: %#+v / %#+v", i, names[0], values[0])
+		}
+
+		prefix := strings.TrimSuffix(names[0], ":")
+
+		for j := 1; j < len(names); j++ {
+			value, err := strconv.ParseInt(values[j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed strconv.ParseInt for %s.%s: %#+v: %s", prefix, names[j], values[j], err)
+			}
+
+			counters[fmt.Sprintf("%s.%s", prefix, names[j])] = value
+		}
+	}
+
+	return counters, nil
+}
+
+// parseNameValueLines handles the format of /proc/net/snmp6, where each line is a prefixed name and a value
+// (e.g. "Ip6InReceives 3")
+func parseNameValueLines(data []byte) (map[string]int64, error) {
+	counters := make(map[string]int64)
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected a name and a value, got %#+v", line)
+		}
+
+		name := parts[0]
+
+		for _, snmp6Prefix := range snmp6Prefixes {
+			if strings.HasPrefix(name, snmp6Prefix) {
+				name = fmt.Sprintf("%s.%s", snmp6Prefix, strings.TrimPrefix(name, snmp6Prefix))
+				break
+			}
+		}
+
+		value, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed strconv.ParseInt for %s: %#+v: %s", name, parts[1], err)
+		}
+
+		counters[name] = value
+	}
+
+	return counters, nil
+}
+
+func GetNetworkStack() (*NetworkStack, error) {
+	now := time.Now()
+
+	counters := make(map[string]int64)
+
+	for _, path := range []string{procNetSNMPPath, procNetNetstatPath, procNetSNMP6Path} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// snmp6 is missing when ipv6 is disabled
+			if errors.Is(err, os.ErrNotExist) && path == procNetSNMP6Path {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed os.ReadFile for %s: %s", path, err)
+		}
+
+		var theseCounters map[string]int64
+
+		if path == procNetSNMP6Path {
+			theseCounters, err = parseNameValueLines(data)
+		} else {
+			theseCounters, err = parseHeaderValuePairs(data)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+		}
+
+		for name, value := range theseCounters {
+			counters[name] = value
+		}
+	}
+
+	// softnet_stat is best effort (e.g. it may not be there under a -procfs from somewhere else); the rest doesn't need it
+	softnetStats, err := GetSoftnetStats()
+	warnSoftnet(err)
+	if err != nil {
+		softnetStats = make([]SoftnetStat, 0)
+	}
+
+	networkStack := NetworkStack{
+		Timestamp: now,
+		Softnet:   softnetStats,
+		Counters:  counters,
+	}
+
+	for _, softnetStat := range softnetStats {
+		networkStack.SoftnetProcessed += softnetStat.Processed
+		networkStack.SoftnetDropped += softnetStat.Dropped
+		networkStack.SoftnetTimeSqueeze += softnetStat.TimeSqueeze
+	}
+
+	networkStack.IPInReceives = counters["Ip.InReceives"]
+	networkStack.IPInHdrErrors = counters["Ip.InHdrErrors"]
+	networkStack.IPInAddrErrors = counters["Ip.InAddrErrors"]
+	networkStack.IPForwDatagrams = counters["Ip.ForwDatagrams"]
+	networkStack.IPInUnknownProtos = counters["Ip.InUnknownProtos"]
+	networkStack.IPInDiscards = counters["Ip.InDiscards"]
+	networkStack.IPInDelivers = counters["Ip.InDelivers"]
+	networkStack.IPOutRequests = counters["Ip.OutRequests"]
+	networkStack.IPOutDiscards = counters["Ip.OutDiscards"]
+	networkStack.IPOutNoRoutes = counters["Ip.OutNoRoutes"]
+	networkStack.IPReasmTimeout = counters["Ip.ReasmTimeout"]
+	networkStack.IPReasmReqds = counters["Ip.ReasmReqds"]
+	networkStack.IPReasmOKs = counters["Ip.ReasmOKs"]
+	networkStack.IPReasmFails = counters["Ip.ReasmFails"]
+	networkStack.IPFragOKs = counters["Ip.FragOKs"]
+	networkStack.IPFragFails = counters["Ip.FragFails"]
+	networkStack.IPFragCreates = counters["Ip.FragCreates"]
+	networkStack.IPExtInNoRoutes = counters["IpExt.InNoRoutes"]
+	networkStack.IPExtInTruncatedPkts = counters["IpExt.InTruncatedPkts"]
+	networkStack.IPExtInCsumErrors = counters["IpExt.InCsumErrors"]
+	networkStack.IPExtInOctets = counters["IpExt.InOctets"]
+	networkStack.IPExtOutOctets = counters["IpExt.OutOctets"]
+	networkStack.ICMPInMsgs = counters["Icmp.InMsgs"]
+	networkStack.ICMPInErrors = counters["Icmp.InErrors"]
+	networkStack.ICMPInCsumErrors = counters["Icmp.InCsumErrors"]
+	networkStack.ICMPInDestUnreachs = counters["Icmp.InDestUnreachs"]
+	networkStack.ICMPInTimeExcds = counters["Icmp.InTimeExcds"]
+	networkStack.ICMPOutMsgs = counters["Icmp.OutMsgs"]
+	networkStack.ICMPOutErrors = counters["Icmp.OutErrors"]
+	networkStack.ICMPOutDestUnreachs = counters["Icmp.OutDestUnreachs"]
+	networkStack.ICMPOutTimeExcds = counters["Icmp.OutTimeExcds"]
+	networkStack.TCPActiveOpens = counters["Tcp.ActiveOpens"]
+	networkStack.TCPPassiveOpens = counters["Tcp.PassiveOpens"]
+	networkStack.TCPAttemptFails = counters["Tcp.AttemptFails"]
+	networkStack.TCPEstabResets = counters["Tcp.EstabResets"]
+	networkStack.TCPCurrEstab = counters["Tcp.CurrEstab"]
+	networkStack.TCPInSegs = counters["Tcp.InSegs"]
+	networkStack.TCPOutSegs = counters["Tcp.OutSegs"]
+	networkStack.TCPRetransSegs = counters["Tcp.RetransSegs"]
+	networkStack.TCPInErrs = counters["Tcp.InErrs"]
+	networkStack.TCPOutRsts = counters["Tcp.OutRsts"]
+	networkStack.TCPInCsumErrors = counters["Tcp.InCsumErrors"]
+	networkStack.TCPExtSyncookiesSent = counters["TcpExt.SyncookiesSent"]
+	networkStack.TCPExtSyncookiesFailed = counters["TcpExt.SyncookiesFailed"]
+	networkStack.TCPExtPruneCalled = counters["TcpExt.PruneCalled"]
+	networkStack.TCPExtRcvPruned = counters["TcpExt.RcvPruned"]
+	networkStack.TCPExtOfoPruned = counters["TcpExt.OfoPruned"]
+	networkStack.TCPExtListenOverflows = counters["TcpExt.ListenOverflows"]
+	networkStack.TCPExtListenDrops = counters["TcpExt.ListenDrops"]
+	networkStack.TCPExtTimeouts = counters["TcpExt.TCPTimeouts"]
+	networkStack.TCPExtLostRetransmit = counters["TcpExt.TCPLostRetransmit"]
+	networkStack.TCPExtFastRetrans = counters["TcpExt.TCPFastRetrans"]
+	networkStack.TCPExtSlowStartRetrans = counters["TcpExt.TCPSlowStartRetrans"]
+	networkStack.TCPExtSynRetrans = counters["TcpExt.TCPSynRetrans"]
+	networkStack.TCPExtLossProbes = counters["TcpExt.TCPLossProbes"]
+	networkStack.TCPExtRetransFail = counters["TcpExt.TCPRetransFail"]
+	networkStack.TCPExtOFOQueue = counters["TcpExt.TCPOFOQueue"]
+	networkStack.TCPExtOFODrop = counters["TcpExt.TCPOFODrop"]
+	networkStack.TCPExtRcvQDrop = counters["TcpExt.TCPRcvQDrop"]
+	networkStack.TCPExtBacklogDrop = counters["TcpExt.TCPBacklogDrop"]
+	networkStack.TCPExtAbortOnTimeout = counters["TcpExt.TCPAbortOnTimeout"]
+	networkStack.TCPExtAbortOnMemory = counters["TcpExt.TCPAbortOnMemory"]
+	networkStack.TCPExtMemoryPressures = counters["TcpExt.TCPMemoryPressures"]
+	networkStack.UDPInDatagrams = counters["Udp.InDatagrams"]
+	networkStack.UDPNoPorts = counters["Udp.NoPorts"]
+	networkStack.UDPInErrors = counters["Udp.InErrors"]
+	networkStack.UDPOutDatagrams = counters["Udp.OutDatagrams"]
+	networkStack.UDPRcvbufErrors = counters["Udp.RcvbufErrors"]
+	networkStack.UDPSndbufErrors = counters["Udp.SndbufErrors"]
+	networkStack.UDPInCsumErrors = counters["Udp.InCsumErrors"]
+	networkStack.UDPIgnoredMulti = counters["Udp.IgnoredMulti"]
+	networkStack.UDPMemErrors = counters["Udp.MemErrors"]
+	networkStack.IP6InReceives = counters["Ip6.InReceives"]
+	networkStack.IP6InHdrErrors = counters["Ip6.InHdrErrors"]
+	networkStack.IP6InAddrErrors = counters["Ip6.InAddrErrors"]
+	networkStack.IP6InNoRoutes = counters["Ip6.InNoRoutes"]
+	networkStack.IP6InTooBigErrors = counters["Ip6.InTooBigErrors"]
+	networkStack.IP6InDiscards = counters["Ip6.InDiscards"]
+	networkStack.IP6InDelivers = counters["Ip6.InDelivers"]
+	networkStack.IP6OutRequests = counters["Ip6.OutRequests"]
+	networkStack.IP6OutDiscards = counters["Ip6.OutDiscards"]
+	networkStack.IP6OutNoRoutes = counters["Ip6.OutNoRoutes"]
+	networkStack.IP6ReasmTimeout = counters["Ip6.ReasmTimeout"]
+	networkStack.IP6ReasmReqds = counters["Ip6.ReasmReqds"]
+	networkStack.IP6ReasmOKs = counters["Ip6.ReasmOKs"]
+	networkStack.IP6ReasmFails = counters["Ip6.ReasmFails"]
+	networkStack.IP6FragOKs = counters["Ip6.FragOKs"]
+	networkStack.IP6FragFails = counters["Ip6.FragFails"]
+	networkStack.IP6FragCreates = counters["Ip6.FragCreates"]
+	networkStack.ICMP6InMsgs = counters["Icmp6.InMsgs"]
+	networkStack.ICMP6InErrors = counters["Icmp6.InErrors"]
+	networkStack.ICMP6InCsumErrors = counters["Icmp6.InCsumErrors"]
+	networkStack.ICMP6InDestUnreachs = counters["Icmp6.InDestUnreachs"]
+	networkStack.ICMP6InPktTooBigs = counters["Icmp6.InPktTooBigs"]
+	networkStack.ICMP6OutMsgs = counters["Icmp6.OutMsgs"]
+	networkStack.ICMP6OutErrors = counters["Icmp6.OutErrors"]
+	networkStack.ICMP6OutDestUnreachs = counters["Icmp6.OutDestUnreachs"]
+	networkStack.UDP6InDatagrams = counters["Udp6.InDatagrams"]
+	networkStack.UDP6NoPorts = counters["Udp6.NoPorts"]
+	networkStack.UDP6InErrors = counters["Udp6.InErrors"]
+	networkStack.UDP6OutDatagrams = counters["Udp6.OutDatagrams"]
+	networkStack.UDP6RcvbufErrors = counters["Udp6.RcvbufErrors"]
+	networkStack.UDP6SndbufErrors = counters["Udp6.SndbufErrors"]
+	networkStack.UDP6InCsumErrors = counters["Udp6.InCsumErrors"]
+	networkStack.UDP6IgnoredMulti = counters["Udp6.IgnoredMulti"]
+	networkStack.UDP6MemErrors = counters["Udp6.MemErrors"]
+
+	return &networkStack, nil
+}
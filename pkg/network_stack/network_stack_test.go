@@ -0,0 +1,100 @@
+package network_stack
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkStack(t *testing.T) {
+	t.Run("ParseHeaderValuePairs", func(t *testing.T) {
+		counters, err := parseHeaderValuePairs([]byte(`Tcp: RtoAlgorithm RtoMin RtoMax MaxConn ActiveOpens RetransSegs
+Tcp: 1 200 120000 -1 30 148
+Udp: InDatagrams NoPorts InErrors RcvbufErrors
+Udp: 9974 1 2 3
+`))
+		require.NoError(t, err)
+		require.Equal(t, int64(-1), counters["Tcp.MaxConn"])
+		require.Equal(t, int64(148), counters["Tcp.RetransSegs"])
+		require.Equal(t, int64(3), counters["Udp.RcvbufErrors"])
+
+		_, err = parseHeaderValuePairs([]byte("Tcp: RtoAlgorithm RtoMin\nTcp: 1\n"))
+		require.Error(t, err)
+
+		_, err = parseHeaderValuePairs([]byte("Tcp: RtoAlgorithm\nUdp: 1\n"))
+		require.Error(t, err)
+	})
+
+	t.Run("ParseNameValueLines", func(t *testing.T) {
+		counters, err := parseNameValueLines([]byte(`Ip6InReceives                   	3
+Ip6ReasmFails                   	4
+Icmp6InMsgs                     	5
+Udp6RcvbufErrors                	6
+UdpLite6InErrors                	7
+`))
+		require.NoError(t, err)
+		require.Equal(t, int64(3), counters["Ip6.InReceives"])
+		require.Equal(t, int64(4), counters["Ip6.ReasmFails"])
+		require.Equal(t, int64(5), counters["Icmp6.InMsgs"])
+		require.Equal(t, int64(6), counters["Udp6.RcvbufErrors"])
+		require.Equal(t, int64(7), counters["UdpLite6.InErrors"])
+	})
+
+	t.Run("ParseSoftnetStat", func(t *testing.T) {
+		softnetStats, err := parseSoftnetStat([]byte(`000007e9 00000002 00000003 00000000 00000000 00000000 00000000 00000000 00000004 00000005 00000006 00000007 00000000
+0000000a 0000000b 0000000c 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000002
+`))
+		require.NoError(t, err)
+		require.Len(t, softnetStats, 2)
+		require.Equal(t, SoftnetStat{CPU: 0, Processed: 2025, Dropped: 2, TimeSqueeze: 3, CPUCollision: 4, ReceivedRPS: 5, FlowLimitCount: 6, BacklogLen: 7}, softnetStats[0])
+		require.Equal(t, 2, softnetStats[1].CPU)
+		require.Equal(t, int64(11), softnetStats[1].Dropped)
+
+		// older kernels have no cpu index column
+		softnetStats, err = parseSoftnetStat([]byte(`00000001 00000002 00000003 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000
+00000001 00000002 00000003 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000
+`))
+		require.NoError(t, err)
+		require.Len(t, softnetStats, 2)
+		require.Equal(t, 1, softnetStats[1].CPU)
+
+		_, err = parseSoftnetStat([]byte("0000000g 00000002 00000003\n"))
+		require.Error(t, err)
+	})
+
+	t.Run("GetNetworkStack", func(t *testing.T) {
+		networkStack, err := GetNetworkStack()
+		require.NoError(t, err)
+		require.NotNil(t, networkStack)
+		require.NotEmpty(t, networkStack.Counters)
+		require.NotEmpty(t, networkStack.Softnet)
+
+		b, err := json.MarshalIndent(networkStack, "", "  ")
+		require.NoError(t, err)
+		log.Printf("networkStack: %s", string(b))
+	})
+
+	t.Run("GetNetworkStackWithoutSoftnet", func(t *testing.T) {
+		t.Cleanup(func() {
+			procNetSoftnetStatPath = "/proc/net/softnet_stat"
+			warnSoftnet(nil)
+		})
+
+		procNetSoftnetStatPath = "/does/not/exist/softnet_stat"
+
+		// the rest is still there, just without the softnet stats
+		for i := 0; i < 2; i++ {
+			networkStack, err := GetNetworkStack()
+			require.NoError(t, err)
+			require.NotEmpty(t, networkStack.Counters)
+			require.NotNil(t, networkStack.Softnet)
+			require.Empty(t, networkStack.Softnet)
+			require.Equal(t, int64(0), networkStack.SoftnetProcessed)
+		}
+
+		softnetWarnedMu.Lock()
+		require.True(t, softnetWarned)
+		softnetWarnedMu.Unlock()
+	})
+}
@@ -0,0 +1,110 @@
+package network_stack
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var procNetSoftnetStatPath = "/proc/net/softnet_stat"
+
+// whether we've already warned about failing to get the softnet stats, so it's not every tick
+var softnetWarnedMu = new(sync.Mutex)
+var softnetWarned = false
+
+type SoftnetStat struct {
+	CPU            int   `json:"cpu"`
+	Processed      int64 `json:"processed"`
+	Dropped        int64 `json:"dropped"`
+	TimeSqueeze    int64 `json:"time_squeeze"`
+	CPUCollision   int64 `json:"cpu_collision"`
+	ReceivedRPS    int64 `json:"received_rps"`
+	FlowLimitCount int64 `json:"flow_limit_count"`
+	BacklogLen     int64 `json:"backlog_len"`
+}
+
+// parseSoftnetStat handles /proc/net/softnet_stat, which has one line of hex columns per online cpu; older kernels have
+// fewer columns (no backlog_len or cpu index), in which case the line number stands in for the cpu index
+func parseSoftnetStat(data []byte) ([]SoftnetStat, error) {
+	softnetStats := make([]SoftnetStat, 0)
+
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		rawColumns := strings.Fields(line)
+		if len(rawColumns) == 0 {
+			continue
+		}
+
+		if len(rawColumns) < 3 {
+			return nil, fmt.Errorf("expected at least 3 columns for line %d, got %#+v", i, line)
+		}
+
+		columns := make([]int64, 13)
+
+		for j, rawColumn := range rawColumns {
+			if j >= len(columns) {
+				break
+			}
+
+			column, err := strconv.ParseInt(rawColumn, 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed strconv.ParseInt for line %d column %d: %#+v: %s", i, j, rawColumn, err)
+			}
+
+			columns[j] = column
+		}
+
+		cpu := i
+		if len(rawColumns) >= 13 {
+			cpu = int(columns[12])
+		}
+
+		softnetStats = append(softnetStats, SoftnetStat{
+			CPU:            cpu,
+			Processed:      columns[0],
+			Dropped:        columns[1],
+			TimeSqueeze:    columns[2],
+			CPUCollision:   columns[8],
+			ReceivedRPS:    columns[9],
+			FlowLimitCount: columns[10],
+			BacklogLen:     columns[11],
+		})
+	}
+
+	return softnetStats, nil
+}
+
+func GetSoftnetStats() ([]SoftnetStat, error) {
+	data, err := os.ReadFile(procNetSoftnetStatPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.ReadFile for %s: %s", procNetSoftnetStatPath, err)
+	}
+
+	softnetStats, err := parseSoftnetStat(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", procNetSoftnetStatPath, err)
+	}
+
+	return softnetStats, nil
+}
+
+// warnSoftnet warns about failing to get the softnet stats the first time it happens (and again if it starts failing
+// after it's worked)
+func warnSoftnet(err error) {
+	softnetWarnedMu.Lock()
+	defer softnetWarnedMu.Unlock()
+
+	if err == nil {
+		softnetWarned = false
+		return
+	}
+
+	if softnetWarned {
+		return
+	}
+
+	softnetWarned = true
+
+	log.Printf("warning: failed GetSoftnetStats (leaving them out, and not warning again until it works): %s", err)
+}
@@ -0,0 +1,95 @@
+package packets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// RunBulkClient saturates the link to host in the given direction using the given number of parallel TCP streams
+// until the context is cancelled; it returns the number of payload bytes moved
+func RunBulkClient(ctx context.Context, host string, direction byte, streams int) (int64, error) {
+	return runBulkClient(ctx, host, bulkPort, direction, streams)
+}
+
+func runBulkClient(ctx context.Context, host string, port int, direction byte, streams int) (int64, error) {
+	dialAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return 0, err
+	}
+
+	conns := make([]*net.TCPConn, 0)
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	for i := 0; i < streams; i++ {
+		conn, err := net.DialTCP("tcp4", nil, dialAddr)
+		if err != nil {
+			return 0, err
+		}
+
+		conns = append(conns, conn)
+
+		_, err = conn.Write([]byte{direction})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	total := new(atomic.Int64)
+	errs := make(chan error, len(conns))
+	wg := new(sync.WaitGroup)
+
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, 65536)
+
+			for {
+				var n int
+				var err error
+
+				if direction == BulkDirectionUpload {
+					n, err = conn.Write(buf)
+				} else {
+					n, err = conn.Read(buf)
+				}
+
+				total.Add(int64(n))
+
+				if err != nil {
+					// the server cutting the transfer off (at its -bulk-max-duration / -bulk-max-bytes) just ends the stream
+					serverEnded := errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+
+					if ctx.Err() == nil && !serverEnded {
+						errs <- err
+					}
+
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	return total.Load(), <-errs
+}
@@ -0,0 +1,114 @@
+package packets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	BulkDirectionUpload   = byte('u')
+	BulkDirectionDownload = byte('d')
+
+	DefaultBulkMaxDuration = time.Minute
+	DefaultBulkMaxBytes    = int64(64 * 1024 * 1024 * 1024) // a minute at ~9 Gbit/s
+)
+
+// RunBulkServer serves the bulk path for RunBulkClient; there's no authentication, so each connection is cut off after
+// maxDuration or once maxBytes have been moved (whichever comes first), so a stranger can't have us send forever
+func RunBulkServer(ctx context.Context, port int, maxDuration time.Duration, maxBytes int64) error {
+	listener, err := listenTCP(port)
+	if err != nil {
+		return err
+	}
+
+	return serveBulk(ctx, listener, maxDuration, maxBytes)
+}
+
+func serveBulk(ctx context.Context, listener *net.TCPListener, maxDuration time.Duration, maxBytes int64) error {
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	handleConn := func(conn *net.TCPConn) {
+		done := make(chan struct{})
+
+		defer func() {
+			close(done)
+			_ = conn.Close()
+		}()
+
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-done:
+			}
+
+			_ = conn.Close()
+		}()
+
+		err := conn.SetDeadline(time.Now().Add(maxDuration))
+		if err != nil {
+			return
+		}
+
+		direction := make([]byte, 1)
+
+		_, err = io.ReadFull(conn, direction)
+		if err != nil {
+			return
+		}
+
+		switch direction[0] {
+		case BulkDirectionUpload:
+			_, err = io.CopyN(io.Discard, conn, maxBytes)
+		case BulkDirectionDownload:
+			buf := make([]byte, 65536)
+			for sent := int64(0); sent < maxBytes; {
+				if remaining := maxBytes - sent; remaining < int64(len(buf)) {
+					buf = buf[:remaining]
+				}
+
+				var n int
+				n, err = conn.Write(buf)
+				sent += int64(n)
+				if err != nil {
+					break
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown bulk direction %#+v", direction[0])
+		}
+
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("bulk connection from TCP %s ended: %s", conn.RemoteAddr(), err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go handleConn(conn)
+	}
+}
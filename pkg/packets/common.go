@@ -3,6 +3,7 @@ package packets
 import (
 	_log "log"
 	"os"
+	"time"
 )
 
 var log = _log.New(
@@ -15,3 +16,76 @@ var log = _log.New(
 		_log.Lmsgprefix|
 		_log.LstdFlags,
 )
+
+// the ports the Run*Client functions dial (and main has the Run*Server functions listen on)
+const (
+	tcpPort  = 6943
+	udpPort  = 6943
+	bulkPort = 6944
+)
+
+type Report struct {
+	Timestamp  time.Time     `json:"timestamp"`
+	Protocol   string        `json:"protocol"`
+	Host       string        `json:"host"`
+	Sent       int64         `json:"sent"`
+	Received   int64         `json:"received"`
+	OutOfOrder int64         `json:"out_of_order"`
+	Lost       int64         `json:"lost"`
+	RTTMin     time.Duration `json:"rtt_min"`
+	RTTAvg     time.Duration `json:"rtt_avg"`
+	RTTMax     time.Duration `json:"rtt_max"`
+	Jitter     time.Duration `json:"jitter"`
+	TCPInfo    *TCPInfo      `json:"tcp_info,omitempty"`
+	MACs       []string      `json:"macs,omitempty"`
+}
+
+// rttStats accumulates round trip times between reports; jitter is the mean difference between consecutive samples
+type rttStats struct {
+	count      int64
+	sum        time.Duration
+	min        time.Duration
+	max        time.Duration
+	jitterSum  time.Duration
+	jitterSize int64
+	last       time.Duration
+}
+
+func (r *rttStats) add(rtt time.Duration) {
+	if r.count == 0 || rtt < r.min {
+		r.min = rtt
+	}
+
+	if rtt > r.max {
+		r.max = rtt
+	}
+
+	if r.last != 0 {
+		delta := rtt - r.last
+		if delta < 0 {
+			delta = -delta
+		}
+
+		r.jitterSum += delta
+		r.jitterSize++
+	}
+
+	r.count++
+	r.sum += rtt
+	r.last = rtt
+}
+
+// apply writes the accumulated stats into the given report and starts a new interval (keeping the last sample for jitter)
+func (r *rttStats) apply(report *Report) {
+	if r.count > 0 {
+		report.RTTMin = r.min
+		report.RTTAvg = r.sum / time.Duration(r.count)
+		report.RTTMax = r.max
+	}
+
+	if r.jitterSize > 0 {
+		report.Jitter = r.jitterSum / time.Duration(r.jitterSize)
+	}
+
+	*r = rttStats{last: r.last}
+}
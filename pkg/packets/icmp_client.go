@@ -0,0 +1,391 @@
+package packets
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	// the errors that quote (the start of) the packet that caused them
+	icmpv4DestinationUnreachable = 3
+	icmpv4TimeExceeded           = 11
+	icmpv6DestinationUnreachable = 1
+	icmpv6PacketTooBig           = 2
+	icmpv6TimeExceeded           = 3
+
+	icmpv4FragmentationNeeded = 4 // a destination unreachable code
+
+	sizeofIPv4Header = 20
+	sizeofIPv6Header = 40
+	sizeofICMPHeader = 8
+)
+
+// gentler than the 10ms the TCP / UDP probes use; routers tend to rate limit ICMP to their control plane
+var icmpSendInterval = time.Millisecond * 100
+
+func icmpChecksum(b []byte) uint16 {
+	sum := uint32(0)
+
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	return ^uint16(sum)
+}
+
+func marshalICMPEcho(echoType byte, id uint16, seq uint16, payload []byte) []byte {
+	b := make([]byte, 8+len(payload))
+	b[0] = echoType
+	b[1] = 0
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], seq)
+	copy(b[8:], payload)
+
+	// the kernel fills in the checksum for ICMPv6 (it needs the pseudo-header)
+	if echoType == icmpv4EchoRequest {
+		binary.BigEndian.PutUint16(b[2:4], icmpChecksum(b))
+	}
+
+	return b
+}
+
+// icmpQuote is what an ICMP error tells us about the echo request that caused it
+type icmpQuote struct {
+	errorType byte
+	errorCode byte
+	id        uint16
+	seq       uint16
+	mtu       int // for fragmentation needed / packet too big (0 if the sender didn't say)
+}
+
+// parseICMPQuote parses an ICMP error (time exceeded, destination unreachable, packet too big) that quotes one of our
+// echo requests; the IPv4 header has already been stripped off (by net.IPConn) and IPv6 never has one
+func parseICMPQuote(b []byte, isIPv6 bool) (*icmpQuote, bool) {
+	if len(b) < sizeofICMPHeader {
+		return nil, false
+	}
+
+	quote := icmpQuote{
+		errorType: b[0],
+		errorCode: b[1],
+	}
+
+	var original []byte
+
+	if isIPv6 {
+		switch b[0] {
+		case icmpv6TimeExceeded, icmpv6DestinationUnreachable:
+		case icmpv6PacketTooBig:
+			quote.mtu = int(binary.BigEndian.Uint32(b[4:8]))
+		default:
+			return nil, false
+		}
+
+		if len(b) < sizeofICMPHeader+sizeofIPv6Header+sizeofICMPHeader {
+			return nil, false
+		}
+
+		original = b[sizeofICMPHeader+sizeofIPv6Header:]
+
+		if original[0] != icmpv6EchoRequest {
+			return nil, false
+		}
+	} else {
+		switch b[0] {
+		case icmpv4TimeExceeded:
+		case icmpv4DestinationUnreachable:
+			if b[1] == icmpv4FragmentationNeeded {
+				quote.mtu = int(binary.BigEndian.Uint16(b[6:8]))
+			}
+		default:
+			return nil, false
+		}
+
+		if len(b) < sizeofICMPHeader+sizeofIPv4Header {
+			return nil, false
+		}
+
+		headerLength := int(b[sizeofICMPHeader]&0x0f) * 4
+		if headerLength < sizeofIPv4Header || len(b) < sizeofICMPHeader+headerLength+sizeofICMPHeader {
+			return nil, false
+		}
+
+		original = b[sizeofICMPHeader+headerLength:]
+
+		if original[0] != icmpv4EchoRequest {
+			return nil, false
+		}
+	}
+
+	quote.id = binary.BigEndian.Uint16(original[4:6])
+	quote.seq = binary.BigEndian.Uint16(original[6:8])
+
+	return &quote, true
+}
+
+// setICMPSockopt sets an int socket option on an ICMP socket
+func setICMPSockopt(conn *net.IPConn, level int, opt int, value int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockoptErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		sockoptErr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockoptErr
+}
+
+// listenICMP opens a raw ICMP socket (needs CAP_NET_RAW) for the family of the given address, which may have an IPv6
+// zone (e.g. "fe80::1%eth0")
+func listenICMP(host string) (*net.IPConn, *net.IPAddr, bool, error) {
+	dialAddr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	isIPv6 := dialAddr.IP.To4() == nil
+
+	network := "ip4:icmp"
+	listenAddr := "0.0.0.0"
+	if isIPv6 {
+		network = "ip6:ipv6-icmp"
+		listenAddr = "::"
+	}
+
+	conn, err := net.ListenIP(network, &net.IPAddr{IP: net.ParseIP(listenAddr)})
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return conn, dialAddr, isIPv6, nil
+}
+
+func RunICMPClient(ctx context.Context, host string, reportInterval time.Duration, actualReportFn func(Report)) error {
+	mu := new(sync.Mutex)
+
+	sent := int64(0)
+	received := int64(0)
+	outOfOrder := int64(0)
+	lost := int64(0)
+
+	lastSent := int64(0)
+	lastReceived := int64(0)
+	lastOutOfOrder := int64(0)
+	lastLost := int64(0)
+
+	rtts := new(rttStats)
+
+	conn, dialAddr, isIPv6, err := listenICMP(host)
+	if err != nil {
+		time.Sleep(time.Second * 1)
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	echoRequest := byte(icmpv4EchoRequest)
+	echoReply := byte(icmpv4EchoReply)
+	if isIPv6 {
+		echoRequest = icmpv6EchoRequest
+		echoReply = icmpv6EchoReply
+	}
+
+	// raw sockets see every echo reply for the host, so we need an id that's ours
+	id := uint16(os.Getpid()&0xffff) ^ uint16(rand.Intn(0xffff))
+
+	log.Printf("pinging ICMP %s", dialAddr)
+	defer func() {
+		log.Printf("stopped pinging ICMP %s", dialAddr)
+	}()
+
+	reportFn := func() {
+		mu.Lock()
+
+		thisSent := sent - lastSent
+		thisReceived := received - lastReceived
+		thisOutOfOrder := outOfOrder - lastOutOfOrder
+		thisLost := lost - lastLost
+
+		if lastSent == 0 {
+			thisSent = 0
+		}
+
+		if lastReceived == 0 {
+			thisReceived = 0
+		}
+
+		if lastOutOfOrder == 0 {
+			thisOutOfOrder = 0
+		}
+
+		if lastLost == 0 {
+			thisLost = 0
+		}
+
+		lastSent = sent
+		lastReceived = received
+		lastOutOfOrder = outOfOrder
+		lastLost = lost
+
+		report := Report{
+			Timestamp:  time.Now(),
+			Protocol:   "icmp",
+			Host:       host,
+			Sent:       thisSent,
+			Received:   thisReceived,
+			OutOfOrder: thisOutOfOrder,
+			Lost:       thisLost,
+		}
+
+		rtts.apply(&report)
+
+		mu.Unlock()
+
+		actualReportFn(report)
+	}
+
+	reportFn()
+
+	defer func() {
+		reportFn()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	sendTicker := time.NewTicker(icmpSendInterval)
+	defer func() {
+		sendTicker.Stop()
+	}()
+
+	buf := make([]byte, 65536)
+
+	reportTicker := time.NewTicker(reportInterval)
+	defer func() {
+		reportTicker.Stop()
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reportTicker.C:
+			}
+
+			reportFn()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sendTicker.C:
+		}
+
+		now := time.Now()
+		expiry := now.Add(time.Second * 1)
+
+		err = conn.SetWriteDeadline(expiry)
+		if err != nil {
+			return err
+		}
+
+		err = conn.SetReadDeadline(expiry)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		sent++
+		mu.Unlock()
+
+		seq := uint16(sent)
+
+		_, err = conn.WriteToIP(marshalICMPEcho(echoRequest, id, seq, []byte(fmt.Sprintf("%d", sent))), dialAddr)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			mu.Lock()
+			lost++
+			mu.Unlock()
+
+			continue
+		}
+
+		for {
+			n, addr, err := conn.ReadFromIP(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+
+				// a timeout is just a lost ping; we keep going (unlike the TCP / UDP probes, there's no session to
+				// tear down)
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					mu.Lock()
+					lost++
+					mu.Unlock()
+
+					break
+				}
+
+				return err
+			}
+
+			b := buf[:n]
+
+			if len(b) < 8 || b[0] != echoReply || binary.BigEndian.Uint16(b[4:6]) != id || !addr.IP.Equal(dialAddr.IP) {
+				continue
+			}
+
+			mu.Lock()
+			if binary.BigEndian.Uint16(b[6:8]) == seq {
+				received++
+				rtts.add(time.Since(now))
+			} else {
+				outOfOrder++
+			}
+			mu.Unlock()
+
+			if binary.BigEndian.Uint16(b[6:8]) == seq {
+				break
+			}
+		}
+	}
+}
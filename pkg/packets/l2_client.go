@@ -0,0 +1,539 @@
+package packets
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	arpHardwareTypeEthernet = 1
+	arpOpRequest            = 1
+	arpOpReply              = 2
+	arpPacketSize           = 28
+
+	ndpNeighbourSolicitation        = 135
+	ndpNeighbourAdvertisement       = 136
+	ndpOptionSourceLinkLayerAddress = 1
+	ndpOptionTargetLinkLayerAddress = 2
+)
+
+// ARP requests / neighbour solicitations go to every host on the segment, so we're gentler again than ICMP
+var l2SendInterval = time.Millisecond * 250
+
+// replies that come in after this are counted as lost
+var l2Timeout = time.Second * 1
+
+// l2Target is an on-link address and the interface (and our address on it) that we reach it through
+type l2Target struct {
+	ip               net.IP
+	isIPv6           bool
+	networkInterface network_interfaces.NetworkInterface
+	sourceIP         net.IP
+	sourceMAC        net.HardwareAddr
+}
+
+// l2Conn hides the differences between ARP (AF_PACKET) and NDP (raw ICMPv6)
+type l2Conn struct {
+	send             func() error
+	read             func(b []byte) (int, error)
+	setReadDeadline  func(t time.Time) error
+	close            func() error
+	parseReplySender func(b []byte) net.HardwareAddr
+}
+
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return binary.NativeEndian.Uint16(b)
+}
+
+// resolveL2Target finds the interface the given address is on-link for (from the interface addresses); the host may have
+// a zone (e.g. "fe80::1%eth0") to pick the interface explicitly
+func resolveL2Target(host string) (*l2Target, error) {
+	rawIP, zone, _ := strings.Cut(host, "%")
+
+	ip := net.ParseIP(rawIP)
+	if ip == nil {
+		return nil, fmt.Errorf("%#+v is not an IP address", host)
+	}
+
+	isIPv6 := ip.To4() == nil
+
+	// straight from rtnetlink (rather than GetNetworkInterfaces) so this is right when we're inside another network
+	// namespace (where sysfs would show us the interfaces from the one it was mounted in)
+	networkInterfaces, err := network_interfaces.GetNetworkInterfacesFromNetlink()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := network_interfaces.GetAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, networkInterface := range networkInterfaces {
+		networkInterface.Addresses = addresses[networkInterface.IFIndex]
+
+		if zone != "" && networkInterface.Name != zone {
+			continue
+		}
+
+		for _, address := range networkInterface.Addresses {
+			sourceIP := net.ParseIP(address.IP)
+			if sourceIP == nil || (sourceIP.To4() == nil) != isIPv6 {
+				continue
+			}
+
+			bits := 32
+			if isIPv6 {
+				bits = 128
+			}
+
+			mask := net.CIDRMask(address.PrefixLen, bits)
+			network := net.IPNet{IP: sourceIP.Mask(mask), Mask: mask}
+			if !network.Contains(ip) {
+				continue
+			}
+
+			sourceMAC, err := net.ParseMAC(networkInterface.MAC)
+			if err != nil || len(sourceMAC) != 6 || bytes.Equal(sourceMAC, make([]byte, 6)) {
+				return nil, fmt.Errorf("%s is on-link for %s but it has no (Ethernet) link-layer address", host, networkInterface.Name)
+			}
+
+			return &l2Target{
+				ip:               ip,
+				isIPv6:           isIPv6,
+				networkInterface: networkInterface,
+				sourceIP:         sourceIP,
+				sourceMAC:        sourceMAC,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not on-link for any interface", host)
+}
+
+func marshalARPRequest(sourceMAC net.HardwareAddr, sourceIP net.IP, targetIP net.IP) []byte {
+	b := make([]byte, arpPacketSize)
+	binary.BigEndian.PutUint16(b[0:2], arpHardwareTypeEthernet)
+	binary.BigEndian.PutUint16(b[2:4], unix.ETH_P_IP)
+	b[4] = 6
+	b[5] = 4
+	binary.BigEndian.PutUint16(b[6:8], arpOpRequest)
+	copy(b[8:14], sourceMAC)
+	copy(b[14:18], sourceIP.To4())
+	copy(b[24:28], targetIP.To4())
+
+	return b
+}
+
+// parseARPReplySender returns the sender MAC of an ARP reply from the target IP (or nil if it's something else)
+func parseARPReplySender(b []byte, targetIP net.IP) net.HardwareAddr {
+	if len(b) < arpPacketSize {
+		return nil
+	}
+
+	if binary.BigEndian.Uint16(b[0:2]) != arpHardwareTypeEthernet ||
+		binary.BigEndian.Uint16(b[2:4]) != unix.ETH_P_IP ||
+		b[4] != 6 || b[5] != 4 ||
+		binary.BigEndian.Uint16(b[6:8]) != arpOpReply {
+		return nil
+	}
+
+	if !net.IP(b[14:18]).Equal(targetIP) {
+		return nil
+	}
+
+	return net.HardwareAddr(bytes.Clone(b[8:14]))
+}
+
+func marshalNeighbourSolicitation(sourceMAC net.HardwareAddr, targetIP net.IP) []byte {
+	// the kernel fills in the checksum (it needs the pseudo-header)
+	b := make([]byte, 32)
+	b[0] = ndpNeighbourSolicitation
+	copy(b[8:24], targetIP.To16())
+	b[24] = ndpOptionSourceLinkLayerAddress
+	b[25] = 1
+	copy(b[26:32], sourceMAC)
+
+	return b
+}
+
+// parseNeighbourAdvertisementSender returns the target link-layer address of a neighbour advertisement for the target
+// IP (or nil if it's something else)
+func parseNeighbourAdvertisementSender(b []byte, targetIP net.IP) net.HardwareAddr {
+	if len(b) < 24 || b[0] != ndpNeighbourAdvertisement || b[1] != 0 {
+		return nil
+	}
+
+	if !net.IP(b[8:24]).Equal(targetIP) {
+		return nil
+	}
+
+	options := b[24:]
+	for len(options) >= 8 {
+		optionSize := int(options[1]) * 8
+		if optionSize == 0 || optionSize > len(options) {
+			return nil
+		}
+
+		if options[0] == ndpOptionTargetLinkLayerAddress && optionSize >= 8 {
+			return net.HardwareAddr(bytes.Clone(options[2:8]))
+		}
+
+		options = options[optionSize:]
+	}
+
+	return nil
+}
+
+// getSolicitedNodeAddress returns the ff02::1:ffXX:XXXX multicast group a neighbour solicitation for the IP goes to
+func getSolicitedNodeAddress(ip net.IP) net.IP {
+	solicitedNodeAddress := net.ParseIP("ff02::1:ff00:0")
+	copy(solicitedNodeAddress[13:16], ip.To16()[13:16])
+
+	return solicitedNodeAddress
+}
+
+// dialARP opens an AF_PACKET socket (needs CAP_NET_RAW) bound to the target's interface that broadcasts ARP requests
+func dialARP(target *l2Target) (*l2Conn, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("failed unix.Socket for AF_PACKET: %s", err)
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: target.networkInterface.IFIndex})
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed unix.Bind for AF_PACKET: %s", err)
+	}
+
+	// a non-blocking fd gets us deadlines (and a Close that unblocks reads) via the runtime poller
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("arp-%s", target.networkInterface.Name))
+
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	request := marshalARPRequest(target.sourceMAC, target.sourceIP, target.ip)
+
+	broadcastAddr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  target.networkInterface.IFIndex,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+
+	return &l2Conn{
+		send: func() error {
+			var sendErr error
+
+			err := rawConn.Write(func(fd uintptr) bool {
+				sendErr = unix.Sendto(int(fd), request, 0, broadcastAddr)
+				return sendErr != unix.EAGAIN
+			})
+			if err != nil {
+				return err
+			}
+
+			return sendErr
+		},
+		read:            file.Read,
+		setReadDeadline: file.SetReadDeadline,
+		close:           file.Close,
+		parseReplySender: func(b []byte) net.HardwareAddr {
+			return parseARPReplySender(b, target.ip)
+		},
+	}, nil
+}
+
+// dialNDP opens a raw ICMPv6 socket (needs CAP_NET_RAW) that sends neighbour solicitations to the target's
+// solicited-node multicast group
+func dialNDP(target *l2Target) (*l2Conn, error) {
+	conn, err := net.ListenIP("ip6:ipv6-icmp", &net.IPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		return nil, err
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// RFC 4861 receivers drop anything that might have been forwarded (i.e. a hop limit other than 255)
+	var setsockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		setsockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255)
+		if setsockoptErr != nil {
+			return
+		}
+
+		setsockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, 255)
+	})
+	if err == nil {
+		err = setsockoptErr
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to set hop limit: %s", err)
+	}
+
+	request := marshalNeighbourSolicitation(target.sourceMAC, target.ip)
+
+	multicastAddr := &net.IPAddr{IP: getSolicitedNodeAddress(target.ip), Zone: target.networkInterface.Name}
+
+	return &l2Conn{
+		send: func() error {
+			_, err := conn.WriteToIP(request, multicastAddr)
+			return err
+		},
+		read: func(b []byte) (int, error) {
+			n, _, err := conn.ReadFromIP(b)
+			return n, err
+		},
+		setReadDeadline: conn.SetReadDeadline,
+		close:           conn.Close,
+		parseReplySender: func(b []byte) net.HardwareAddr {
+			return parseNeighbourAdvertisementSender(b, target.ip)
+		},
+	}, nil
+}
+
+// RunL2Client probes an on-link host with ARP (IPv4) or neighbour solicitations (IPv6); every distinct MAC that answers
+// ends up in Report.MACs, so more than one means an IP conflict
+func RunL2Client(ctx context.Context, host string, reportInterval time.Duration, actualReportFn func(Report)) error {
+	mu := new(sync.Mutex)
+
+	sent := int64(0)
+	received := int64(0)
+	lost := int64(0)
+
+	lastSent := int64(0)
+	lastReceived := int64(0)
+	lastLost := int64(0)
+
+	rtts := new(rttStats)
+	macs := make(map[string]struct{})
+	conflictLogged := false
+
+	target, err := resolveL2Target(host)
+	if err != nil {
+		time.Sleep(time.Second * 1)
+		return err
+	}
+
+	protocol := "arp"
+	dial := dialARP
+	if target.isIPv6 {
+		protocol = "ndp"
+		dial = dialNDP
+	}
+
+	conn, err := dial(target)
+	if err != nil {
+		time.Sleep(time.Second * 1)
+		return err
+	}
+	defer func() {
+		_ = conn.close()
+	}()
+
+	log.Printf("probing %s %s via %s", strings.ToUpper(protocol), target.ip, target.networkInterface.Name)
+	defer func() {
+		log.Printf("stopped probing %s %s via %s", strings.ToUpper(protocol), target.ip, target.networkInterface.Name)
+	}()
+
+	reportFn := func() {
+		mu.Lock()
+
+		thisSent := sent - lastSent
+		thisReceived := received - lastReceived
+		thisLost := lost - lastLost
+
+		if lastSent == 0 {
+			thisSent = 0
+		}
+
+		if lastReceived == 0 {
+			thisReceived = 0
+		}
+
+		if lastLost == 0 {
+			thisLost = 0
+		}
+
+		lastSent = sent
+		lastReceived = received
+		lastLost = lost
+
+		report := Report{
+			Timestamp: time.Now(),
+			Protocol:  protocol,
+			Host:      host,
+			Sent:      thisSent,
+			Received:  thisReceived,
+			Lost:      thisLost,
+		}
+
+		rtts.apply(&report)
+
+		if len(macs) > 0 {
+			report.MACs = make([]string, 0, len(macs))
+			for mac := range macs {
+				report.MACs = append(report.MACs, mac)
+			}
+			sort.Strings(report.MACs)
+		}
+
+		if len(macs) > 1 && !conflictLogged {
+			log.Printf("warning: %s answered from more than one MAC (%s); IP conflict?", host, strings.Join(report.MACs, ", "))
+			conflictLogged = true
+		}
+
+		macs = make(map[string]struct{})
+
+		mu.Unlock()
+
+		actualReportFn(report)
+	}
+
+	reportFn()
+
+	defer func() {
+		reportFn()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.close()
+	}()
+
+	sendTicker := time.NewTicker(l2SendInterval)
+	defer func() {
+		sendTicker.Stop()
+	}()
+
+	buf := make([]byte, 65536)
+
+	reportTicker := time.NewTicker(reportInterval)
+	defer func() {
+		reportTicker.Stop()
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reportTicker.C:
+			}
+
+			reportFn()
+		}
+	}()
+
+	isClosed := func(err error) bool {
+		return errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sendTicker.C:
+		}
+
+		now := time.Now()
+
+		err = conn.setReadDeadline(now.Add(l2Timeout))
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		mu.Lock()
+		sent++
+		mu.Unlock()
+
+		err = conn.send()
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+
+			mu.Lock()
+			lost++
+			mu.Unlock()
+
+			continue
+		}
+
+		answered := false
+
+		for {
+			n, err := conn.read(buf)
+			if err != nil {
+				if isClosed(err) {
+					return nil
+				}
+
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					if !answered {
+						mu.Lock()
+						lost++
+						mu.Unlock()
+					}
+
+					break
+				}
+
+				return err
+			}
+
+			mac := conn.parseReplySender(buf[:n])
+			if mac == nil {
+				continue
+			}
+
+			mu.Lock()
+			macs[mac.String()] = struct{}{}
+			if !answered {
+				received++
+				rtts.add(time.Since(now))
+			}
+			mu.Unlock()
+
+			if !answered {
+				answered = true
+
+				// keep listening until the next request is due, so a second host answering for the same IP gets seen
+				err = conn.setReadDeadline(now.Add(l2SendInterval / 2))
+				if err != nil {
+					if isClosed(err) {
+						return nil
+					}
+
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package packets
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	PhaseIdle     = "idle"
+	PhaseUpload   = "upload"
+	PhaseDownload = "download"
+)
+
+type LatencyUnderLoadPhase struct {
+	Name          string        `json:"name"`
+	Sent          int64         `json:"sent"`
+	Received      int64         `json:"received"`
+	Lost          int64         `json:"lost"`
+	RTTMin        time.Duration `json:"rtt_min"`
+	RTTAvg        time.Duration `json:"rtt_avg"`
+	RTTMax        time.Duration `json:"rtt_max"`
+	Jitter        time.Duration `json:"jitter"`
+	RTTIncrease   time.Duration `json:"rtt_increase"`
+	BitsPerSecond float64       `json:"bits_per_second"`
+}
+
+type LatencyUnderLoadResult struct {
+	Timestamp time.Time                `json:"timestamp"`
+	Host      string                   `json:"host"`
+	Phases    []*LatencyUnderLoadPhase `json:"phases"`
+}
+
+// RunLatencyUnderLoad measures idle RTT with the UDP probe, then keeps that probe running while saturating the link
+// with the bulk path (first upload, then download) and reports how much the RTT grew in each direction
+func RunLatencyUnderLoad(ctx context.Context, host string, phaseDuration time.Duration, streams int) (*LatencyUnderLoadResult, error) {
+	return runLatencyUnderLoad(ctx, host, udpPort, bulkPort, phaseDuration, streams)
+}
+
+func runLatencyUnderLoad(ctx context.Context, host string, probePort int, loadPort int, phaseDuration time.Duration, streams int) (*LatencyUnderLoadResult, error) {
+	warmUp := time.Second * 2
+	reportInterval := time.Millisecond * 500
+
+	mu := new(sync.Mutex)
+	currentPhase := (*LatencyUnderLoadPhase)(nil)
+	rttSums := make(map[string]time.Duration)
+	jitterSums := make(map[string]time.Duration)
+	reports := make(map[string]int64)
+
+	reportFn := func(report Report) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if currentPhase == nil || report.Sent == 0 {
+			return
+		}
+
+		phase := currentPhase
+
+		phase.Sent += report.Sent
+		phase.Received += report.Received
+		phase.Lost += report.Lost
+
+		if report.Received == 0 {
+			return
+		}
+
+		if phase.RTTMin == 0 || report.RTTMin < phase.RTTMin {
+			phase.RTTMin = report.RTTMin
+		}
+
+		if report.RTTMax > phase.RTTMax {
+			phase.RTTMax = report.RTTMax
+		}
+
+		rttSums[phase.Name] += report.RTTAvg * time.Duration(report.Received)
+		jitterSums[phase.Name] += report.Jitter
+		reports[phase.Name]++
+	}
+
+	probeCtx, cancelProbe := context.WithCancel(ctx)
+	defer cancelProbe()
+
+	go func() {
+		for probeCtx.Err() == nil {
+			err := runUDPClient(probeCtx, host, probePort, reportInterval, reportFn)
+			if err != nil {
+				log.Printf("warning: failed RunUDPClient during latency under load test: %s", err)
+			}
+		}
+	}()
+
+	result := &LatencyUnderLoadResult{
+		Timestamp: time.Now(),
+		Host:      host,
+	}
+
+	runPhase := func(name string, direction byte) error {
+		phase := &LatencyUnderLoadPhase{Name: name}
+		result.Phases = append(result.Phases, phase)
+
+		loadCtx, cancelLoad := context.WithCancel(ctx)
+		defer cancelLoad()
+
+		loadErrs := make(chan error, 1)
+		loadBytes := int64(0)
+		loadStarted := time.Now()
+
+		if direction != 0 {
+			go func() {
+				var err error
+				loadBytes, err = runBulkClient(loadCtx, host, loadPort, direction, streams)
+				loadErrs <- err
+			}()
+		} else {
+			close(loadErrs)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(warmUp):
+		}
+
+		mu.Lock()
+		currentPhase = phase
+		mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(phaseDuration):
+		}
+
+		mu.Lock()
+		currentPhase = nil
+		mu.Unlock()
+
+		cancelLoad()
+
+		err := <-loadErrs
+		if err != nil {
+			return err
+		}
+
+		if direction != 0 {
+			phase.BitsPerSecond = float64(loadBytes*8) / time.Since(loadStarted).Seconds()
+		}
+
+		return nil
+	}
+
+	err := runPhase(PhaseIdle, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runPhase(PhaseUpload, BulkDirectionUpload)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runPhase(PhaseDownload, BulkDirectionDownload)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, phase := range result.Phases {
+		if phase.Received > 0 {
+			phase.RTTAvg = rttSums[phase.Name] / time.Duration(phase.Received)
+		}
+
+		if reports[phase.Name] > 0 {
+			phase.Jitter = jitterSums[phase.Name] / time.Duration(reports[phase.Name])
+		}
+
+		phase.RTTIncrease = phase.RTTAvg - result.Phases[0].RTTAvg
+	}
+
+	return result, nil
+}
@@ -0,0 +1,222 @@
+package packets
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultMTUSweepMax = 9000
+
+	mtuSweepAttempts = 2
+	mtuSweepTimeout  = time.Second
+)
+
+// MTUProbe is one size we tried (the size is the whole IP packet, like an MTU)
+type MTUProbe struct {
+	Size  int    `json:"size"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type MTUResult struct {
+	Timestamp time.Time `json:"timestamp"`
+	Host      string    `json:"host"`
+	// PathMTU is the biggest packet that made it there and back without being fragmented (0 if even the smallest
+	// didn't)
+	PathMTU int `json:"path_mtu"`
+	// ReportedMTU is what a router said the MTU was when something was too big (0 if nobody did)
+	ReportedMTU int        `json:"reported_mtu,omitempty"`
+	Probes      []MTUProbe `json:"probes"`
+}
+
+// getMinimumMTU is the MTU every link has to be able to do (576 is the IPv4 minimum reassembly size, which is a more
+// useful floor in practice than the 68 byte minimum MTU)
+func getMinimumMTU(isIPv6 bool) int {
+	if isIPv6 {
+		return 1280
+	}
+
+	return 576
+}
+
+// RunMTUSweep works out the path MTU to a host by pinging it with the don't fragment bit set, binary searching between
+// the minimum MTU and maxSize (DefaultMTUSweepMax if it's 0); it needs CAP_NET_RAW, like RunICMPClient
+func RunMTUSweep(ctx context.Context, host string, maxSize int) (*MTUResult, error) {
+	conn, dialAddr, isIPv6, err := listenICMP(host)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	// PMTUDISC_PROBE sets DF but ignores any path MTU the kernel has cached, so we find out for ourselves
+	if isIPv6 {
+		err = setICMPSockopt(conn, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		if err == nil {
+			err = setICMPSockopt(conn, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+		}
+	} else {
+		err = setICMPSockopt(conn, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set the don't fragment bit: %s", err)
+	}
+
+	echoRequest := byte(icmpv4EchoRequest)
+	echoReply := byte(icmpv4EchoReply)
+	headerSize := sizeofIPv4Header + sizeofICMPHeader
+	if isIPv6 {
+		echoRequest = icmpv6EchoRequest
+		echoReply = icmpv6EchoReply
+		headerSize = sizeofIPv6Header + sizeofICMPHeader
+	}
+
+	if maxSize <= 0 {
+		maxSize = DefaultMTUSweepMax
+	}
+
+	minSize := getMinimumMTU(isIPv6)
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+
+	result := MTUResult{
+		Timestamp: time.Now(),
+		Host:      host,
+		Probes:    make([]MTUProbe, 0),
+	}
+
+	id := uint16(os.Getpid()&0xffff) ^ uint16(rand.Intn(0xffff))
+	seq := uint16(0)
+	buf := make([]byte, 65536)
+
+	// try sends a ping of the given size, returning whether it came back
+	try := func(size int) MTUProbe {
+		probe := MTUProbe{Size: size}
+
+		for attempt := 0; attempt < mtuSweepAttempts; attempt++ {
+			if ctx.Err() != nil {
+				probe.Error = ctx.Err().Error()
+				return probe
+			}
+
+			seq++
+			thisSeq := seq
+
+			err := conn.SetDeadline(time.Now().Add(mtuSweepTimeout))
+			if err != nil {
+				probe.Error = err.Error()
+				return probe
+			}
+
+			_, err = conn.WriteToIP(marshalICMPEcho(echoRequest, id, thisSeq, make([]byte, size-headerSize)), dialAddr)
+			if err != nil {
+				// bigger than our own interface's MTU
+				if errors.Is(err, unix.EMSGSIZE) {
+					probe.Error = "message too long (local MTU)"
+					return probe
+				}
+
+				probe.Error = err.Error()
+				continue
+			}
+
+			for {
+				n, addr, err := conn.ReadFromIP(buf)
+				if err != nil {
+					if !errors.Is(err, os.ErrDeadlineExceeded) {
+						probe.Error = err.Error()
+					}
+
+					break
+				}
+
+				b := buf[:n]
+
+				if len(b) >= sizeofICMPHeader && b[0] == echoReply && addr.IP.Equal(dialAddr.IP) {
+					if binary.BigEndian.Uint16(b[4:6]) == id && binary.BigEndian.Uint16(b[6:8]) == thisSeq {
+						probe.OK = true
+						probe.Error = ""
+						return probe
+					}
+
+					continue
+				}
+
+				quote, ok := parseICMPQuote(b, isIPv6)
+				if !ok || quote.id != id || quote.seq != thisSeq {
+					continue
+				}
+
+				if quote.mtu > 0 {
+					result.ReportedMTU = quote.mtu
+					probe.Error = fmt.Sprintf("too big (%s says the MTU is %d)", addr.IP, quote.mtu)
+					return probe
+				}
+
+				probe.Error = fmt.Sprintf("ICMP type %d code %d from %s", quote.errorType, quote.errorCode, addr.IP)
+				return probe
+			}
+		}
+
+		if probe.Error == "" {
+			probe.Error = "timed out"
+		}
+
+		return probe
+	}
+
+	probe := try(minSize)
+	result.Probes = append(result.Probes, probe)
+	if !probe.OK {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return &result, nil
+	}
+
+	// lowest is the biggest size known to work, highest the smallest size known not to (or one past the max)
+	lowest := minSize
+	highest := maxSize + 1
+
+	for highest-lowest > 1 {
+		size := lowest + (highest-lowest)/2
+
+		// a router told us, so try that next rather than bisecting our way there
+		if result.ReportedMTU > lowest && result.ReportedMTU < highest && result.ReportedMTU != size {
+			size = result.ReportedMTU
+		}
+
+		probe = try(size)
+		result.Probes = append(result.Probes, probe)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if probe.OK {
+			lowest = size
+		} else {
+			highest = size
+		}
+	}
+
+	result.PathMTU = lowest
+
+	return &result, nil
+}
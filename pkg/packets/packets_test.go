@@ -2,12 +2,38 @@ package packets
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// skipIfNotPermitted skips a test that needs raw sockets when we don't have CAP_NET_RAW
+func skipIfNotPermitted(t *testing.T, err error) {
+	if errors.Is(err, os.ErrPermission) {
+		t.Skipf("can't open a raw socket (needs CAP_NET_RAW): %s", err)
+	}
+}
+
+// hasIPv6Loopback is whether ::1 is usable (it isn't with IPv6 disabled, e.g. in some CI)
+func hasIPv6Loopback() bool {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+
+	_ = listener.Close()
+
+	return true
+}
+
 func TestPackets(t *testing.T) {
 	t.Run("RunTCPServerAndTCPClient", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -18,15 +44,273 @@ func TestPackets(t *testing.T) {
 			cancel()
 		}()
 
+		listener, err := listenTCP(0)
+		require.NoError(t, err)
+		port := listener.Addr().(*net.TCPAddr).Port
+
+		mu := new(sync.Mutex)
+		tcpInfos := make([]*TCPInfo, 0)
+		clientDone := make(chan struct{})
+
 		go func() {
+			defer close(clientDone)
+
 			<-time.After(time.Second * 1)
-			err := RunTCPClient(ctx, "127.0.0.1:6943", func(t time.Time, i1, i2, i3, i4 int64) {
-				log.Printf("%#+v", []any{t, i1, i2, i3, i4})
+			err := runTCPClient(ctx, "127.0.0.1", port, time.Second*1, func(report Report) {
+				log.Printf("%#+v", report)
+				if report.TCPInfo != nil {
+					log.Printf("%#+v", report.TCPInfo)
+
+					mu.Lock()
+					tcpInfos = append(tcpInfos, report.TCPInfo)
+					mu.Unlock()
+				}
 			})
 			require.NoError(t, err)
 		}()
 
-		err := RunTCPServer(ctx, 6943)
+		err = serveTCP(ctx, listener)
+		require.NoError(t, err)
+
+		<-clientDone
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// TCP_INFO sampling works if any of the reports got an RTT out of it
+		hasRTT := false
+		for _, tcpInfo := range tcpInfos {
+			if tcpInfo.RTT > 0 {
+				hasRTT = true
+			}
+		}
+
+		require.True(t, hasRTT, "no report had a TCPInfo with an RTT")
+	})
+
+	t.Run("GetTCPInfo", func(t *testing.T) {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() {
+			_ = listener.Close()
+		}()
+
+		conn, err := net.Dial("tcp4", listener.Addr().String())
+		require.NoError(t, err)
+
+		tcpInfo, err := GetTCPInfo(conn.(*net.TCPConn))
+		require.NoError(t, err)
+		require.NotNil(t, tcpInfo)
+
+		// nothing to ask about once it's closed (e.g. the last report on shutdown), which the client doesn't warn about
+		_ = conn.Close()
+
+		_, err = GetTCPInfo(conn.(*net.TCPConn))
+		require.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("RunICMPClient", func(t *testing.T) {
+		for _, host := range []string{"127.0.0.1", "::1"} {
+			if host == "::1" && !hasIPv6Loopback() {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*2500)
+
+			mu := new(sync.Mutex)
+			reports := make([]Report, 0)
+
+			err := RunICMPClient(ctx, host, time.Second*1, func(report Report) {
+				mu.Lock()
+				reports = append(reports, report)
+				mu.Unlock()
+			})
+			cancel()
+			skipIfNotPermitted(t, err)
+			require.NoError(t, err)
+
+			mu.Lock()
+			gotReports := slices.Clone(reports)
+			mu.Unlock()
+
+			received := int64(0)
+			for _, report := range gotReports {
+				log.Printf("%#+v", report)
+				require.Equal(t, "icmp", report.Protocol)
+				received += report.Received
+			}
+
+			require.Greater(t, received, int64(0))
+		}
+	})
+
+	t.Run("L2RequestsAndReplies", func(t *testing.T) {
+		sourceMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+		targetMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+		sourceIP := net.ParseIP("192.168.100.1")
+		targetIP := net.ParseIP("192.168.100.2")
+
+		// a reply is a request with the op flipped and the sender / target swapped
+		reply := marshalARPRequest(targetMAC, targetIP, sourceIP)
+		reply[7] = arpOpReply
+		require.Equal(t, targetMAC, parseARPReplySender(reply, targetIP))
+		require.Nil(t, parseARPReplySender(reply, sourceIP))
+		require.Nil(t, parseARPReplySender(marshalARPRequest(sourceMAC, sourceIP, targetIP), targetIP))
+
+		targetIPv6 := net.ParseIP("fd00::1:2:3")
+		require.Equal(t, net.ParseIP("ff02::1:ff02:3"), getSolicitedNodeAddress(targetIPv6))
+
+		advertisement := marshalNeighbourSolicitation(targetMAC, targetIPv6)
+		advertisement[0] = ndpNeighbourAdvertisement
+		advertisement[24] = ndpOptionTargetLinkLayerAddress
+		require.Equal(t, targetMAC, parseNeighbourAdvertisementSender(advertisement, targetIPv6))
+		require.Nil(t, parseNeighbourAdvertisementSender(advertisement, net.ParseIP("fd00::1")))
+		require.Nil(t, parseNeighbourAdvertisementSender(marshalNeighbourSolicitation(sourceMAC, targetIPv6), targetIPv6))
+
+		_, err := resolveL2Target("127.0.0.1")
+		require.Error(t, err)
+	})
+
+	t.Run("RunLatencyUnderLoad", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		probeListener, err := listenUDP(0)
+		require.NoError(t, err)
+
+		loadListener, err := listenTCP(0)
+		require.NoError(t, err)
+
+		go func() {
+			_ = serveUDP(ctx, probeListener)
+		}()
+
+		go func() {
+			_ = serveBulk(ctx, loadListener, DefaultBulkMaxDuration, DefaultBulkMaxBytes)
+		}()
+
+		probePort := probeListener.LocalAddr().(*net.UDPAddr).Port
+		loadPort := loadListener.Addr().(*net.TCPAddr).Port
+
+		result, err := runLatencyUnderLoad(ctx, "127.0.0.1", probePort, loadPort, time.Second*2, 2)
+		require.NoError(t, err)
+		require.Len(t, result.Phases, 3)
+
+		for _, phase := range result.Phases {
+			log.Printf("%#+v", phase)
+			require.Greater(t, phase.Received, int64(0))
+			require.Greater(t, phase.RTTAvg, time.Duration(0))
+		}
+
+		require.Equal(t, PhaseIdle, result.Phases[0].Name)
+		require.Greater(t, result.Phases[1].BitsPerSecond, float64(0))
+		require.Greater(t, result.Phases[2].BitsPerSecond, float64(0))
+	})
+
+	t.Run("RunBulkServerLimits", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		listener, err := listenTCP(0)
+		require.NoError(t, err)
+
+		go func() {
+			_ = serveBulk(ctx, listener, time.Second, 1024*1024)
+		}()
+
+		addr := fmt.Sprintf("127.0.0.1:%d", listener.Addr().(*net.TCPAddr).Port)
+
+		// the download stops at the byte limit
+		conn, err := net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, err = conn.Write([]byte{BulkDirectionDownload})
+		require.NoError(t, err)
+
+		n, err := io.Copy(io.Discard, conn)
+		require.NoError(t, err)
+		require.Equal(t, int64(1024*1024), n)
+
+		// and an idle connection at the time limit
+		conn, err = net.Dial("tcp4", addr)
+		require.NoError(t, err)
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		started := time.Now()
+		_, err = io.Copy(io.Discard, conn)
+		require.NoError(t, err)
+		require.Less(t, time.Since(started), time.Second*2)
+	})
+
+	t.Run("ParseICMPQuote", func(t *testing.T) {
+		request := marshalICMPEcho(icmpv4EchoRequest, 0x1234, 7, nil)
+
+		// time exceeded: the ICMP header, then the original IPv4 header (with options, so 24 bytes) and the request
+		ipv4Header := make([]byte, 24)
+		ipv4Header[0] = 0x46
+		timeExceeded := append(append([]byte{icmpv4TimeExceeded, 0, 0, 0, 0, 0, 0, 0}, ipv4Header...), request...)
+
+		quote, ok := parseICMPQuote(timeExceeded, false)
+		require.True(t, ok)
+		require.Equal(t, uint16(0x1234), quote.id)
+		require.Equal(t, uint16(7), quote.seq)
+		require.Equal(t, 0, quote.mtu)
+
+		// fragmentation needed carries the next hop MTU
+		fragmentationNeeded := append(append([]byte{icmpv4DestinationUnreachable, icmpv4FragmentationNeeded, 0, 0, 0, 0, 0x05, 0xdc}, ipv4Header...), request...)
+		quote, ok = parseICMPQuote(fragmentationNeeded, false)
+		require.True(t, ok)
+		require.Equal(t, 1500, quote.mtu)
+
+		// packet too big (IPv6)
+		packetTooBig := append(append([]byte{icmpv6PacketTooBig, 0, 0, 0, 0, 0, 0x05, 0x00}, make([]byte, sizeofIPv6Header)...), marshalICMPEcho(icmpv6EchoRequest, 0x1234, 8, nil)...)
+		quote, ok = parseICMPQuote(packetTooBig, true)
+		require.True(t, ok)
+		require.Equal(t, uint16(8), quote.seq)
+		require.Equal(t, 1280, quote.mtu)
+
+		// not an error, or truncated
+		_, ok = parseICMPQuote(marshalICMPEcho(icmpv4EchoReply, 0x1234, 7, nil), false)
+		require.False(t, ok)
+		_, ok = parseICMPQuote(timeExceeded[:30], false)
+		require.False(t, ok)
+	})
+
+	t.Run("RunMTUSweep", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		// lo's MTU is way bigger than the max, so everything fits
+		result, err := RunMTUSweep(ctx, "127.0.0.1", 4000)
+		skipIfNotPermitted(t, err)
+		require.NoError(t, err)
+		log.Printf("%#+v", result)
+		require.Equal(t, 4000, result.PathMTU)
+
+		if !hasIPv6Loopback() {
+			t.Skipf("can't sweep ::1 (no IPv6 on lo)")
+		}
+
+		result, err = RunMTUSweep(ctx, "::1", 4000)
+		require.NoError(t, err)
+		require.Equal(t, 4000, result.PathMTU)
+	})
+
+	t.Run("RunTraceroute", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		result, err := RunTraceroute(ctx, "127.0.0.1", 5)
+		skipIfNotPermitted(t, err)
 		require.NoError(t, err)
+		require.True(t, result.Reached)
+		require.Len(t, result.Hops, 1)
+		require.Equal(t, "127.0.0.1", result.Hops[0].Address)
+		require.Greater(t, result.Hops[0].Received, int64(0))
 	})
 }
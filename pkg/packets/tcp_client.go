@@ -11,7 +11,15 @@ import (
 	"time"
 )
 
-func RunTCPClient(ctx context.Context, host string, actualReportFn func(time.Time, int64, int64, int64, int64)) error {
+// tcpDialTimeout is how long a connection attempt gets before it's a failure (rather than the minutes the kernel would
+// keep retrying the SYN for)
+const tcpDialTimeout = time.Second * 5
+
+func RunTCPClient(ctx context.Context, host string, reportInterval time.Duration, actualReportFn func(Report)) error {
+	return runTCPClient(ctx, host, tcpPort, reportInterval, actualReportFn)
+}
+
+func runTCPClient(ctx context.Context, host string, port int, reportInterval time.Duration, actualReportFn func(Report)) error {
 	mu := new(sync.Mutex)
 
 	sent := int64(0)
@@ -24,17 +32,23 @@ func RunTCPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 	lastOutOfOrder := int64(0)
 	lastLost := int64(0)
 
-	dialAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:6943", host))
+	rtts := new(rttStats)
+
+	dialAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", host, port))
 	if err != nil {
 		time.Sleep(time.Second * 1)
 		return err
 	}
 
-	conn, err := net.DialTCP("tcp4", nil, dialAddr)
+	dialer := net.Dialer{Timeout: tcpDialTimeout}
+
+	dialConn, err := dialer.DialContext(ctx, "tcp4", dialAddr.String())
 	if err != nil {
 		time.Sleep(time.Second * 1)
 		return err
 	}
+
+	conn := dialConn.(*net.TCPConn)
 	defer func() {
 		_ = conn.Close()
 	}()
@@ -73,11 +87,33 @@ func RunTCPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 		lastOutOfOrder = outOfOrder
 		lastLost = lost
 
+		report := Report{
+			Timestamp:  time.Now(),
+			Protocol:   "tcp",
+			Host:       host,
+			Sent:       thisSent,
+			Received:   thisReceived,
+			OutOfOrder: thisOutOfOrder,
+			Lost:       thisLost,
+		}
+
+		rtts.apply(&report)
+
 		mu.Unlock()
 
+		// the last report can come after the connection's been closed (e.g. on shutdown), with no TCP_INFO to be had
+		tcpInfo, err := GetTCPInfo(conn)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("warning: failed GetTCPInfo for TCP %s: %s", conn.RemoteAddr(), err)
+			}
+		} else {
+			report.TCPInfo = tcpInfo
+		}
+
 		// TODO: keeping the noise down
 		// log.Printf("UDP %s sent: %d, received: %d, outOfOrder: %d, lost: %d", conn.RemoteAddr(), thisSent, thisReceived, thisOutOfOrder, thisLost)
-		actualReportFn(time.Now(), thisSent, thisReceived, thisOutOfOrder, thisLost)
+		actualReportFn(report)
 	}
 
 	reportFn()
@@ -98,7 +134,7 @@ func RunTCPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 
 	buf := make([]byte, 65536)
 
-	reportTicker := time.NewTicker(time.Second * 5)
+	reportTicker := time.NewTicker(reportInterval)
 	defer func() {
 		reportTicker.Stop()
 	}()
@@ -135,11 +171,13 @@ func RunTCPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 			return err
 		}
 
+		mu.Lock()
 		sent++
+		mu.Unlock()
 
 		_, err = conn.Write([]byte(fmt.Sprintf("%d", sent)))
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return nil
 			}
 
@@ -152,7 +190,7 @@ func RunTCPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 
 		n, err := conn.Read(buf)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return nil
 			}
 
@@ -173,6 +211,7 @@ func RunTCPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 		mu.Lock()
 		if ack == sent {
 			received++
+			rtts.add(time.Since(now))
 		} else {
 			outOfOrder++
 		}
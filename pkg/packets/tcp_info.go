@@ -0,0 +1,61 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type TCPInfo struct {
+	RTT          time.Duration `json:"rtt"`
+	RTTVar       time.Duration `json:"rtt_var"`
+	Retransmits  int64         `json:"retransmits"`
+	TotalRetrans int64         `json:"total_retrans"`
+	SndCwnd      int64         `json:"snd_cwnd"`
+	Lost         int64         `json:"lost"`
+	Reordering   int64         `json:"reordering"`
+	PacingRate   int64         `json:"pacing_rate"`
+}
+
+// GetTCPInfo asks the kernel for what it knows about the given connection (getsockopt(TCP_INFO)); if the connection's
+// already closed there's nothing to ask about, and the error is net.ErrClosed as is
+func GetTCPInfo(conn *net.TCPConn) (*TCPInfo, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed conn.SyscallConn: %s", err)
+	}
+
+	var rawTCPInfo *unix.TCPInfo
+	var getsockoptErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		rawTCPInfo, getsockoptErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return nil, net.ErrClosed
+		}
+
+		return nil, fmt.Errorf("failed rawConn.Control: %s", err)
+	}
+
+	if getsockoptErr != nil {
+		return nil, fmt.Errorf("failed unix.GetsockoptTCPInfo: %s", getsockoptErr)
+	}
+
+	tcpInfo := TCPInfo{
+		RTT:          time.Duration(rawTCPInfo.Rtt) * time.Microsecond,
+		RTTVar:       time.Duration(rawTCPInfo.Rttvar) * time.Microsecond,
+		Retransmits:  int64(rawTCPInfo.Retransmits),
+		TotalRetrans: int64(rawTCPInfo.Total_retrans),
+		SndCwnd:      int64(rawTCPInfo.Snd_cwnd),
+		Lost:         int64(rawTCPInfo.Lost),
+		Reordering:   int64(rawTCPInfo.Reordering),
+		PacingRate:   int64(rawTCPInfo.Pacing_rate),
+	}
+
+	return &tcpInfo, nil
+}
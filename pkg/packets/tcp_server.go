@@ -9,15 +9,25 @@ import (
 )
 
 func RunTCPServer(ctx context.Context, port int) error {
-	listenAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("0.0.0.0:%d", port))
+	listener, err := listenTCP(port)
 	if err != nil {
 		return err
 	}
 
-	listener, err := net.ListenTCP("tcp4", listenAddr)
+	return serveTCP(ctx, listener)
+}
+
+// listenTCP listens on the given port on all IPv4 addresses (0 for any free port, see listener.Addr() for which)
+func listenTCP(port int) (*net.TCPListener, error) {
+	listenAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("0.0.0.0:%d", port))
 	if err != nil {
-		return err
+		return nil, err
 	}
+
+	return net.ListenTCP("tcp4", listenAddr)
+}
+
+func serveTCP(ctx context.Context, listener *net.TCPListener) error {
 	defer func() {
 		_ = listener.Close()
 	}()
@@ -0,0 +1,214 @@
+package packets
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultTracerouteMaxHops = 30
+
+	tracerouteRounds  = 3
+	tracerouteTimeout = time.Second * 2
+)
+
+// TracerouteHop is what came back from the probes with a given TTL; a hop that never answered has no address
+type TracerouteHop struct {
+	TTL      int           `json:"ttl"`
+	Address  string        `json:"address,omitempty"`
+	Sent     int64         `json:"sent"`
+	Received int64         `json:"received"`
+	RTTMin   time.Duration `json:"rtt_min"`
+	RTTAvg   time.Duration `json:"rtt_avg"`
+	RTTMax   time.Duration `json:"rtt_max"`
+}
+
+type TracerouteResult struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Host      string           `json:"host"`
+	Reached   bool             `json:"reached"`
+	Hops      []*TracerouteHop `json:"hops"`
+}
+
+// RunTraceroute traces the path to a host with ICMP echo requests; like mtr it sends the probes for every TTL at once
+// (a few rounds of them, to see through the rate limiting routers do on ICMP), rather than a hop at a time, so it takes
+// a few seconds however long the path is; it needs CAP_NET_RAW, like RunICMPClient
+func RunTraceroute(ctx context.Context, host string, maxHops int) (*TracerouteResult, error) {
+	conn, dialAddr, isIPv6, err := listenICMP(host)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	echoRequest := byte(icmpv4EchoRequest)
+	echoReply := byte(icmpv4EchoReply)
+	ttlLevel, ttlOpt := unix.IPPROTO_IP, unix.IP_TTL
+	if isIPv6 {
+		echoRequest = icmpv6EchoRequest
+		echoReply = icmpv6EchoReply
+		ttlLevel, ttlOpt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+	}
+
+	if maxHops <= 0 {
+		maxHops = DefaultTracerouteMaxHops
+	}
+
+	result := TracerouteResult{
+		Timestamp: time.Now(),
+		Host:      host,
+		Hops:      make([]*TracerouteHop, 0),
+	}
+
+	hops := make([]*TracerouteHop, maxHops)
+	for i := range hops {
+		hops[i] = &TracerouteHop{TTL: i + 1}
+	}
+
+	rttSums := make([]time.Duration, maxHops)
+
+	// the seq encodes the round and the TTL, so we know what a reply is for
+	id := uint16(os.Getpid()&0xffff) ^ uint16(rand.Intn(0xffff))
+
+	add := func(seq uint16, address string, rtt time.Duration) {
+		ttl := int(seq)%maxHops + 1
+		hop := hops[ttl-1]
+
+		if hop.Address == "" {
+			hop.Address = address
+		}
+
+		hop.Received++
+		rttSums[ttl-1] += rtt
+
+		if hop.RTTMin == 0 || rtt < hop.RTTMin {
+			hop.RTTMin = rtt
+		}
+
+		if rtt > hop.RTTMax {
+			hop.RTTMax = rtt
+		}
+	}
+
+	// the first TTL that got an echo reply (i.e. where the host is)
+	reachedTTL := 0
+
+	buf := make([]byte, 65536)
+
+	for round := 0; round < tracerouteRounds; round++ {
+		// anything from the last round that's still to come back is as good as lost
+		sentAt := make(map[uint16]time.Time)
+
+		for ttl := 1; ttl <= maxHops; ttl++ {
+			// no point going past the host
+			if reachedTTL != 0 && ttl > reachedTTL {
+				break
+			}
+
+			err = setICMPSockopt(conn, ttlLevel, ttlOpt, ttl)
+			if err != nil {
+				return nil, err
+			}
+
+			seq := uint16(round*maxHops + ttl - 1)
+			sentAt[seq] = time.Now()
+			hops[ttl-1].Sent++
+
+			_, err = conn.WriteToIP(marshalICMPEcho(echoRequest, id, seq, nil), dialAddr)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+
+				return nil, err
+			}
+		}
+
+		err = conn.SetReadDeadline(time.Now().Add(tracerouteTimeout))
+		if err != nil {
+			return nil, err
+		}
+
+		for len(sentAt) > 0 {
+			n, addr, err := conn.ReadFromIP(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+
+				return nil, err
+			}
+
+			now := time.Now()
+			b := buf[:n]
+
+			var seq uint16
+
+			if len(b) >= sizeofICMPHeader && b[0] == echoReply {
+				if binary.BigEndian.Uint16(b[4:6]) != id || !addr.IP.Equal(dialAddr.IP) {
+					continue
+				}
+
+				seq = binary.BigEndian.Uint16(b[6:8])
+
+				ttl := int(seq)%maxHops + 1
+				if reachedTTL == 0 || ttl < reachedTTL {
+					reachedTTL = ttl
+				}
+			} else {
+				quote, ok := parseICMPQuote(b, isIPv6)
+				if !ok || quote.id != id {
+					continue
+				}
+
+				seq = quote.seq
+			}
+
+			sent, ok := sentAt[seq]
+			if !ok {
+				continue
+			}
+
+			delete(sentAt, seq)
+
+			add(seq, addr.IP.String(), now.Sub(sent))
+		}
+	}
+
+	last := maxHops
+	if reachedTTL != 0 {
+		last = reachedTTL
+		result.Reached = true
+	} else {
+		// don't bother with the trailing hops that never answered
+		for last > 0 && hops[last-1].Received == 0 {
+			last--
+		}
+	}
+
+	for i := 0; i < last; i++ {
+		if hops[i].Received > 0 {
+			hops[i].RTTAvg = rttSums[i] / time.Duration(hops[i].Received)
+		}
+
+		result.Hops = append(result.Hops, hops[i])
+	}
+
+	return &result, nil
+}
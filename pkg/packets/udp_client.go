@@ -11,7 +11,11 @@ import (
 	"time"
 )
 
-func RunUDPClient(ctx context.Context, host string, actualReportFn func(time.Time, int64, int64, int64, int64)) error {
+func RunUDPClient(ctx context.Context, host string, reportInterval time.Duration, actualReportFn func(Report)) error {
+	return runUDPClient(ctx, host, udpPort, reportInterval, actualReportFn)
+}
+
+func runUDPClient(ctx context.Context, host string, port int, reportInterval time.Duration, actualReportFn func(Report)) error {
 	mu := new(sync.Mutex)
 
 	sent := int64(0)
@@ -24,7 +28,9 @@ func RunUDPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 	lastOutOfOrder := int64(0)
 	lastLost := int64(0)
 
-	dialAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:6943", host))
+	rtts := new(rttStats)
+
+	dialAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", host, port))
 	if err != nil {
 		time.Sleep(time.Second * 1)
 		return err
@@ -73,11 +79,23 @@ func RunUDPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 		lastOutOfOrder = outOfOrder
 		lastLost = lost
 
+		report := Report{
+			Timestamp:  time.Now(),
+			Protocol:   "udp",
+			Host:       host,
+			Sent:       thisSent,
+			Received:   thisReceived,
+			OutOfOrder: thisOutOfOrder,
+			Lost:       thisLost,
+		}
+
+		rtts.apply(&report)
+
 		mu.Unlock()
 
 		// TODO: keeping the noise down
 		// log.Printf("UDP %s sent: %d, received: %d, outOfOrder: %d, lost: %d", conn.RemoteAddr(), thisSent, thisReceived, thisOutOfOrder, thisLost)
-		actualReportFn(time.Now(), thisSent, thisReceived, thisOutOfOrder, thisLost)
+		actualReportFn(report)
 	}
 
 	reportFn()
@@ -98,7 +116,7 @@ func RunUDPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 
 	buf := make([]byte, 65536)
 
-	reportTicker := time.NewTicker(time.Second * 5)
+	reportTicker := time.NewTicker(reportInterval)
 	defer func() {
 		reportTicker.Stop()
 	}()
@@ -135,11 +153,13 @@ func RunUDPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 			return err
 		}
 
+		mu.Lock()
 		sent++
+		mu.Unlock()
 
 		_, err = conn.Write([]byte(fmt.Sprintf("%d", sent)))
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return nil
 			}
 
@@ -152,7 +172,7 @@ func RunUDPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 
 		n, err := conn.Read(buf)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return nil
 			}
 
@@ -173,6 +193,7 @@ func RunUDPClient(ctx context.Context, host string, actualReportFn func(time.Tim
 		mu.Lock()
 		if ack == sent {
 			received++
+			rtts.add(time.Since(now))
 		} else {
 			outOfOrder++
 		}
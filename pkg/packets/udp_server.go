@@ -9,15 +9,25 @@ import (
 )
 
 func RunUDPServer(ctx context.Context, port int) error {
-	listenAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("0.0.0.0:%d", port))
+	listener, err := listenUDP(port)
 	if err != nil {
 		return err
 	}
 
-	listener, err := net.ListenUDP("udp", listenAddr)
+	return serveUDP(ctx, listener)
+}
+
+// listenUDP listens on the given port on all addresses (0 for any free port, see listener.LocalAddr() for which)
+func listenUDP(port int) (*net.UDPConn, error) {
+	listenAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("0.0.0.0:%d", port))
 	if err != nil {
-		return err
+		return nil, err
 	}
+
+	return net.ListenUDP("udp", listenAddr)
+}
+
+func serveUDP(ctx context.Context, listener *net.UDPConn) error {
 	defer func() {
 		_ = listener.Close()
 	}()
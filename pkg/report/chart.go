@@ -0,0 +1,226 @@
+package report
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/initialed85/loser/pkg/history"
+)
+
+const (
+	chartWidth        = 800
+	chartHeight       = 160
+	chartMarginLeft   = 70
+	chartMarginRight  = 10
+	chartMarginTop    = 20
+	chartMarginBottom = 20
+
+	colourLine    = "#1565c0"
+	colourLineAlt = "#ef6c00"
+	colourLoss    = "#c62828"
+	colourAxis    = "#888888"
+)
+
+type chartPoint struct {
+	timestamp time.Time
+	value     float64 // NaN for a gap in the line
+}
+
+type chartLine struct {
+	label  string
+	colour string
+	points []chartPoint
+}
+
+// chart is a time series chart rendered as a standalone SVG (no scripts or external styles, so it survives being
+// pasted about): some lines on a shared axis, optionally some percentage bars (e.g. loss) on a 0 - 100 axis of their
+// own, and some shaded bands (e.g. outages)
+type chart struct {
+	from      time.Time
+	to        time.Time
+	format    func(float64) string
+	lines     []chartLine
+	barsLabel string
+	bars      []chartPoint
+	bands     []Outage
+}
+
+func (c chart) getX(timestamp time.Time) float64 {
+	span := c.to.Sub(c.from)
+	if span <= 0 {
+		return chartMarginLeft
+	}
+
+	plotWidth := float64(chartWidth - chartMarginLeft - chartMarginRight)
+	x := float64(timestamp.Sub(c.from)) / float64(span) * plotWidth
+
+	return chartMarginLeft + math.Max(0, math.Min(plotWidth, x))
+}
+
+func (c chart) getY(value float64, maxValue float64) float64 {
+	plotHeight := float64(chartHeight - chartMarginTop - chartMarginBottom)
+
+	return chartMarginTop + plotHeight - math.Max(0, math.Min(1, value/maxValue))*plotHeight
+}
+
+// formatAxisTime leaves the date off if the chart's all on one day
+func (c chart) formatAxisTime(timestamp time.Time) string {
+	if c.from.UTC().YearDay() == c.to.UTC().YearDay() && c.from.UTC().Year() == c.to.UTC().Year() {
+		return timestamp.UTC().Format("15:04:05")
+	}
+
+	return timestamp.UTC().Format("01-02 15:04")
+}
+
+func (c chart) svg() string {
+	b := new(strings.Builder)
+
+	plotBottom := float64(chartHeight - chartMarginBottom)
+	plotRight := float64(chartWidth - chartMarginRight)
+
+	_, _ = fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" font-family="monospace" font-size="11">`, chartWidth, chartHeight, chartWidth, chartHeight)
+
+	for _, band := range c.bands {
+		x1, x2 := c.getX(band.Start), c.getX(band.End)
+
+		_, _ = fmt.Fprintf(b, `<rect x="%.1f" y="%d" width="%.1f" height="%.1f" fill="%s" fill-opacity="0.12"/>`, x1, chartMarginTop, math.Max(1, x2-x1), plotBottom-chartMarginTop, colourLoss)
+	}
+
+	// the bars are as wide as the interval the sample covers
+	for i, bar := range c.bars {
+		if bar.value <= 0 || math.IsNaN(bar.value) {
+			continue
+		}
+
+		x2 := c.getX(bar.timestamp)
+		x1 := x2 - 1
+		if i > 0 {
+			x1 = c.getX(c.bars[i-1].timestamp)
+		}
+
+		y := c.getY(bar.value, 100)
+
+		_, _ = fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" fill-opacity="0.5"/>`, x1, y, math.Max(1, x2-x1), plotBottom-y, colourLoss)
+	}
+
+	maxValue := 0.0
+	for _, line := range c.lines {
+		for _, point := range line.points {
+			if !math.IsNaN(point.value) {
+				maxValue = math.Max(maxValue, point.value)
+			}
+		}
+	}
+
+	// nothing to scale to (e.g. a target that never answered)
+	hasValues := maxValue > 0
+	if !hasValues {
+		maxValue = 1
+	}
+
+	maxValue *= 1.1
+
+	for _, line := range c.lines {
+		segments := make([]string, 0)
+		current := make([]string, 0)
+
+		for _, point := range line.points {
+			if math.IsNaN(point.value) {
+				if len(current) > 0 {
+					segments = append(segments, strings.Join(current, " "))
+					current = make([]string, 0)
+				}
+
+				continue
+			}
+
+			current = append(current, fmt.Sprintf("%.1f,%.1f", c.getX(point.timestamp), c.getY(point.value, maxValue)))
+		}
+
+		if len(current) > 0 {
+			segments = append(segments, strings.Join(current, " "))
+		}
+
+		for _, segment := range segments {
+			_, _ = fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, segment, line.colour)
+		}
+	}
+
+	// axes and labels
+	_, _ = fmt.Fprintf(b, `<polyline points="%d,%d %d,%.1f %.1f,%.1f" fill="none" stroke="%s"/>`, chartMarginLeft, chartMarginTop, chartMarginLeft, plotBottom, plotRight, plotBottom, colourAxis)
+
+	if c.format != nil && hasValues {
+		_, _ = fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end" fill="%s">%s</text>`, chartMarginLeft-4, chartMarginTop+4, colourAxis, html.EscapeString(c.format(maxValue)))
+		_, _ = fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end" fill="%s">0</text>`, chartMarginLeft-4, plotBottom, colourAxis)
+	}
+
+	_, _ = fmt.Fprintf(b, `<text x="%d" y="%d" fill="%s">%s</text>`, chartMarginLeft, chartHeight-4, colourAxis, c.formatAxisTime(c.from))
+	_, _ = fmt.Fprintf(b, `<text x="%.1f" y="%d" text-anchor="end" fill="%s">%s</text>`, plotRight, chartHeight-4, colourAxis, c.formatAxisTime(c.to))
+
+	// the legend
+	x := float64(chartMarginLeft + 4)
+	for _, line := range c.lines {
+		_, _ = fmt.Fprintf(b, `<text x="%.1f" y="%d" fill="%s">%s</text>`, x, chartMarginTop-6, line.colour, html.EscapeString(line.label))
+		x += float64(len(line.label)+3) * 7
+	}
+
+	if c.barsLabel != "" {
+		_, _ = fmt.Fprintf(b, `<text x="%.1f" y="%d" fill="%s">%s</text>`, x, chartMarginTop-6, colourLoss, html.EscapeString(c.barsLabel))
+	}
+
+	b.WriteString(`</svg>`)
+
+	return b.String()
+}
+
+// getTargetChart is a target's average RTT (with gaps where nothing came back), its loss and its outages
+func getTargetChart(from time.Time, to time.Time, target TargetReport) chart {
+	rtt := chartLine{label: "rtt avg", colour: colourLine}
+	loss := make([]chartPoint, 0, len(target.probeSamples))
+
+	for _, sample := range target.probeSamples {
+		value := math.NaN()
+		if sample.Received > 0 {
+			value = float64(sample.RTTAvg)
+		}
+
+		rtt.points = append(rtt.points, chartPoint{sample.Timestamp, value})
+
+		loss = append(loss, chartPoint{sample.Timestamp, history.GetLossPercent(sample.Received, sample.Lost)})
+	}
+
+	return chart{
+		from: from,
+		to:   to,
+		format: func(value float64) string {
+			return formatRTT(time.Duration(value))
+		},
+		lines:     []chartLine{rtt},
+		barsLabel: "loss % (0 - 100)",
+		bars:      loss,
+		bands:     target.Outages,
+	}
+}
+
+// getInterfaceChart is an interface's errors and drops per second (rx and tx together)
+func getInterfaceChart(from time.Time, to time.Time, networkInterface InterfaceReport) chart {
+	errors := chartLine{label: "errors/s", colour: colourLoss}
+	dropped := chartLine{label: "dropped/s", colour: colourLineAlt}
+
+	for _, sample := range networkInterface.samples {
+		errors.points = append(errors.points, chartPoint{sample.Timestamp, sample.RxErrorsPerSecond + sample.TxErrorsPerSecond})
+		dropped.points = append(dropped.points, chartPoint{sample.Timestamp, sample.RxDroppedPerSecond + sample.TxDroppedPerSecond})
+	}
+
+	return chart{
+		from: from,
+		to:   to,
+		format: func(value float64) string {
+			return fmt.Sprintf("%.1f/s", value)
+		},
+		lines: []chartLine{errors, dropped},
+	}
+}
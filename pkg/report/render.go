@@ -0,0 +1,387 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+func formatTime(timestamp time.Time) string {
+	return timestamp.UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+func formatRTT(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+
+	return d.Round(time.Microsecond * 10).String()
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+func formatBytes(value int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	size := float64(value)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", value)
+	}
+
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+func formatOutageEnd(outage Outage) string {
+	if outage.Ongoing {
+		return formatTime(outage.End) + " (ongoing)"
+	}
+
+	return formatTime(outage.End)
+}
+
+func formatOperState(networkInterface InterfaceReport) string {
+	if networkInterface.OperStateStart == networkInterface.OperStateEnd {
+		return networkInterface.OperStateEnd
+	}
+
+	return fmt.Sprintf("%s -> %s", networkInterface.OperStateStart, networkInterface.OperStateEnd)
+}
+
+// getSummary is the gist of the report, a line at a time
+func getSummary(r *Report) []string {
+	affectedTargets := r.AffectedTargets()
+	outages := r.Outages()
+
+	downtime := time.Duration(0)
+	for _, outage := range outages {
+		downtime += outage.Duration
+	}
+
+	summary := []string{
+		fmt.Sprintf("%d of %d targets affected", len(affectedTargets), len(r.Targets)),
+		fmt.Sprintf("%d outages (%s of downtime across the targets)", len(outages), formatDuration(downtime)),
+		fmt.Sprintf("%d of %d interfaces with errors, drops or link events", len(r.AffectedInterfaces()), len(r.Interfaces)),
+		fmt.Sprintf("%d link events", len(r.Events)),
+	}
+
+	if len(r.Targets) == 0 && len(r.Interfaces) == 0 {
+		summary = append(summary, "no history for this time range (is it older than the retention?)")
+	}
+
+	return summary
+}
+
+// escapeMarkdown makes some text safe to put in a table cell
+func escapeMarkdown(text string) string {
+	text = strings.ReplaceAll(text, "\\", "\\\\")
+	text = strings.ReplaceAll(text, "|", "\\|")
+	text = strings.ReplaceAll(text, "\n", " ")
+
+	return text
+}
+
+func writeMarkdownTable(b *strings.Builder, header []string, rows [][]string) {
+	b.WriteString("| " + strings.Join(header, " | ") + " |\n")
+	b.WriteString("|" + strings.Repeat(" --- |", len(header)) + "\n")
+
+	for _, row := range rows {
+		cells := make([]string, 0, len(row))
+		for _, cell := range row {
+			cells = append(cells, escapeMarkdown(cell))
+		}
+
+		b.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+}
+
+func getTargetRow(target TargetReport) []string {
+	return []string{
+		target.Target,
+		fmt.Sprintf("%d", len(target.Outages)),
+		formatDuration(target.Downtime),
+		fmt.Sprintf("%.2f%%", target.LossPercent),
+		fmt.Sprintf("%.2f%%", target.WorstLossPercent),
+		formatRTT(target.RTTMin),
+		formatRTT(target.RTTP50),
+		formatRTT(target.RTTP90),
+		formatRTT(target.RTTP99),
+		formatRTT(target.RTTMax),
+	}
+}
+
+var targetHeader = []string{"target", "outages", "downtime", "loss", "worst interval", "rtt min", "rtt p50", "rtt p90", "rtt p99", "rtt max"}
+
+func getInterfaceRow(networkInterface InterfaceReport) []string {
+	return []string{
+		networkInterface.Name,
+		formatOperState(networkInterface),
+		fmt.Sprintf("%d", networkInterface.RxErrors),
+		fmt.Sprintf("%d", networkInterface.TxErrors),
+		fmt.Sprintf("%d", networkInterface.RxDropped),
+		fmt.Sprintf("%d", networkInterface.TxDropped),
+		fmt.Sprintf("%d", networkInterface.Events),
+		formatBytes(networkInterface.RxBytes),
+		formatBytes(networkInterface.TxBytes),
+	}
+}
+
+var interfaceHeader = []string{"interface", "state", "rx errors", "tx errors", "rx dropped", "tx dropped", "events", "rx", "tx"}
+
+var outageHeader = []string{"target", "start", "end", "duration"}
+
+var eventHeader = []string{"time", "interface", "kind", "message"}
+
+// WriteMarkdown writes the report as Markdown (tables, no charts), e.g. to paste into a post-incident review
+func WriteMarkdown(w io.Writer, r *Report) error {
+	b := new(strings.Builder)
+
+	_, _ = fmt.Fprintf(b, "# Network report: %s to %s\n\n", formatTime(r.From), formatTime(r.To))
+
+	generated := fmt.Sprintf("Generated by loser at %s", formatTime(r.GeneratedAt))
+	if r.Hostname != "" {
+		generated += fmt.Sprintf(" on %s", r.Hostname)
+	}
+
+	b.WriteString(generated + ".\n\n## Summary\n\n")
+
+	for _, line := range getSummary(r) {
+		b.WriteString("- " + line + "\n")
+	}
+
+	b.WriteString("\n## Targets\n\n")
+
+	if len(r.Targets) == 0 {
+		b.WriteString("No probe history.\n")
+	} else {
+		rows := make([][]string, 0, len(r.Targets))
+		for _, target := range r.Targets {
+			rows = append(rows, getTargetRow(target))
+		}
+
+		writeMarkdownTable(b, targetHeader, rows)
+	}
+
+	b.WriteString("\n## Outages\n\n")
+
+	outages := r.Outages()
+	if len(outages) == 0 {
+		b.WriteString("None.\n")
+	} else {
+		rows := make([][]string, 0, len(outages))
+		for _, outage := range outages {
+			rows = append(rows, []string{outage.Target, formatTime(outage.Start), formatOutageEnd(outage.Outage), formatDuration(outage.Duration)})
+		}
+
+		writeMarkdownTable(b, outageHeader, rows)
+	}
+
+	b.WriteString("\n## Interfaces\n\n")
+
+	if len(r.Interfaces) == 0 {
+		b.WriteString("No interface history.\n")
+	} else {
+		rows := make([][]string, 0, len(r.Interfaces))
+		for _, networkInterface := range r.Interfaces {
+			rows = append(rows, getInterfaceRow(networkInterface))
+		}
+
+		writeMarkdownTable(b, interfaceHeader, rows)
+	}
+
+	b.WriteString("\n## Link events\n\n")
+
+	if len(r.Events) == 0 {
+		b.WriteString("None.\n")
+	} else {
+		rows := make([][]string, 0, len(r.Events))
+		for _, event := range r.Events {
+			rows = append(rows, []string{formatTime(event.Timestamp), event.Interface, event.Kind, event.Message})
+		}
+
+		writeMarkdownTable(b, eventHeader, rows)
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+type htmlChart struct {
+	Title string
+	SVG   template.HTML
+}
+
+type htmlTable struct {
+	Header []string
+	Rows   [][]string
+}
+
+type htmlData struct {
+	Title           string
+	Generated       string
+	Summary         []string
+	Targets         htmlTable
+	TargetCharts    []htmlChart
+	Outages         htmlTable
+	Interfaces      htmlTable
+	InterfaceCharts []htmlChart
+	Events          htmlTable
+}
+
+// htmlTemplate is a single self-contained page (inline styles and SVG, no scripts), so it can be attached to a ticket
+// or emailed about as is
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { margin: 2em; font-family: ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; font-size: 13px; color: #222; background: #fff; }
+h1 { font-size: 18px; }
+h2 { font-size: 14px; margin-top: 2em; }
+h3 { font-size: 13px; margin: 1.5em 0 0.5em 0; }
+table { border-collapse: collapse; }
+th, td { padding: 0.25em 0.75em; border-bottom: 1px solid #ddd; text-align: left; white-space: nowrap; }
+th { color: #888; font-weight: normal; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="muted">{{.Generated}}</p>
+
+<h2>Summary</h2>
+<ul>
+{{- range .Summary}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+
+<h2>Targets</h2>
+{{template "table" .Targets}}
+{{- range .TargetCharts}}
+<h3>{{.Title}}</h3>
+{{.SVG}}
+{{- end}}
+
+<h2>Outages</h2>
+{{template "table" .Outages}}
+
+<h2>Interfaces</h2>
+{{template "table" .Interfaces}}
+{{- range .InterfaceCharts}}
+<h3>{{.Title}}</h3>
+{{.SVG}}
+{{- end}}
+
+<h2>Link events</h2>
+{{template "table" .Events}}
+</body>
+</html>
+{{define "table"}}
+{{- if .Rows}}
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{- range .Rows}}
+<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- else}}
+<p>None.</p>
+{{- end}}
+{{end}}`))
+
+// WriteHTML writes the report as a standalone HTML page, with a chart for each affected target (RTT, loss and outages)
+// and each affected interface (errors and drops)
+func WriteHTML(w io.Writer, r *Report) error {
+	generated := fmt.Sprintf("Generated by loser at %s", formatTime(r.GeneratedAt))
+	if r.Hostname != "" {
+		generated += fmt.Sprintf(" on %s", r.Hostname)
+	}
+
+	data := htmlData{
+		Title:      fmt.Sprintf("Network report: %s to %s", formatTime(r.From), formatTime(r.To)),
+		Generated:  generated,
+		Summary:    getSummary(r),
+		Targets:    htmlTable{Header: targetHeader},
+		Outages:    htmlTable{Header: outageHeader},
+		Interfaces: htmlTable{Header: interfaceHeader},
+		Events:     htmlTable{Header: eventHeader},
+	}
+
+	for _, target := range r.Targets {
+		data.Targets.Rows = append(data.Targets.Rows, getTargetRow(target))
+
+		if target.Affected {
+			data.TargetCharts = append(data.TargetCharts, htmlChart{
+				Title: target.Target,
+				SVG:   template.HTML(getTargetChart(r.From, r.To, target).svg()),
+			})
+		}
+	}
+
+	for _, outage := range r.Outages() {
+		data.Outages.Rows = append(data.Outages.Rows, []string{outage.Target, formatTime(outage.Start), formatOutageEnd(outage.Outage), formatDuration(outage.Duration)})
+	}
+
+	for _, networkInterface := range r.Interfaces {
+		data.Interfaces.Rows = append(data.Interfaces.Rows, getInterfaceRow(networkInterface))
+
+		if networkInterface.Affected {
+			data.InterfaceCharts = append(data.InterfaceCharts, htmlChart{
+				Title: networkInterface.Name,
+				SVG:   template.HTML(getInterfaceChart(r.From, r.To, networkInterface).svg()),
+			})
+		}
+	}
+
+	for _, event := range r.Events {
+		data.Events.Rows = append(data.Events.Rows, []string{formatTime(event.Timestamp), event.Interface, event.Kind, event.Message})
+	}
+
+	return htmlTemplate.Execute(w, data)
+}
+
+// GetContentType is the Content-Type for one of the Formats
+func GetContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
+	}
+
+	return "application/json"
+}
+
+// Write writes the report in one of the Formats
+func Write(w io.Writer, r *Report, format string) error {
+	switch format {
+	case FormatMarkdown:
+		return WriteMarkdown(w, r)
+	case FormatHTML:
+		return WriteHTML(w, r)
+	case FormatJSON:
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(append(b, '\n'))
+
+		return err
+	}
+
+	return fmt.Errorf("unknown format %#+v (should be one of %v)", format, Formats)
+}
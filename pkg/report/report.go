@@ -0,0 +1,440 @@
+package report
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/initialed85/loser/pkg/network_interfaces"
+)
+
+const (
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+	FormatJSON     = "json"
+)
+
+var Formats = []string{FormatMarkdown, FormatHTML, FormatJSON}
+
+// Outage is a stretch of time a target wasn't answering at all; it starts at the last sample before it went down (since
+// a sample covers the interval up to its timestamp) and ends at the last sample that was still down
+type Outage struct {
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration time.Duration `json:"duration"`
+	// Ongoing means it was still down at the end of the report
+	Ongoing bool `json:"ongoing"`
+}
+
+// TargetReport is how a probe target did over the report; the RTT percentiles are of the samples' average RTTs (each
+// sample being a report interval's worth of probes)
+type TargetReport struct {
+	Target           string        `json:"target"`
+	Affected         bool          `json:"affected"`
+	Samples          int           `json:"samples"`
+	Sent             int64         `json:"sent"`
+	Received         int64         `json:"received"`
+	Lost             int64         `json:"lost"`
+	LossPercent      float64       `json:"loss_percent"`
+	WorstLossPercent float64       `json:"worst_loss_percent"`
+	RTTMin           time.Duration `json:"rtt_min"`
+	RTTP50           time.Duration `json:"rtt_p50"`
+	RTTP90           time.Duration `json:"rtt_p90"`
+	RTTP99           time.Duration `json:"rtt_p99"`
+	RTTMax           time.Duration `json:"rtt_max"`
+	Outages          []Outage      `json:"outages"`
+	Downtime         time.Duration `json:"downtime"`
+	probeSamples     []history.ProbeSample
+}
+
+// InterfaceReport is how an interface's counters moved over the report (the deltas are summed sample to sample, so a
+// counter wrapping or resetting part way through doesn't throw them out)
+type InterfaceReport struct {
+	Name           string `json:"name"`
+	Affected       bool   `json:"affected"`
+	OperStateStart string `json:"oper_state_start"`
+	OperStateEnd   string `json:"oper_state_end"`
+	RxBytes        int64  `json:"rx_bytes"`
+	TxBytes        int64  `json:"tx_bytes"`
+	RxErrors       int64  `json:"rx_errors"`
+	TxErrors       int64  `json:"tx_errors"`
+	RxDropped      int64  `json:"rx_dropped"`
+	TxDropped      int64  `json:"tx_dropped"`
+	Events         int    `json:"events"`
+	samples        []history.InterfaceSample
+}
+
+type Report struct {
+	Hostname    string            `json:"hostname,omitempty"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	Targets     []TargetReport    `json:"targets"`
+	Interfaces  []InterfaceReport `json:"interfaces"`
+	Events      []events.Event    `json:"events"`
+}
+
+// AffectedTargets returns the targets that lost anything or had an outage
+func (r *Report) AffectedTargets() []TargetReport {
+	affected := make([]TargetReport, 0)
+	for _, target := range r.Targets {
+		if target.Affected {
+			affected = append(affected, target)
+		}
+	}
+
+	return affected
+}
+
+// AffectedInterfaces returns the interfaces that had errors, drops, a change of state or any events
+func (r *Report) AffectedInterfaces() []InterfaceReport {
+	affected := make([]InterfaceReport, 0)
+	for _, networkInterface := range r.Interfaces {
+		if networkInterface.Affected {
+			affected = append(affected, networkInterface)
+		}
+	}
+
+	return affected
+}
+
+// TargetOutage is an outage and the target it was for
+type TargetOutage struct {
+	Target string `json:"target"`
+	Outage
+}
+
+// Outages returns every target's outages, in the order they started
+func (r *Report) Outages() []TargetOutage {
+	outages := make([]TargetOutage, 0)
+	for _, target := range r.Targets {
+		for _, outage := range target.Outages {
+			outages = append(outages, TargetOutage{Target: target.Target, Outage: outage})
+		}
+	}
+
+	sort.SliceStable(outages, func(i, j int) bool {
+		return outages[i].Start.Before(outages[j].Start)
+	})
+
+	return outages
+}
+
+// GetPercentile is the nearest rank percentile of some sorted values (0 if there aren't any)
+func GetPercentile(sorted []time.Duration, percentile float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+
+	return sorted[rank-1]
+}
+
+func isDown(sample history.ProbeSample) bool {
+	return sample.Received == 0 && (sample.Sent > 0 || sample.Lost > 0)
+}
+
+// getInterval is the usual time between some samples (the median), i.e. the report interval (or the history resolution,
+// if that's longer); 0 if there aren't enough samples to tell
+func getInterval(samples []history.ProbeSample) time.Duration {
+	intervals := make([]time.Duration, 0, len(samples))
+	for i := 1; i < len(samples); i++ {
+		interval := samples[i].Timestamp.Sub(samples[i-1].Timestamp)
+		if interval > 0 {
+			intervals = append(intervals, interval)
+		}
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i] < intervals[j]
+	})
+
+	return GetPercentile(intervals, 50)
+}
+
+// GetOutages finds the stretches where nothing came back: samples where nothing did, and gaps of more than half again the
+// usual interval between samples (e.g. a TCP probe that's lost its connection reports nothing until it's back), which
+// last until the interval before the next sample; samples with nothing sent or lost (like the first one from a probe)
+// don't change anything
+func GetOutages(samples []history.ProbeSample) []Outage {
+	outages := make([]Outage, 0)
+
+	interval := getInterval(samples)
+
+	var current *Outage
+	var last *history.ProbeSample
+
+	for i := range samples {
+		sample := samples[i]
+
+		if last != nil && interval > 0 && sample.Timestamp.Sub(last.Timestamp) > interval*3/2 {
+			if current == nil {
+				current = &Outage{Start: last.Timestamp}
+			}
+
+			current.End = sample.Timestamp.Add(-interval)
+		}
+
+		switch {
+		case isDown(sample):
+			if current == nil {
+				current = &Outage{Start: sample.Timestamp}
+				if last != nil {
+					current.Start = last.Timestamp
+				}
+			}
+
+			current.End = sample.Timestamp
+		case sample.Received > 0:
+			if current != nil {
+				outages = append(outages, *current)
+				current = nil
+			}
+		}
+
+		last = &samples[i]
+	}
+
+	if current != nil {
+		current.Ongoing = true
+		outages = append(outages, *current)
+	}
+
+	for i := range outages {
+		outages[i].Duration = outages[i].End.Sub(outages[i].Start)
+	}
+
+	return outages
+}
+
+func getTargetReport(target string, samples []history.ProbeSample) TargetReport {
+	targetReport := TargetReport{
+		Target:       target,
+		Samples:      len(samples),
+		probeSamples: samples,
+	}
+
+	rtts := make([]time.Duration, 0, len(samples))
+
+	for _, sample := range samples {
+		targetReport.Sent += sample.Sent
+		targetReport.Received += sample.Received
+		targetReport.Lost += sample.Lost
+
+		if sample.Received+sample.Lost > 0 {
+			targetReport.WorstLossPercent = math.Max(targetReport.WorstLossPercent, history.GetLossPercent(sample.Received, sample.Lost))
+		}
+
+		if sample.Received == 0 {
+			continue
+		}
+
+		rtts = append(rtts, sample.RTTAvg)
+
+		if targetReport.RTTMin == 0 || sample.RTTMin < targetReport.RTTMin {
+			targetReport.RTTMin = sample.RTTMin
+		}
+
+		if sample.RTTMax > targetReport.RTTMax {
+			targetReport.RTTMax = sample.RTTMax
+		}
+	}
+
+	sort.Slice(rtts, func(i, j int) bool {
+		return rtts[i] < rtts[j]
+	})
+
+	targetReport.LossPercent = history.GetLossPercent(targetReport.Received, targetReport.Lost)
+	targetReport.RTTP50 = GetPercentile(rtts, 50)
+	targetReport.RTTP90 = GetPercentile(rtts, 90)
+	targetReport.RTTP99 = GetPercentile(rtts, 99)
+	targetReport.Outages = GetOutages(samples)
+
+	for _, outage := range targetReport.Outages {
+		targetReport.Downtime += outage.Duration
+	}
+
+	targetReport.Affected = targetReport.Lost > 0 || len(targetReport.Outages) > 0
+
+	return targetReport
+}
+
+func getInterfaceReport(name string, samples []history.InterfaceSample, eventCount int) InterfaceReport {
+	interfaceReport := InterfaceReport{
+		Name:    name,
+		Events:  eventCount,
+		samples: samples,
+	}
+
+	if len(samples) > 0 {
+		interfaceReport.OperStateStart = samples[0].OperState
+		interfaceReport.OperStateEnd = samples[len(samples)-1].OperState
+	}
+
+	for i := 1; i < len(samples); i++ {
+		last, current := samples[i-1], samples[i]
+
+		interfaceReport.RxBytes += network_interfaces.GetCounterDelta(last.RxBytes, current.RxBytes)
+		interfaceReport.TxBytes += network_interfaces.GetCounterDelta(last.TxBytes, current.TxBytes)
+		interfaceReport.RxErrors += network_interfaces.GetCounterDelta(last.RxErrors, current.RxErrors)
+		interfaceReport.TxErrors += network_interfaces.GetCounterDelta(last.TxErrors, current.TxErrors)
+		interfaceReport.RxDropped += network_interfaces.GetCounterDelta(last.RxDropped, current.RxDropped)
+		interfaceReport.TxDropped += network_interfaces.GetCounterDelta(last.TxDropped, current.TxDropped)
+
+		if last.OperState != current.OperState {
+			interfaceReport.Affected = true
+		}
+	}
+
+	if interfaceReport.RxErrors+interfaceReport.TxErrors+interfaceReport.RxDropped+interfaceReport.TxDropped > 0 || eventCount > 0 {
+		interfaceReport.Affected = true
+	}
+
+	return interfaceReport
+}
+
+// GetSeries groups some samples (e.g. from the store) into a series per target, keeping those between from and to
+func GetSeries(samples []history.Sample, from time.Time, to time.Time) []*history.Series {
+	seriesByTarget := make(map[string]*history.Series)
+
+	inRange := func(timestamp time.Time) bool {
+		return !timestamp.Before(from) && !timestamp.After(to)
+	}
+
+	for _, sample := range samples {
+		s, ok := seriesByTarget[sample.Target]
+		if !ok {
+			s = &history.Series{
+				Target: sample.Target,
+				Kind:   sample.Kind,
+				From:   from,
+				To:     to,
+			}
+		}
+
+		switch {
+		case sample.Kind == history.KindProbe && sample.Probe != nil:
+			if !inRange(sample.Probe.Timestamp) {
+				continue
+			}
+
+			s.ProbeSamples = append(s.ProbeSamples, *sample.Probe)
+		case sample.Kind == history.KindInterface && sample.Interface != nil:
+			if !inRange(sample.Interface.Timestamp) {
+				continue
+			}
+
+			s.InterfaceSamples = append(s.InterfaceSamples, *sample.Interface)
+		default:
+			continue
+		}
+
+		seriesByTarget[sample.Target] = s
+	}
+
+	allSeries := make([]*history.Series, 0, len(seriesByTarget))
+	for _, s := range seriesByTarget {
+		allSeries = append(allSeries, s)
+	}
+
+	sort.Slice(allSeries, func(i, j int) bool {
+		return allSeries[i].Target < allSeries[j].Target
+	})
+
+	return allSeries
+}
+
+// Build works out the report for the time between from and to, from the history (as series, like /api/history gives)
+// and the events
+func Build(from time.Time, to time.Time, allSeries []*history.Series, allEvents []events.Event) *Report {
+	r := Report{
+		GeneratedAt: time.Now(),
+		From:        from,
+		To:          to,
+		Targets:     make([]TargetReport, 0),
+		Interfaces:  make([]InterfaceReport, 0),
+		Events:      make([]events.Event, 0),
+	}
+
+	eventCountByInterface := make(map[string]int)
+
+	for _, event := range allEvents {
+		if event.Timestamp.Before(from) || event.Timestamp.After(to) {
+			continue
+		}
+
+		r.Events = append(r.Events, event)
+		eventCountByInterface[event.Interface]++
+	}
+
+	sort.SliceStable(r.Events, func(i, j int) bool {
+		return r.Events[i].Timestamp.Before(r.Events[j].Timestamp)
+	})
+
+	for _, s := range allSeries {
+		switch s.Kind {
+		case history.KindProbe:
+			if len(s.ProbeSamples) == 0 {
+				continue
+			}
+
+			samples := append([]history.ProbeSample(nil), s.ProbeSamples...)
+			sort.SliceStable(samples, func(i, j int) bool {
+				return samples[i].Timestamp.Before(samples[j].Timestamp)
+			})
+
+			r.Targets = append(r.Targets, getTargetReport(s.Target, samples))
+		case history.KindInterface:
+			if len(s.InterfaceSamples) == 0 {
+				continue
+			}
+
+			samples := append([]history.InterfaceSample(nil), s.InterfaceSamples...)
+			sort.SliceStable(samples, func(i, j int) bool {
+				return samples[i].Timestamp.Before(samples[j].Timestamp)
+			})
+
+			name := strings.TrimPrefix(s.Target, history.KindInterface+"/")
+
+			r.Interfaces = append(r.Interfaces, getInterfaceReport(name, samples, eventCountByInterface[name]))
+		}
+	}
+
+	// worst first, like everywhere else
+	sort.SliceStable(r.Targets, func(i, j int) bool {
+		a, b := r.Targets[i], r.Targets[j]
+
+		if a.Downtime != b.Downtime {
+			return a.Downtime > b.Downtime
+		}
+
+		if a.LossPercent != b.LossPercent {
+			return a.LossPercent > b.LossPercent
+		}
+
+		return a.Target < b.Target
+	})
+
+	sort.SliceStable(r.Interfaces, func(i, j int) bool {
+		a, b := r.Interfaces[i], r.Interfaces[j]
+
+		if a.Affected != b.Affected {
+			return a.Affected
+		}
+
+		return a.Name < b.Name
+	})
+
+	return &r
+}
@@ -0,0 +1,197 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	from := start
+	to := start.Add(time.Minute)
+
+	at := func(seconds int) time.Time {
+		return start.Add(time.Second * time.Duration(seconds))
+	}
+
+	// ten seconds of 1ms, then ten seconds of nothing, then ten seconds of 5ms with one interval losing 10%
+	samples := make([]history.Sample, 0)
+	for i := 1; i <= 30; i++ {
+		probe := history.ProbeSample{Timestamp: at(i), Sent: 1}
+
+		switch {
+		case i <= 10:
+			probe.Received = 1
+			probe.RTTMin, probe.RTTAvg, probe.RTTMax = time.Millisecond, time.Millisecond, time.Millisecond
+		case i <= 20:
+			probe.Lost = 1
+		case i == 25:
+			probe.Sent, probe.Received, probe.Lost = 10, 9, 1
+			probe.RTTMin, probe.RTTAvg, probe.RTTMax = time.Millisecond*5, time.Millisecond*5, time.Millisecond*5
+		default:
+			probe.Received = 1
+			probe.RTTMin, probe.RTTAvg, probe.RTTMax = time.Millisecond*5, time.Millisecond*5, time.Millisecond*5
+		}
+
+		samples = append(samples, history.Sample{Target: "icmp/192.168.1.1", Kind: history.KindProbe, Probe: &probe})
+
+		samples = append(samples, history.Sample{
+			Target: "icmp/192.168.1.2",
+			Kind:   history.KindProbe,
+			Probe:  &history.ProbeSample{Timestamp: at(i), Sent: 1, Received: 1, RTTMin: time.Millisecond, RTTAvg: time.Millisecond, RTTMax: time.Millisecond},
+		})
+
+		samples = append(samples, history.Sample{
+			Target: history.GetInterfaceTarget("eth0"),
+			Kind:   history.KindInterface,
+			Interface: &history.InterfaceSample{
+				Timestamp: at(i),
+				OperState: "up",
+				RxBytes:   int64(i * 1000),
+				RxErrors:  int64(i / 10),
+			},
+		})
+	}
+
+	// outside the time range
+	samples = append(samples, history.Sample{
+		Target: "icmp/192.168.1.2",
+		Kind:   history.KindProbe,
+		Probe:  &history.ProbeSample{Timestamp: at(-10), Sent: 1, Lost: 1},
+	})
+
+	allEvents := []events.Event{
+		{Timestamp: at(-10), Kind: events.KindLinkUp, Interface: "eth0", Message: "eth0 came up"},
+		{Timestamp: at(11), Kind: events.KindCarrierChanged, Interface: "eth0", Old: "1", New: "0", Message: "eth0 carrier | lost"},
+	}
+
+	t.Run("GetPercentile", func(t *testing.T) {
+		values := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+		require.Equal(t, time.Duration(0), GetPercentile(nil, 50))
+		require.Equal(t, time.Duration(5), GetPercentile(values, 50))
+		require.Equal(t, time.Duration(9), GetPercentile(values, 90))
+		require.Equal(t, time.Duration(10), GetPercentile(values, 99))
+		require.Equal(t, time.Duration(1), GetPercentile(values, 0))
+	})
+
+	t.Run("GetOutages", func(t *testing.T) {
+		outages := GetOutages([]history.ProbeSample{
+			{Timestamp: at(1)},
+			{Timestamp: at(2), Sent: 1, Received: 1},
+			{Timestamp: at(3), Sent: 1, Lost: 1},
+			{Timestamp: at(4), Sent: 1, Lost: 1},
+			{Timestamp: at(5)},
+			{Timestamp: at(6), Sent: 1, Received: 1},
+			{Timestamp: at(7), Sent: 1, Lost: 1},
+		})
+
+		require.Equal(t, []Outage{
+			{Start: at(2), End: at(4), Duration: time.Second * 2},
+			{Start: at(6), End: at(7), Duration: time.Second, Ongoing: true},
+		}, outages)
+	})
+
+	t.Run("GetOutagesGaps", func(t *testing.T) {
+		// nothing reported between 3 and 9 (e.g. a TCP probe that lost its connection), then lost from 9 to 10
+		outages := GetOutages([]history.ProbeSample{
+			{Timestamp: at(1), Sent: 1, Received: 1},
+			{Timestamp: at(2), Sent: 1, Received: 1},
+			{Timestamp: at(3), Sent: 1, Received: 1},
+			{Timestamp: at(9), Sent: 1, Lost: 1},
+			{Timestamp: at(10), Sent: 1, Received: 1},
+			{Timestamp: at(11), Sent: 1, Received: 1},
+			{Timestamp: at(16)},
+			{Timestamp: at(17), Sent: 1, Received: 1},
+			{Timestamp: at(18), Sent: 1, Received: 1},
+			{Timestamp: at(25)},
+		})
+
+		require.Equal(t, []Outage{
+			{Start: at(3), End: at(9), Duration: time.Second * 6},
+			{Start: at(11), End: at(15), Duration: time.Second * 4},
+			{Start: at(18), End: at(24), Duration: time.Second * 6, Ongoing: true},
+		}, outages)
+
+		// with only two samples, the time between them is the interval
+		require.Empty(t, GetOutages([]history.ProbeSample{{Timestamp: at(1), Sent: 1, Received: 1}, {Timestamp: at(60), Sent: 1, Received: 1}}))
+	})
+
+	t.Run("Build", func(t *testing.T) {
+		r := Build(from, to, GetSeries(samples, from, to), allEvents)
+
+		require.Len(t, r.Targets, 2)
+		require.Len(t, r.AffectedTargets(), 1)
+
+		target := r.Targets[0]
+		require.Equal(t, "icmp/192.168.1.1", target.Target)
+		require.True(t, target.Affected)
+		require.Equal(t, int64(39), target.Sent)
+		require.Equal(t, int64(28), target.Received)
+		require.Equal(t, int64(11), target.Lost)
+		require.Equal(t, 100.0, target.WorstLossPercent)
+		require.Equal(t, time.Millisecond, target.RTTMin)
+		require.Equal(t, time.Millisecond*5, target.RTTP90)
+		require.Equal(t, time.Millisecond*5, target.RTTMax)
+		require.Equal(t, []Outage{{Start: at(10), End: at(20), Duration: time.Second * 10}}, target.Outages)
+		require.Equal(t, time.Second*10, target.Downtime)
+
+		require.False(t, r.Targets[1].Affected)
+		require.Equal(t, int64(30), r.Targets[1].Sent)
+
+		require.Len(t, r.Interfaces, 1)
+		networkInterface := r.Interfaces[0]
+		require.Equal(t, "eth0", networkInterface.Name)
+		require.True(t, networkInterface.Affected)
+		require.Equal(t, int64(29000), networkInterface.RxBytes)
+		require.Equal(t, int64(3), networkInterface.RxErrors)
+		require.Equal(t, 1, networkInterface.Events)
+
+		require.Len(t, r.Events, 1)
+		require.Equal(t, events.KindCarrierChanged, r.Events[0].Kind)
+
+		require.Len(t, r.Outages(), 1)
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		r := Build(from, to, GetSeries(samples, from, to), allEvents)
+
+		b := new(bytes.Buffer)
+		err := Write(b, r, FormatMarkdown)
+		require.NoError(t, err)
+		markdown := b.String()
+		require.Contains(t, markdown, "# Network report: 2024-01-01 00:00:00 UTC to 2024-01-01 00:01:00 UTC")
+		require.Contains(t, markdown, "- 1 of 2 targets affected")
+		require.Contains(t, markdown, "| icmp/192.168.1.1 | 2024-01-01 00:00:10 UTC | 2024-01-01 00:00:20 UTC | 10s |")
+		require.Contains(t, markdown, "eth0 carrier \\| lost")
+
+		b.Reset()
+		err = Write(b, r, FormatHTML)
+		require.NoError(t, err)
+		page := b.String()
+		require.Contains(t, page, "<h3>icmp/192.168.1.1</h3>\n<svg")
+		require.Contains(t, page, "<h3>eth0</h3>\n<svg")
+		require.NotContains(t, page, "<h3>icmp/192.168.1.2</h3>")
+		require.Equal(t, 2, strings.Count(page, "<svg"))
+		require.Contains(t, page, "eth0 carrier | lost")
+		require.NotContains(t, page, "<script")
+
+		b.Reset()
+		err = Write(b, r, FormatJSON)
+		require.NoError(t, err)
+		var decoded Report
+		err = json.Unmarshal(b.Bytes(), &decoded)
+		require.NoError(t, err)
+		require.Len(t, decoded.Targets, 2)
+
+		err = Write(b, r, "pdf")
+		require.Error(t, err)
+	})
+}
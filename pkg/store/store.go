@@ -0,0 +1,370 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	_log "log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+)
+
+var log = _log.New(
+	os.Stdout,
+	"loser: ",
+	_log.Ldate|
+		_log.Ltime|
+		_log.Lmicroseconds|
+		_log.LUTC|
+		_log.Lmsgprefix|
+		_log.LstdFlags,
+)
+
+const (
+	TypeSample = "sample"
+	TypeEvent  = "event"
+	TypeHost   = "host"
+
+	segmentSuffix = ".jsonl"
+
+	maxSegmentSize = 16 * 1024 * 1024
+	maxSegmentAge  = time.Hour
+	maxLineSize    = 1024 * 1024
+)
+
+// Record is a line in a segment; only one of Sample, Event or Hostname is set, depending on the type (a host record is
+// the first in each segment, so the data still says where it came from once it's been copied off the box)
+type Record struct {
+	Type     string          `json:"type"`
+	Sample   *history.Sample `json:"sample,omitempty"`
+	Event    *events.Event   `json:"event,omitempty"`
+	Hostname string          `json:"hostname,omitempty"`
+}
+
+// Store is an append-only, on-disk log of records, kept as a directory of JSON Lines segment files (named for when
+// they were started, so they sort oldest first); it's meant to be something you can copy off a box and poke at with
+// jq, so there's no index or anything clever
+type Store struct {
+	mu             *sync.Mutex
+	dir            string
+	hostname       string
+	maxAge         time.Duration
+	maxSize        int64
+	maxSegmentSize int64
+	file           *os.File
+	writer         *bufio.Writer
+	segmentPath    string
+	segmentSize    int64
+	segmentStarted time.Time
+	lastRetention  time.Time
+}
+
+// Open opens (creating if need be) the store in the given directory and starts a new segment; segments older than
+// maxAge, and the oldest segments while the total is over maxSize, get deleted (either limit can be 0 for none)
+func Open(dir string, maxAge time.Duration, maxSize int64) (*Store, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.MkdirAll: %s", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("warning: failed os.Hostname (the data won't say where it came from): %s", err)
+	}
+
+	s := Store{
+		mu:             new(sync.Mutex),
+		dir:            dir,
+		hostname:       hostname,
+		maxAge:         maxAge,
+		maxSize:        maxSize,
+		maxSegmentSize: maxSegmentSize,
+	}
+
+	// otherwise a single segment could be most of the allowed size and we'd never be able to delete it
+	if maxSize > 0 && maxSize/4 < s.maxSegmentSize {
+		s.maxSegmentSize = maxSize / 4
+	}
+
+	err = s.rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func getSegmentPaths(dir string) ([]string, error) {
+	segmentPaths, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed filepath.Glob: %s", err)
+	}
+
+	sort.Strings(segmentPaths)
+
+	return segmentPaths, nil
+}
+
+func (s *Store) closeSegment() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.writer.Flush()
+	if err != nil {
+		_ = s.file.Close()
+		return fmt.Errorf("failed to flush %s: %s", s.segmentPath, err)
+	}
+
+	err = s.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close %s: %s", s.segmentPath, err)
+	}
+
+	s.file = nil
+	s.writer = nil
+
+	return nil
+}
+
+// rotate closes the current segment (if any), starts a new one and then enforces the retention
+func (s *Store) rotate(now time.Time) error {
+	err := s.closeSegment()
+	if err != nil {
+		return err
+	}
+
+	segmentPath := filepath.Join(s.dir, fmt.Sprintf("%020d%s", now.UnixNano(), segmentSuffix))
+
+	file, err := os.OpenFile(segmentPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed os.OpenFile: %s", err)
+	}
+
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.segmentPath = segmentPath
+	s.segmentSize = 0
+	s.segmentStarted = now
+
+	s.enforceRetention(now)
+
+	if s.hostname != "" {
+		data, err := json.Marshal(Record{Type: TypeHost, Hostname: s.hostname})
+		if err != nil {
+			return fmt.Errorf("failed json.Marshal: %s", err)
+		}
+
+		err = s.append(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// append writes a line to the current segment (the caller holds the lock)
+func (s *Store) append(data []byte) error {
+	n, err := s.writer.Write(data)
+	s.segmentSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %s", s.segmentPath, err)
+	}
+
+	return nil
+}
+
+// enforceRetention deletes the segments (other than the current one) that are too old or that take us over the size
+func (s *Store) enforceRetention(now time.Time) {
+	s.lastRetention = now
+
+	segmentPaths, err := getSegmentPaths(s.dir)
+	if err != nil {
+		log.Printf("warning: failed to enforce retention: %s", err)
+		return
+	}
+
+	type segment struct {
+		path string
+		size int64
+	}
+
+	segments := make([]segment, 0, len(segmentPaths))
+	totalSize := int64(0)
+
+	for _, segmentPath := range segmentPaths {
+		if segmentPath == s.segmentPath {
+			continue
+		}
+
+		info, err := os.Stat(segmentPath)
+		if err != nil {
+			continue
+		}
+
+		// the modification time is when the segment was last written to, so it's as new as its newest record
+		if s.maxAge > 0 && now.Sub(info.ModTime()) > s.maxAge {
+			s.remove(segmentPath)
+			continue
+		}
+
+		segments = append(segments, segment{path: segmentPath, size: info.Size()})
+		totalSize += info.Size()
+	}
+
+	if s.maxSize <= 0 {
+		return
+	}
+
+	// leave room for the current segment to fill up
+	totalSize += s.maxSegmentSize
+
+	for len(segments) > 0 && totalSize > s.maxSize {
+		s.remove(segments[0].path)
+		totalSize -= segments[0].size
+		segments = segments[1:]
+	}
+}
+
+func (s *Store) remove(segmentPath string) {
+	err := os.Remove(segmentPath)
+	if err != nil {
+		log.Printf("warning: failed to remove %s: %s", segmentPath, err)
+		return
+	}
+
+	log.Printf("removed %s (retention)", segmentPath)
+}
+
+// Write appends a record to the current segment (rotating first if it's full or old enough); records are buffered, so
+// call Flush (or Close) to be sure they're on disk
+func (s *Store) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed json.Marshal: %s", err)
+	}
+
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("store closed")
+	}
+
+	now := time.Now()
+
+	if s.segmentSize > 0 && (s.segmentSize+int64(len(data)) > s.maxSegmentSize || now.Sub(s.segmentStarted) > maxSegmentAge) {
+		err = s.rotate(now)
+		if err != nil {
+			return err
+		}
+	} else if now.Sub(s.lastRetention) > time.Minute {
+		s.enforceRetention(now)
+	}
+
+	return s.append(data)
+}
+
+func (s *Store) WriteSample(sample history.Sample) error {
+	return s.Write(Record{Type: TypeSample, Sample: &sample})
+}
+
+func (s *Store) WriteEvent(event events.Event) error {
+	return s.Write(Record{Type: TypeEvent, Event: &event})
+}
+
+// Flush pushes any buffered records out to the current segment
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		return nil
+	}
+
+	return s.writer.Flush()
+}
+
+// Read calls the given function for every record in the store, oldest segment first (see ReadDir)
+func (s *Store) Read(fn func(Record)) error {
+	err := s.Flush()
+	if err != nil {
+		return err
+	}
+
+	return ReadDir(s.dir, fn)
+}
+
+// ReadDir calls the given function for every record in a store's directory (e.g. one copied off a box), oldest segment
+// first; anything that won't parse (e.g. the partial last line from a crash) is skipped with a warning
+func ReadDir(dir string, fn func(Record)) error {
+	segmentPaths, err := getSegmentPaths(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, segmentPath := range segmentPaths {
+		err = readSegment(segmentPath, fn)
+		if err != nil {
+			log.Printf("warning: failed to read %s: %s", segmentPath, err)
+		}
+	}
+
+	return nil
+}
+
+func readSegment(segmentPath string, fn func(Record)) error {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		record := Record{}
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			log.Printf("warning: skipping %s line %d: %s", filepath.Base(segmentPath), lineNumber, err)
+			continue
+		}
+
+		if (record.Type == TypeSample && record.Sample == nil) || (record.Type == TypeEvent && record.Event == nil) {
+			log.Printf("warning: skipping %s line %d: empty %s record", filepath.Base(segmentPath), lineNumber, record.Type)
+			continue
+		}
+
+		fn(record)
+	}
+
+	return scanner.Err()
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeSegment()
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, s *Store) []Record {
+	records := make([]Record, 0)
+
+	err := s.Read(func(record Record) {
+		records = append(records, record)
+	})
+	require.NoError(t, err)
+
+	return records
+}
+
+func TestStore(t *testing.T) {
+	t.Run("WriteAndRead", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s, err := Open(dir, 0, 0)
+		require.NoError(t, err)
+
+		err = s.WriteSample(history.Sample{
+			Target: "tcp/192.168.1.1",
+			Kind:   history.KindProbe,
+			Probe:  &history.ProbeSample{Timestamp: time.Unix(1, 0), Sent: 5, RTTAvg: time.Millisecond},
+		})
+		require.NoError(t, err)
+
+		err = s.WriteEvent(events.Event{Timestamp: time.Unix(2, 0), Kind: events.KindLinkDown, Interface: "eth0", Message: "eth0 down"})
+		require.NoError(t, err)
+
+		err = s.Close()
+		require.NoError(t, err)
+
+		// a new segment per open, and the old one is still there
+		s, err = Open(dir, 0, 0)
+		require.NoError(t, err)
+		defer func() {
+			_ = s.Close()
+		}()
+
+		segmentPaths, err := getSegmentPaths(dir)
+		require.NoError(t, err)
+		require.Len(t, segmentPaths, 2)
+
+		// a partial line (e.g. from a crash) in the old segment gets skipped
+		f, err := os.OpenFile(segmentPaths[0], os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"type":"sample","sam`)
+		require.NoError(t, err)
+		_ = f.Close()
+
+		err = s.WriteEvent(events.Event{Timestamp: time.Unix(3, 0), Kind: events.KindLinkUp, Interface: "eth0", Message: "eth0 up"})
+		require.NoError(t, err)
+
+		records := readAll(t, s)
+		require.Len(t, records, 5)
+
+		// each segment starts by saying where it's from
+		hostname, err := os.Hostname()
+		require.NoError(t, err)
+		require.Equal(t, Record{Type: TypeHost, Hostname: hostname}, records[0])
+		require.Equal(t, Record{Type: TypeHost, Hostname: hostname}, records[3])
+
+		require.Equal(t, TypeSample, records[1].Type)
+		require.Equal(t, "tcp/192.168.1.1", records[1].Sample.Target)
+		require.Equal(t, int64(5), records[1].Sample.Probe.Sent)
+		require.Equal(t, time.Millisecond, records[1].Sample.Probe.RTTAvg)
+
+		require.Equal(t, TypeEvent, records[2].Type)
+		require.Equal(t, events.KindLinkDown, records[2].Event.Kind)
+		require.Equal(t, events.KindLinkUp, records[4].Event.Kind)
+	})
+
+	t.Run("RetentionByAge", func(t *testing.T) {
+		dir := t.TempDir()
+
+		oldSegmentPath := filepath.Join(dir, "00000000000000000001.jsonl")
+		err := os.WriteFile(oldSegmentPath, []byte(`{"type":"event","event":{"kind":"link_up","message":"old"}}`+"\n"), 0o644)
+		require.NoError(t, err)
+		err = os.Chtimes(oldSegmentPath, time.Now().Add(-time.Hour*2), time.Now().Add(-time.Hour*2))
+		require.NoError(t, err)
+
+		s, err := Open(dir, time.Hour, 0)
+		require.NoError(t, err)
+		defer func() {
+			_ = s.Close()
+		}()
+
+		_, err = os.Stat(oldSegmentPath)
+		require.True(t, os.IsNotExist(err))
+
+		// just the new segment's host record
+		records := readAll(t, s)
+		require.Len(t, records, 1)
+		require.Equal(t, TypeHost, records[0].Type)
+	})
+
+	t.Run("RetentionBySize", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s, err := Open(dir, 0, 4096)
+		require.NoError(t, err)
+		defer func() {
+			_ = s.Close()
+		}()
+
+		// segments get capped at a quarter of the max size, so this rotates a bunch of times
+		for i := 0; i < 200; i++ {
+			err = s.WriteEvent(events.Event{Timestamp: time.Unix(int64(i), 0), Kind: events.KindLinkUp, Message: "some event or other"})
+			require.NoError(t, err)
+		}
+
+		err = s.Flush()
+		require.NoError(t, err)
+
+		segmentPaths, err := getSegmentPaths(dir)
+		require.NoError(t, err)
+
+		totalSize := int64(0)
+		for _, segmentPath := range segmentPaths {
+			info, err := os.Stat(segmentPath)
+			require.NoError(t, err)
+			totalSize += info.Size()
+		}
+
+		require.LessOrEqual(t, totalSize, int64(4096))
+
+		// and what's left is the newest
+		records := readAll(t, s)
+		require.NotEmpty(t, records)
+		require.Equal(t, time.Unix(199, 0).UTC(), records[len(records)-1].Event.Timestamp.UTC())
+	})
+}
@@ -0,0 +1,259 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	_log "log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = _log.New(
+	os.Stdout,
+	"loser: ",
+	_log.Ldate|
+		_log.Ltime|
+		_log.Lmicroseconds|
+		_log.LUTC|
+		_log.Lmsgprefix|
+		_log.LstdFlags,
+)
+
+const (
+	TypeProbe     = "probe"
+	TypeInterface = "interface"
+	TypeEvent     = "event"
+
+	// TypeDropped tells a subscriber it's been too slow and missed some messages (the data is how many)
+	TypeDropped = "dropped"
+
+	FormatSSE    = "sse"
+	FormatNDJSON = "ndjson"
+
+	heartbeatInterval = time.Second * 15
+)
+
+// Message is what goes out to the subscribers; the data is whatever was published (e.g. a packets.Report, a
+// network_interfaces.NetworkInterface or an events.Event)
+type Message struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Target    string    `json:"target,omitempty"`
+	Data      any       `json:"data"`
+}
+
+// Encoded is a message as it goes out to a subscriber (marshalled once, however many subscribers there are)
+type Encoded struct {
+	Type string
+	Data []byte
+}
+
+type subscriber struct {
+	types   map[string]struct{}
+	ch      chan Encoded
+	dropped int64
+}
+
+func (s *subscriber) wants(messageType string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+
+	_, ok := s.types[messageType]
+	return ok
+}
+
+// Broker fans published messages out to the subscribers; it never blocks the publisher, so a subscriber that can't
+// keep up has messages dropped (and is told how many)
+type Broker struct {
+	mu          *sync.Mutex
+	bufferSize  int
+	subscribers map[int]*subscriber
+	lastID      int
+}
+
+func NewBroker(bufferSize int) *Broker {
+	b := Broker{
+		mu:          new(sync.Mutex),
+		bufferSize:  bufferSize,
+		subscribers: make(map[int]*subscriber),
+	}
+
+	return &b
+}
+
+// Publish sends a message to each subscriber that wants its type (it's only marshalled if someone does)
+func (b *Broker) Publish(message Message) {
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var data []byte
+
+	for _, s := range b.subscribers {
+		if !s.wants(message.Type) {
+			continue
+		}
+
+		if data == nil {
+			var err error
+
+			data, err = json.Marshal(message)
+			if err != nil {
+				log.Printf("warning: failed json.Marshal() for %s message: %s", message.Type, err)
+				return
+			}
+		}
+
+		select {
+		case s.ch <- Encoded{Type: message.Type, Data: data}:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// Subscribe returns a channel of messages of the given types (all of them if none are given), the number
+// of messages dropped so far and a function to unsubscribe
+func (b *Broker) Subscribe(types ...string) (<-chan Encoded, func() int64, func()) {
+	s := subscriber{
+		types: make(map[string]struct{}),
+		ch:    make(chan Encoded, b.bufferSize),
+	}
+
+	for _, messageType := range types {
+		s.types[messageType] = struct{}{}
+	}
+
+	b.mu.Lock()
+	b.lastID++
+	id := b.lastID
+	b.subscribers[id] = &s
+	b.mu.Unlock()
+
+	getDropped := func() int64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		dropped := s.dropped
+		s.dropped = 0
+
+		return dropped
+	}
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subscribers, id)
+	}
+
+	return s.ch, getDropped, unsubscribe
+}
+
+// ServeHTTP streams messages as Server-Sent Events (the default; the SSE event name is the message type) or as
+// newline delimited JSON (format=ndjson, handy for curl | jq); types=probe,event etc limits what's sent
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = FormatSSE
+	}
+
+	if format != FormatSSE && format != FormatNDJSON {
+		http.Error(w, fmt.Sprintf("bad format: %#+v (should be %s or %s)", format, FormatSSE, FormatNDJSON), http.StatusBadRequest)
+		return
+	}
+
+	types := make([]string, 0)
+	for _, messageType := range strings.Split(query.Get("types"), ",") {
+		messageType = strings.TrimSpace(messageType)
+		if messageType == "" {
+			continue
+		}
+
+		if messageType != TypeProbe && messageType != TypeInterface && messageType != TypeEvent {
+			http.Error(w, fmt.Sprintf("bad type: %#+v (should be %s, %s or %s)", messageType, TypeProbe, TypeInterface, TypeEvent), http.StatusBadRequest)
+			return
+		}
+
+		types = append(types, messageType)
+	}
+
+	rc := http.NewResponseController(w)
+
+	ch, getDropped, unsubscribe := b.Subscribe(types...)
+	defer unsubscribe()
+
+	if format == FormatSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx and friends from buffering it all up
+	w.WriteHeader(http.StatusOK)
+
+	write := func(encoded Encoded) error {
+		var err error
+
+		if format == FormatSSE {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", encoded.Type, encoded.Data)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", encoded.Data)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return rc.Flush()
+	}
+
+	// so the client knows it's connected (and the headers go out) before the first message
+	if format == FormatSSE {
+		_, _ = fmt.Fprintf(w, ": connected\n\n")
+	}
+	_ = rc.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// keeps proxies from timing out a quiet stream (ndjson just gets a blank line)
+			if format == FormatSSE {
+				_, _ = fmt.Fprintf(w, ": heartbeat\n\n")
+			} else {
+				_, _ = fmt.Fprintf(w, "\n")
+			}
+
+			if rc.Flush() != nil {
+				return
+			}
+		case encoded := <-ch:
+			dropped := getDropped()
+			if dropped > 0 {
+				droppedData, _ := json.Marshal(Message{Type: TypeDropped, Timestamp: time.Now(), Data: dropped})
+				if write(Encoded{Type: TypeDropped, Data: droppedData}) != nil {
+					return
+				}
+			}
+
+			if write(encoded) != nil {
+				return
+			}
+		}
+	}
+}
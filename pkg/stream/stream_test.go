@@ -0,0 +1,131 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	t.Run("Subscribe", func(t *testing.T) {
+		b := NewBroker(2)
+
+		all, _, unsubscribeAll := b.Subscribe()
+		events, getDropped, unsubscribeEvents := b.Subscribe(TypeEvent)
+
+		b.Publish(Message{Type: TypeProbe, Target: "tcp/192.168.1.1", Data: map[string]int{"sent": 1}})
+		b.Publish(Message{Type: TypeEvent, Data: "first"})
+
+		require.Equal(t, TypeProbe, (<-all).Type)
+
+		encoded := <-all
+		require.Equal(t, TypeEvent, encoded.Type)
+		require.Equal(t, encoded, <-events)
+
+		message := Message{}
+		err := json.Unmarshal(encoded.Data, &message)
+		require.NoError(t, err)
+		require.Equal(t, "first", message.Data)
+		require.False(t, message.Timestamp.IsZero())
+
+		unsubscribeAll()
+
+		// the buffer's 2, so the third one gets dropped rather than blocking the publisher
+		for i := 0; i < 3; i++ {
+			b.Publish(Message{Type: TypeEvent})
+		}
+
+		require.Len(t, events, 2)
+		require.Equal(t, int64(1), getDropped())
+		require.Equal(t, int64(0), getDropped())
+
+		unsubscribeEvents()
+		require.Len(t, b.subscribers, 0)
+	})
+
+	t.Run("ServeHTTP", func(t *testing.T) {
+		b := NewBroker(16)
+
+		server := httptest.NewServer(b)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "?types=nope")
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+		for _, format := range []string{FormatSSE, FormatNDJSON} {
+			t.Run(format, func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				defer cancel()
+
+				request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?types=probe&format="+format, nil)
+				require.NoError(t, err)
+
+				response, err := http.DefaultClient.Do(request)
+				require.NoError(t, err)
+				defer func() {
+					_ = response.Body.Close()
+				}()
+
+				require.Equal(t, http.StatusOK, response.StatusCode)
+
+				// wait for the handler to have subscribed
+				require.Eventually(t, func() bool {
+					b.mu.Lock()
+					defer b.mu.Unlock()
+
+					return len(b.subscribers) == 1
+				}, time.Second, time.Millisecond*10)
+
+				b.Publish(Message{Type: TypeEvent, Data: "not wanted"})
+				b.Publish(Message{Type: TypeProbe, Target: "icmp/192.168.1.1", Data: "wanted"})
+
+				reader := bufio.NewReader(response.Body)
+
+				var line string
+				for {
+					line, err = reader.ReadString('\n')
+					require.NoError(t, err)
+
+					line = strings.TrimSpace(line)
+					if line != "" && !strings.HasPrefix(line, ":") {
+						break
+					}
+				}
+
+				if format == FormatSSE {
+					require.Equal(t, "event: probe", line)
+
+					line, err = reader.ReadString('\n')
+					require.NoError(t, err)
+					require.True(t, strings.HasPrefix(line, "data: "))
+					line = strings.TrimPrefix(strings.TrimSpace(line), "data: ")
+				}
+
+				message := Message{}
+				err = json.Unmarshal([]byte(line), &message)
+				require.NoError(t, err)
+				require.Equal(t, TypeProbe, message.Type)
+				require.Equal(t, "icmp/192.168.1.1", message.Target)
+				require.Equal(t, "wanted", message.Data)
+
+				cancel()
+
+				require.Eventually(t, func() bool {
+					b.mu.Lock()
+					defer b.mu.Unlock()
+
+					return len(b.subscribers) == 0
+				}, time.Second, time.Millisecond*10)
+			})
+		}
+	})
+}
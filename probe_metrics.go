@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/initialed85/loser/pkg/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// getFriendlyName makes something (an address, an interface name) usable as part of a metric name
+func getFriendlyName(name string) string {
+	friendlyName := strings.ReplaceAll(name, ".", "_")
+	friendlyName = strings.ReplaceAll(friendlyName, ":", "_")
+	friendlyName = strings.ReplaceAll(friendlyName, "%", "_")
+	friendlyName = strings.ReplaceAll(friendlyName, "-", "_")
+
+	return friendlyName
+}
+
+// getL2Protocol returns the protocol packets.RunL2Client uses for the host (ARP for IPv4, NDP for IPv6)
+func getL2Protocol(host string) string {
+	if strings.Contains(host, ":") {
+		return "ndp"
+	}
+
+	return "arp"
+}
+
+type probeMetrics struct {
+	collectors []prometheus.Collector
+
+	sentCounter       prometheus.Counter
+	receivedCounter   prometheus.Counter
+	outOfOrderCounter prometheus.Counter
+	lostCounter       prometheus.Counter
+	rttMinGauge       prometheus.Gauge
+	rttAvgGauge       prometheus.Gauge
+	rttMaxGauge       prometheus.Gauge
+	jitterGauge       prometheus.Gauge
+
+	// only for tcp
+	kernelRTTGauge          prometheus.Gauge
+	kernelRTTVarGauge       prometheus.Gauge
+	kernelRetransmitsGauge  prometheus.Gauge
+	kernelTotalRetransGauge prometheus.Gauge
+	kernelSndCwndGauge      prometheus.Gauge
+	kernelLostGauge         prometheus.Gauge
+	kernelReorderingGauge   prometheus.Gauge
+	kernelPacingRateGauge   prometheus.Gauge
+
+	// only for arp / ndp
+	macsGauge prometheus.Gauge
+}
+
+// newProbeMetrics registers the metrics for a probe (e.g. tcp_192_168_100_102_sent); constLabels may be nil
+func newProbeMetrics(protocol string, host string, constLabels prometheus.Labels) *probeMetrics {
+	friendlyRawDialAddr := getFriendlyName(host)
+
+	p := probeMetrics{
+		collectors: make([]prometheus.Collector, 0),
+	}
+
+	newCounter := func(name string) prometheus.Counter {
+		counter := promauto.NewCounter(prometheus.CounterOpts{Name: fmt.Sprintf("%s_%s_%s", protocol, friendlyRawDialAddr, name), ConstLabels: constLabels})
+		p.collectors = append(p.collectors, counter)
+		return counter
+	}
+
+	newGauge := func(name string) prometheus.Gauge {
+		gauge := promauto.NewGauge(prometheus.GaugeOpts{Name: fmt.Sprintf("%s_%s_%s", protocol, friendlyRawDialAddr, name), ConstLabels: constLabels})
+		p.collectors = append(p.collectors, gauge)
+		return gauge
+	}
+
+	p.sentCounter = newCounter("sent")
+	p.receivedCounter = newCounter("received")
+	p.outOfOrderCounter = newCounter("out_of_order")
+	p.lostCounter = newCounter("lost")
+	p.rttMinGauge = newGauge("rtt_min_seconds")
+	p.rttAvgGauge = newGauge("rtt_avg_seconds")
+	p.rttMaxGauge = newGauge("rtt_max_seconds")
+	p.jitterGauge = newGauge("jitter_seconds")
+
+	if protocol == "tcp" {
+		p.kernelRTTGauge = newGauge("kernel_rtt_seconds")
+		p.kernelRTTVarGauge = newGauge("kernel_rtt_var_seconds")
+		p.kernelRetransmitsGauge = newGauge("kernel_retransmits")
+		p.kernelTotalRetransGauge = newGauge("kernel_total_retrans")
+		p.kernelSndCwndGauge = newGauge("kernel_snd_cwnd")
+		p.kernelLostGauge = newGauge("kernel_lost")
+		p.kernelReorderingGauge = newGauge("kernel_reordering")
+		p.kernelPacingRateGauge = newGauge("kernel_pacing_rate_bytes_per_second")
+	}
+
+	if protocol == "arp" || protocol == "ndp" {
+		p.macsGauge = newGauge("macs")
+	}
+
+	return &p
+}
+
+func (p *probeMetrics) report(report packets.Report) {
+	p.sentCounter.Add(float64(report.Sent))
+	p.receivedCounter.Add(float64(report.Received))
+	p.outOfOrderCounter.Add(float64(report.OutOfOrder))
+	p.lostCounter.Add(float64(report.Lost))
+	p.rttMinGauge.Set(report.RTTMin.Seconds())
+	p.rttAvgGauge.Set(report.RTTAvg.Seconds())
+	p.rttMaxGauge.Set(report.RTTMax.Seconds())
+	p.jitterGauge.Set(report.Jitter.Seconds())
+
+	if report.TCPInfo != nil && p.kernelRTTGauge != nil {
+		p.kernelRTTGauge.Set(report.TCPInfo.RTT.Seconds())
+		p.kernelRTTVarGauge.Set(report.TCPInfo.RTTVar.Seconds())
+		p.kernelRetransmitsGauge.Set(float64(report.TCPInfo.Retransmits))
+		p.kernelTotalRetransGauge.Set(float64(report.TCPInfo.TotalRetrans))
+		p.kernelSndCwndGauge.Set(float64(report.TCPInfo.SndCwnd))
+		p.kernelLostGauge.Set(float64(report.TCPInfo.Lost))
+		p.kernelReorderingGauge.Set(float64(report.TCPInfo.Reordering))
+		p.kernelPacingRateGauge.Set(float64(report.TCPInfo.PacingRate))
+	}
+
+	if p.macsGauge != nil {
+		p.macsGauge.Set(float64(len(report.MACs)))
+	}
+}
+
+func (p *probeMetrics) unregister() {
+	for _, collector := range p.collectors {
+		_ = prometheus.DefaultRegisterer.Unregister(collector)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/initialed85/loser/pkg/packets"
+)
+
+// probeProtocols are the probes the subcommands (top, diagnose) know how to run against a host
+var probeProtocols = []string{"icmp", "tcp", "udp", "arp"}
+
+// getProbeFn returns the packets.Run*Client for a protocol (arp means packets.RunL2Client, which does NDP for IPv6)
+func getProbeFn(protocol string) (func(context.Context, string, time.Duration, func(packets.Report)) error, error) {
+	switch protocol {
+	case "icmp":
+		return packets.RunICMPClient, nil
+	case "tcp":
+		return packets.RunTCPClient, nil
+	case "udp":
+		return packets.RunUDPClient, nil
+	case "arp", "ndp":
+		return packets.RunL2Client, nil
+	}
+
+	return nil, fmt.Errorf("unknown probe %#+v (should be one of %v)", protocol, probeProtocols)
+}
+
+// runProbeLoop runs a probe against a host until the context is done, starting it again (after a second) whenever it
+// fails, like the daemon does; errFn (if given) is told about the failures
+func runProbeLoop(ctx context.Context, protocol string, host string, reportInterval time.Duration, reportFn func(packets.Report), errFn func(error)) {
+	probeFn, err := getProbeFn(protocol)
+	if err != nil {
+		log.Printf("warning: %s", err)
+		return
+	}
+
+	for {
+		err = probeFn(ctx, host, reportInterval, reportFn)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("warning: failed %s probe for %s: %s", protocol, host, err)
+
+			if errFn != nil {
+				errFn(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
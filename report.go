@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/initialed85/loser/pkg/report"
+	"github.com/initialed85/loser/pkg/store"
+)
+
+// getAttachedReport gets the report from a running instance's /api/report (so it's worked out from its in-memory
+// history and events)
+func getAttachedReport(ctx context.Context, attach string, from time.Time, to time.Time, format string, w io.Writer) error {
+	baseURL := strings.TrimSuffix(attach, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+
+	query := url.Values{}
+	query.Set("from", from.Format(time.RFC3339Nano))
+	query.Set("to", to.Format(time.RFC3339Nano))
+	query.Set("format", format)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/report?%s", baseURL, query.Encode()), nil)
+	if err != nil {
+		return fmt.Errorf("failed http.NewRequestWithContext: %s", err)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to get /api/report: %s", err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("failed to get /api/report: %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	_, err = io.Copy(w, response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read /api/report: %s", err)
+	}
+
+	return nil
+}
+
+// getDataDirReport works the report out from what an instance wrote to its -data-dir (so it can go back as far as the
+// -data-retention, and works with the instance stopped)
+func getDataDirReport(dataDir string, from time.Time, to time.Time, format string, w io.Writer) error {
+	samples := make([]history.Sample, 0)
+	allEvents := make([]events.Event, 0)
+	hostname := ""
+
+	err := store.ReadDir(dataDir, func(record store.Record) {
+		switch record.Type {
+		case store.TypeHost:
+			// the box that wrote it (which needn't be this one)
+			hostname = record.Hostname
+		case store.TypeSample:
+			if record.Sample != nil {
+				samples = append(samples, *record.Sample)
+			}
+		case store.TypeEvent:
+			if record.Event != nil {
+				allEvents = append(allEvents, *record.Event)
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read -data-dir: %s", err)
+	}
+
+	incidentReport := report.Build(from, to, report.GetSeries(samples, from, to), allEvents)
+	incidentReport.Hostname = hostname
+
+	return report.Write(w, incidentReport, format)
+}
+
+func runReport(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	attach := flags.String("attach", "", "get the report from a running instance's API (e.g. localhost:6942), from its in-memory history")
+	dataDir := flags.String("data-dir", "", "work the report out from an instance's -data-dir instead")
+	fromValue := flags.String("from", "1h", "the start of the report (RFC3339, unix seconds or a duration back from now)")
+	toValue := flags.String("to", "now", "the end of the report (RFC3339, unix seconds or a duration back from now)")
+	format := flags.String("format", report.FormatMarkdown, fmt.Sprintf("what to write the report as (%s)", strings.Join(report.Formats, ", ")))
+	output := flags.String("o", "", "where to write the report to (default stdout)")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: loser report [flags] -attach <host:port>\n       loser report [flags] -data-dir <dir>\n\n")
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 || (*attach == "") == (*dataDir == "") || !slices.Contains(report.Formats, *format) {
+		flags.Usage()
+		return 2
+	}
+
+	now := time.Now()
+
+	from, err := history.ParseTime(*fromValue, now, now.Add(-time.Hour))
+	if err != nil {
+		log.Printf("error: bad -from: %s", err)
+		return 2
+	}
+
+	to, err := history.ParseTime(*toValue, now, now)
+	if err != nil {
+		log.Printf("error: bad -to: %s", err)
+		return 2
+	}
+
+	if !to.After(from) {
+		log.Printf("error: -to (%s) isn't after -from (%s)", to.Format(time.RFC3339), from.Format(time.RFC3339))
+		return 2
+	}
+
+	w := io.Writer(os.Stdout)
+
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Printf("error: failed to create -o: %s", err)
+			return 1
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+
+		w = f
+	}
+
+	if *attach != "" {
+		err = getAttachedReport(ctx, *attach, from, to, *format, w)
+	} else {
+		err = getDataDirReport(*dataDir, from, to, *format, w)
+	}
+
+	if err != nil {
+		log.Printf("error: %s", err)
+		return 1
+	}
+
+	if *output != "" {
+		log.Printf("wrote the report to %s", *output)
+	}
+
+	return 0
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/initialed85/loser/pkg/packets"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ansiClearToEOL = "\x1b[K"
+	ansiClearToEOS = "\x1b[J"
+	ansiHome       = "\x1b[H"
+	ansiAltScreen  = "\x1b[?1049h"
+	ansiMainScreen = "\x1b[?1049l"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiBold       = "\x1b[1m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiGrey       = "\x1b[90m"
+	ansiReset      = "\x1b[0m"
+
+	topMaxEvents      = 10
+	topDefaultWidth   = 120
+	topDefaultHeight  = 40
+	topRequestTimeout = time.Second * 2
+
+	// kindTargetStateChanged is the event top makes up for a target changing state when it's running its own probes
+	kindTargetStateChanged = "target_state_changed"
+)
+
+// topSource is where top gets its data from: either a running instance's API or probes of its own
+type topSource interface {
+	describe() string
+	statuses(window time.Duration) ([]history.Status, error)
+	networkInterfaces() ([]network_interfaces.NetworkInterface, error)
+	events() ([]events.Event, error)
+	probeErrors() []error
+}
+
+//
+// attached to a running instance
+//
+
+type apiTopSource struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (s *apiTopSource) describe() string {
+	return fmt.Sprintf("attached to %s", s.baseURL)
+}
+
+func (s *apiTopSource) get(path string, v any) error {
+	response, err := s.client.Get(s.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, response.Status)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	// /network-interfaces is empty until its first tick
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (s *apiTopSource) statuses(window time.Duration) ([]history.Status, error) {
+	statuses := make([]history.Status, 0)
+	err := s.get(fmt.Sprintf("/api/status?window=%s", url.QueryEscape(window.String())), &statuses)
+	return statuses, err
+}
+
+func (s *apiTopSource) networkInterfaces() ([]network_interfaces.NetworkInterface, error) {
+	networkInterfaces := make([]network_interfaces.NetworkInterface, 0)
+	err := s.get("/network-interfaces", &networkInterfaces)
+	return networkInterfaces, err
+}
+
+func (s *apiTopSource) events() ([]events.Event, error) {
+	recentEvents := make([]events.Event, 0)
+	err := s.get("/events", &recentEvents)
+	return recentEvents, err
+}
+
+// probeErrors is nothing when attached, the instance's probes failing show up as their targets being down
+func (s *apiTopSource) probeErrors() []error {
+	return nil
+}
+
+//
+// running its own probes
+//
+
+type localTopSource struct {
+	hosts                 []string
+	protocols             []string
+	sampleHistory         *history.History
+	eventLog              *events.Log
+	lastNetworkInterfaces map[string]network_interfaces.NetworkInterface
+	lastStates            map[string]string
+	mu                    *sync.Mutex
+	lastErrors            map[string]error
+}
+
+func newLocalTopSource(ctx context.Context, hosts []string, protocols []string, interval time.Duration) *localTopSource {
+	s := localTopSource{
+		hosts:                 hosts,
+		protocols:             protocols,
+		sampleHistory:         history.New(time.Hour, interval),
+		eventLog:              events.NewLog(100),
+		lastNetworkInterfaces: make(map[string]network_interfaces.NetworkInterface),
+		lastStates:            make(map[string]string),
+		mu:                    new(sync.Mutex),
+		lastErrors:            make(map[string]error),
+	}
+
+	for _, host := range hosts {
+		for _, protocol := range protocols {
+			target := history.GetProbeTarget(protocol, host)
+
+			reportFn := func(report packets.Report) {
+				s.sampleHistory.AddProbeReport(report)
+
+				if report.Received > 0 {
+					s.mu.Lock()
+					delete(s.lastErrors, target)
+					s.mu.Unlock()
+				}
+			}
+
+			// a probe attempt that failed outright (e.g. a TCP connection that was refused or timed out) counts as a lost
+			// probe, so its target shows as down (rather than not at all) with why in the frame
+			errFn := func(err error) {
+				s.sampleHistory.AddProbeReport(packets.Report{Timestamp: time.Now(), Protocol: protocol, Host: host, Sent: 1, Lost: 1})
+
+				s.mu.Lock()
+				s.lastErrors[target] = err
+				s.mu.Unlock()
+			}
+
+			go runProbeLoop(ctx, protocol, host, interval, reportFn, errFn)
+		}
+	}
+
+	return &s
+}
+
+func (s *localTopSource) describe() string {
+	return fmt.Sprintf("probing %s (%s)", strings.Join(s.hosts, ", "), strings.Join(s.protocols, ", "))
+}
+
+// statuses also turns targets changing state into events, since there's no event log to attach to
+func (s *localTopSource) statuses(window time.Duration) ([]history.Status, error) {
+	statuses := s.sampleHistory.Statuses(time.Now(), window)
+
+	for _, status := range statuses {
+		lastState, ok := s.lastStates[status.Target]
+		if ok && lastState != status.State {
+			s.eventLog.Load(events.Event{
+				Timestamp: time.Now(),
+				Kind:      kindTargetStateChanged,
+				Old:       lastState,
+				New:       status.State,
+				Message:   fmt.Sprintf("%s went from %s to %s", status.Target, lastState, status.State),
+			})
+		}
+
+		s.lastStates[status.Target] = status.State
+	}
+
+	return statuses, nil
+}
+
+func (s *localTopSource) networkInterfaces() ([]network_interfaces.NetworkInterface, error) {
+	networkInterfaces, err := network_interfaces.GetNetworkInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, networkInterface := range networkInterfaces {
+		lastNetworkInterface, ok := s.lastNetworkInterfaces[networkInterface.Name]
+		if ok {
+			networkInterfaces[i].Rates = network_interfaces.GetRates(lastNetworkInterface, networkInterface)
+		}
+
+		s.lastNetworkInterfaces[networkInterface.Name] = networkInterface
+	}
+
+	return networkInterfaces, nil
+}
+
+func (s *localTopSource) events() ([]events.Event, error) {
+	return s.eventLog.Events(), nil
+}
+
+// probeErrors is the last error for each target whose probe has failed since it last heard anything back
+func (s *localTopSource) probeErrors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make([]string, 0, len(s.lastErrors))
+	for target := range s.lastErrors {
+		targets = append(targets, target)
+	}
+
+	sort.Strings(targets)
+
+	errs := make([]error, 0, len(targets))
+	for _, target := range targets {
+		errs = append(errs, fmt.Errorf("%s: %s", target, s.lastErrors[target]))
+	}
+
+	return errs
+}
+
+//
+// rendering
+//
+
+// topFrame is everything on the screen at once
+type topFrame struct {
+	now               time.Time
+	description       string
+	window            time.Duration
+	statuses          []history.Status
+	networkInterfaces []network_interfaces.NetworkInterface
+	firstSeen         map[string]network_interfaces.NetworkInterface
+	events            []events.Event
+	errs              []error
+}
+
+func formatTopDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+
+	if d < time.Millisecond {
+		return fmt.Sprintf("%dµs", d.Microseconds())
+	}
+
+	return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+}
+
+func formatTopBits(bitsPerSecond float64) string {
+	units := []string{"b", "Kb", "Mb", "Gb", "Tb"}
+
+	i := 0
+	for bitsPerSecond >= 1000 && i < len(units)-1 {
+		bitsPerSecond /= 1000
+		i++
+	}
+
+	return fmt.Sprintf("%.1f%s/s", bitsPerSecond, units[i])
+}
+
+func formatTopPercent(value *float64) string {
+	if value == nil {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.1f%%", *value)
+}
+
+// colour wraps some text in a colour, padding it first (the escape codes would otherwise throw the padding out)
+func colour(colourCode string, width int, text string, enabled bool) string {
+	padded := fmt.Sprintf("%-*s", width, text)
+	if !enabled || colourCode == "" {
+		return padded
+	}
+
+	return colourCode + padded + ansiReset
+}
+
+// getStateColour works for both target states and interface oper states
+func getStateColour(state string) string {
+	switch state {
+	case history.StateUp:
+		return ansiGreen
+	case history.StateDown, "lowerlayerdown":
+		return ansiRed
+	}
+
+	return ansiGrey
+}
+
+// renderTop draws a frame as lines (at most height of them, each at most width wide; colours if colours is set)
+func renderTop(frame topFrame, width int, height int, colours bool) []string {
+	lines := make([]string, 0, height)
+
+	add := func(line string) {
+		lines = append(lines, line)
+	}
+
+	bold := func(text string) string {
+		if !colours {
+			return text
+		}
+
+		return ansiBold + text + ansiReset
+	}
+
+	// worst first, whatever order they came in
+	statuses := slices.Clone(frame.statuses)
+	history.SortStatuses(statuses)
+
+	down := 0
+	for _, status := range statuses {
+		if status.State == history.StateDown {
+			down++
+		}
+	}
+
+	add(bold(fmt.Sprintf("loser top - %s - %s - window %s - %d targets, %d down", frame.description, frame.now.Format("15:04:05"), frame.window, len(statuses), down)))
+
+	for _, err := range frame.errs {
+		add(colour(ansiRed, 0, fmt.Sprintf("error: %s", err), colours))
+	}
+
+	add("")
+	add(bold(fmt.Sprintf("%-32s %-8s %8s %10s %10s %10s %10s %7s %7s %7s", "TARGET", "STATE", "LOSS", "RTT MIN", "RTT AVG", "RTT MAX", "JITTER", "SENT", "RECV", "LOST")))
+
+	if len(statuses) == 0 {
+		add("(no targets yet)")
+	}
+
+	// leave room for the interfaces and events
+	maxTargets := max(height/2-4, 3)
+
+	for i, status := range statuses {
+		if i >= maxTargets {
+			add(fmt.Sprintf("... and %d more", len(statuses)-i))
+			break
+		}
+
+		add(fmt.Sprintf(
+			"%-32s %s %7.2f%% %10s %10s %10s %10s %7d %7d %7d",
+			status.Target,
+			colour(getStateColour(status.State), 8, status.State, colours),
+			status.LossPercent,
+			formatTopDuration(status.RTTMin),
+			formatTopDuration(status.RTTAvg),
+			formatTopDuration(status.RTTMax),
+			formatTopDuration(status.Jitter),
+			status.Sent,
+			status.Received,
+			status.Lost,
+		))
+	}
+
+	add("")
+	add(bold(fmt.Sprintf("%-16s %-8s %12s %12s %8s %8s %10s %10s %10s %10s", "INTERFACE", "STATE", "RX", "TX", "RX UTIL", "TX UTIL", "+RX ERRS", "+TX ERRS", "+RX DROPS", "+TX DROPS")))
+
+	networkInterfaces := slices.Clone(frame.networkInterfaces)
+
+	getDeltas := func(networkInterface network_interfaces.NetworkInterface) (int64, int64, int64, int64) {
+		first, ok := frame.firstSeen[networkInterface.Name]
+		if !ok {
+			return 0, 0, 0, 0
+		}
+
+		return network_interfaces.GetCounterDelta(first.RxErrors, networkInterface.RxErrors),
+			network_interfaces.GetCounterDelta(first.TxErrors, networkInterface.TxErrors),
+			network_interfaces.GetCounterDelta(first.RxDropped, networkInterface.RxDropped),
+			network_interfaces.GetCounterDelta(first.TxDropped, networkInterface.TxDropped)
+	}
+
+	// the ones racking up errors first, then the busiest
+	sort.SliceStable(networkInterfaces, func(i, j int) bool {
+		ai, bi, ci, di := getDeltas(networkInterfaces[i])
+		aj, bj, cj, dj := getDeltas(networkInterfaces[j])
+		if ai+bi+ci+di != aj+bj+cj+dj {
+			return ai+bi+ci+di > aj+bj+cj+dj
+		}
+
+		getBits := func(networkInterface network_interfaces.NetworkInterface) float64 {
+			if networkInterface.Rates == nil {
+				return 0
+			}
+
+			return networkInterface.Rates.RxBitsPerSecond + networkInterface.Rates.TxBitsPerSecond
+		}
+
+		if getBits(networkInterfaces[i]) != getBits(networkInterfaces[j]) {
+			return getBits(networkInterfaces[i]) > getBits(networkInterfaces[j])
+		}
+
+		return networkInterfaces[i].Name < networkInterfaces[j].Name
+	})
+
+	eventLines := min(len(frame.events), topMaxEvents)
+	maxInterfaces := max(height-len(lines)-eventLines-4, 1)
+
+	for i, networkInterface := range networkInterfaces {
+		if i >= maxInterfaces {
+			add(fmt.Sprintf("... and %d more", len(networkInterfaces)-i))
+			break
+		}
+
+		rates := network_interfaces.Rates{}
+		if networkInterface.Rates != nil {
+			rates = *networkInterface.Rates
+		}
+
+		rxErrors, txErrors, rxDropped, txDropped := getDeltas(networkInterface)
+
+		add(fmt.Sprintf(
+			"%-16s %s %12s %12s %8s %8s %10d %10d %10d %10d",
+			networkInterface.Name,
+			colour(getStateColour(networkInterface.OperState), 8, networkInterface.OperState, colours),
+			formatTopBits(rates.RxBitsPerSecond),
+			formatTopBits(rates.TxBitsPerSecond),
+			formatTopPercent(rates.RxUtilisationPercent),
+			formatTopPercent(rates.TxUtilisationPercent),
+			rxErrors,
+			txErrors,
+			rxDropped,
+			txDropped,
+		))
+	}
+
+	if len(frame.events) > 0 {
+		add("")
+		add(bold("RECENT EVENTS"))
+
+		for i := len(frame.events) - 1; i >= 0 && i >= len(frame.events)-eventLines; i-- {
+			event := frame.events[i]
+			add(fmt.Sprintf("%s %-28s %s", event.Timestamp.Local().Format("15:04:05"), event.Kind, event.Message))
+		}
+	}
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+
+	if width > 0 {
+		for i, line := range lines {
+			lines[i] = truncateLine(line, width)
+		}
+	}
+
+	return lines
+}
+
+// truncateLine cuts a line down to the given width, not counting any escape codes in it
+func truncateLine(line string, width int) string {
+	b := new(strings.Builder)
+
+	visible := 0
+	inEscape := false
+
+	for _, r := range line {
+		if r == '\x1b' {
+			inEscape = true
+		}
+
+		if inEscape {
+			b.WriteRune(r)
+
+			if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' {
+				inEscape = false
+			}
+
+			continue
+		}
+
+		if visible >= width {
+			// make sure we don't leave a colour on
+			if strings.Contains(line, "\x1b") {
+				b.WriteString(ansiReset)
+			}
+
+			break
+		}
+
+		b.WriteRune(r)
+		visible++
+	}
+
+	return b.String()
+}
+
+// getTerminalSize returns the width and height of the terminal behind the given fd (or the defaults if it isn't one)
+func getTerminalSize(fd int) (int, int) {
+	winsize, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil || winsize.Col == 0 || winsize.Row == 0 {
+		return topDefaultWidth, topDefaultHeight
+	}
+
+	return int(winsize.Col), int(winsize.Row)
+}
+
+// redirectOutput points stdout and stderr (at the fd level, so the package loggers follow) at the given file (or
+// /dev/null), returning a file for what used to be stdout
+func redirectOutput(logPath string) (*os.File, error) {
+	ttyFd, err := unix.Dup(int(os.Stdout.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed unix.Dup: %s", err)
+	}
+
+	if logPath == "" {
+		logPath = os.DevNull
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.OpenFile: %s", err)
+	}
+
+	for _, fd := range []int{int(os.Stdout.Fd()), int(os.Stderr.Fd())} {
+		err = unix.Dup3(int(logFile.Fd()), fd, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed unix.Dup3: %s", err)
+		}
+	}
+
+	_ = logFile.Close()
+
+	return os.NewFile(uintptr(ttyFd), "/dev/tty"), nil
+}
+
+// readKeys puts the terminal into non-canonical, no echo mode (so single key presses come through, but ^C still
+// works), calling the returned function puts it back
+func readKeys(fd int, keys chan<- byte) func() {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return func() {}
+	}
+
+	original := *termios
+
+	termios.Lflag &^= unix.ICANON | unix.ECHO
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+
+	err = unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	if err != nil {
+		return func() {}
+	}
+
+	go func() {
+		b := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(b)
+			if err != nil {
+				return
+			}
+
+			if n == 1 {
+				keys <- b[0]
+			}
+		}
+	}()
+
+	return func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, &original)
+	}
+}
+
+func runTop(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	attach := flags.String("attach", "", "attach to a running instance's API (e.g. localhost:6942) instead of running probes of our own")
+	probes := flags.String("probes", "icmp", fmt.Sprintf("comma separated probes to run against each host when not attached (%s; tcp and udp need loser at the other end)", strings.Join(probeProtocols, ", ")))
+	interval := flags.Duration("interval", time.Second, "how often to refresh (and how often the probes report when not attached)")
+	window := flags.Duration("window", time.Minute, "the window the loss / RTT / jitter are worked out over")
+	logPath := flags.String("log", "", "where the log lines go while the screen's up (default nowhere)")
+	once := flags.Bool("once", false, "print a single frame (without colours, after a few intervals when not attached) and exit")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: loser top [flags] <host...>\n       loser top -attach <host:port> [flags]\n\n")
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(args)
+
+	if *interval <= 0 || *window <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var source topSource
+
+	if *attach != "" {
+		if flags.NArg() != 0 {
+			flags.Usage()
+			return 2
+		}
+
+		baseURL := strings.TrimSuffix(*attach, "/")
+		if !strings.Contains(baseURL, "://") {
+			baseURL = "http://" + baseURL
+		}
+
+		source = &apiTopSource{
+			baseURL: baseURL,
+			client:  &http.Client{Timeout: topRequestTimeout},
+		}
+	} else {
+		if flags.NArg() == 0 {
+			flags.Usage()
+			return 2
+		}
+
+		protocols := splitList(*probes)
+		for _, protocol := range protocols {
+			_, err := getProbeFn(protocol)
+			if err != nil {
+				log.Printf("error: %s", err)
+				return 2
+			}
+		}
+
+		source = newLocalTopSource(ctx, flags.Args(), protocols, *interval)
+	}
+
+	firstSeen := make(map[string]network_interfaces.NetworkInterface)
+
+	getFrame := func() topFrame {
+		frame := topFrame{
+			now:         time.Now(),
+			description: source.describe(),
+			window:      *window,
+			firstSeen:   firstSeen,
+		}
+
+		var err error
+
+		frame.statuses, err = source.statuses(*window)
+		if err != nil {
+			frame.errs = append(frame.errs, fmt.Errorf("failed to get statuses: %s", err))
+		}
+
+		frame.networkInterfaces, err = source.networkInterfaces()
+		if err != nil {
+			frame.errs = append(frame.errs, fmt.Errorf("failed to get interfaces: %s", err))
+		}
+
+		for _, networkInterface := range frame.networkInterfaces {
+			if _, ok := firstSeen[networkInterface.Name]; !ok {
+				firstSeen[networkInterface.Name] = networkInterface
+			}
+		}
+
+		frame.events, err = source.events()
+		if err != nil {
+			frame.errs = append(frame.errs, fmt.Errorf("failed to get events: %s", err))
+		}
+
+		frame.errs = append(frame.errs, source.probeErrors()...)
+
+		return frame
+	}
+
+	if *once {
+		if *attach == "" {
+			_, _ = source.networkInterfaces() // so there's something to work the rates out from
+			time.Sleep(*interval * 3)
+		}
+
+		for _, line := range renderTop(getFrame(), 0, 1<<16, false) {
+			_, _ = fmt.Fprintln(os.Stdout, line)
+		}
+
+		return 0
+	}
+
+	tty, err := redirectOutput(*logPath)
+	if err != nil {
+		log.Printf("error: failed to take over the terminal: %s", err)
+		return 1
+	}
+	defer func() {
+		_ = tty.Close()
+	}()
+
+	keys := make(chan byte, 16)
+	restoreTerminal := readKeys(int(os.Stdin.Fd()), keys)
+
+	_, _ = fmt.Fprint(tty, ansiAltScreen+ansiHideCursor)
+
+	defer func() {
+		_, _ = fmt.Fprint(tty, ansiShowCursor+ansiMainScreen)
+		restoreTerminal()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	frame := getFrame()
+
+	for {
+		width, height := getTerminalSize(int(tty.Fd()))
+
+		// no newline after the last line, so a full screen doesn't scroll
+		lines := renderTop(frame, width, height, true)
+		_, _ = fmt.Fprint(tty, ansiHome+strings.Join(lines, ansiClearToEOL+"\n")+ansiClearToEOL+ansiClearToEOS)
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case sig := <-signals:
+			if sig != syscall.SIGWINCH {
+				return 0
+			}
+
+			continue
+		case key := <-keys:
+			if key == 'q' || key == 'Q' {
+				return 0
+			}
+		case <-ticker.C:
+		}
+
+		frame = getFrame()
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/initialed85/loser/pkg/events"
+	"github.com/initialed85/loser/pkg/history"
+	"github.com/initialed85/loser/pkg/network_interfaces"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTop(t *testing.T) {
+	t.Run("Format", func(t *testing.T) {
+		percent := 12.345
+
+		for _, testCase := range []struct {
+			name     string
+			actual   string
+			expected string
+		}{
+			{"BitsZero", formatTopBits(0), "0.0b/s"},
+			{"BitsKilo", formatTopBits(1500), "1.5Kb/s"},
+			{"BitsMega", formatTopBits(999_999), "1000.0Kb/s"},
+			{"BitsGiga", formatTopBits(2_500_000_000), "2.5Gb/s"},
+			{"BitsBiggest", formatTopBits(5e15), "5000.0Tb/s"},
+			{"PercentNil", formatTopPercent(nil), "-"},
+			{"Percent", formatTopPercent(&percent), "12.3%"},
+			{"DurationZero", formatTopDuration(0), "-"},
+			{"DurationMicroseconds", formatTopDuration(time.Microsecond * 250), "250µs"},
+			{"DurationMilliseconds", formatTopDuration(time.Microsecond * 12345), "12.35ms"},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				require.Equal(t, testCase.expected, testCase.actual)
+			})
+		}
+	})
+
+	t.Run("TruncateLine", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name     string
+			line     string
+			width    int
+			expected string
+		}{
+			{"Short", "abc", 5, "abc"},
+			{"Exact", "abcde", 5, "abcde"},
+			{"Long", "abcdefgh", 5, "abcde"},
+			{"EscapesDontCount", ansiRed + "abc" + ansiReset + "def", 4, ansiRed + "abc" + ansiReset + "d" + ansiReset},
+			{"EscapesKeptWhenShort", ansiRed + "abc" + ansiReset, 5, ansiRed + "abc" + ansiReset},
+			{"Multibyte", "µµµµ", 2, "µµ"},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				require.Equal(t, testCase.expected, truncateLine(testCase.line, testCase.width))
+			})
+		}
+	})
+
+	t.Run("RenderTop", func(t *testing.T) {
+		now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+		utilisation := 50.0
+
+		frame := topFrame{
+			now:         now,
+			description: "attached to http://localhost:6942",
+			window:      time.Minute,
+			// deliberately not worst first
+			statuses: []history.Status{
+				{Target: "icmp/192.168.1.1", State: history.StateUp, Sent: 60, Received: 60, RTTMin: time.Millisecond, RTTAvg: time.Millisecond * 2, RTTMax: time.Millisecond * 3},
+				{Target: "tcp/192.168.1.3", State: history.StateUnknown},
+				{Target: "udp/192.168.1.2", State: history.StateDown, Sent: 60, Lost: 60, LossPercent: 100},
+				{Target: "icmp/192.168.1.4", State: history.StateUp, Sent: 60, Received: 54, Lost: 6, LossPercent: 10, RTTAvg: time.Millisecond},
+			},
+			networkInterfaces: []network_interfaces.NetworkInterface{
+				{Name: "eth0", OperState: "up", RxErrors: 10, Rates: &network_interfaces.Rates{RxBitsPerSecond: 1_500_000, TxBitsPerSecond: 2_500_000, RxUtilisationPercent: &utilisation}},
+				{Name: "eth1", OperState: "up", RxErrors: 1005, TxDropped: 7},
+				{Name: "lo", OperState: "unknown"},
+			},
+			// eth1's errors are since we started watching, eth0's were there before
+			firstSeen: map[string]network_interfaces.NetworkInterface{
+				"eth0": {Name: "eth0", RxErrors: 10},
+				"eth1": {Name: "eth1", RxErrors: 1000},
+			},
+			events: []events.Event{
+				{Timestamp: now.Add(-time.Second * 2), Kind: events.KindLinkDown, Message: "eth1 went down"},
+				{Timestamp: now.Add(-time.Second), Kind: events.KindLinkUp, Message: "eth1 came up"},
+			},
+		}
+
+		lines := renderTop(frame, 200, 40, false)
+		text := strings.Join(lines, "\n")
+
+		require.Equal(t, "loser top - attached to http://localhost:6942 - 12:00:00 - window 1m0s - 4 targets, 1 down", lines[0])
+
+		// targets worst first: down, then unknown, then up by loss
+		targetLines := make([]string, 0)
+		for _, line := range lines {
+			for _, prefix := range []string{"icmp/", "tcp/", "udp/"} {
+				if strings.HasPrefix(line, prefix) {
+					targetLines = append(targetLines, strings.Fields(line)[0])
+				}
+			}
+		}
+
+		require.Equal(t, []string{"udp/192.168.1.2", "tcp/192.168.1.3", "icmp/192.168.1.4", "icmp/192.168.1.1"}, targetLines)
+		require.Contains(t, text, "udp/192.168.1.2                  down      100.00%")
+		require.Contains(t, text, "icmp/192.168.1.1                 up          0.00%     1.00ms     2.00ms     3.00ms")
+
+		// interfaces with new errors first, then the busiest; the error / drop columns are deltas since first seen
+		interfaceLines := make([]string, 0)
+		for _, line := range lines {
+			if strings.HasPrefix(line, "eth") || strings.HasPrefix(line, "lo ") {
+				interfaceLines = append(interfaceLines, line)
+			}
+		}
+
+		require.Len(t, interfaceLines, 3)
+		require.Equal(t, []string{"eth1", "up", "0.0b/s", "0.0b/s", "-", "-", "5", "0", "0", "7"}, strings.Fields(interfaceLines[0]))
+		require.Equal(t, []string{"eth0", "up", "1.5Mb/s", "2.5Mb/s", "50.0%", "-", "0", "0", "0", "0"}, strings.Fields(interfaceLines[1]))
+		require.Equal(t, "lo", strings.Fields(interfaceLines[2])[0])
+
+		// the events newest first
+		require.Contains(t, text, "RECENT EVENTS\n")
+		require.Less(t, strings.Index(text, "eth1 came up"), strings.Index(text, "eth1 went down"))
+
+		// everything fits the width and height, colours or not
+		for _, colours := range []bool{false, true} {
+			lines = renderTop(frame, 40, 12, colours)
+			require.LessOrEqual(t, len(lines), 12)
+
+			for _, line := range lines {
+				require.LessOrEqual(t, len([]rune(stripEscapes(line))), 40, line)
+			}
+		}
+
+		lines = renderTop(frame, 200, 12, false)
+		require.Contains(t, strings.Join(lines, "\n"), "... and 1 more")
+	})
+}
+
+// stripEscapes drops the escape codes from a line, to see how wide it really is
+func stripEscapes(line string) string {
+	b := new(strings.Builder)
+
+	inEscape := false
+	for _, r := range line {
+		if r == '\x1b' {
+			inEscape = true
+		}
+
+		if inEscape {
+			if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' {
+				inEscape = false
+			}
+
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}